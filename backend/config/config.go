@@ -0,0 +1,405 @@
+// Package config loads the server's settings from UPLOAD_* environment
+// variables.
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxUploadBytes is the per-file limit when UPLOAD_MAX_UPLOAD_BYTES
+// and the limits file do not say otherwise.
+const DefaultMaxUploadBytes = 200 << 20
+
+type Config struct {
+	PIIScan       bool
+	PIISampleRows int
+	PIIMask       bool
+	PIIQuarantine bool
+	PIIRoles      []string
+	AdminToken    string
+	SigningKey    string
+	ReceiptKey    string
+
+	SecretsRefreshSeconds int
+	VaultAddr             string
+	VaultToken            string
+
+	EncryptionKEK     string
+	EncryptionOldKEKs []string
+	GCPAccessToken    string
+
+	FeatureFlagsFile string
+
+	ArchiveAfterDays int
+	ArchiveDir       string
+
+	Compression         string
+	ResponseCompression bool
+	CompressMinBytes    int
+
+	VerifyWrites bool
+
+	EventsBus   string
+	EventsAddr  string
+	EventsTopic string
+
+	RedisCacheAddr       string
+	RedisCacheTTLSeconds int
+
+	LockRedisAddr string
+
+	SessionDir      string
+	SessionTTLHours int
+	MaxChunkBytes   int64
+
+	DirectS3Bucket      string
+	DirectS3Prefix      string
+	DirectURLTTLSeconds int
+
+	ScrubIntervalHours int
+	ScrubQuarantine    bool
+
+	MaxBatchBytes  int64
+	MaxUploadBytes int64
+	LimitsFile     string
+	MaxRows        int64
+	MaxColumns     int
+	MaxCellBytes   int64
+	FileFields     string
+
+	FormulaPolicy     string
+	FormulaPolicyFile string
+
+	ClamAVAddr  string
+	SchemasFile string
+
+	MessagesFile string
+
+	StatsRetentionDays int
+
+	AlertFailurePercent int
+	AlertMinRequests    int
+	AlertWindowMinutes  int
+	AlertDiskPercent    int
+
+	ClientQuotaMB      int
+	ClientQuotaMinutes int
+
+	IDFormat string
+
+	AccessLogFormat string
+	AccessLogPath   string
+	AccessLogSample int
+	AccessLogRedact []string
+
+	RequestRecording     bool
+	RequestRecordingSize int
+
+	LogSinks       string
+	LogMaxMB       int
+	LogRotateHours int
+	LogKeep        int
+
+	SentryDSN    string
+	ErrorWebhook string
+
+	DebugAddr  string
+	DebugToken string
+
+	Chaos             bool
+	ChaosLatencyRate  int
+	ChaosMaxLatencyMS int
+	ChaosErrorRate    int
+	ChaosTruncateRate int
+	ChaosPathPrefix   string
+
+	BandwidthGlobalKBps int
+	BandwidthConnKBps   int
+
+	UploadSlots        int
+	SmallLaneSlots     int
+	SmallUploadBytes   int64
+	LaneMaxWaitSeconds int
+
+	ListenAddr string
+	SocketMode os.FileMode
+
+	DrainSeconds          int
+	StorageTimeoutSeconds int
+	StartupChecks         bool
+
+	UploadDeadlineMinThroughputKBps int
+	UploadDeadlineSlackSeconds      int
+	UploadDeadlineMaxSeconds        int
+
+	CachePublic                 bool
+	CacheImmutableMaxAgeSeconds int
+	CacheLatestMaxAgeSeconds    int
+
+	AdminListen  string
+	AdminAllow   []string
+	AdminTLSCert string
+	AdminTLSKey  string
+
+	RateLimitRPS   int
+	RateLimitBurst int
+	CORSOrigins    []string
+
+	TLSCert string
+	TLSKey  string
+
+	APIKeys                 []string
+	DownloadTokenTTLSeconds int
+
+	CDNBaseURL       string
+	CDNKeyPairID     string
+	CDNSigningKey    string
+	CDNURLTTLSeconds int
+	CDNCookieDomain  string
+
+	SMTPAddr        string
+	SMTPUsername    string
+	SMTPPassword    string
+	SMTPFrom        string
+	NotifyTo        []string
+	NotifyEvents    []string
+	NotifyUploader  bool
+	NotifyTemplates string
+	NotifyWebhooks  string
+	PublicURL       string
+
+	SFTPSources string
+
+	WatchDir           string
+	WatchQuarantineDir string
+	WatchSettleSeconds int
+
+	QueryMaxRows        int
+	QueryTimeoutSeconds int
+
+	HTTP2                  bool
+	H2C                    bool
+	H2MaxConcurrentStreams int
+	H2StreamWindowKB       int
+	H2ConnWindowKB         int
+}
+
+// Load reads the configuration from the environment, applying defaults for
+// anything unset or unparsable.
+func Load() Config {
+	return Config{
+		PIIScan:       envBool("UPLOAD_PII_SCAN", true),
+		PIISampleRows: envInt("UPLOAD_PII_SAMPLE_ROWS", 1000),
+		PIIMask:       envBool("UPLOAD_PII_MASK", false),
+		PIIQuarantine: envBool("UPLOAD_PII_QUARANTINE", false),
+		PIIRoles:      envList("UPLOAD_PII_ROLES"),
+		AdminToken:    envString("UPLOAD_ADMIN_TOKEN", ""),
+		SigningKey:    envString("UPLOAD_SIGNING_KEY", ""),
+		ReceiptKey:    envString("UPLOAD_RECEIPT_KEY_FILE", ""),
+
+		SecretsRefreshSeconds: envInt("UPLOAD_SECRETS_REFRESH_SECONDS", 300),
+		VaultAddr:             envString("UPLOAD_VAULT_ADDR", os.Getenv("VAULT_ADDR")),
+		VaultToken:            envString("UPLOAD_VAULT_TOKEN", os.Getenv("VAULT_TOKEN")),
+
+		EncryptionKEK:     envString("UPLOAD_ENCRYPTION_KEK", ""),
+		EncryptionOldKEKs: envList("UPLOAD_ENCRYPTION_OLD_KEKS"),
+		GCPAccessToken:    envString("UPLOAD_GCP_ACCESS_TOKEN", ""),
+
+		FeatureFlagsFile: envString("UPLOAD_FEATURE_FLAGS_FILE", ""),
+
+		ArchiveAfterDays: envInt("UPLOAD_ARCHIVE_AFTER_DAYS", 0),
+		ArchiveDir:       envString("UPLOAD_ARCHIVE_DIR", "./data/archive"),
+
+		Compression:         envString("UPLOAD_COMPRESSION", ""),
+		ResponseCompression: envBool("UPLOAD_RESPONSE_COMPRESSION", true),
+		CompressMinBytes:    envInt("UPLOAD_COMPRESS_MIN_BYTES", 1024),
+
+		VerifyWrites: envBool("UPLOAD_VERIFY_WRITES", false),
+
+		EventsBus:   envString("UPLOAD_EVENTS_BUS", ""),
+		EventsAddr:  envString("UPLOAD_EVENTS_ADDR", ""),
+		EventsTopic: envString("UPLOAD_EVENTS_TOPIC", "file-events"),
+
+		RedisCacheAddr:       envString("UPLOAD_REDIS_CACHE_ADDR", ""),
+		RedisCacheTTLSeconds: envInt("UPLOAD_REDIS_CACHE_TTL_SECONDS", 300),
+
+		LockRedisAddr: envString("UPLOAD_LOCK_REDIS_ADDR", ""),
+
+		SessionDir:      envString("UPLOAD_SESSION_DIR", "./data/sessions"),
+		SessionTTLHours: envInt("UPLOAD_SESSION_TTL_HOURS", 24),
+		MaxChunkBytes:   int64(envInt("UPLOAD_MAX_CHUNK_BYTES", 16<<20)),
+
+		DirectS3Bucket:      envString("UPLOAD_DIRECT_S3_BUCKET", ""),
+		DirectS3Prefix:      envString("UPLOAD_DIRECT_S3_PREFIX", "incoming/"),
+		DirectURLTTLSeconds: envInt("UPLOAD_DIRECT_URL_TTL_SECONDS", 900),
+
+		ScrubIntervalHours: envInt("UPLOAD_SCRUB_INTERVAL_HOURS", 24),
+		ScrubQuarantine:    envBool("UPLOAD_SCRUB_QUARANTINE", true),
+
+		MaxBatchBytes:  int64(envInt("UPLOAD_MAX_BATCH_BYTES", 1<<30)),
+		MaxUploadBytes: int64(envInt("UPLOAD_MAX_UPLOAD_BYTES", DefaultMaxUploadBytes)),
+		LimitsFile:     envString("UPLOAD_LIMITS_FILE", ""),
+		MaxRows:        int64(envInt("UPLOAD_MAX_ROWS", 0)),
+		MaxColumns:     envInt("UPLOAD_MAX_COLUMNS", 16384),
+		MaxCellBytes:   int64(envInt("UPLOAD_MAX_CELL_BYTES", 1<<20)),
+		FileFields:     envString("UPLOAD_FILE_FIELDS", "file"),
+
+		FormulaPolicy:     envString("UPLOAD_FORMULA_POLICY", "off"),
+		FormulaPolicyFile: envString("UPLOAD_FORMULA_POLICY_FILE", ""),
+
+		ClamAVAddr:  envString("UPLOAD_CLAMAV_ADDR", ""),
+		SchemasFile: envString("UPLOAD_SCHEMAS_FILE", ""),
+
+		MessagesFile: envString("UPLOAD_MESSAGES_FILE", ""),
+
+		StatsRetentionDays: envInt("UPLOAD_STATS_RETENTION_DAYS", 90),
+
+		AlertFailurePercent: envInt("UPLOAD_ALERT_FAILURE_PERCENT", 0),
+		AlertMinRequests:    envInt("UPLOAD_ALERT_MIN_REQUESTS", 20),
+		AlertWindowMinutes:  envInt("UPLOAD_ALERT_WINDOW_MINUTES", 15),
+		AlertDiskPercent:    envInt("UPLOAD_ALERT_DISK_PERCENT", 0),
+
+		ClientQuotaMB:      envInt("UPLOAD_CLIENT_QUOTA_MB", 0),
+		ClientQuotaMinutes: envInt("UPLOAD_CLIENT_QUOTA_MINUTES", 60),
+
+		IDFormat: envString("UPLOAD_ID_FORMAT", "hex"),
+
+		AccessLogFormat: envString("UPLOAD_ACCESS_LOG", ""),
+		AccessLogPath:   envString("UPLOAD_ACCESS_LOG_PATH", ""),
+		AccessLogSample: envInt("UPLOAD_ACCESS_LOG_SAMPLE", 100),
+		AccessLogRedact: envList("UPLOAD_ACCESS_LOG_REDACT"),
+
+		RequestRecording:     envBool("UPLOAD_REQUEST_RECORDING", false),
+		RequestRecordingSize: envInt("UPLOAD_REQUEST_RECORDING_SIZE", 500),
+
+		LogSinks:       envString("UPLOAD_LOG_SINKS", ""),
+		LogMaxMB:       envInt("UPLOAD_LOG_MAX_MB", 100),
+		LogRotateHours: envInt("UPLOAD_LOG_ROTATE_HOURS", 24),
+		LogKeep:        envInt("UPLOAD_LOG_KEEP", 7),
+
+		SentryDSN:    envString("UPLOAD_SENTRY_DSN", ""),
+		ErrorWebhook: envString("UPLOAD_ERROR_WEBHOOK", ""),
+
+		DebugAddr:  envString("UPLOAD_DEBUG_ADDR", ""),
+		DebugToken: envString("UPLOAD_DEBUG_TOKEN", ""),
+
+		Chaos:             envBool("UPLOAD_CHAOS", false),
+		ChaosLatencyRate:  envInt("UPLOAD_CHAOS_LATENCY_RATE", 0),
+		ChaosMaxLatencyMS: envInt("UPLOAD_CHAOS_MAX_LATENCY_MS", 2000),
+		ChaosErrorRate:    envInt("UPLOAD_CHAOS_ERROR_RATE", 0),
+		ChaosTruncateRate: envInt("UPLOAD_CHAOS_TRUNCATE_RATE", 0),
+		ChaosPathPrefix:   envString("UPLOAD_CHAOS_PATH_PREFIX", "/v1/"),
+
+		BandwidthGlobalKBps: envInt("UPLOAD_BANDWIDTH_GLOBAL_KBPS", 0),
+		BandwidthConnKBps:   envInt("UPLOAD_BANDWIDTH_CONN_KBPS", 0),
+
+		UploadSlots:        envInt("UPLOAD_SLOTS", 0),
+		SmallLaneSlots:     envInt("UPLOAD_SMALL_LANE_SLOTS", 4),
+		SmallUploadBytes:   int64(envInt("UPLOAD_SMALL_UPLOAD_BYTES", 5<<20)),
+		LaneMaxWaitSeconds: envInt("UPLOAD_LANE_MAX_WAIT_SECONDS", 30),
+
+		ListenAddr: envString("UPLOAD_LISTEN", ":8080"),
+		SocketMode: envFileMode("UPLOAD_SOCKET_MODE", 0o660),
+
+		DrainSeconds:          envInt("UPLOAD_DRAIN_SECONDS", 300),
+		StorageTimeoutSeconds: envInt("UPLOAD_STORAGE_TIMEOUT_SECONDS", 10),
+		StartupChecks:         envBool("UPLOAD_STARTUP_CHECKS", true),
+
+		UploadDeadlineMinThroughputKBps: envInt("UPLOAD_DEADLINE_MIN_THROUGHPUT_KBPS", 1024),
+		UploadDeadlineSlackSeconds:      envInt("UPLOAD_DEADLINE_SLACK_SECONDS", 30),
+		UploadDeadlineMaxSeconds:        envInt("UPLOAD_DEADLINE_MAX_SECONDS", 6*60*60),
+
+		CachePublic:                 envBool("UPLOAD_CACHE_PUBLIC", false),
+		CacheImmutableMaxAgeSeconds: envInt("UPLOAD_CACHE_IMMUTABLE_MAX_AGE_SECONDS", 365*24*60*60),
+		CacheLatestMaxAgeSeconds:    envInt("UPLOAD_CACHE_LATEST_MAX_AGE_SECONDS", 60),
+
+		AdminListen:  envString("UPLOAD_ADMIN_LISTEN", ""),
+		AdminAllow:   envList("UPLOAD_ADMIN_ALLOW"),
+		AdminTLSCert: envString("UPLOAD_ADMIN_TLS_CERT", ""),
+		AdminTLSKey:  envString("UPLOAD_ADMIN_TLS_KEY", ""),
+
+		RateLimitRPS:   envInt("UPLOAD_RATE_LIMIT_RPS", 0),
+		RateLimitBurst: envInt("UPLOAD_RATE_LIMIT_BURST", 20),
+		CORSOrigins:    envList("UPLOAD_CORS_ORIGINS"),
+
+		TLSCert: envString("UPLOAD_TLS_CERT", ""),
+		TLSKey:  envString("UPLOAD_TLS_KEY", ""),
+
+		APIKeys:                 envList("UPLOAD_API_KEYS"),
+		DownloadTokenTTLSeconds: envInt("UPLOAD_DOWNLOAD_TOKEN_TTL_SECONDS", 300),
+
+		CDNBaseURL:       envString("UPLOAD_CDN_BASE_URL", ""),
+		CDNKeyPairID:     envString("UPLOAD_CDN_KEY_PAIR_ID", "upload"),
+		CDNSigningKey:    envString("UPLOAD_CDN_SIGNING_KEY", ""),
+		CDNURLTTLSeconds: envInt("UPLOAD_CDN_URL_TTL_SECONDS", 3600),
+		CDNCookieDomain:  envString("UPLOAD_CDN_COOKIE_DOMAIN", ""),
+
+		SMTPAddr:        envString("UPLOAD_SMTP_ADDR", ""),
+		SMTPUsername:    envString("UPLOAD_SMTP_USERNAME", ""),
+		SMTPPassword:    envString("UPLOAD_SMTP_PASSWORD", ""),
+		SMTPFrom:        envString("UPLOAD_SMTP_FROM", ""),
+		NotifyTo:        envList("UPLOAD_NOTIFY_TO"),
+		NotifyEvents:    envList("UPLOAD_NOTIFY_EVENTS"),
+		NotifyUploader:  envBool("UPLOAD_NOTIFY_UPLOADER", false),
+		NotifyTemplates: envString("UPLOAD_NOTIFY_TEMPLATES", ""),
+		NotifyWebhooks:  envString("UPLOAD_NOTIFY_WEBHOOKS", ""),
+		PublicURL:       envString("UPLOAD_PUBLIC_URL", ""),
+
+		SFTPSources: envString("UPLOAD_SFTP_SOURCES", ""),
+
+		WatchDir:           envString("UPLOAD_WATCH_DIR", ""),
+		WatchQuarantineDir: envString("UPLOAD_WATCH_QUARANTINE_DIR", ""),
+		WatchSettleSeconds: envInt("UPLOAD_WATCH_SETTLE_SECONDS", 2),
+
+		QueryMaxRows:        envInt("UPLOAD_QUERY_MAX_ROWS", 10000),
+		QueryTimeoutSeconds: envInt("UPLOAD_QUERY_TIMEOUT_SECONDS", 30),
+
+		HTTP2:                  envBool("UPLOAD_HTTP2", true),
+		H2C:                    envBool("UPLOAD_H2C", false),
+		H2MaxConcurrentStreams: envInt("UPLOAD_H2_MAX_STREAMS", 250),
+		H2StreamWindowKB:       envInt("UPLOAD_H2_STREAM_WINDOW_KB", 4<<10),
+		H2ConnWindowKB:         envInt("UPLOAD_H2_CONN_WINDOW_KB", 16<<10),
+	}
+}
+
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && strings.TrimSpace(v) != "" {
+		return strings.TrimSpace(v)
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(envString(key, ""))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(envString(key, ""))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envFileMode reads an octal permission such as 0660.
+func envFileMode(key string, def os.FileMode) os.FileMode {
+	v, err := strconv.ParseUint(envString(key, ""), 8, 32)
+	if err != nil {
+		return def
+	}
+	return os.FileMode(v).Perm()
+}
+
+func envList(key string) []string {
+	v := envString(key, "")
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
@@ -1 +0,0 @@
-package main
\ No newline at end of file
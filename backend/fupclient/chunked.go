@@ -0,0 +1,280 @@
+package fupclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ChunkedOptions tune UploadFile and UploadStream. Zero values take the
+// defaults.
+type ChunkedOptions struct {
+	TransferOptions
+
+	// ChunkSize is the size of each chunk, 8 MiB by default and at most
+	// what the server accepts.
+	ChunkSize int64
+
+	// Concurrency is how many chunks are in flight at once, 4 by default.
+	// UploadStream sends one at a time.
+	Concurrency int
+
+	// Retries is how many times a failed chunk is retried, with backoff,
+	// before the upload gives up; 3 by default, and negative for none.
+	// Only network errors, 408, 409, 429 and 5xx responses other than 501
+	// and 507 are retried.
+	Retries int
+
+	// StateFile, when set, records the session so an interrupted upload of
+	// the same, unchanged file resumes where the server left off instead of
+	// starting over. It is removed once the upload completes. UploadStream
+	// cannot resume and ignores it.
+	StateFile string
+}
+
+const (
+	defaultChunkSize   = 8 << 20
+	defaultConcurrency = 4
+	defaultRetries     = 3
+)
+
+// uploadState is what StateFile holds.
+type uploadState struct {
+	SessionID string    `json:"sessionId"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+}
+
+// UploadFile uploads the file at path over a parallel upload session:
+// chunks the server does not have yet are sent Concurrency at a time, and
+// the session is completed once all have arrived. If a chunk fails for
+// good the session is left open, so a later call with the same StateFile
+// picks it up.
+func (c *APIClient) UploadFile(ctx context.Context, path string, opts ChunkedOptions) (*UploadResponse, error) {
+	opts = opts.withDefaults()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	want := uploadState{Path: abs, Size: fi.Size(), ModTime: fi.ModTime().UTC()}
+
+	sess, err := c.resume(ctx, opts.StateFile, want)
+	if err != nil {
+		return nil, err
+	}
+	if sess == nil {
+		if sess, err = c.CreateSession(ctx, filepath.Base(path), fi.Size(), true); err != nil {
+			return nil, err
+		}
+		want.SessionID = sess.ID
+		if err := saveState(opts.StateFile, want); err != nil {
+			return nil, err
+		}
+	}
+
+	chunk := opts.ChunkSize
+	if sess.MaxChunk > 0 {
+		chunk = min(chunk, sess.MaxChunk)
+	}
+	if err := c.sendChunks(ctx, f, sess, chunk, opts); err != nil {
+		return nil, err
+	}
+	var res *UploadResponse
+	err = retry(ctx, opts.Retries, func() error {
+		res, err = c.CompleteSession(ctx, sess.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.StateFile != "" {
+		_ = os.Remove(opts.StateFile)
+	}
+	return res, nil
+}
+
+func (o ChunkedOptions) withDefaults() ChunkedOptions {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = defaultChunkSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultConcurrency
+	}
+	if o.Retries == 0 {
+		o.Retries = defaultRetries
+	}
+	o.Retries = max(o.Retries, 0)
+	return o
+}
+
+// resume returns the session recorded in the state file when it is for
+// the same file and the server still has it, or nil to start afresh.
+func (c *APIClient) resume(ctx context.Context, stateFile string, want uploadState) (*Session, error) {
+	if stateFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st uploadState
+	if json.Unmarshal(b, &st) != nil || st.SessionID == "" {
+		return nil, nil
+	}
+	if st.Path != want.Path || st.Size != want.Size || !st.ModTime.Equal(want.ModTime) {
+		// The file changed; what the server holds is of the old one.
+		_ = c.AbortSession(ctx, st.SessionID)
+		return nil, nil
+	}
+	sess, err := c.GetSession(ctx, st.SessionID)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !sess.Parallel {
+		return nil, nil
+	}
+	return sess, nil
+}
+
+func saveState(path string, st uploadState) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sendChunks uploads the chunks of f not yet covered by sess.Parts.
+func (c *APIClient) sendChunks(ctx context.Context, f io.ReaderAt, sess *Session, chunk int64, opts ChunkedOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m := newMeter(opts.TransferOptions, sess.Size)
+	m.add(rangesLen(sess.Parts))
+	offsets := make(chan int64)
+	go func() {
+		defer close(offsets)
+		for off := int64(0); off < sess.Size; off += chunk {
+			if covered(sess.Parts, off, min(off+chunk, sess.Size)) {
+				continue
+			}
+			select {
+			case offsets <- off:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for range opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, chunk)
+			for off := range offsets {
+				n, err := f.ReadAt(buf[:min(chunk, sess.Size-off)], off)
+				if err == nil || errors.Is(err, io.EOF) && int64(n) == min(chunk, sess.Size-off) {
+					err = retry(ctx, opts.Retries, func() error {
+						return c.sendChunk(ctx, m, sess.ID, off, buf[:n])
+					})
+				}
+				if err != nil {
+					once.Do(func() { firstErr = err; cancel() })
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// retry calls fn until it succeeds, fails for good, or has been retried
+// retries times, backing off exponentially in between.
+func retry(ctx context.Context, retries int, fn func() error) error {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retries || !retryable(ctx, err) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a failed request may succeed if sent again.
+// A 409 means another request holds the session, which is brief.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	switch apiErr.Status {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusInsufficientStorage:
+		return false
+	}
+	return apiErr.Status >= 500
+}
+
+func rangesLen(rs []ByteRange) int64 {
+	var n int64
+	for _, r := range rs {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// covered reports whether [start, end) lies within one of parts.
+func covered(parts []ByteRange, start, end int64) bool {
+	for _, p := range parts {
+		if p.Start <= start && end <= p.End {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+// Package fupclient is a Go client for the file upload API. Upload sends a
+// file in one request; UploadFile splits a large file into chunks sent in
+// parallel over the session API, retrying chunks that fail and resuming an
+// interrupted upload from a local state file; UploadStream sends any
+// io.Reader, such as the output of a gzip.Writer through an io.Pipe, in
+// chunks over a session. Each takes TransferOptions to report progress and
+// cap bandwidth.
+//
+// Code that uploads should depend on the Client interface. Its tests can
+// point an *APIClient at a fuptest.Server, which runs the real handlers and
+// can simulate full storage, failures and timeouts.
+package fupclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UploadResponse mirrors the JSON the server returns for a stored file.
+type UploadResponse struct {
+	ID          string   `json:"id"`
+	Bytes       int64    `json:"bytesWritten"`
+	ChecksumSHA string   `json:"sha256"`
+	ContentType string   `json:"contentType"`
+	Filename    string   `json:"filename"`
+	State       string   `json:"state"`
+	RowCount    int64    `json:"rowCount"`
+	Columns     []string `json:"columns"`
+}
+
+// ByteRange is the half-open range [Start, End) of a file.
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Session mirrors an upload session. For a parallel session Offset is the
+// number of bytes received and Parts says which.
+type Session struct {
+	ID        string      `json:"id"`
+	Filename  string      `json:"filename"`
+	Offset    int64       `json:"offset"`
+	Size      int64       `json:"size,omitempty"`
+	State     string      `json:"state"`
+	MaxChunk  int64       `json:"maxChunkBytes"`
+	Parallel  bool        `json:"parallel,omitempty"`
+	Parts     []ByteRange `json:"parts,omitempty"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+}
+
+// Error is an error response from the server. Code is the stable error
+// code, such as "conflict"; Status is the HTTP status.
+type Error struct {
+	Status    int    `json:"-"`
+	Code      string `json:"error"`
+	Message   string `json:"message"`
+	MessageID string `json:"messageId,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("upload API: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Client is what the SDK offers, so code that uploads can be handed a stand-in
+// in its tests. *APIClient is the implementation that talks to a server.
+type Client interface {
+	Upload(ctx context.Context, filename string, r io.Reader, opts TransferOptions) (*UploadResponse, error)
+	UploadFile(ctx context.Context, path string, opts ChunkedOptions) (*UploadResponse, error)
+	UploadStream(ctx context.Context, filename string, r io.Reader, opts ChunkedOptions) (*UploadResponse, error)
+	CreateSession(ctx context.Context, filename string, size int64, parallel bool) (*Session, error)
+	GetSession(ctx context.Context, id string) (*Session, error)
+	PutChunk(ctx context.Context, id string, offset int64, data []byte) (*Session, error)
+	CompleteSession(ctx context.Context, id string) (*UploadResponse, error)
+	AbortSession(ctx context.Context, id string) error
+}
+
+var _ Client = (*APIClient)(nil)
+
+// APIClient talks to one server. The zero HTTPClient is
+// http.DefaultClient.
+type APIClient struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, such as
+// "https://uploads.example.com".
+func New(baseURL, apiKey string) *APIClient {
+	return &APIClient{BaseURL: strings.TrimSuffix(baseURL, "/"), APIKey: apiKey}
+}
+
+func (c *APIClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do sends a request and decodes a JSON response into out, or the error
+// body into an *Error.
+func (c *APIClient) do(ctx context.Context, method, path string, header http.Header, body io.Reader, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	if b, ok := body.(interface{ Len() int }); ok {
+		req.ContentLength = int64(b.Len())
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		e := &Error{Status: resp.StatusCode}
+		if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(e) != nil || e.Code == "" {
+			e.Code, e.Message = strings.ToLower(strings.ReplaceAll(http.StatusText(resp.StatusCode), " ", "_")), resp.Status
+		}
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Upload sends r as filename in a single multipart request. The body is
+// streamed, so r may be larger than memory. Progress reports a total only
+// when r has a Len method, as a *bytes.Reader does.
+func (c *APIClient) Upload(ctx context.Context, filename string, r io.Reader, opts TransferOptions) (*UploadResponse, error) {
+	total := int64(-1)
+	if l, ok := r.(interface{ Len() int }); ok {
+		total = int64(l.Len())
+	}
+	r = &meteredReader{ctx: ctx, r: r, m: newMeter(opts, total)}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	var res UploadResponse
+	header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+	if err := c.do(ctx, http.MethodPost, "/v1/files/", header, pr, &res); err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
+	return &res, nil
+}
+
+// CreateSession opens an upload session. A parallel session needs size
+// and accepts chunks in any order.
+func (c *APIClient) CreateSession(ctx context.Context, filename string, size int64, parallel bool) (*Session, error) {
+	body, err := json.Marshal(map[string]any{"filename": filename, "size": size, "parallel": parallel})
+	if err != nil {
+		return nil, err
+	}
+	var sess Session
+	header := http.Header{"Content-Type": {"application/json"}}
+	if err := c.do(ctx, http.MethodPost, "/v1/uploads", header, bytes.NewReader(body), &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// GetSession returns the session's progress.
+func (c *APIClient) GetSession(ctx context.Context, id string) (*Session, error) {
+	var sess Session
+	if err := c.do(ctx, http.MethodGet, "/v1/uploads/"+url.PathEscape(id), nil, nil, &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// PutChunk sends data as the bytes of the session starting at offset.
+func (c *APIClient) PutChunk(ctx context.Context, id string, offset int64, data []byte) (*Session, error) {
+	return c.putChunk(ctx, id, offset, bytes.NewReader(data))
+}
+
+func (c *APIClient) putChunk(ctx context.Context, id string, offset int64, body io.Reader) (*Session, error) {
+	var sess Session
+	header := http.Header{
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {strconv.FormatInt(offset, 10)},
+	}
+	if err := c.do(ctx, http.MethodPatch, "/v1/uploads/"+url.PathEscape(id), header, body, &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// CompleteSession turns a fully received session into a stored file.
+func (c *APIClient) CompleteSession(ctx context.Context, id string) (*UploadResponse, error) {
+	var res UploadResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/uploads/"+url.PathEscape(id)+"/complete", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AbortSession discards a session and what it received.
+func (c *APIClient) AbortSession(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/uploads/"+url.PathEscape(id), nil, nil, nil)
+}
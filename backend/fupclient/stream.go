@@ -0,0 +1,79 @@
+package fupclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// UploadStream uploads everything read from r as filename over a session,
+// one chunk at a time, so r need not be seekable or of known size: a
+// gzip.Writer feeding an io.Pipe works. Each chunk is held in memory until
+// the server has it, which lets a failed chunk be retried. If the upload
+// fails for good the session is aborted; a stream cannot be resumed.
+func (c *APIClient) UploadStream(ctx context.Context, filename string, r io.Reader, opts ChunkedOptions) (*UploadResponse, error) {
+	opts = opts.withDefaults()
+	sess, err := c.CreateSession(ctx, filename, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.stream(ctx, sess, r, opts)
+	if err != nil {
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		_ = c.AbortSession(abortCtx, sess.ID)
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *APIClient) stream(ctx context.Context, sess *Session, r io.Reader, opts ChunkedOptions) (*UploadResponse, error) {
+	chunk := opts.ChunkSize
+	if sess.MaxChunk > 0 {
+		chunk = min(chunk, sess.MaxChunk)
+	}
+	m := newMeter(opts.TransferOptions, -1)
+	buf := make([]byte, chunk)
+	var off int64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if rerr != nil && !errors.Is(rerr, io.EOF) && !errors.Is(rerr, io.ErrUnexpectedEOF) {
+			return nil, rerr
+		}
+		if n > 0 {
+			err := retry(ctx, opts.Retries, func() error {
+				err := c.sendChunk(ctx, m, sess.ID, off, buf[:n])
+				return c.landed(ctx, sess.ID, off+int64(n), err)
+			})
+			if err != nil {
+				return nil, err
+			}
+			off += int64(n)
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	var res *UploadResponse
+	err := retry(ctx, opts.Retries, func() error {
+		var err error
+		res, err = c.CompleteSession(ctx, sess.ID)
+		return err
+	})
+	return res, err
+}
+
+// landed clears the 409 a retried chunk gets when the server committed
+// the previous attempt but its response was lost.
+func (c *APIClient) landed(ctx context.Context, id string, end int64, err error) error {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusConflict {
+		return err
+	}
+	if sess, gerr := c.GetSession(ctx, id); gerr == nil && sess.Offset == end {
+		return nil
+	}
+	return err
+}
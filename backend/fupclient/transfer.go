@@ -0,0 +1,132 @@
+package fupclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// TransferOptions observe and shape the bytes an upload sends.
+type TransferOptions struct {
+	// Progress, when set, is called as bytes go out with the running total
+	// and the upload's size, or -1 when the size is not known. Calls are
+	// never concurrent, even when chunks are. A chunk that fails is taken
+	// back out of the total before it is retried, so sent can go down.
+	Progress func(sent, total int64)
+
+	// BytesPerSecond caps the upload's bandwidth, across all of its chunks
+	// in flight. Zero means no limit.
+	BytesPerSecond int64
+}
+
+// meter counts and paces the bytes of one upload.
+type meter struct {
+	progress func(sent, total int64)
+	total    int64
+
+	mu   sync.Mutex
+	sent int64
+
+	bps  int64
+	rmu  sync.Mutex
+	next time.Time // when the bytes let through so far are paid for
+}
+
+func newMeter(opts TransferOptions, total int64) *meter {
+	return &meter{progress: opts.Progress, total: total, bps: opts.BytesPerSecond}
+}
+
+// add counts n more bytes sent, or n fewer when negative.
+func (m *meter) add(n int64) {
+	if m.progress == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent += n
+	m.progress(m.sent, m.total)
+}
+
+// wait holds back until n more bytes fit within the rate limit.
+func (m *meter) wait(ctx context.Context, n int) error {
+	if m.bps <= 0 {
+		return nil
+	}
+	m.rmu.Lock()
+	now := time.Now()
+	if m.next.Before(now) {
+		m.next = now
+	}
+	m.next = m.next.Add(time.Duration(n) * time.Second / time.Duration(m.bps))
+	d := m.next.Sub(now)
+	m.rmu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readSize bounds each read so a rate-limited upload moves smoothly
+// rather than in bursts of a whole buffer.
+func (m *meter) readSize(n int) int {
+	if m.bps <= 0 {
+		return n
+	}
+	return min(n, 32<<10, max(int(m.bps/4), 1))
+}
+
+// meteredReader passes reads through a meter, remembering how much it
+// counted so a failed attempt can be taken back.
+type meteredReader struct {
+	ctx   context.Context
+	r     io.Reader
+	m     *meter
+	count int64
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p[:r.m.readSize(len(p))])
+	if n > 0 {
+		if werr := r.m.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+		r.count += int64(n)
+		r.m.add(int64(n))
+	}
+	return n, err
+}
+
+// undo takes what this reader counted back out of the progress.
+func (r *meteredReader) undo() {
+	if r.count != 0 {
+		r.m.add(-r.count)
+		r.count = 0
+	}
+}
+
+// sizedReader is a request body whose length is known up front.
+type sizedReader struct {
+	io.Reader
+	n int
+}
+
+func (r sizedReader) Len() int { return r.n }
+
+// sendChunk sends data at offset through the meter.
+func (c *APIClient) sendChunk(ctx context.Context, m *meter, id string, offset int64, data []byte) error {
+	mr := &meteredReader{ctx: ctx, r: bytes.NewReader(data), m: m}
+	_, err := c.putChunk(ctx, id, offset, sizedReader{mr, len(data)})
+	if err != nil {
+		mr.undo()
+	}
+	return err
+}
@@ -0,0 +1,384 @@
+// Package fuptest runs the file upload API in-process and provides helpers
+// for building upload requests, so services that integrate with the API can
+// test against it without running the real binary.
+//
+// A Server answers with the server's own handlers (see server.Embedded):
+// uploads, downloads, listing, file metadata, upload sessions and
+// capabilities behave as they do in production. Records are kept in memory
+// and blobs in temporary directories removed by Close. Toggles on the
+// Server simulate the failures callers have to handle: SetQuota for running
+// out of storage, FailNext for error responses, TimeoutNext for requests
+// that never get an answer, and SetLatency for slow ones.
+package fuptest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/file-upload-go/config"
+	"example.com/file-upload-go/server"
+)
+
+// DefaultMaxUploadBytes matches the server's default limit.
+const DefaultMaxUploadBytes = config.DefaultMaxUploadBytes
+
+// File is an upload held by the server.
+type File struct {
+	ID          string
+	Filename    string
+	ContentType string
+	SHA256      string
+	Data        []byte
+	UploadedAt  time.Time
+}
+
+// UploadResponse mirrors the JSON the server returns for a stored file.
+type UploadResponse struct {
+	ID          string   `json:"id"`
+	Bytes       int64    `json:"bytesWritten"`
+	ChecksumSHA string   `json:"sha256"`
+	ContentType string   `json:"contentType"`
+	Filename    string   `json:"filename"`
+	State       string   `json:"state"`
+	RowCount    int64    `json:"rowCount"`
+	Columns     []string `json:"columns"`
+}
+
+// ErrorResponse mirrors the server's error body.
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// Options configures a Server. Zero values take the server's defaults.
+type Options struct {
+	MaxUploadBytes int64
+	MaxChunkBytes  int64
+}
+
+// Server is a running upload API. Close it when the test is done.
+type Server struct {
+	*httptest.Server
+
+	api    *server.Embedded
+	dir    string
+	closed chan struct{}
+
+	mu       sync.Mutex
+	quota    int64
+	latency  time.Duration
+	failures []int
+	timeouts int
+}
+
+// NewServer starts a server with the default options on a loopback port.
+func NewServer() *Server {
+	return NewServerWith(Options{})
+}
+
+// NewServerWith starts a server configured by opts on a loopback port. It
+// panics if the temporary directories cannot be created, as httptest does
+// when it cannot listen.
+func NewServerWith(opts Options) *Server {
+	if err := acquireBlobDir(); err != nil {
+		panic("fuptest: " + err.Error())
+	}
+	dir, err := os.MkdirTemp("", "fuptest-*")
+	if err != nil {
+		releaseBlobDir()
+		panic("fuptest: " + err.Error())
+	}
+	api, err := server.NewEmbedded(server.EmbedConfig{Dir: dir, MaxUploadBytes: opts.MaxUploadBytes, MaxChunkBytes: opts.MaxChunkBytes})
+	if err != nil {
+		os.RemoveAll(dir)
+		releaseBlobDir()
+		panic("fuptest: " + err.Error())
+	}
+	s := &Server{api: api, dir: dir, closed: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Close shuts the server down, releasing requests held by TimeoutNext, and
+// removes its files.
+func (s *Server) Close() {
+	close(s.closed)
+	s.Server.Close()
+	os.RemoveAll(s.dir)
+	releaseBlobDir()
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	latency, quota := s.latency, s.quota
+	failure, timeout := 0, false
+	switch {
+	case s.timeouts > 0:
+		s.timeouts--
+		timeout = true
+	case len(s.failures) > 0:
+		failure = s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	s.mu.Unlock()
+
+	if timeout {
+		select {
+		case <-r.Context().Done():
+		case <-s.closed:
+		}
+		return
+	}
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if failure != 0 {
+		writeError(w, failure, "injected_failure", "Failure injected by fuptest")
+		return
+	}
+	if quota > 0 && storesBytes(r) && s.used(r.Context())+max(r.ContentLength, 0) > quota {
+		writeError(w, http.StatusInsufficientStorage, "insufficient_storage", "Not enough storage space for this upload")
+		return
+	}
+	s.api.ServeHTTP(w, r)
+}
+
+// storesBytes reports whether r sends file content: a single upload or a
+// session chunk.
+func storesBytes(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost:
+		return r.URL.Path == "/v1/files/"
+	case http.MethodPatch:
+		return strings.HasPrefix(r.URL.Path, "/v1/uploads/")
+	}
+	return false
+}
+
+// used is the number of bytes stored.
+func (s *Server) used(ctx context.Context) int64 {
+	recs, _ := s.api.Store().List(ctx)
+	var n int64
+	for _, rec := range recs {
+		n += rec.Bytes
+	}
+	return n
+}
+
+// SetQuota caps the bytes stored, when positive. Uploads and session
+// chunks that would go over it fail with 507 insufficient_storage, as the
+// server answers when its disk is full.
+func (s *Server) SetQuota(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quota = bytes
+}
+
+// SetLatency delays every request by d, unless the client gives up first.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// FailNext makes the next len(statuses) requests fail with the given
+// statuses, in order, before reaching any handler.
+func (s *Server) FailNext(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// TimeoutNext makes the next n requests go unanswered until the client
+// gives up on them, so a client with a timeout sees it expire.
+func (s *Server) TimeoutNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeouts += n
+}
+
+// Files returns a copy of every stored file, oldest first.
+func (s *Server) Files() ([]File, error) {
+	recs, err := s.api.Store().List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].UploadedAt.Before(recs[j].UploadedAt) })
+	out := make([]File, 0, len(recs))
+	for _, rec := range recs {
+		f, err := s.file(rec)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// File returns the stored file with the given ID.
+func (s *Server) File(id string) (File, bool) {
+	rec, err := s.api.Store().Get(context.Background(), id)
+	if err != nil {
+		return File{}, false
+	}
+	f, err := s.file(rec)
+	if err != nil {
+		return File{}, false
+	}
+	return f, true
+}
+
+// Put stores a file directly, for tests that start with existing data.
+func (s *Server) Put(filename string, data []byte) (File, error) {
+	rec, err := s.api.Put(context.Background(), filename, data)
+	if err != nil {
+		return File{}, err
+	}
+	return s.file(rec)
+}
+
+func (s *Server) file(rec *server.FileRecord) (File, error) {
+	data, err := s.api.Content(rec)
+	if err != nil {
+		return File{}, err
+	}
+	return File{
+		ID:          rec.ID,
+		Filename:    rec.Filename,
+		ContentType: rec.ContentType,
+		SHA256:      rec.ChecksumSHA,
+		Data:        data,
+		UploadedAt:  rec.UploadedAt,
+	}, nil
+}
+
+// Blobs are stored under one directory per process (see
+// server.SetUploadDir), shared by the servers running at the time.
+var blobs struct {
+	sync.Mutex
+	dir   string
+	users int
+}
+
+func acquireBlobDir() error {
+	blobs.Lock()
+	defer blobs.Unlock()
+	if blobs.users == 0 {
+		dir, err := os.MkdirTemp("", "fuptest-blobs-*")
+		if err != nil {
+			return err
+		}
+		blobs.dir = dir
+		server.SetUploadDir(dir)
+	}
+	blobs.users++
+	return nil
+}
+
+func releaseBlobDir() {
+	blobs.Lock()
+	defer blobs.Unlock()
+	if blobs.users--; blobs.users == 0 {
+		os.RemoveAll(blobs.dir)
+	}
+}
+
+// MultipartBody encodes content as the "file" part named filename, preceded
+// by the given form fields, and returns the body with its Content-Type.
+func MultipartBody(filename string, content []byte, fields map[string]string) (io.Reader, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := mw.WriteField(k, fields[k]); err != nil {
+			return nil, "", err
+		}
+	}
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fw.Write(content); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return &buf, mw.FormDataContentType(), nil
+}
+
+// NewUploadRequest builds a POST to baseURL+"/v1/files/" uploading content
+// as filename.
+func NewUploadRequest(baseURL, filename string, content []byte, fields map[string]string) (*http.Request, error) {
+	body, contentType, err := MultipartBody(filename, content, fields)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/v1/files/", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return req, nil
+}
+
+// Upload sends content to the server at baseURL and decodes the response.
+// Non-2xx responses are returned as *APIError.
+func Upload(client *http.Client, baseURL, filename string, content []byte) (*UploadResponse, error) {
+	req, err := NewUploadRequest(baseURL, filename, content, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e := &APIError{Status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(&e.Body)
+		return nil, e
+	}
+	var ur UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ur); err != nil {
+		return nil, err
+	}
+	return &ur, nil
+}
+
+// APIError is a non-2xx response from the upload API.
+type APIError struct {
+	Status int
+	Body   ErrorResponse
+}
+
+func (e *APIError) Error() string {
+	return http.StatusText(e.Status) + ": " + e.Body.Message
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: errorType, Message: message, Code: status})
+}
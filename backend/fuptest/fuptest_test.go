@@ -0,0 +1,102 @@
+package fuptest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/file-upload-go/fupclient"
+	"example.com/file-upload-go/fuptest"
+)
+
+const people = "name,email\nbob,bob@example.com\n"
+
+func TestServerUploads(t *testing.T) {
+	srv := fuptest.NewServerWith(fuptest.Options{MaxChunkBytes: 8})
+	defer srv.Close()
+	ctx := context.Background()
+	client := fupclient.New(srv.URL, "")
+
+	tests := []struct {
+		name   string
+		upload func() (string, error)
+	}{
+		{"multipart", func() (string, error) {
+			resp, err := fuptest.Upload(srv.Client(), srv.URL, "people.csv", []byte(people))
+			if err != nil {
+				return "", err
+			}
+			return resp.ID, nil
+		}},
+		{"session", func() (string, error) {
+			resp, err := client.UploadStream(ctx, "people.csv", strings.NewReader(people), fupclient.ChunkedOptions{ChunkSize: 8})
+			if err != nil {
+				return "", err
+			}
+			return resp.ID, nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := tt.upload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, ok := srv.File(id)
+			if !ok || string(f.Data) != people || f.SHA256 == "" {
+				t.Fatalf("stored file %+v, %v", f, ok)
+			}
+		})
+	}
+	files, err := srv.Files()
+	if err != nil || len(files) != len(tests) {
+		t.Errorf("Files() = %d files, %v; want %d", len(files), err, len(tests))
+	}
+}
+
+func TestServerToggles(t *testing.T) {
+	srv := fuptest.NewServer()
+	defer srv.Close()
+	if _, err := srv.Put("seed.csv", bytes.Repeat([]byte("a,b\n"), 10)); err != nil {
+		t.Fatal(err)
+	}
+	hc := &http.Client{Timeout: 100 * time.Millisecond}
+
+	tests := []struct {
+		name    string
+		set     func()
+		status  int
+		timeout bool
+	}{
+		{"quota", func() { srv.SetQuota(50) }, http.StatusInsufficientStorage, false},
+		{"fail next", func() { srv.FailNext(http.StatusServiceUnavailable) }, http.StatusServiceUnavailable, false},
+		{"timeout next", func() { srv.TimeoutNext(1) }, 0, true},
+		{"latency", func() { srv.SetLatency(time.Second) }, 0, true},
+		{"reset", func() { srv.SetLatency(0) }, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv.SetQuota(0)
+			tt.set()
+			_, err := fuptest.Upload(hc, srv.URL, "people.csv", []byte(people))
+			var apiErr *fuptest.APIError
+			var netErr interface{ Timeout() bool }
+			switch {
+			case tt.timeout:
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					t.Errorf("err = %v, want a client timeout", err)
+				}
+			case tt.status == http.StatusOK:
+				if err != nil {
+					t.Errorf("err = %v", err)
+				}
+			case !errors.As(err, &apiErr) || apiErr.Status != tt.status:
+				t.Errorf("err = %v, want status %d", err, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	AccessLogCommon = "common"
+	AccessLogJSON   = "json"
+)
+
+// defaultRedactedHeaders are never written to the access log verbatim.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-API-Key"}
+
+// AccessLogEntry is one logged request. Custom templates see these fields,
+// e.g. `{{.Method}} {{.Path}} {{.Status}} {{.Duration}}`.
+type AccessLogEntry struct {
+	Time       time.Time         `json:"time"`
+	RemoteAddr string            `json:"remoteAddr"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Query      string            `json:"query,omitempty"`
+	Proto      string            `json:"proto"`
+	Status     int               `json:"status"`
+	Bytes      int64             `json:"bytes"`
+	Duration   time.Duration     `json:"durationNs"`
+	UserAgent  string            `json:"userAgent,omitempty"`
+	Referer    string            `json:"referer,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// AccessLog writes one line per request in common, JSON or template form,
+// to its own writer so it stays separate from application logs. Successful
+// requests are sampled at sampleRate percent; errors are always logged.
+type AccessLog struct {
+	mu         sync.Mutex
+	out        io.Writer
+	format     string
+	tmpl       *template.Template
+	sampleRate int
+	redact     map[string]bool
+}
+
+// NewAccessLog builds an access log for format, which is "common", "json" or
+// a text/template. extraRedact adds header names to the default redactions.
+func NewAccessLog(out io.Writer, format string, sampleRate int, extraRedact []string) (*AccessLog, error) {
+	l := &AccessLog{out: out, format: format, sampleRate: sampleRate, redact: redactedHeaders(extraRedact)}
+	if format != AccessLogCommon && format != AccessLogJSON {
+		tmpl, err := template.New("access").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("parse access log template: %w", err)
+		}
+		l.tmpl = tmpl
+		l.format = ""
+	}
+	return l, nil
+}
+
+// OpenAccessLogOutput returns stdout for "" or "-", otherwise a file at path
+// rotated like the application log files.
+func OpenAccessLogOutput(path string, rot RotationPolicy) (io.Writer, error) {
+	if path == "" || path == "-" {
+		return os.Stdout, nil
+	}
+	return newRotatingFile(path, rot)
+}
+
+func (l *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status < 400 && l.sampleRate < 100 && rand.IntN(100) >= l.sampleRate {
+			return
+		}
+		l.write(AccessLogEntry{
+			Time:       start,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      redactQuery(r.URL),
+			Proto:      r.Proto,
+			Status:     status,
+			Bytes:      aw.bytes,
+			Duration:   time.Since(start),
+			UserAgent:  r.UserAgent(),
+			Referer:    r.Referer(),
+			Headers:    redactHeaders(r.Header, l.redact),
+		})
+	})
+}
+
+// redactedHeaders is the set of canonical header names to redact: the
+// defaults plus extra.
+func redactedHeaders(extra []string) map[string]bool {
+	set := map[string]bool{}
+	for _, h := range append(defaultRedactedHeaders, extra...) {
+		if h = strings.TrimSpace(h); h != "" {
+			set[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return set
+}
+
+func redactHeaders(h http.Header, redact map[string]bool) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if redact[k] {
+			out[k] = "[REDACTED]"
+			continue
+		}
+		out[k] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+// redactQuery hides download tokens, which grant access on their own.
+func redactQuery(u *url.URL) string {
+	q := u.Query()
+	if !q.Has("token") {
+		return u.RawQuery
+	}
+	q.Set("token", "[REDACTED]")
+	return q.Encode()
+}
+
+func (l *AccessLog) write(e AccessLogEntry) {
+	var b strings.Builder
+	switch l.format {
+	case AccessLogCommon:
+		host, _, err := net.SplitHostPort(e.RemoteAddr)
+		if err != nil {
+			host = e.RemoteAddr
+		}
+		uri := e.Path
+		if e.Query != "" {
+			uri += "?" + e.Query
+		}
+		fmt.Fprintf(&b, "%s - - [%s] %q %d %d", host, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method+" "+uri+" "+e.Proto, e.Status, e.Bytes)
+	case AccessLogJSON:
+		enc, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		b.Write(enc)
+	default:
+		if err := l.tmpl.Execute(&b, e); err != nil {
+			fmt.Fprintf(&b, "access log template error: %v", err)
+		}
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = io.WriteString(l.out, b.String())
+}
+
+// accessLogWriter records the status and body size sent to the client.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessLogWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessLogWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessLogWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
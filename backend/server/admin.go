@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin rejects requests that do not carry the configured admin
+// bearer token. With no token configured the admin API is disabled.
+func requireAdmin(secret *Secret, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := secret.Value()
+		if token == "" {
+			writeForbidden(w, "Admin API is disabled; set UPLOAD_ADMIN_TOKEN to enable it")
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeUnauthorized(w, "Missing or invalid admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// parseNetworks parses CIDRs or bare IPs for requireNetwork.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// requireNetwork only admits clients whose address is in one of nets. Unix
+// socket peers are admitted too, their access being governed by the socket's
+// file permissions. It returns nil, admitting everyone, when nets is empty.
+func requireNetwork(nets []*net.IPNet) Middleware {
+	if len(nets) == 0 {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ip := net.ParseIP(host)
+			for _, n := range nets {
+				if ip != nil && n.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			writeForbidden(w, "Admin API is not reachable from this address")
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alerts an AlertMonitor can raise.
+const (
+	AlertFailureRate = "upload_failure_rate"
+	AlertDiskUsage   = "disk_usage"
+)
+
+// AlertConfig holds the alert thresholds; a zero threshold turns its alert
+// off. FailureRate is the fraction of upload requests answered 4xx or 5xx
+// over Window, judged only once MinRequests were made in it, so a broken
+// client integration shows up even when the server itself is healthy.
+// DiskUsedPercent is how full the upload filesystem may get.
+type AlertConfig struct {
+	FailureRate     float64
+	MinRequests     int64
+	Window          time.Duration
+	DiskUsedPercent float64
+}
+
+// Alert is the state of one alert, as GET /v1/admin/alerts reports it.
+// Since is when it started firing.
+type Alert struct {
+	Name      string     `json:"name"`
+	Firing    bool       `json:"firing"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	Summary   string     `json:"summary"`
+	Since     *time.Time `json:"since,omitempty"`
+	CheckedAt time.Time  `json:"checkedAt"`
+}
+
+// AlertMonitor checks the thresholds periodically and sends alert.fired
+// through the notifier when one is crossed and alert.resolved when it
+// recovers, once each rather than on every check. Failure rates are this
+// instance's own.
+type AlertMonitor struct {
+	cfg      AlertConfig
+	history  *UploadHistory
+	notifier *Notifier
+	dir      string
+
+	mu     sync.Mutex
+	alerts map[string]*Alert
+}
+
+// NewAlertMonitor returns a monitor for the thresholds set in cfg, or nil
+// when none are.
+func NewAlertMonitor(cfg AlertConfig, history *UploadHistory, notifier *Notifier, dir string) *AlertMonitor {
+	if cfg.FailureRate <= 0 && cfg.DiskUsedPercent <= 0 {
+		return nil
+	}
+	return &AlertMonitor{cfg: cfg, history: history, notifier: notifier, dir: dir, alerts: map[string]*Alert{}}
+}
+
+func (m *AlertMonitor) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			m.check(now.UTC())
+		}
+	}
+}
+
+func (m *AlertMonitor) check(now time.Time) {
+	if m.cfg.FailureRate > 0 {
+		requests, failures := m.history.Recent(now, m.cfg.Window)
+		rate := 0.0
+		if requests > 0 {
+			rate = float64(failures) / float64(requests)
+		}
+		breached := requests >= m.cfg.MinRequests && rate >= m.cfg.FailureRate
+		m.update(now, AlertFailureRate, breached, rate, m.cfg.FailureRate,
+			fmt.Sprintf("%d of %d upload requests failed in the last %s (%.0f%%)", failures, requests, m.cfg.Window, rate*100))
+	}
+	if m.cfg.DiskUsedPercent > 0 {
+		free, total, err := diskUsage(m.dir)
+		if err != nil || total == 0 {
+			log.Printf("alerts: disk usage of %s: %v", m.dir, err)
+			return
+		}
+		used := 100 * float64(total-free) / float64(total)
+		m.update(now, AlertDiskUsage, used >= m.cfg.DiskUsedPercent, used, m.cfg.DiskUsedPercent,
+			fmt.Sprintf("The upload filesystem is %.1f%% full, with %s free", used, formatBytes(int64(free))))
+	}
+}
+
+// update records a check and notifies when the alert changes state.
+func (m *AlertMonitor) update(now time.Time, name string, breached bool, value, threshold float64, summary string) {
+	m.mu.Lock()
+	a, ok := m.alerts[name]
+	if !ok {
+		a = &Alert{Name: name}
+		m.alerts[name] = a
+	}
+	changed := a.Firing != breached
+	a.Firing, a.Value, a.Threshold, a.Summary, a.CheckedAt = breached, value, threshold, summary, now
+	if changed && breached {
+		since := now
+		a.Since = &since
+	}
+	snapshot := *a
+	if !breached {
+		a.Since = nil
+	}
+	m.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	event := NotifyAlertResolved
+	if breached {
+		event = NotifyAlertFired
+		metrics.Counter("upload_alerts_fired_total", "Alerts that started firing, by alert.", "alert", name).Inc()
+	}
+	log.Printf("alerts: %s %s: %s", name, strings.TrimPrefix(event, "alert."), summary)
+	m.notifier.Notify(NotifyData{Event: event, Time: now, Alert: &snapshot})
+}
+
+// Handler serves GET /v1/admin/alerts. A nil monitor reports no alerts.
+func (m *AlertMonitor) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		alerts := []Alert{}
+		if m != nil {
+			m.mu.Lock()
+			for _, a := range m.alerts {
+				alerts = append(alerts, *a)
+			}
+			m.mu.Unlock()
+		}
+		slices.SortFunc(alerts, func(a, b Alert) int { return strings.Compare(a.Name, b.Name) })
+		writeJSON(w, http.StatusOK, map[string]any{"alerts": alerts})
+	}
+}
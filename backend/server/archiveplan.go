@@ -0,0 +1,322 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrArchivePlanNotFound = errors.New("archive plan not found")
+
+// A dataset archive is laid out once per dataset version and the layout is
+// kept as an ArchivePlan. Members are stored uncompressed, so every byte
+// offset follows from names and sizes alone and the archive comes out the
+// same on every request. That is what lets a client resume a dropped
+// download with Range (and If-Range on the ETag) instead of starting over,
+// and fetch a single member by the offsets in the plan.
+//
+// Each member carries its CRC-32 in a data descriptor after its data. The
+// CRCs are learned the first time a member is streamed and saved with the
+// plan; a resumed download only reads the members it actually sends, plus
+// any skipped member whose CRC is still unknown.
+type ArchivePlan struct {
+	ID        string          `json:"id"`
+	Dataset   string          `json:"dataset"`
+	Version   int             `json:"version"`
+	Filename  string          `json:"filename"`
+	ETag      string          `json:"etag"`
+	Size      int64           `json:"size"`
+	Members   []ArchiveMember `json:"members"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// ArchiveMember is one file in an archive. Content holds members generated
+// with the plan, such as manifest.json; the others are read from FileID.
+type ArchiveMember struct {
+	Name     string    `json:"name"`
+	FileID   string    `json:"fileId,omitempty"`
+	Content  []byte    `json:"content,omitempty"`
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+	Offset   int64     `json:"offset"` // of the member's local header
+	CRC32    *uint32   `json:"crc32,omitempty"`
+}
+
+// zipLocalHeaderLen is the fixed part of a zip local file header.
+const zipLocalHeaderLen = 30
+
+func archivePlanID(ds *Dataset, v DatasetVersion) string {
+	return ds.ID + "-v" + strconv.Itoa(v.Version)
+}
+
+// newArchivePlan lays out the archive of dataset version v: manifest.json,
+// then the files in manifest order.
+func newArchivePlan(ds *Dataset, v DatasetVersion, recs []*FileRecord, manifest []byte) (*ArchivePlan, error) {
+	now := time.Now().UTC()
+	sum := crc32.ChecksumIEEE(manifest)
+	p := &ArchivePlan{
+		ID:        archivePlanID(ds, v),
+		Dataset:   ds.ID,
+		Version:   v.Version,
+		Filename:  sanitizeArchiveName(ds.Name) + "-v" + strconv.Itoa(v.Version) + ".zip",
+		Members:   []ArchiveMember{{Name: "manifest.json", Content: manifest, Bytes: int64(len(manifest)), Modified: now, CRC32: &sum}},
+		CreatedAt: now,
+	}
+	used := map[string]bool{}
+	for i, rec := range recs {
+		p.Members = append(p.Members, ArchiveMember{
+			Name:     uniqueName(used, v.Files[i].Filename, i),
+			FileID:   rec.ID,
+			Bytes:    rec.Bytes,
+			Modified: rec.UploadedAt,
+		})
+	}
+	if _, err := p.write(nil, 0, nil); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	for _, m := range p.Members {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\n", m.Name, m.FileID, m.Bytes, m.Offset)
+	}
+	h.Write(manifest)
+	p.ETag = strconv.Quote(hex.EncodeToString(h.Sum(nil)[:16]))
+	return p, nil
+}
+
+// skipWriter drops the first skip bytes written to it and counts them all.
+// With a nil w it only counts, which is how a plan measures itself.
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+	n    int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	s.n += int64(n)
+	k := min(s.skip, int64(n))
+	s.skip -= k
+	if p = p[k:]; len(p) > 0 && s.w != nil {
+		if _, err := s.w.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+var zeroBlock = make([]byte, 64<<10)
+
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		k := min(n, int64(len(zeroBlock)))
+		if _, err := w.Write(zeroBlock[:k]); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+// msDosTime encodes t in UTC as the date and time fields of a zip header.
+func msDosTime(t time.Time) (date, tm uint16) {
+	t = t.UTC()
+	date = uint16(t.Day() + int(t.Month())<<5 + max(t.Year()-1980, 0)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}
+
+// write writes the archive to w from byte offset from on, and reports
+// whether it learned any member CRCs. Bytes before from are generated but
+// dropped; members lying wholly before it stand in as zeros when their CRC
+// is already known. With a nil open nothing is read at all, and write only
+// records member offsets and the archive size.
+func (p *ArchivePlan) write(w io.Writer, from int64, open func(*ArchiveMember) (io.ReadCloser, error)) (learned bool, err error) {
+	sw := &skipWriter{w: w, skip: from}
+	zw := zip.NewWriter(sw)
+	for i := range p.Members {
+		m := &p.Members[i]
+		fh := &zip.FileHeader{
+			Name:               m.Name,
+			CreatorVersion:     20,
+			ReaderVersion:      20,
+			Flags:              0x8, // sizes and CRC follow the data
+			Method:             zip.Store,
+			CompressedSize64:   uint64(m.Bytes),
+			UncompressedSize64: uint64(m.Bytes),
+		}
+		for _, c := range m.Name {
+			if c >= utf8.RuneSelf {
+				fh.Flags |= 0x800 // UTF-8 name
+				break
+			}
+		}
+		fh.ModifiedDate, fh.ModifiedTime = msDosTime(m.Modified)
+		if m.CRC32 != nil {
+			fh.CRC32 = *m.CRC32
+		}
+		fw, err := zw.CreateRaw(fh)
+		if err != nil {
+			return learned, err
+		}
+		if err := zw.Flush(); err != nil {
+			return learned, err
+		}
+		start := sw.n
+		m.Offset = start - zipLocalHeaderLen - int64(len(m.Name))
+
+		skip := min(max(from-start, 0), m.Bytes)
+		switch {
+		case open == nil || (m.CRC32 != nil && skip == m.Bytes):
+			err = writeZeros(fw, m.Bytes)
+		default:
+			var sum uint32
+			sum, err = copyMember(fw, m, skip, open)
+			if err == nil && m.CRC32 == nil {
+				m.CRC32, learned = &sum, true
+			}
+			// The writer keeps fh and writes the data descriptor and
+			// central directory entry from it, so the CRC can be filled
+			// in once the data is through.
+			fh.CRC32 = sum
+		}
+		if err != nil {
+			return learned, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return learned, err
+	}
+	if open == nil {
+		p.Size = sw.n
+	}
+	return learned, nil
+}
+
+// copyMember writes m's data to fw and returns its CRC. With the CRC already
+// known, the first skip bytes, which will be dropped anyway, are not read.
+func copyMember(fw io.Writer, m *ArchiveMember, skip int64, open func(*ArchiveMember) (io.ReadCloser, error)) (uint32, error) {
+	var body io.ReadCloser
+	if m.Content != nil {
+		body = io.NopCloser(bytes.NewReader(m.Content))
+	} else {
+		var err error
+		if body, err = open(m); err != nil {
+			return 0, err
+		}
+	}
+	defer body.Close()
+
+	if m.CRC32 != nil && skip > 0 {
+		if err := writeZeros(fw, skip); err != nil {
+			return 0, err
+		}
+		var err error
+		if s, ok := body.(io.Seeker); ok {
+			_, err = s.Seek(skip, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, body, skip)
+		}
+		if err != nil {
+			return 0, err
+		}
+		n, err := io.Copy(fw, body)
+		if err != nil {
+			return 0, err
+		}
+		if skip+n != m.Bytes {
+			return 0, fmt.Errorf("member %s is %d bytes, planned %d", m.Name, skip+n, m.Bytes)
+		}
+		return *m.CRC32, nil
+	}
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(fw, h), body)
+	if err != nil {
+		return 0, err
+	}
+	if n != m.Bytes {
+		return 0, fmt.Errorf("member %s is %d bytes, planned %d", m.Name, n, m.Bytes)
+	}
+	sum := h.Sum32()
+	if m.CRC32 != nil && *m.CRC32 != sum {
+		return 0, fmt.Errorf("member %s no longer matches its CRC", m.Name)
+	}
+	return sum, nil
+}
+
+// archiveReader presents a plan as an io.ReadSeeker for http.ServeContent,
+// which takes care of Range, If-Range and HEAD. Each seek that moves the
+// position restarts generation from there.
+type archiveReader struct {
+	plan *ArchivePlan
+	open func(*ArchiveMember) (io.ReadCloser, error)
+
+	off     int64
+	pr      *io.PipeReader
+	done    chan struct{}
+	learned bool
+	err     error // of the last generation, other than the reader leaving
+}
+
+func (a *archiveReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += a.off
+	case io.SeekEnd:
+		offset += a.plan.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("archive: negative position")
+	}
+	if offset != a.off {
+		a.stop()
+		a.off = offset
+	}
+	return offset, nil
+}
+
+func (a *archiveReader) Read(p []byte) (int, error) {
+	if a.off >= a.plan.Size {
+		return 0, io.EOF
+	}
+	if a.pr == nil {
+		pr, pw := io.Pipe()
+		a.pr, a.done = pr, make(chan struct{})
+		go func(from int64) {
+			defer close(a.done)
+			learned, err := a.plan.write(pw, from, a.open)
+			a.learned = a.learned || learned
+			if !errors.Is(err, io.ErrClosedPipe) {
+				a.err = err
+			}
+			pw.CloseWithError(err)
+		}(a.off)
+	}
+	n, err := a.pr.Read(p)
+	a.off += int64(n)
+	return n, err
+}
+
+// stop ends any generation in progress and waits for it to finish, after
+// which the plan's learned CRCs are safe to read.
+func (a *archiveReader) stop() {
+	if a.pr == nil {
+		return
+	}
+	a.pr.Close()
+	<-a.done
+	a.pr = nil
+}
+
+func (a *archiveReader) Close() error {
+	a.stop()
+	return nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const auditLogPath = "./data/audit.log"
+
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	FileID string    `json:"fileId,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	// Redacted marks an event whose detail was removed when its file was
+	// purged.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// AuditLog appends one JSON event per line. It is append-only by design:
+// the only rewrite is a purge's redaction, which removes what earlier
+// events say about the purged file but keeps the events themselves.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, f: f}, nil
+}
+
+func (a *AuditLog) Record(ev AuditEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("audit: encode %s: %v", ev.Action, err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		log.Printf("audit: write %s: %v", ev.Action, err)
+	}
+}
+
+// mentions reports whether ev says anything about the file id beyond
+// naming it.
+func (ev *AuditEvent) mentions(id string) bool {
+	return ev.Detail != "" && (ev.FileID == id || strings.Contains(ev.Detail, id))
+}
+
+// Redact clears the detail of every event that mentions the file id,
+// rewriting the log in place of the old one.
+func (a *AuditLog) Redact(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	changed := false
+	for i, line := range lines {
+		var ev AuditEvent
+		if json.Unmarshal(line, &ev) != nil || !ev.mentions(id) {
+			continue
+		}
+		ev.Detail, ev.Redacted = "", true
+		out, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		lines[i] = append(out, '\n')
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, bytes.Join(lines, nil), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_ = a.f.Close()
+	a.f = f
+	return nil
+}
+
+// Mentions reports whether any event still says something about the file
+// id.
+func (a *AuditLog) Mentions(id string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var ev AuditEvent
+		if json.Unmarshal(sc.Bytes(), &ev) == nil && ev.mentions(id) {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const backupFormatVersion = 1
+
+// BackupManifest is the first entry of every backup archive. Blobs are
+// stored decoded, so an archive restores regardless of the compression or
+// storage class the source server used.
+type BackupManifest struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Since     *time.Time        `json:"since,omitempty"`
+	Files     []BackupFileEntry `json:"files"`
+}
+
+type BackupFileEntry struct {
+	ID     string `json:"id"`
+	Record string `json:"record"`
+	Blob   string `json:"blob"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Backup writes every record uploaded at or after since, plus its blob, to a
+// tar.gz at out. Files encrypted with a customer-provided key are skipped,
+// as their blobs cannot be decoded.
+func Backup(ctx context.Context, store MetadataStore, out string, since time.Time) (*BackupManifest, error) {
+	recs, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &BackupManifest{Version: backupFormatVersion, CreatedAt: time.Now().UTC()}
+	if !since.IsZero() {
+		m.Since = &since
+	}
+	var selected []*FileRecord
+	for _, rec := range recs {
+		if rec.UploadedAt.Before(since) || rec.Encryption.customer() {
+			continue
+		}
+		selected = append(selected, rec)
+		m.Files = append(m.Files, BackupFileEntry{
+			ID:     rec.ID,
+			Record: "records/" + rec.ID + ".json",
+			Blob:   "blobs/" + rec.ID + rec.extension(),
+			Bytes:  rec.Bytes,
+			SHA256: rec.ChecksumSHA,
+		})
+	}
+
+	f, err := os.Create(out + ".part")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out + ".part")
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarBytes(tw, "manifest.json", manifest); err != nil {
+		return nil, err
+	}
+	for i, rec := range selected {
+		entry := m.Files[i]
+		b, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeTarBytes(tw, entry.Record, b); err != nil {
+			return nil, err
+		}
+		if err := writeTarBlob(tw, entry, rec); err != nil {
+			return nil, fmt.Errorf("backup %s: %w", rec.ID, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return m, os.Rename(out+".part", out)
+}
+
+func writeTarBytes(tw *tar.Writer, name string, b []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(b)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+func writeTarBlob(tw *tar.Writer, entry BackupFileEntry, rec *FileRecord) error {
+	body, err := openBlob(rec, false)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	hdr := &tar.Header{Name: entry.Blob, Mode: 0o644, Size: rec.Bytes, ModTime: rec.UploadedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), body); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != rec.ChecksumSHA {
+		return fmt.Errorf("checksum mismatch: stored blob hashes to %s", sum)
+	}
+	return nil
+}
+
+// Restore imports an archive written by Backup. Each blob is verified
+// against the manifest checksum before its record is written. Existing
+// records are kept unless overwrite is set.
+func Restore(ctx context.Context, store MetadataStore, locker Locker, in string, overwrite bool) (int, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "manifest.json" {
+		return 0, errors.New("restore: archive does not start with manifest.json")
+	}
+	var m BackupManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return 0, fmt.Errorf("restore: read manifest: %w", err)
+	}
+	if m.Version != backupFormatVersion {
+		return 0, fmt.Errorf("restore: unsupported archive version %d", m.Version)
+	}
+	byName := map[string]BackupFileEntry{}
+	for _, e := range m.Files {
+		byName[e.Record] = e
+		byName[e.Blob] = e
+	}
+
+	records := map[string]*FileRecord{}
+	restored := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return restored, err
+		}
+		entry, ok := byName[hdr.Name]
+		if !ok {
+			return restored, fmt.Errorf("restore: %s is not listed in the manifest", hdr.Name)
+		}
+
+		if hdr.Name == entry.Record {
+			var rec FileRecord
+			if err := json.NewDecoder(tr).Decode(&rec); err != nil {
+				return restored, fmt.Errorf("restore %s: %w", entry.ID, err)
+			}
+			records[entry.ID] = &rec
+			continue
+		}
+
+		rec := records[entry.ID]
+		if rec == nil || rec.ID != entry.ID {
+			return restored, fmt.Errorf("restore %s: blob precedes its record", entry.ID)
+		}
+		if _, err := store.Get(ctx, rec.ID); err == nil && !overwrite {
+			continue
+		}
+		if err := restoreBlob(ctx, store, locker, tr, entry, rec); err != nil {
+			return restored, fmt.Errorf("restore %s: %w", entry.ID, err)
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+func restoreBlob(ctx context.Context, store MetadataStore, locker Locker, r io.Reader, entry BackupFileEntry, rec *FileRecord) error {
+	finalPath, err := blobPath(rec.ID, rec.extension(), rec.UploadedAt)
+	if err != nil {
+		return err
+	}
+	dst, err := createTemp(finalPath)
+	if err != nil {
+		return err
+	}
+	tmp := dst.Name()
+	defer os.Remove(tmp)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dst, h), r)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != entry.SHA256 {
+		return fmt.Errorf("checksum mismatch: archive blob hashes to %s", sum)
+	}
+	if err := os.Rename(tmp, finalPath); err != nil {
+		return err
+	}
+
+	// The restored blob is hot and unencoded, and encrypted afresh when
+	// encryption at rest is on. Derivatives such as masked copies are not
+	// part of the archive.
+	rec.Path = finalPath
+	rec.Encoding, rec.Compression, rec.Encryption = "", nil, nil
+	rec.StorageClass, rec.ArchivePath, rec.RestoreStatus = StorageHot, "", ""
+	rec.MaskedPath, rec.MaskedBytes, rec.MaskedEncoding, rec.MaskedEncryption = "", 0, "", nil
+	if blobKeys != nil {
+		if err := encryptBlob(ctx, blobKeys, rec); err != nil {
+			return err
+		}
+		if err := os.Remove(finalPath); err != nil {
+			return err
+		}
+	}
+	// A record restored over an existing one takes the next revision, so
+	// clients holding the old one see the change.
+	release, err := lockRecord(ctx, locker, rec.ID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if cur, err := store.Get(ctx, rec.ID); err == nil {
+		rec.Revision = cur.Revision + 1
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return store.Put(ctx, rec)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// BatchManifest maps each file part, by filename or form field name, to
+// where it should be filed. It must be sent as a "manifest" form field
+// ahead of the file parts it describes.
+type BatchManifest struct {
+	Files map[string]BatchTarget `json:"files"`
+}
+
+type BatchTarget struct {
+	Folder string   `json:"folder"`
+	Tags   []string `json:"tags"`
+}
+
+type BatchResult struct {
+	Index    int             `json:"index"`
+	Field    string          `json:"field"`
+	Filename string          `json:"filename"`
+	Status   string          `json:"status"`
+	File     *UploadResponse `json:"file,omitempty"`
+	Error    *UploadError    `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results   []BatchResult `json:"results"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+}
+
+// BatchUploadHandler accepts several file parts in one multipart request
+// and reports success or a typed failure for each: POST /v1/files/batch.
+// ?dryRun=true validates every file without storing any.
+func BatchUploadHandler(in *Ingest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := in.Limits.For(r)
+		if r.Method == http.MethodOptions {
+			writeUploadOptions(w, "POST, OPTIONS", limit)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for batch uploads")
+			return
+		}
+		if !preflight(w, r, in.Config.MaxBatchBytes, limit) {
+			return
+		}
+		customer, uerr := customerKey(r)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, in.Config.MaxBatchBytes)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeMessage(w, http.StatusBadRequest, "bad_request", newMessage("invalid_multipart"))
+			return
+		}
+
+		var manifest BatchManifest
+		resp := BatchResponse{Results: []BatchResult{}}
+		for {
+			p, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				if len(resp.Results) == 0 && isTooLarge(err) {
+					writeRequestEntityTooLarge(w, "Batch exceeds the maximum size of "+strconv.FormatInt(in.Config.MaxBatchBytes, 10)+" bytes")
+					return
+				}
+				if len(resp.Results) == 0 {
+					writeBadRequest(w, "Error processing multipart data: "+err.Error())
+					return
+				}
+				// The stream is unusable past this point; report what
+				// was processed.
+				break
+			}
+
+			if partFilename(p) == "" {
+				if partFormName(p) == "manifest" {
+					if err := json.NewDecoder(io.LimitReader(p, 1<<20)).Decode(&manifest); err != nil {
+						p.Close()
+						writeBadRequest(w, "Invalid JSON in 'manifest' field")
+						return
+					}
+				}
+				p.Close()
+				continue
+			}
+
+			res := BatchResult{Index: len(resp.Results), Field: partFormName(p), Filename: partFilename(p)}
+			meta, uerr := batchMeta(manifest, partFilename(p), partFormName(p))
+			meta.MaxBytes = limit
+			meta.CustomerKey = customer
+			meta.IfNotExists = r.URL.Query().Get("ifNotExists") == "true"
+			meta.DryRun = r.URL.Query().Get("dryRun") == "true"
+			meta.NotifyEmail = notifyAddress(r)
+			var rec *FileRecord
+			if uerr == nil {
+				rec, uerr = in.Receive(r.Context(), &limitFile{r: p, n: limit}, partFilename(p), meta)
+			}
+			p.Close()
+
+			if uerr != nil {
+				res.Status, res.Error = "error", uerr
+				resp.Failed++
+			} else {
+				ur := newUploadResponse(rec)
+				ur.DryRun = meta.DryRun
+				res.Status, res.File = "ok", &ur
+				resp.Succeeded++
+			}
+			resp.Results = append(resp.Results, res)
+		}
+
+		if len(resp.Results) == 0 {
+			writeBadRequest(w, "No file parts provided")
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func batchMeta(m BatchManifest, filename, field string) (UploadMeta, *UploadError) {
+	t, ok := m.Files[filename]
+	if !ok {
+		t = m.Files[field]
+	}
+	folder, ok := cleanFolder(t.Folder)
+	if !ok {
+		return UploadMeta{}, newUploadError(http.StatusBadRequest, "bad_request", "Invalid folder '"+t.Folder+"'")
+	}
+	return UploadMeta{Folder: folder, Tags: t.Tags}, nil
+}
+
+// cleanFolder normalises a client folder path to a relative, slash-separated
+// form and rejects any ".." segment.
+func cleanFolder(folder string) (string, bool) {
+	var segs []string
+	for _, seg := range strings.Split(strings.ReplaceAll(folder, `\`, "/"), "/") {
+		seg = strings.TrimSpace(seg)
+		switch seg {
+		case "", ".":
+			continue
+		case "..":
+			return "", false
+		}
+		segs = append(segs, seg)
+	}
+	return strings.Join(segs, "/"), true
+}
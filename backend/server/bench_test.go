@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"example.com/file-upload-go/config"
+)
+
+// testIngest returns an Ingest writing into a fresh temp directory. The
+// working directory is switched there because blob paths are relative.
+func testIngest(tb testing.TB) *Ingest {
+	tb.Helper()
+	dir := tb.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = os.Chdir(wd) })
+
+	store, err := NewJSONStore(metadataDir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	limits, _ := LoadSizeLimits("", config.DefaultMaxUploadBytes)
+	return &Ingest{Store: store, IDs: hexIDs{}, Limits: limits}
+}
+
+// BenchmarkReceive measures the storage and hash pipeline behind every
+// upload endpoint, without HTTP or multipart overhead.
+func BenchmarkReceive(b *testing.B) {
+	for _, sizeMB := range []int64{1, 50, 200} {
+		data := syntheticCSV(sizeMB << 20)
+		for _, conc := range []int{1, 4, 16} {
+			if sizeMB == 200 && conc > 4 {
+				continue
+			}
+			b.Run(fmt.Sprintf("size=%dMB/c=%d", sizeMB, conc), func(b *testing.B) {
+				in := testIngest(b)
+				b.SetBytes(int64(len(data)) * int64(conc))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var wg sync.WaitGroup
+					for c := 0; c < conc; c++ {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							meta := UploadMeta{MaxBytes: config.DefaultMaxUploadBytes}
+							if _, uerr := in.Receive(context.Background(), bytes.NewReader(data), "bench.csv", meta); uerr != nil {
+								b.Error(uerr)
+							}
+						}()
+					}
+					wg.Wait()
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkUploadHandler adds multipart parsing and response encoding on
+// top of BenchmarkReceive.
+func BenchmarkUploadHandler(b *testing.B) {
+	for _, sizeMB := range []int64{1, 50} {
+		body, contentType, err := multipartUpload(syntheticCSV(sizeMB << 20))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("size=%dMB", sizeMB), func(b *testing.B) {
+			in := testIngest(b)
+			h := UploadHandler(in, nil)
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/v1/files/", bytes.NewReader(body))
+				req.Header.Set("Content-Type", contentType)
+				w := httptest.NewRecorder()
+				h(w, req)
+				if w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+const cacheListKey = "files:list"
+
+// cachedStore fronts a MetadataStore with Redis. Reads are served from the
+// cache when possible; every write invalidates the affected record and the
+// cached listing. Redis failures fall through to the backing store.
+type cachedStore struct {
+	MetadataStore
+	redis *redisClient
+	ttl   time.Duration
+}
+
+func NewCachedStore(backing MetadataStore, addr string, ttl time.Duration) *cachedStore {
+	return &cachedStore{MetadataStore: backing, redis: newRedisClient(addr), ttl: ttl}
+}
+
+func cacheKey(id string) string { return "file:" + id }
+
+func (c *cachedStore) get(ctx context.Context, key string, v any) bool {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	reply, err := c.redis.Do(ctx, "GET", key)
+	if err != nil {
+		if !errors.Is(err, errRedisNil) {
+			log.Printf("cache: get %s: %v", key, err)
+		}
+		return false
+	}
+	s, ok := reply.(string)
+	return ok && json.Unmarshal([]byte(s), v) == nil
+}
+
+func (c *cachedStore) set(ctx context.Context, key string, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	ms := strconv.FormatInt(c.ttl.Milliseconds(), 10)
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	if _, err := c.redis.Do(ctx, "SET", key, string(b), "PX", ms); err != nil {
+		log.Printf("cache: set %s: %v", key, err)
+	}
+}
+
+// invalidate is not tied to the caller's context: a write that reached the
+// backing store must drop the stale entries even if the request was
+// cancelled meanwhile.
+func (c *cachedStore) invalidate(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	if _, err := c.redis.Do(ctx, "DEL", cacheKey(id), cacheListKey); err != nil {
+		log.Printf("cache: invalidate %s: %v", id, err)
+	}
+}
+
+func (c *cachedStore) Get(ctx context.Context, id string) (*FileRecord, error) {
+	var rec FileRecord
+	if c.get(ctx, cacheKey(id), &rec) {
+		return &rec, nil
+	}
+	r, err := c.MetadataStore.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.set(ctx, cacheKey(id), r)
+	return r, nil
+}
+
+func (c *cachedStore) Put(ctx context.Context, rec *FileRecord) error {
+	err := c.MetadataStore.Put(ctx, rec)
+	c.invalidate(rec.ID)
+	return err
+}
+
+func (c *cachedStore) Create(ctx context.Context, rec *FileRecord) error {
+	err := c.MetadataStore.Create(ctx, rec)
+	c.invalidate(rec.ID)
+	return err
+}
+
+func (c *cachedStore) Delete(ctx context.Context, id string) error {
+	err := c.MetadataStore.Delete(ctx, id)
+	c.invalidate(id)
+	return err
+}
+
+func (c *cachedStore) List(ctx context.Context) ([]*FileRecord, error) {
+	var recs []*FileRecord
+	if c.get(ctx, cacheListKey, &recs) {
+		return recs, nil
+	}
+	recs, err := c.MetadataStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.set(ctx, cacheListKey, recs)
+	return recs, nil
+}
+
+// Walk reads through to the backing store; a full scan would only evict
+// what the cache holds.
+func (c *cachedStore) Walk(ctx context.Context, fn func(*FileRecord) error) error {
+	return walkRecords(ctx, c.MetadataStore, fn)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Cache classes of a download response. A file fetched by ID never changes,
+// so its URL is immutable; a URL that resolves to whatever is current, such
+// as an object key without ?version=, may change at any time and only gets a
+// short TTL. Share links count downloads and must reach the server every
+// time, so they are never cached.
+const (
+	CacheImmutable = "immutable"
+	CacheLatest    = "latest"
+	CacheNone      = "none"
+)
+
+// CachePolicy sets Cache-Control and Expires on downloads so a CDN or
+// reverse proxy can sit in front of the server. Responses are only marked
+// public when Public is set and the request carried no credentials or
+// encryption key in its headers; otherwise a shared cache could hand an
+// API-key or customer-key download to anyone asking for the same URL. Token URLs, and CDN-signed URLs at an
+// edge that validates signatures, only reach holders of a valid link, so
+// those responses can be public.
+type CachePolicy struct {
+	Public          bool
+	ImmutableMaxAge time.Duration
+	LatestMaxAge    time.Duration
+}
+
+// cachePolicy is set from configuration at startup.
+var cachePolicy = CachePolicy{ImmutableMaxAge: 365 * 24 * time.Hour, LatestMaxAge: time.Minute}
+
+type cacheClassKey struct{}
+
+// withCacheClass marks r, before it is handed to the download handler, as
+// served from a URL of the given cache class.
+func withCacheClass(r *http.Request, class string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), cacheClassKey{}, class))
+}
+
+func cacheClass(r *http.Request) string {
+	if class, ok := r.Context().Value(cacheClassKey{}).(string); ok {
+		return class
+	}
+	return CacheImmutable
+}
+
+// apply sets the caching headers of a successful response to r.
+func (p CachePolicy) apply(w http.ResponseWriter, r *http.Request, class string) {
+	maxAge := p.ImmutableMaxAge
+	if class == CacheLatest {
+		maxAge = p.LatestMaxAge
+	}
+	if class == CacheNone || maxAge <= 0 {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	scope := "private"
+	if p.Public && r.Header.Get("Authorization") == "" && r.Header.Get("X-API-Key") == "" && r.Header.Get(customerKeyHeader) == "" {
+		scope = "public"
+	}
+	value := scope + ", max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if class == CacheImmutable {
+		value += ", immutable"
+	}
+	w.Header().Set("Cache-Control", value)
+	w.Header().Set("Expires", time.Now().Add(maxAge).UTC().Format(http.TimeFormat))
+}
@@ -0,0 +1,83 @@
+package server
+
+import "net/http"
+
+// Capabilities describes what this server accepts so clients can validate
+// uploads and pick features without hardcoding them.
+type Capabilities struct {
+	MaxUploadBytes     int64                   `json:"maxUploadBytes"`
+	MaxBatchBytes      int64                   `json:"maxBatchBytes"`
+	AllowedTypes       []fileType              `json:"allowedTypes"`
+	ChecksumAlgorithms []string                `json:"checksumAlgorithms"`
+	IDFormat           string                  `json:"idFormat"`
+	ConflictPolicies   []string                `json:"conflictPolicies"`
+	Resumable          ResumableCapabilities   `json:"resumable"`
+	Compression        CompressionCapabilities `json:"compression"`
+	PIIScan            bool                    `json:"piiScan"`
+	FormulaPolicy      string                  `json:"formulaPolicy"`
+	CSVLimits          CSVLimitCapabilities    `json:"csvLimits"`
+	FileFields         []string                `json:"fileFields"`
+
+	// DirectUploads is true when files can be sent straight to the S3
+	// bucket through POST /v1/uploads/direct.
+	DirectUploads bool `json:"directUploads"`
+}
+
+// CSVLimitCapabilities bounds the shape of an upload; zero means
+// unlimited.
+type CSVLimitCapabilities struct {
+	MaxRows      int64 `json:"maxRows"`
+	MaxColumns   int   `json:"maxColumns"`
+	MaxCellBytes int64 `json:"maxCellBytes"`
+}
+
+type ResumableCapabilities struct {
+	Supported         bool  `json:"supported"`
+	MaxChunkBytes     int64 `json:"maxChunkBytes"`
+	SessionTTLSeconds int64 `json:"sessionTtlSeconds"`
+}
+
+// CompressionCapabilities lists the stored-blob encoding (empty when blobs
+// are kept as uploaded) and the encodings responses may be sent with.
+type CompressionCapabilities struct {
+	Storage   string   `json:"storage,omitempty"`
+	Responses []string `json:"responses"`
+}
+
+// CapabilitiesHandler serves GET /v1/capabilities. The upload limit is the
+// one that applies to the caller, so the response varies with the identity
+// headers SizeLimits reads. ?key= reports the formula policy of that key's
+// bucket.
+func CapabilitiesHandler(in *Ingest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w, "Only GET and HEAD methods are allowed for capabilities")
+			return
+		}
+		cfg := in.Config
+		caps := Capabilities{
+			MaxUploadBytes:     in.Limits.For(r),
+			MaxBatchBytes:      cfg.MaxBatchBytes,
+			AllowedTypes:       uploadTypes,
+			ChecksumAlgorithms: []string{"sha256"},
+			IDFormat:           cfg.IDFormat,
+			ConflictPolicies:   []string{ConflictReject, ConflictOverwrite, ConflictVersion},
+			Resumable: ResumableCapabilities{
+				Supported:         true,
+				MaxChunkBytes:     cfg.MaxChunkBytes,
+				SessionTTLSeconds: int64(cfg.SessionTTLHours) * 3600,
+			},
+			Compression:   CompressionCapabilities{Storage: cfg.Compression, Responses: []string{}},
+			PIIScan:       in.PII != nil,
+			FormulaPolicy: in.Formulas.For(r.URL.Query().Get("key")),
+			CSVLimits:     CSVLimitCapabilities{MaxRows: cfg.MaxRows, MaxColumns: cfg.MaxColumns, MaxCellBytes: cfg.MaxCellBytes},
+			FileFields:    parseFileFields(cfg.FileFields),
+			DirectUploads: cfg.DirectS3Bucket != "",
+		}
+		if cfg.ResponseCompression {
+			caps.Compression.Responses = []string{EncodingZstd, EncodingGzip}
+		}
+		w.Header().Set("Vary", "X-Tenant-ID, X-API-Key")
+		writeJSON(w, http.StatusOK, caps)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CDNSigner issues CloudFront/Fastly-style signed URLs and cookies for
+// downloads, so download traffic can go through a CDN while this service
+// stays the authority on who may fetch what. The service signs after its
+// own authorization check; the CDN forwards cache misses with the signature
+// intact and the origin validates it here. Edges that can check an HMAC
+// themselves (Fastly, Cloudflare workers, a CloudFront function) can be
+// given the same key and reject bad signatures before they reach the origin.
+//
+// A signed URL carries Expires (unix seconds), Key-Pair-Id and Signature
+// query parameters; signed cookies carry the same values as CDN-Expires,
+// CDN-Key-Pair-Id and CDN-Signature, scoped to the file's path. The
+// signature is the hex HMAC-SHA256 of "cdn\n<Key-Pair-Id>\n<path>\n<Expires>".
+// The CDN should leave these parameters out of its cache key.
+type CDNSigner struct {
+	base         string
+	keyID        string
+	signer       *Signer
+	maxTTL       time.Duration
+	cookieDomain string
+}
+
+// NewCDNSigner returns nil when base is empty, which disables CDN URLs.
+// cookieDomain, when set, lets signed cookies minted by the API reach a CDN
+// host under the same parent domain.
+func NewCDNSigner(base, keyID string, signer *Signer, maxTTL time.Duration, cookieDomain string) *CDNSigner {
+	if base == "" {
+		return nil
+	}
+	return &CDNSigner{base: strings.TrimSuffix(base, "/"), keyID: keyID, signer: signer, maxTTL: maxTTL, cookieDomain: cookieDomain}
+}
+
+func cdnPayload(keyID, path string, exp int64) []byte {
+	return []byte("cdn\n" + keyID + "\n" + path + "\n" + strconv.FormatInt(exp, 10))
+}
+
+// Sign returns the signature values for path, valid for ttl capped at the
+// configured maximum.
+func (c *CDNSigner) Sign(path string, ttl time.Duration) (exp time.Time, sig string) {
+	if ttl <= 0 || ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	exp = time.Now().Add(ttl).Truncate(time.Second)
+	return exp, c.signer.Sign(cdnPayload(c.keyID, path, exp.Unix()))
+}
+
+// Valid reports whether r carries an unexpired CDN signature for its path,
+// in its query or its cookies.
+func (c *CDNSigner) Valid(r *http.Request) bool {
+	if c == nil {
+		return false
+	}
+	q := r.URL.Query()
+	rawExp, keyID, sig := q.Get("Expires"), q.Get("Key-Pair-Id"), q.Get("Signature")
+	if sig == "" {
+		rawExp, keyID, sig = cookieValue(r, "CDN-Expires"), cookieValue(r, "CDN-Key-Pair-Id"), cookieValue(r, "CDN-Signature")
+	}
+	if sig == "" || keyID != c.keyID {
+		return false
+	}
+	exp, err := strconv.ParseInt(rawExp, 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return false
+	}
+	return c.signer.Verify(cdnPayload(keyID, r.URL.Path, exp), sig)
+}
+
+func cookieValue(r *http.Request, name string) string {
+	if ck, err := r.Cookie(name); err == nil {
+		return ck.Value
+	}
+	return ""
+}
+
+type cdnURLRequest struct {
+	TTLSeconds int  `json:"ttlSeconds"`
+	Cookies    bool `json:"cookies"`
+}
+
+type CDNURLResponse struct {
+	FileID    string    `json:"fileId"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// MintHandler issues a signed CDN URL for an existing file:
+// POST /v1/files/{id}/cdn-url {"ttlSeconds": N, "cookies": true}. With
+// cookies the response also sets signed cookies for the file's path, for
+// players and viewers that fetch the plain URL. The body is optional.
+func (c *CDNSigner) MintHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req cdnURLRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+		}
+		if req.TTLSeconds < 0 {
+			writeBadRequest(w, "Field 'ttlSeconds' must not be negative")
+			return
+		}
+		rec, ok := loadRecord(w, r, store, r.PathValue("id"))
+		if !ok {
+			return
+		}
+		path := "/v1/files/" + rec.ID
+		exp, sig := c.Sign(path, time.Duration(req.TTLSeconds)*time.Second)
+		q := url.Values{
+			"Expires":     {strconv.FormatInt(exp.Unix(), 10)},
+			"Key-Pair-Id": {c.keyID},
+			"Signature":   {sig},
+		}
+		if req.Cookies {
+			for name, v := range map[string]string{"CDN-Expires": q.Get("Expires"), "CDN-Key-Pair-Id": c.keyID, "CDN-Signature": sig} {
+				http.SetCookie(w, &http.Cookie{Name: name, Value: v, Path: path, Domain: c.cookieDomain, Expires: exp, Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, CDNURLResponse{FileID: rec.ID, URL: c.base + path + "?" + q.Encode(), ExpiresAt: exp.UTC()})
+	}
+}
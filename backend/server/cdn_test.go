@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Signed URLs and cookies minted for a file open that file's path, with
+// the configured key pair, until they expire.
+func TestCDNSigner(t *testing.T) {
+	in := testIngest(t)
+	rec := testRecord(t, in)
+	key := StaticSecret("cdn-key")
+	cdn := NewCDNSigner("https://cdn.example.com/", "kp1", NewSigner(key), time.Hour, "example.com")
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/files/"+rec.ID+"/cdn-url", strings.NewReader(`{"ttlSeconds": 600, "cookies": true}`))
+	req.SetPathValue("id", rec.ID)
+	w := httptest.NewRecorder()
+	cdn.MintHandler(in.Store)(w, req)
+	var resp CDNURLResponse
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+		t.Fatalf("mint: %d %s", w.Code, w.Body)
+	}
+	u, err := url.Parse(resp.URL)
+	if err != nil || u.Host != "cdn.example.com" || u.Path != "/v1/files/"+rec.ID {
+		t.Fatalf("signed URL %q", resp.URL)
+	}
+	if d := time.Until(resp.ExpiresAt); d <= 9*time.Minute || d > 10*time.Minute {
+		t.Errorf("URL expires in %s, want 10m", d)
+	}
+	cookies := w.Result().Cookies()
+	for _, ck := range cookies {
+		if ck.Path != u.Path || ck.Domain != "example.com" || !ck.Secure || !ck.HttpOnly {
+			t.Errorf("cookie %+v not scoped to the file", ck)
+		}
+	}
+
+	q := u.Query()
+	with := func(name, value string) string {
+		q := u.Query()
+		q.Set(name, value)
+		return q.Encode()
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+	expired := "Expires=" + strconv.FormatInt(past, 10) + "&Key-Pair-Id=kp1&Signature=" + NewSigner(key).Sign(cdnPayload("kp1", u.Path, past))
+	tests := []struct {
+		name, path, query string
+		cookies           bool
+		ok                bool
+	}{
+		{"signed URL", u.Path, u.RawQuery, false, true},
+		{"signed cookies", u.Path, "", true, true},
+		{"other file", "/v1/files/other", u.RawQuery, false, false},
+		{"cookies for another file", "/v1/files/other", "", true, false},
+		{"other key pair", u.Path, with("Key-Pair-Id", "kp2"), false, false},
+		{"expiry moved", u.Path, with("Expires", strconv.FormatInt(resp.ExpiresAt.Unix()+3600, 10)), false, false},
+		{"expired", u.Path, expired, false, false},
+		{"signature changed", u.Path, with("Signature", strings.Repeat("0", len(q.Get("Signature")))), false, false},
+		{"unsigned", u.Path, "", false, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path+"?"+tt.query, nil)
+		if tt.cookies {
+			for _, ck := range cookies {
+				r.AddCookie(ck)
+			}
+		}
+		if got := cdn.Valid(r); got != tt.ok {
+			t.Errorf("%s: Valid = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+
+	if exp, _ := cdn.Sign(u.Path, 48*time.Hour); time.Until(exp) > time.Hour {
+		t.Errorf("TTL past the maximum was not capped: expires %s", exp)
+	}
+	if (*CDNSigner)(nil).Valid(httptest.NewRequest(http.MethodGet, u.Path+"?"+u.RawQuery, nil)) {
+		t.Error("disabled CDN signing accepted a signature")
+	}
+}
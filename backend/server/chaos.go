@@ -0,0 +1,78 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ChaosConfig sets fault-injection rates, in percent of matching requests.
+// It exists to exercise client retries and resumable uploads and must stay
+// off in production.
+type ChaosConfig struct {
+	LatencyRate  int
+	MaxLatency   time.Duration
+	ErrorRate    int
+	TruncateRate int
+	PathPrefix   string
+}
+
+var chaosStatuses = []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+
+// Chaos injects latency, 5xx responses and truncated response bodies into
+// requests under cfg.PathPrefix. Injected faults are marked with X-Chaos.
+func Chaos(cfg ChaosConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, cfg.PathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cfg.MaxLatency > 0 && hit(cfg.LatencyRate) {
+			w.Header().Add("X-Chaos", "latency")
+			select {
+			case <-time.After(rand.N(cfg.MaxLatency)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if hit(cfg.ErrorRate) {
+			w.Header().Add("X-Chaos", "error")
+			w.Header().Set("Retry-After", "1")
+			writeError(w, chaosStatuses[rand.IntN(len(chaosStatuses))], "chaos_injected", "Fault injected by chaos middleware")
+			return
+		}
+		if hit(cfg.TruncateRate) {
+			w.Header().Add("X-Chaos", "truncate")
+			w = &truncatingWriter{ResponseWriter: w, remaining: rand.Int64N(512)}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hit(percent int) bool {
+	return percent > 0 && rand.IntN(100) < percent
+}
+
+// truncatingWriter passes through the first remaining bytes of the body and
+// then aborts the connection, as a dropped transfer would.
+type truncatingWriter struct {
+	http.ResponseWriter
+	remaining int64
+}
+
+func (tw *truncatingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= tw.remaining {
+		tw.remaining -= int64(len(p))
+		return tw.ResponseWriter.Write(p)
+	}
+	_, _ = tw.ResponseWriter.Write(p[:tw.remaining])
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func (tw *truncatingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
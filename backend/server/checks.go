@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ClamAVCheck scans files with a clamd daemon over its INSTREAM command.
+// Addr is host:port, or a Unix socket path when it starts with "/".
+type ClamAVCheck struct {
+	Addr string
+}
+
+func (c *ClamAVCheck) Name() string { return "virus_scan" }
+
+func (c *ClamAVCheck) Check(ctx context.Context, rec *FileRecord) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.Addr, "/") {
+		network = "unix"
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.Addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	body, err := openBlob(rec, false)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+64<<10)
+	for {
+		n, err := body.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return "", werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	reply = strings.TrimPrefix(strings.TrimRight(reply, "\x00\n"), "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return "malware detected: " + strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// FileSchema lists the columns a bucket's files must have. With Exact the
+// header must match Columns in order with nothing extra.
+type FileSchema struct {
+	Columns []string `json:"columns"`
+	Exact   bool     `json:"exact,omitempty"`
+}
+
+// SchemaCheck validates headers against schemas. A file names one of
+// Schemas by ID when uploaded; otherwise its key's bucket picks from
+// Buckets, and files with neither pass.
+type SchemaCheck struct {
+	Schemas map[string]FileSchema `json:"schemas,omitempty"`
+	Buckets map[string]FileSchema `json:"buckets,omitempty"`
+}
+
+// Has reports whether id names a schema. A nil *SchemaCheck has none.
+func (c *SchemaCheck) Has(id string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.Schemas[id]
+	return ok
+}
+
+// LoadSchemaCheck reads a JSON SchemaCheck document from path.
+func LoadSchemaCheck(path string) (*SchemaCheck, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &SchemaCheck{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *SchemaCheck) Name() string { return "schema" }
+
+func (c *SchemaCheck) Check(_ context.Context, rec *FileRecord) (string, error) {
+	bucket, _, _ := strings.Cut(rec.Key, "/")
+	schema, ok := c.Buckets[bucket]
+	name := "bucket '" + bucket + "'"
+	if rec.SchemaID != "" {
+		schema, ok = c.Schemas[rec.SchemaID]
+		name = "schema '" + rec.SchemaID + "'"
+		if !ok {
+			return "unknown " + name, nil
+		}
+	}
+	if !ok || (bucket == "" && rec.SchemaID == "") {
+		return "", nil
+	}
+	if rec.Columns == nil {
+		return "header row could not be read", nil
+	}
+	if schema.Exact {
+		if !slices.Equal(rec.Columns, schema.Columns) {
+			return fmt.Sprintf("columns %q do not match %s %q", rec.Columns, name, schema.Columns), nil
+		}
+		return "", nil
+	}
+	var missing []string
+	for _, col := range schema.Columns {
+		if !slices.Contains(rec.Columns, col) {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("missing columns required by %s: %s", name, strings.Join(missing, ", ")), nil
+	}
+	return "", nil
+}
+
+// PIICheck quarantines files the upload-time PII scan found personal data
+// in.
+type PIICheck struct{}
+
+func (PIICheck) Name() string { return "pii_policy" }
+
+func (PIICheck) Check(_ context.Context, rec *FileRecord) (string, error) {
+	if !rec.PII.Detected() {
+		return "", nil
+	}
+	kinds := map[string]bool{}
+	for _, f := range rec.PII.Findings {
+		kinds[f.Kind] = true
+	}
+	names := make([]string, 0, len(kinds))
+	for k := range kinds {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	return "personal data found: " + strings.Join(names, ", "), nil
+}
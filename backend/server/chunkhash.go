@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"hash"
+	"net/http"
+)
+
+// chunkHashBlock is the size of the blocks a blob is hashed in. Blocks are
+// fixed rather than following the chunks a client happened to send, so the
+// hashes line up with byte ranges however the file arrived.
+const chunkHashBlock = 1 << 20
+
+// ChunkHashes are the SHA-256 of each chunkHashBlock-sized block of a file
+// (the last may be shorter) and the Merkle root over them. Interior nodes
+// are SHA-256(0x01 || left || right); a node without a sibling is carried
+// up unchanged.
+type ChunkHashes struct {
+	BlockSize int64    `json:"blockSize"`
+	Hashes    []string `json:"hashes"`
+	Root      string   `json:"root"`
+}
+
+// chunkHasher hashes a stream block by block as it is written. Its state is
+// exported so resumable uploads can carry it between chunks, as csvStats
+// does.
+type chunkHasher struct {
+	Hashes []string `json:"hashes,omitempty"`
+	Filled int64    `json:"filled,omitempty"` // bytes of the current block so far
+	State  []byte   `json:"state,omitempty"`  // marshaled hash of the current block
+
+	h hash.Hash
+}
+
+func (c *chunkHasher) block() hash.Hash {
+	if c.h == nil {
+		c.h = sha256.New()
+		if len(c.State) > 0 {
+			if err := c.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(c.State); err != nil {
+				c.h.Reset()
+			}
+		}
+	}
+	return c.h
+}
+
+func (c *chunkHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(int64(len(p)), chunkHashBlock-c.Filled)
+		c.block().Write(p[:take])
+		c.Filled += take
+		p = p[take:]
+		if c.Filled == chunkHashBlock {
+			c.Hashes = append(c.Hashes, hex.EncodeToString(c.h.Sum(nil)))
+			c.h.Reset()
+			c.Filled = 0
+		}
+	}
+	return n, nil
+}
+
+// save records the current block's hash state for the next chunk.
+func (c *chunkHasher) save() error {
+	if c.h == nil {
+		return nil
+	}
+	state, err := c.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	c.State = state
+	return nil
+}
+
+// Sum returns the hashes of everything written so far.
+func (c *chunkHasher) Sum() *ChunkHashes {
+	hashes := append([]string(nil), c.Hashes...)
+	if c.Filled > 0 {
+		hashes = append(hashes, hex.EncodeToString(c.block().Sum(nil)))
+	}
+	return &ChunkHashes{BlockSize: chunkHashBlock, Hashes: hashes, Root: merkleRoot(hashes)}
+}
+
+// merkleRoot folds hex leaf hashes into the root of their Merkle tree.
+func merkleRoot(hashes []string) string {
+	if len(hashes) == 0 {
+		return ""
+	}
+	level := make([][]byte, len(hashes))
+	for i, s := range hashes {
+		level[i], _ = hex.DecodeString(s)
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// badBlocks lists the blocks whose hashes differ between want and got,
+// counting blocks missing from either side.
+func badBlocks(want, got *ChunkHashes) []int {
+	var bad []int
+	for i := 0; i < max(len(want.Hashes), len(got.Hashes)); i++ {
+		if i >= len(want.Hashes) || i >= len(got.Hashes) || want.Hashes[i] != got.Hashes[i] {
+			bad = append(bad, i)
+		}
+	}
+	return bad
+}
+
+// ChunksHandler serves a file's block hashes and Merkle root:
+// GET /v1/files/{id}/chunks. A client that downloads a byte range can hash
+// the blocks it covers and compare them here, and check the list itself
+// against the root. Files stored before block hashes were kept have them
+// computed on request. Those of a file under a customer key need the key.
+func ChunksHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec, ok := loadRecord(w, r, store, r.PathValue("id"))
+		if !ok {
+			return
+		}
+		if unavailable(w, rec) || !requireCustomerKey(w, r, rec) {
+			return
+		}
+		chunks := rec.Chunks
+		if chunks == nil {
+			var err error
+			_, chunks, err = hashBlob(rec)
+			if err != nil {
+				writeInternalError(w, "Failed to read file")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, chunks)
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"example.com/file-upload-go/config"
+	"example.com/file-upload-go/fupclient"
+)
+
+// runCommand dispatches the maintenance subcommands that share the server's
+// configuration and data directories.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "backup":
+		fs := flag.NewFlagSet("backup", flag.ExitOnError)
+		out := fs.String("out", "", "path of the archive to write (.tar.gz)")
+		since := fs.String("since", "", "only include files uploaded at or after this RFC 3339 time (incremental backup)")
+		_ = fs.Parse(args)
+		if *out == "" {
+			return fmt.Errorf("backup: -out is required")
+		}
+		var sinceT time.Time
+		if *since != "" {
+			t, err := time.Parse(time.RFC3339, *since)
+			if err != nil {
+				return fmt.Errorf("backup: invalid -since: %w", err)
+			}
+			sinceT = t
+		}
+		if err := cliBlobKeys(); err != nil {
+			return err
+		}
+		store, err := NewJSONStore(metadataDir)
+		if err != nil {
+			return err
+		}
+		m, err := Backup(context.Background(), store, *out, sinceT)
+		if err != nil {
+			return err
+		}
+		log.Printf("backup: wrote %d files to %s", len(m.Files), *out)
+		return nil
+
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		in := fs.String("in", "", "archive produced by backup")
+		overwrite := fs.Bool("overwrite", false, "replace records that already exist")
+		_ = fs.Parse(args)
+		if *in == "" {
+			return fmt.Errorf("restore: -in is required")
+		}
+		if err := cliBlobKeys(); err != nil {
+			return err
+		}
+		store, err := NewJSONStore(metadataDir)
+		if err != nil {
+			return err
+		}
+		n, err := Restore(context.Background(), store, cliLocker(), *in, *overwrite)
+		if err != nil {
+			return err
+		}
+		log.Printf("restore: restored %d files from %s", n, *in)
+		return nil
+
+	case "rewrap":
+		fs := flag.NewFlagSet("rewrap", flag.ExitOnError)
+		force := fs.Bool("force", false, "also re-wrap keys already under the primary KEK")
+		_ = fs.Parse(args)
+		if err := cliBlobKeys(); err != nil {
+			return err
+		}
+		if blobKeys == nil {
+			return fmt.Errorf("rewrap: UPLOAD_ENCRYPTION_KEK is not set")
+		}
+		store, err := NewJSONStore(metadataDir)
+		if err != nil {
+			return err
+		}
+		report, err := Rewrap(context.Background(), store, cliLocker(), blobKeys, *force)
+		if err != nil {
+			return err
+		}
+		log.Printf("rewrap: re-wrapped %d of %d data keys with %s", report.Rewrapped, report.Encrypted, report.KEK)
+		if len(report.Failed) > 0 {
+			return fmt.Errorf("rewrap: %d data keys could not be re-wrapped", len(report.Failed))
+		}
+		return nil
+
+	case "doctor":
+		fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+		asJSON := fs.Bool("json", false, "print the diagnoses as JSON")
+		_ = fs.Parse(args)
+		ds := Doctor(context.Background(), config.Load())
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(ds); err != nil {
+				return err
+			}
+		} else {
+			for _, d := range ds {
+				fmt.Println(d)
+			}
+		}
+		if diagnosesFailed(ds) {
+			return fmt.Errorf("doctor: some checks failed")
+		}
+		return nil
+
+	case "loadgen":
+		fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+		url := fs.String("url", "http://localhost:8080/v1/files/", "upload endpoint")
+		sizeMB := fs.Int("size-mb", 1, "size of each upload in MB")
+		conc := fs.Int("c", 4, "concurrent uploads")
+		n := fs.Int("n", 20, "total uploads")
+		_ = fs.Parse(args)
+		if *sizeMB <= 0 || *conc <= 0 || *n <= 0 {
+			return fmt.Errorf("loadgen: -size-mb, -c and -n must be positive")
+		}
+		res, err := LoadGen(context.Background(), LoadGenConfig{URL: *url, Size: int64(*sizeMB) << 20, Concurrency: *conc, Requests: *n})
+		if err != nil {
+			return err
+		}
+		log.Printf("loadgen: size=%dMB c=%d %s", *sizeMB, *conc, res)
+		if res.FirstError != nil {
+			log.Printf("loadgen: first error: %v", res.FirstError)
+		}
+		return nil
+
+	case "verify-receipt":
+		fs := flag.NewFlagSet("verify-receipt", flag.ExitOnError)
+		receipt := fs.String("receipt", "", "receipt from an upload response")
+		keys := fs.String("keys", "", "key set saved from GET /v1/receipts/keys")
+		file := fs.String("file", "", "optional copy of the file to check against the receipt")
+		_ = fs.Parse(args)
+		if *receipt == "" || *keys == "" {
+			return fmt.Errorf("verify-receipt: -receipt and -keys are required")
+		}
+		b, err := os.ReadFile(*keys)
+		if err != nil {
+			return err
+		}
+		var set JWKSet
+		if err := json.Unmarshal(b, &set); err != nil {
+			return fmt.Errorf("verify-receipt: parse %s: %w", *keys, err)
+		}
+		claims, err := VerifyReceipt(*receipt, set)
+		if err != nil {
+			return fmt.Errorf("verify-receipt: %w", err)
+		}
+		if *file != "" {
+			sum, size, err := hashFile(*file)
+			if err != nil {
+				return err
+			}
+			if sum != claims.SHA256 || size != claims.Size {
+				return fmt.Errorf("verify-receipt: %s does not match the receipt for %s", *file, claims.ID)
+			}
+		}
+		log.Printf("verify-receipt: file %s, sha256 %s, %d bytes, accepted %s", claims.ID, claims.SHA256, claims.Size, claims.Time().Format(time.RFC3339))
+		return nil
+
+	case "upload":
+		fs := flag.NewFlagSet("upload", flag.ExitOnError)
+		url := fs.String("url", "http://localhost:8080", "server base URL")
+		key := fs.String("key", os.Getenv("UPLOAD_API_KEY"), "API key")
+		chunkMB := fs.Int("chunk-mb", 8, "chunk size in MB")
+		conc := fs.Int("c", 4, "chunks in flight at once")
+		retries := fs.Int("retries", 3, "retries per chunk")
+		state := fs.String("state", "", "resume state file (default <file>.upload-state)")
+		name := fs.String("name", "", "filename to store when reading stdin")
+		rateKB := fs.Int64("rate-kb", 0, "bandwidth cap in KB/s (0 for none)")
+		progress := fs.Bool("progress", false, "report progress on stderr")
+		_ = fs.Parse(args)
+		if fs.NArg() != 1 {
+			return fmt.Errorf("upload: exactly one file, or - for stdin, is required")
+		}
+		if *chunkMB <= 0 || *conc <= 0 || *retries < 0 || *rateKB < 0 {
+			return fmt.Errorf("upload: -chunk-mb and -c must be positive and -retries and -rate-kb not negative")
+		}
+		path := fs.Arg(0)
+		opts := fupclient.ChunkedOptions{ChunkSize: int64(*chunkMB) << 20, Concurrency: *conc, Retries: *retries, StateFile: *state}
+		opts.BytesPerSecond = *rateKB << 10
+		if *retries == 0 {
+			opts.Retries = -1
+		}
+		if *progress {
+			opts.Progress = printProgress()
+		}
+		client := fupclient.New(*url, *key)
+		var res *fupclient.UploadResponse
+		var err error
+		if path == "-" {
+			if *name == "" {
+				return fmt.Errorf("upload: -name is required when reading stdin")
+			}
+			res, err = client.UploadStream(context.Background(), *name, os.Stdin, opts)
+		} else {
+			if opts.StateFile == "" {
+				opts.StateFile = path + ".upload-state"
+			}
+			res, err = client.UploadFile(context.Background(), path, opts)
+			if err != nil {
+				err = fmt.Errorf("%w (rerun to resume)", err)
+			}
+		}
+		if *progress {
+			fmt.Fprintln(os.Stderr)
+		}
+		if err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+		return json.NewEncoder(os.Stdout).Encode(res)
+	}
+
+	fmt.Fprintf(os.Stderr, "usage: %s [backup|restore|rewrap|doctor|loadgen|verify-receipt|upload] [flags]\n", os.Args[0])
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// printProgress returns a progress callback that redraws one stderr line
+// whenever the count moves by a tenth of a megabyte or more.
+func printProgress() func(sent, total int64) {
+	var last int64 = -1
+	return func(sent, total int64) {
+		if last >= 0 && sent-last < 100<<10 && last-sent < 100<<10 && sent != total {
+			return
+		}
+		last = sent
+		if total < 0 {
+			fmt.Fprintf(os.Stderr, "\rupload: %.1f MB", float64(sent)/(1<<20))
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\rupload: %.1f / %.1f MB (%d%%)", float64(sent)/(1<<20), float64(total)/(1<<20), sent*100/max(total, 1))
+	}
+}
+
+// cliBlobKeys sets up encryption at rest as the server would, so commands
+// can read and write encrypted blobs.
+func cliBlobKeys() error {
+	cfg := config.Load()
+	secrets, err := loadSecrets(cfg)
+	if err != nil {
+		return err
+	}
+	blobKeys, err = loadBlobKeys(cfg, secrets.GCPToken)
+	return err
+}
+
+// cliLocker returns the lock backend the server uses, so commands that
+// change records take the same locks as a server running alongside them.
+func cliLocker() Locker {
+	if addr := config.Load().LockRedisAddr; addr != "" {
+		return NewRedisLocker(addr)
+	}
+	return newLocalLocker()
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingZstd = "zstd"
+	EncodingGzip = "gzip"
+)
+
+type CompressionStats struct {
+	Algorithm     string  `json:"algorithm"`
+	OriginalBytes int64   `json:"originalBytes"`
+	StoredBytes   int64   `json:"storedBytes"`
+	Ratio         float64 `json:"ratio"`
+}
+
+func encodingSuffix(encoding string) string {
+	switch encoding {
+	case EncodingZstd:
+		return ".zst"
+	case EncodingGzip:
+		return ".gz"
+	}
+	return ""
+}
+
+func compressWriter(encoding string) func(io.Writer) (io.WriteCloser, error) {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		switch encoding {
+		case EncodingZstd:
+			return zstd.NewWriter(w)
+		case EncodingGzip:
+			return gzip.NewWriterLevel(w, gzip.BestCompression)
+		}
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+func decompressReader(encoding string) func(io.Reader) (io.ReadCloser, error) {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		switch encoding {
+		case EncodingZstd:
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		case EncodingGzip:
+			return gzip.NewReader(r)
+		}
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// compressBlob replaces rec's stored blob with a compressed copy and records
+// the resulting sizes. The original is only removed once the metadata points
+// at the compressed file.
+func compressBlob(rec *FileRecord, encoding string) error {
+	dst := rec.Path + encodingSuffix(encoding)
+	if err := copyFile(dst, rec.Path, compressWriter(encoding), nil); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+
+	stats := &CompressionStats{
+		Algorithm:     encoding,
+		OriginalBytes: rec.Bytes,
+		StoredBytes:   fi.Size(),
+	}
+	if fi.Size() > 0 {
+		stats.Ratio = float64(rec.Bytes) / float64(fi.Size())
+	}
+	rec.Path, rec.Encoding, rec.Compression = dst, encoding, stats
+	return nil
+}
+
+// openBlob opens the stored blob, wherever its storage class keeps it, and
+// unless raw is set transparently decodes it so callers see the original
+// bytes. Encryption at rest is always undone; raw only keeps the stored
+// encoding.
+func openBlob(rec *FileRecord, raw bool) (io.ReadCloser, error) {
+	path, encoding := rec.Path, rec.Encoding
+	if rec.storageClass() == StorageCold {
+		path = rec.ArchivePath
+		if encoding == "" && rec.Encryption == nil {
+			encoding = EncodingGzip
+		}
+	}
+	var f io.ReadCloser
+	var err error
+	if rec.Encryption != nil {
+		f, err = openEncrypted(path, rec.Encryption, rec.customerKey)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if raw || encoding == "" {
+		return f, nil
+	}
+	dr, err := decompressReader(encoding)(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{Reader: dr, close: func() error { dr.Close(); return f.Close() }}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error { return rc.close() }
+
+// acceptsEncoding reports whether the Accept-Encoding header allows enc.
+func acceptsEncoding(header, enc string) bool {
+	return encodingQuality(parseAcceptEncoding(header), enc) > 0
+}
+
+// parseAcceptEncoding returns the weight an Accept-Encoding header gives
+// each content coding, by lower-cased name (RFC 9110 §12.5.3). A coding
+// without a q parameter weighs 1; one whose weight is not a valid qvalue
+// (§12.4.2) is dropped. The first entry for a coding wins.
+func parseAcceptEncoding(header string) map[string]float64 {
+	qs := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q, ok := 1.0, true
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				q, ok = parseQValue(strings.TrimSpace(v))
+			}
+		}
+		if _, seen := qs[name]; ok && !seen {
+			qs[name] = q
+		}
+	}
+	return qs
+}
+
+func parseQValue(s string) (float64, bool) {
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(q >= 0 && q <= 1) {
+		return 0, false
+	}
+	return q, true
+}
+
+// encodingQuality is the weight qs gives enc: its own entry, else that of
+// "*", else 0.
+func encodingQuality(qs map[string]float64, enc string) float64 {
+	if q, ok := qs[strings.ToLower(enc)]; ok {
+		return q
+	}
+	return qs["*"]
+}
+
+// CompressResponses gzip/zstd-encodes responses when the client asks for it
+// and the body reaches minSize. Responses that already carry a
+// Content-Encoding, partial content, and HEAD requests pass through.
+func CompressResponses(minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addVary(w.Header(), "Accept-Encoding")
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: enc, minSize: minSize, status: http.StatusOK}
+		defer cw.finish()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the coding the client weighs highest, preferring
+// zstd on a tie, or "" when it accepts neither.
+func negotiateEncoding(header string) string {
+	qs := parseAcceptEncoding(header)
+	best, bestQ := "", 0.0
+	for _, enc := range []string{EncodingZstd, EncodingGzip} {
+		if q := encodingQuality(qs, enc); q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// compressResponseWriter buffers up to minSize bytes before deciding whether
+// the response is worth compressing.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	buf      []byte
+	decided  bool
+	enc      io.WriteCloser
+}
+
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.decided {
+		return
+	}
+	cw.status = status
+	// Informational and bodiless statuses go straight through.
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.minSize {
+			return len(p), nil
+		}
+		// p is buffered either way; an error is from sending the buffer.
+		return len(p), cw.decide(true)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressResponseWriter) Flush() {
+	if !cw.decided {
+		_ = cw.decide(len(cw.buf) >= cw.minSize)
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressResponseWriter) decide(compress bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" || cw.status != http.StatusOK || alreadyCompressed(h.Get("Content-Type")) {
+		compress = false
+	}
+	if compress {
+		enc, err := compressWriter(cw.encoding)(cw.ResponseWriter)
+		if err != nil {
+			compress = false
+		} else {
+			cw.enc = enc
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", cw.encoding)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressResponseWriter) finish() {
+	if !cw.decided {
+		_ = cw.decide(false)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+	}
+}
+
+func alreadyCompressed(contentType string) bool {
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "application/zip", "application/gzip", "application/zstd":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"example.com/file-upload-go/config"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		header     string
+		gzip       bool
+		negotiated string
+	}{
+		{"", false, ""},
+		{"gzip", true, EncodingGzip},
+		{"gzip, zstd", true, EncodingZstd},
+		{"GZIP;q=0.5", true, EncodingGzip},
+		{"gzip;q=0", false, ""},
+		{"gzip;q=0.00", false, ""},
+		{"gzip;Q=0", false, ""},
+		{"gzip; q = 0", false, ""},
+		{"gzip;q=0.001", true, EncodingGzip},
+		{"gzip;q=2", false, ""},
+		{"gzip;q=NaN", false, ""},
+		{"gzip;q=abc", false, ""},
+		{"gzip;q=abc, gzip", true, EncodingGzip},
+		{"zstd;q=0.5, gzip", true, EncodingGzip},
+		{"zstd;q=0.5, gzip;q=0.5", true, EncodingZstd},
+		{"*", true, EncodingZstd},
+		{"*;q=0.1, gzip;q=0", false, EncodingZstd},
+		{"gzip, gzip;q=0", true, EncodingGzip},
+	}
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.header, EncodingGzip); got != tt.gzip {
+			t.Errorf("acceptsEncoding(%q, gzip) = %v, want %v", tt.header, got, tt.gzip)
+		}
+		if got := negotiateEncoding(tt.header); got != tt.negotiated {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.negotiated)
+		}
+	}
+}
+
+// A response is compressed once: a download whose blob is stored gzipped
+// goes out as stored, and only plain bodies of minSize or more are
+// compressed by the middleware.
+func TestCompressResponses(t *testing.T) {
+	in := testIngest(t)
+	in.Config.Compression = EncodingGzip
+	csv := "name,email\n" + strings.Repeat("bob,bob@example.com\n", 200)
+	resp, uerr := in.Receive(context.Background(), strings.NewReader(csv), "people.csv", UploadMeta{MaxBytes: config.DefaultMaxUploadBytes})
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	db := in.Store.(*jsonStore)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/files/{id}", DownloadHandler(db, db, nil))
+	mux.HandleFunc("GET /plain/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.PathValue("n"))
+		_, _ = io.WriteString(w, csv[:n])
+	})
+	handler := CompressResponses(1024, mux)
+
+	tests := []struct {
+		name, path, encoding, want string
+	}{
+		{"precompressed download", "/v1/files/" + resp.ID, EncodingGzip, csv},
+		{"plain body", "/plain/" + strconv.Itoa(len(csv)), EncodingGzip, csv},
+		{"small body", "/plain/100", "", csv[:100]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if got := w.Header().Values("Content-Encoding"); strings.Join(got, ",") != tt.encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			body := io.Reader(w.Body)
+			if tt.encoding == EncodingGzip {
+				zr, err := gzip.NewReader(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			}
+			got, err := io.ReadAll(body)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("decoded body %q, %v; want %d bytes of CSV", got, err, len(tt.want))
+			}
+		})
+	}
+}
+
+type failingWriter struct{ *httptest.ResponseRecorder }
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+// A write that reaches minSize consumes its bytes even when sending the
+// buffered body fails.
+func TestCompressWriteError(t *testing.T) {
+	cw := &compressResponseWriter{ResponseWriter: failingWriter{httptest.NewRecorder()}, encoding: EncodingGzip, minSize: 4, status: http.StatusOK}
+	cw.Header().Set("Content-Encoding", EncodingGzip)
+	p := []byte("a,b\nc,d\n")
+	if n, err := cw.Write(p); n != len(p) || err == nil {
+		t.Errorf("Write = %d, %v; want %d and the send error", n, err, len(p))
+	}
+}
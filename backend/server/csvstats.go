@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+)
+
+// csvHeaderMax bounds how much of the first record is kept to report the
+// column names.
+const csvHeaderMax = 64 << 10
+
+// csvStats counts CSV records and captures the header row as bytes stream
+// past, so uploads learn their shape without a second read. It follows
+// quoting well enough to not count newlines inside quoted fields, and
+// skips blank lines as encoding/csv does. Its state is exported so
+// resumable uploads can carry it between chunks.
+//
+// With limits set, Write fails with a *csvLimitError as soon as the stream
+// crosses one, so a pathological file is refused before it is stored.
+type csvStats struct {
+	Records     int64  `json:"records"`
+	InQuotes    bool   `json:"inQuotes,omitempty"`
+	LineContent bool   `json:"lineContent,omitempty"`
+	Header      []byte `json:"header,omitempty"`
+	HeaderDone  bool   `json:"headerDone,omitempty"`
+	Fields      int    `json:"fields,omitempty"`    // separators seen in the current record
+	CellBytes   int64  `json:"cellBytes,omitempty"` // length of the current cell so far
+
+	limits csvLimits
+}
+
+// csvLimits bounds the shape of an upload; zero means unlimited. Rows does
+// not count the header.
+type csvLimits struct {
+	Rows      int64
+	Columns   int
+	CellBytes int64
+}
+
+type csvLimitError struct {
+	msg string
+}
+
+func (e *csvLimitError) Error() string { return e.msg }
+
+func (s *csvStats) Write(p []byte) (int, error) {
+	if !s.HeaderDone {
+		s.captureHeader(p)
+	}
+	for i, c := range p {
+		switch {
+		case c == '\n' && !s.InQuotes:
+			if s.LineContent {
+				s.Records++
+				s.LineContent = false
+			}
+			s.Fields, s.CellBytes = 0, 0
+			continue
+		case c == '\r' && !s.InQuotes:
+			continue
+		}
+		if !s.LineContent {
+			s.LineContent = true
+			if s.limits.Rows > 0 && s.Records > s.limits.Rows {
+				return i, &csvLimitError{fmt.Sprintf("File has more than %d rows", s.limits.Rows)}
+			}
+		}
+		switch {
+		case c == '"':
+			s.InQuotes = !s.InQuotes
+		case c == ',' && !s.InQuotes:
+			s.Fields++
+			s.CellBytes = 0
+			if s.limits.Columns > 0 && s.Fields >= s.limits.Columns {
+				return i, &csvLimitError{fmt.Sprintf("Row %d has more than %d columns", s.Records+1, s.limits.Columns)}
+			}
+			continue
+		}
+		s.CellBytes++
+		if s.limits.CellBytes > 0 && s.CellBytes > s.limits.CellBytes {
+			return i, &csvLimitError{fmt.Sprintf("Row %d has a cell longer than %d bytes", s.Records+1, s.limits.CellBytes)}
+		}
+	}
+	return len(p), nil
+}
+
+// captureHeader appends bytes up to the end of the first record. The state
+// machine in Write has not seen p yet, so quoting is tracked locally.
+func (s *csvStats) captureHeader(p []byte) {
+	inQuotes, content := s.InQuotes, s.LineContent
+	for i, c := range p {
+		switch c {
+		case '"':
+			inQuotes = !inQuotes
+			content = true
+		case '\n':
+			if !inQuotes && content {
+				s.appendHeader(p[:i])
+				s.HeaderDone = true
+				return
+			}
+		case '\r':
+		default:
+			content = true
+		}
+	}
+	s.appendHeader(p)
+}
+
+func (s *csvStats) appendHeader(p []byte) {
+	if len(s.Header)+len(p) > csvHeaderMax {
+		s.Header, s.HeaderDone = nil, true
+		return
+	}
+	s.Header = append(s.Header, p...)
+}
+
+// rowCount is the number of data rows, not counting the header.
+func (s *csvStats) rowCount() int64 {
+	n := s.Records
+	if s.LineContent {
+		n++ // a last record without a trailing newline
+	}
+	return max(n-1, 0)
+}
+
+// columns parses the captured header row, or returns nil when it was too
+// long to keep.
+func (s *csvStats) columns() []string {
+	h := bytes.TrimPrefix(s.Header, []byte("\ufeff"))
+	if len(bytes.TrimSpace(h)) == 0 {
+		return nil
+	}
+	cr := csv.NewReader(bytes.NewReader(h))
+	cr.LazyQuotes = true
+	cols, err := cr.Read()
+	if err != nil {
+		return nil
+	}
+	return cols
+}
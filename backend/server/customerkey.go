@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// A client can have a file encrypted with a key of its own, in the manner
+// of S3's SSE-C: the upload sends a base64 256-bit key in X-Encryption-Key,
+// and optionally its base64 SHA-256 in X-Encryption-Key-Sha256 to catch a
+// key garbled on the way. The blob is sealed like any other encrypted at
+// rest, except that its data key is wrapped with the client's key instead
+// of a KEK, and only the key's SHA-256 is kept. Downloads must send the
+// same key.
+//
+// Without the key the server cannot read the file, so such files are left
+// out of backups and integrity scrubs, are checked during the upload
+// rather than asynchronously, and get no masked copy. Nor is anything
+// derived from the plaintext shown to a request without the key: its
+// checksum, columns, row count, PII and formula findings, block hashes and
+// receipt are left out of metadata, lists, exports and events, block hashes
+// and delta signatures need the key, and it is never reported as the file
+// another upload duplicates.
+const (
+	customerKeyHeader       = "X-Encryption-Key"
+	customerKeySHA256Header = "X-Encryption-Key-Sha256"
+
+	// CustomerKEK stands in for the KEK of a data key wrapped with a
+	// customer-provided key.
+	CustomerKEK = "customer"
+)
+
+// errCustomerKeyRequired is returned when reading a blob encrypted with a
+// customer-provided key that the request did not supply.
+var errCustomerKeyRequired = errors.New("blob is encrypted with a customer-provided key")
+
+// customerKey reads the client's key from r, or nil when none was sent.
+func customerKey(r *http.Request) ([]byte, *UploadError) {
+	v := r.Header.Get(customerKeyHeader)
+	if v == "" {
+		if r.Header.Get(customerKeySHA256Header) != "" {
+			return nil, newUploadError(http.StatusBadRequest, "bad_request", "Header '"+customerKeySHA256Header+"' requires '"+customerKeyHeader+"'")
+		}
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(key) != 32 {
+		return nil, newUploadError(http.StatusBadRequest, "bad_request", "Header '"+customerKeyHeader+"' must be a base64-encoded 256-bit key")
+	}
+	if want := r.Header.Get(customerKeySHA256Header); want != "" && want != customerKeyHash(key) {
+		return nil, newUploadError(http.StatusBadRequest, "bad_request", "Header '"+customerKeySHA256Header+"' does not match the key")
+	}
+	return key, nil
+}
+
+// customerKeyHash is the base64 SHA-256 of key, as recorded and as sent in
+// X-Encryption-Key-Sha256.
+func customerKeyHash(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// customer reports whether e's data key is wrapped with a customer key.
+func (e *BlobEncryption) customer() bool {
+	return e != nil && e.KEK == CustomerKEK
+}
+
+// requireCustomerKey checks that r carries the key rec is encrypted with,
+// if any, and makes it available for reading rec's blob. It writes the
+// response and reports false when it does not.
+func requireCustomerKey(w http.ResponseWriter, r *http.Request, rec *FileRecord) bool {
+	key, uerr := customerKey(r)
+	if uerr != nil {
+		writeUploadError(w, uerr)
+		return false
+	}
+	if !rec.Encryption.customer() {
+		if key != nil {
+			writeBadRequest(w, "File '"+rec.ID+"' is not encrypted with a customer-provided key")
+			return false
+		}
+		return true
+	}
+	if key == nil {
+		writeBadRequest(w, "File '"+rec.ID+"' is encrypted with a customer-provided key; send it in '"+customerKeyHeader+"'")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(customerKeyHash(key)), []byte(rec.Encryption.KeySHA256)) != 1 {
+		writeForbidden(w, "The key does not match the one file '"+rec.ID+"' was encrypted with")
+		return false
+	}
+	rec.customerKey = key
+	return true
+}
+
+// withoutPlaintext returns rec as shown to those without its customer key:
+// a copy with everything derived from the plaintext left out. Any other
+// record is returned as is.
+func (r *FileRecord) withoutPlaintext() *FileRecord {
+	if !r.Encryption.customer() {
+		return r
+	}
+	c := *r
+	c.ChecksumSHA, c.RowCount, c.Columns = "", 0, nil
+	c.PII, c.Formulas, c.Chunks, c.Receipt = nil, nil, nil, ""
+	c.customerKey = nil
+	return &c
+}
+
+// encryptBlobWithCustomerKey is encryptBlob with the data key wrapped by
+// a customer key.
+func encryptBlobWithCustomerKey(rec *FileRecord, key []byte) error {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	enc := &BlobEncryption{
+		Algorithm:  BlobCipherAES256GCM,
+		KEK:        CustomerKEK,
+		WrappedKey: aead.Seal(nonce, nonce, dek, nil),
+		KeySHA256:  customerKeyHash(key),
+	}
+	return sealBlob(rec, dek, enc)
+}
+
+// customerDataKey unwraps the data key of enc with a customer key.
+func customerDataKey(enc *BlobEncryption, key []byte) ([]byte, error) {
+	if key == nil {
+		return nil, errCustomerKeyRequired
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(enc.WrappedKey) < aead.NonceSize() {
+		return nil, errors.New("customer-wrapped data key is truncated")
+	}
+	nonce, sealed := enc.WrappedKey[:aead.NonceSize()], enc.WrappedKey[aead.NonceSize():]
+	dek, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key with customer key: %w", err)
+	}
+	return dek, nil
+}
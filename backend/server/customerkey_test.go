@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/file-upload-go/config"
+)
+
+func TestCustomerKeyHidesPlaintext(t *testing.T) {
+	const csv = "name,email\nbob,bob@example.com\n"
+	key := bytes.Repeat([]byte{7}, 32)
+	other := bytes.Repeat([]byte{8}, 32)
+
+	in := testIngest(t)
+	meta := UploadMeta{MaxBytes: config.DefaultMaxUploadBytes, CustomerKey: key}
+	resp, uerr := in.Receive(context.Background(), strings.NewReader(csv), "people.csv", meta)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	if resp.ChecksumSHA == "" || resp.Columns == nil {
+		t.Errorf("upload response to the key holder left out %+v", resp)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/files/{id}/metadata", FileHandler(in.Store, newLocalLocker(), &AuditLog{}, nil))
+	mux.HandleFunc("GET /v1/files/{id}/chunks", ChunksHandler(in.Store))
+
+	tests := []struct {
+		name      string
+		path      string
+		key       []byte
+		status    int
+		plaintext bool // whether the checksum and columns are shown
+	}{
+		{"metadata without key", "/metadata", nil, http.StatusOK, false},
+		{"metadata with key", "/metadata", key, http.StatusOK, true},
+		{"metadata with wrong key", "/metadata", other, http.StatusForbidden, false},
+		{"chunks without key", "/chunks", nil, http.StatusBadRequest, false},
+		{"chunks with wrong key", "/chunks", other, http.StatusForbidden, false},
+		{"chunks with key", "/chunks", key, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/files/"+resp.ID+tt.path, nil)
+			if tt.key != nil {
+				req.Header.Set(customerKeyHeader, base64.StdEncoding.EncodeToString(tt.key))
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if tt.path != "/metadata" || w.Code != http.StatusOK {
+				return
+			}
+			var got FileMetadata
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if shown := got.ChecksumSHA != "" || got.Columns != nil || got.RowCount != 0 || got.ChunkRoot != ""; shown != tt.plaintext {
+				t.Errorf("plaintext shown = %v, want %v: %s", shown, tt.plaintext, w.Body)
+			}
+		})
+	}
+
+	// The same content uploaded in the clear is not told the sealed file
+	// exists.
+	plain, uerr := in.Receive(context.Background(), strings.NewReader(csv), "again.csv", UploadMeta{MaxBytes: config.DefaultMaxUploadBytes, IfNotExists: true})
+	if uerr != nil {
+		t.Fatalf("second upload: %v", uerr)
+	}
+	if plain.DuplicateOf != "" {
+		t.Errorf("duplicateOf = %q, naming a file under a customer key", plain.DuplicateOf)
+	}
+
+	rec, err := in.Store.Get(context.Background(), resp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(rec.withoutPlaintext())
+	if bytes.Contains(b, []byte(resp.ChecksumSHA)) || bytes.Contains(b, []byte(`"email"`)) {
+		t.Errorf("event payload shows plaintext: %s", b)
+	}
+}
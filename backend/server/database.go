@@ -0,0 +1,967 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const metadataDir = "./data/metadata"
+
+// storageTimeout bounds each metadata and blob operation; see bounded.
+var storageTimeout = 10 * time.Second
+
+// storageSlots caps the storage operations in flight, abandoned ones
+// included, so a hung mount cannot pile up goroutines without limit.
+var storageSlots = make(chan struct{}, 64)
+
+// errAbandoned is returned to an operation whose caller gave up on it
+// before it committed.
+var errAbandoned = errors.New("storage operation abandoned")
+
+// errInDoubt is returned for an operation that committed but did not
+// finish within a further storageTimeout: its change may or may not have
+// landed.
+var errInDoubt = errors.New("storage operation in doubt")
+
+// A storageOp is one bounded operation. Its state moves from pending to
+// either committed, once the op starts its visible change, or abandoned,
+// once the caller stops waiting; whichever comes first wins.
+type storageOp struct {
+	state atomic.Int32
+}
+
+const (
+	opPending int32 = iota
+	opCommitted
+	opAbandoned
+)
+
+// commit reports whether the op may still make its change.
+func (o *storageOp) commit() error {
+	if !o.state.CompareAndSwap(opPending, opCommitted) && o.state.Load() == opAbandoned {
+		return errAbandoned
+	}
+	return nil
+}
+
+// bounded runs op under ctx and storageTimeout. A filesystem call stuck on
+// an unresponsive mount cannot be interrupted, so when the deadline passes
+// or ctx is cancelled op is left to finish in the background and the caller
+// gets the context error instead of waiting on it.
+func bounded[T any](ctx context.Context, name string, op func() (T, error)) (T, error) {
+	return runBounded(ctx, name, func(*storageOp) (T, error) { return op() })
+}
+
+// boundedWrite is bounded for changes. op calls commit immediately before
+// the step that makes its change visible (the rename, link or remove) and
+// backs out if it fails: a write the caller reported as timed out must not
+// land afterwards. Once op has committed, the caller waits for it one more
+// storageTimeout, then gets errInDoubt.
+func boundedWrite(ctx context.Context, name string, op func(commit func() error) error) error {
+	_, err := runBounded(ctx, name, func(o *storageOp) (struct{}, error) { return struct{}{}, op(o.commit) })
+	return err
+}
+
+// boundedOpen is bounded for opening a file or blob: one that opens after
+// the caller gave up on it is closed again rather than leaked.
+func boundedOpen[T io.Closer](ctx context.Context, name string, open func() (T, error)) (T, error) {
+	return runBounded(ctx, name, func(o *storageOp) (T, error) {
+		f, err := open()
+		if err == nil && o.commit() != nil {
+			f.Close()
+			var zero T
+			return zero, errAbandoned
+		}
+		return f, err
+	})
+}
+
+// boundedWriter bounds each write to w, for streaming into a blob: a copy
+// from a slow client takes as long as the upload deadline allows, but no
+// single write may hang on storage.
+type boundedWriter struct {
+	ctx  context.Context
+	name string
+	w    io.Writer
+}
+
+func (b boundedWriter) Write(p []byte) (int, error) {
+	return bounded(b.ctx, b.name, func() (int, error) { return b.w.Write(p) })
+}
+
+func runBounded[T any](ctx context.Context, name string, op func(*storageOp) (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	select {
+	case storageSlots <- struct{}{}:
+	case <-ctx.Done():
+		return zero, storageTimedOut(ctx, name)
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	o := new(storageOp)
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-storageSlots }()
+		v, err := op(o)
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		if !o.state.CompareAndSwap(opPending, opAbandoned) {
+			// op has started its change, so its error is the one to
+			// report, but not at any cost: past a further timeout the
+			// change is reported as in doubt.
+			t := time.NewTimer(storageTimeout)
+			defer t.Stop()
+			select {
+			case r := <-done:
+				return r.v, r.err
+			case <-t.C:
+				metrics.Counter("storage_in_doubt_total", "Storage operations that committed but did not finish in time.", "op", name).Inc()
+				return zero, fmt.Errorf("%s: %w", name, errInDoubt)
+			}
+		}
+		return zero, storageTimedOut(ctx, name)
+	}
+}
+
+func storageTimedOut(ctx context.Context, name string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		metrics.Counter("storage_timeouts_total", "Storage operations abandoned after UPLOAD_STORAGE_TIMEOUT_SECONDS.", "op", name).Inc()
+	}
+	return fmt.Errorf("%s: %w", name, ctx.Err())
+}
+
+// jsonStore keeps each FileRecord as <dir>/<id>.json. Writes go through a
+// temp file and rename so a crash never leaves a half-written record.
+type jsonStore struct {
+	mu  sync.RWMutex
+	dir string
+}
+
+func NewJSONStore(dir string) (*jsonStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &jsonStore{dir: dir}
+	if err := s.buildIndex(); err != nil {
+		return nil, fmt.Errorf("build checksum index: %w", err)
+	}
+	return s, nil
+}
+
+func (s *jsonStore) recordPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *jsonStore) Get(ctx context.Context, id string) (*FileRecord, error) {
+	return bounded(ctx, "metadata get", func() (*FileRecord, error) { return s.get(id) })
+}
+
+func (s *jsonStore) get(id string) (*FileRecord, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, err := os.ReadFile(s.recordPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec FileRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *jsonStore) Put(ctx context.Context, rec *FileRecord) error {
+	if err := maintenance.writable(); err != nil {
+		return err
+	}
+	return boundedWrite(ctx, "metadata put", func(commit func() error) error { return s.put(rec, commit) })
+}
+
+func (s *jsonStore) put(rec *FileRecord, commit func() error) error {
+	if !validID(rec.ID) {
+		return errors.New("invalid record id")
+	}
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Index first: a marker without its record is skipped on lookup, but a
+	// record without its marker would go unfound.
+	if err := s.indexAdd(rec); err != nil {
+		return err
+	}
+	tmp := s.recordPath(rec.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.recordPath(rec.ID))
+}
+
+func (s *jsonStore) Create(ctx context.Context, rec *FileRecord) error {
+	if err := maintenance.writable(); err != nil {
+		return err
+	}
+	return boundedWrite(ctx, "metadata create", func(commit func() error) error { return s.create(rec, commit) })
+}
+
+func (s *jsonStore) create(rec *FileRecord, commit func() error) error {
+	if !validID(rec.ID) {
+		return errors.New("invalid record id")
+	}
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.indexAdd(rec); err != nil {
+		return err
+	}
+	tmp := s.recordPath(rec.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := commit(); err != nil {
+		return err
+	}
+	if err := os.Link(tmp, s.recordPath(rec.ID)); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *jsonStore) Delete(ctx context.Context, id string) error {
+	if err := maintenance.writable(); err != nil {
+		return err
+	}
+	return boundedWrite(ctx, "metadata delete", func(commit func() error) error { return s.delete(id, commit) })
+}
+
+func (s *jsonStore) delete(id string, commit func() error) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rec FileRecord
+	if b, err := os.ReadFile(s.recordPath(id)); err == nil {
+		_ = json.Unmarshal(b, &rec)
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+	err := os.Remove(s.recordPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err == nil {
+		s.indexRemove(rec.ChecksumSHA, id)
+	}
+	return err
+}
+
+func (s *jsonStore) List(ctx context.Context) ([]*FileRecord, error) {
+	return bounded(ctx, "metadata list", s.list)
+}
+
+// Walk calls fn with each record in directory order, reading a few
+// directory entries and one record at a time, so the catalog is never held
+// in memory whole. Records deleted during the walk are skipped.
+func (s *jsonStore) Walk(ctx context.Context, fn func(*FileRecord) error) error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	for {
+		entries, err := bounded(ctx, "metadata walk", func() ([]os.DirEntry, error) { return d.ReadDir(256) })
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			rec, err := s.Get(ctx, strings.TrimSuffix(name, ".json"))
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *jsonStore) list() ([]*FileRecord, error) {
+	s.mu.RLock()
+	entries, err := os.ReadDir(s.dir)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	recs := make([]*FileRecord, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		rec, err := s.get(strings.TrimSuffix(name, ".json"))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].UploadedAt.Before(recs[j].UploadedAt) })
+	return recs, nil
+}
+
+// validID guards the store against path traversal via crafted IDs.
+func validID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *jsonStore) outboxDir() string {
+	return filepath.Join(s.dir, "outbox")
+}
+
+// Enqueue persists ev under a time-ordered name so Pending returns events in
+// the order they were emitted.
+func (s *jsonStore) Enqueue(ctx context.Context, ev Event) error {
+	return boundedWrite(ctx, "outbox enqueue", func(commit func() error) error { return s.enqueue(ev, commit) })
+}
+
+func (s *jsonStore) enqueue(ev Event, commit func() error) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.outboxDir(), 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s.json", ev.Time.UnixNano(), ev.ID)
+	tmp := filepath.Join(s.outboxDir(), name+".tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.outboxDir(), name))
+}
+
+func (s *jsonStore) Pending(ctx context.Context, limit int) ([]Event, error) {
+	return bounded(ctx, "outbox pending", func() ([]Event, error) { return s.pending(limit) })
+}
+
+func (s *jsonStore) pending(limit int) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(s.outboxDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var evs []Event
+	for _, e := range entries {
+		if len(evs) == limit {
+			break
+		}
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.outboxDir(), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var ev Event
+		if err := json.Unmarshal(b, &ev); err != nil {
+			return nil, err
+		}
+		evs = append(evs, ev)
+	}
+	return evs, nil
+}
+
+func (s *jsonStore) Ack(ctx context.Context, id string) error {
+	return boundedWrite(ctx, "outbox ack", func(commit func() error) error { return s.ack(id, commit) })
+}
+
+func (s *jsonStore) ack(id string, commit func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matches, err := filepath.Glob(filepath.Join(s.outboxDir(), "*-"+id+".json"))
+	if err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := os.Remove(m); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDoc and writeDoc back the auxiliary collections (sessions, datasets)
+// kept as one JSON document per ID under a subdirectory of the store.
+func (s *jsonStore) readDoc(ctx context.Context, kind, id string, v any, notFound error) error {
+	if !validID(id) {
+		return notFound
+	}
+	// Decode into a copy so an abandoned read cannot write into v later.
+	b, err := bounded(ctx, kind+" read", func() ([]byte, error) { return s.readDocBytes(kind, id) })
+	if errors.Is(err, os.ErrNotExist) {
+		return notFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (s *jsonStore) readDocBytes(kind, id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return os.ReadFile(filepath.Join(s.dir, kind, id+".json"))
+}
+
+func (s *jsonStore) writeDoc(ctx context.Context, kind, id string, v any) error {
+	if !validID(id) {
+		return errors.New("invalid " + kind + " id")
+	}
+	if readOnlyKinds[kind] {
+		if err := maintenance.writable(); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return boundedWrite(ctx, kind+" write", func(commit func() error) error { return s.writeDocBytes(kind, id, b, commit) })
+}
+
+func (s *jsonStore) writeDocBytes(kind, id string, b []byte, commit func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, kind)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, id+".json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, id+".json"))
+}
+
+func (s *jsonStore) deleteDoc(ctx context.Context, kind, id string, notFound error) error {
+	if !validID(id) {
+		return notFound
+	}
+	if readOnlyKinds[kind] {
+		if err := maintenance.writable(); err != nil {
+			return err
+		}
+	}
+	err := boundedWrite(ctx, kind+" delete", func(commit func() error) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := commit(); err != nil {
+			return err
+		}
+		return os.Remove(filepath.Join(s.dir, kind, id+".json"))
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return notFound
+	}
+	return err
+}
+
+func (s *jsonStore) docIDs(ctx context.Context, kind string) ([]string, error) {
+	entries, err := bounded(ctx, kind+" list", func() ([]os.DirEntry, error) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return os.ReadDir(filepath.Join(s.dir, kind))
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *jsonStore) GetSession(ctx context.Context, id string) (*UploadSession, error) {
+	var sess UploadSession
+	if err := s.readDoc(ctx, "sessions", id, &sess, ErrSessionNotFound); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *jsonStore) PutSession(ctx context.Context, sess *UploadSession) error {
+	return s.writeDoc(ctx, "sessions", sess.ID, sess)
+}
+
+func (s *jsonStore) DeleteSession(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, "sessions", id, ErrSessionNotFound)
+}
+
+func (s *jsonStore) ListSessions(ctx context.Context) ([]*UploadSession, error) {
+	ids, err := s.docIDs(ctx, "sessions")
+	if err != nil {
+		return nil, err
+	}
+	var out []*UploadSession
+	for _, id := range ids {
+		sess, err := s.GetSession(ctx, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sess)
+	}
+	return out, nil
+}
+
+func (s *jsonStore) GetDirectUpload(ctx context.Context, id string) (*DirectUpload, error) {
+	var du DirectUpload
+	if err := s.readDoc(ctx, "direct", id, &du, ErrDirectUploadNotFound); err != nil {
+		return nil, err
+	}
+	return &du, nil
+}
+
+func (s *jsonStore) PutDirectUpload(ctx context.Context, du *DirectUpload) error {
+	return s.writeDoc(ctx, "direct", du.ID, du)
+}
+
+func (s *jsonStore) DeleteDirectUpload(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, "direct", id, ErrDirectUploadNotFound)
+}
+
+func (s *jsonStore) ListDirectUploads(ctx context.Context) ([]*DirectUpload, error) {
+	ids, err := s.docIDs(ctx, "direct")
+	if err != nil {
+		return nil, err
+	}
+	var out []*DirectUpload
+	for _, id := range ids {
+		du, err := s.GetDirectUpload(ctx, id)
+		if errors.Is(err, ErrDirectUploadNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, du)
+	}
+	return out, nil
+}
+
+// errNoAccess marks a file with no access doc, never downloaded.
+var errNoAccess = errors.New("no access recorded")
+
+type accessDoc struct {
+	At time.Time `json:"at"`
+}
+
+func (s *jsonStore) TouchAccess(ctx context.Context, id string, at time.Time) error {
+	return s.writeDoc(ctx, "access", id, accessDoc{At: at})
+}
+
+func (s *jsonStore) LastAccess(ctx context.Context, id string) (time.Time, error) {
+	var d accessDoc
+	err := s.readDoc(ctx, "access", id, &d, errNoAccess)
+	if errors.Is(err, errNoAccess) {
+		return time.Time{}, nil
+	}
+	return d.At, err
+}
+
+func (s *jsonStore) DeleteAccess(ctx context.Context, id string) error {
+	err := s.deleteDoc(ctx, "access", id, errNoAccess)
+	if errors.Is(err, errNoAccess) {
+		return nil
+	}
+	return err
+}
+
+func (s *jsonStore) GetDataset(ctx context.Context, id string) (*Dataset, error) {
+	var ds Dataset
+	if err := s.readDoc(ctx, "datasets", id, &ds, ErrDatasetNotFound); err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
+
+func (s *jsonStore) PutDataset(ctx context.Context, ds *Dataset) error {
+	return s.writeDoc(ctx, "datasets", ds.ID, ds)
+}
+
+func (s *jsonStore) ListDatasets(ctx context.Context) ([]*Dataset, error) {
+	ids, err := s.docIDs(ctx, "datasets")
+	if err != nil {
+		return nil, err
+	}
+	var out []*Dataset
+	for _, id := range ids {
+		ds, err := s.GetDataset(ctx, id)
+		if errors.Is(err, ErrDatasetNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ds)
+	}
+	return out, nil
+}
+
+func (s *jsonStore) GetArchivePlan(ctx context.Context, id string) (*ArchivePlan, error) {
+	var p ArchivePlan
+	if err := s.readDoc(ctx, "archives", id, &p, ErrArchivePlanNotFound); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *jsonStore) PutArchivePlan(ctx context.Context, p *ArchivePlan) error {
+	return s.writeDoc(ctx, "archives", p.ID, p)
+}
+
+func (s *jsonStore) ListPolicies(ctx context.Context) ([]*UploadPolicy, error) {
+	ids, err := s.docIDs(ctx, "policies")
+	if err != nil {
+		return nil, err
+	}
+	var out []*UploadPolicy
+	for _, id := range ids {
+		var p UploadPolicy
+		err := s.readDoc(ctx, "policies", id, &p, ErrPolicyNotFound)
+		if errors.Is(err, ErrPolicyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &p)
+	}
+	return out, nil
+}
+
+func (s *jsonStore) PutPolicy(ctx context.Context, p *UploadPolicy) error {
+	return s.writeDoc(ctx, "policies", p.ID, p)
+}
+
+func (s *jsonStore) DeletePolicy(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, "policies", id, ErrPolicyNotFound)
+}
+
+func (s *jsonStore) ListBuckets(ctx context.Context) ([]*Bucket, error) {
+	names, err := s.docIDs(ctx, "buckets")
+	if err != nil {
+		return nil, err
+	}
+	var out []*Bucket
+	for _, name := range names {
+		b, err := s.GetBucket(ctx, name)
+		if errors.Is(err, ErrBucketNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func (s *jsonStore) GetBucket(ctx context.Context, name string) (*Bucket, error) {
+	var b Bucket
+	if err := s.readDoc(ctx, "buckets", name, &b, ErrBucketNotFound); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *jsonStore) PutBucket(ctx context.Context, b *Bucket) error {
+	return s.writeDoc(ctx, "buckets", b.Name, b)
+}
+
+func (s *jsonStore) DeleteBucket(ctx context.Context, name string) error {
+	return s.deleteDoc(ctx, "buckets", name, ErrBucketNotFound)
+}
+
+func (s *jsonStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	ids, err := s.docIDs(ctx, "apikeys")
+	if err != nil {
+		return nil, err
+	}
+	var out []*APIKey
+	for _, id := range ids {
+		k, err := s.GetAPIKey(ctx, id)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, nil
+}
+
+func (s *jsonStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	var k APIKey
+	if err := s.readDoc(ctx, "apikeys", id, &k, ErrAPIKeyNotFound); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s *jsonStore) PutAPIKey(ctx context.Context, k *APIKey) error {
+	return s.writeDoc(ctx, "apikeys", k.ID, k)
+}
+
+func (s *jsonStore) DeleteAPIKey(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, "apikeys", id, ErrAPIKeyNotFound)
+}
+
+// uploadStatsID names a stats document by hour and instance, so each
+// instance writes its own.
+func uploadStatsID(hour time.Time, instance string) string {
+	return hour.UTC().Format("2006010215") + "-" + instance
+}
+
+func uploadStatsHour(id string) (time.Time, bool) {
+	h, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006010215", h)
+	return t, err == nil
+}
+
+func (s *jsonStore) ListUploadStats(ctx context.Context, from, to time.Time) ([]*UploadStats, error) {
+	ids, err := s.docIDs(ctx, "stats")
+	if err != nil {
+		return nil, err
+	}
+	var out []*UploadStats
+	for _, id := range ids {
+		hour, ok := uploadStatsHour(id)
+		if !ok || hour.Before(from) || !hour.Before(to) {
+			continue
+		}
+		var st UploadStats
+		err := s.readDoc(ctx, "stats", id, &st, os.ErrNotExist)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &st)
+	}
+	return out, nil
+}
+
+func (s *jsonStore) PutUploadStats(ctx context.Context, st *UploadStats) error {
+	return s.writeDoc(ctx, "stats", uploadStatsID(st.Hour, st.Instance), st)
+}
+
+func (s *jsonStore) DeleteUploadStatsBefore(ctx context.Context, t time.Time) error {
+	ids, err := s.docIDs(ctx, "stats")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if hour, ok := uploadStatsHour(id); ok && hour.Before(t) {
+			if err := s.deleteDoc(ctx, "stats", id, os.ErrNotExist); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonStore) ListFlags(ctx context.Context) ([]*FeatureFlag, error) {
+	names, err := s.docIDs(ctx, "flags")
+	if err != nil {
+		return nil, err
+	}
+	var out []*FeatureFlag
+	for _, name := range names {
+		var f FeatureFlag
+		err := s.readDoc(ctx, "flags", name, &f, ErrFlagNotFound)
+		if errors.Is(err, ErrFlagNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &f)
+	}
+	return out, nil
+}
+
+func (s *jsonStore) PutFlag(ctx context.Context, f *FeatureFlag) error {
+	return s.writeDoc(ctx, "flags", f.Name, f)
+}
+
+func (s *jsonStore) DeleteFlag(ctx context.Context, name string) error {
+	return s.deleteDoc(ctx, "flags", name, ErrFlagNotFound)
+}
+
+func (s *jsonStore) GetMaintenance(ctx context.Context) (*MaintenanceState, error) {
+	var m MaintenanceState
+	if err := s.readDoc(ctx, "settings", "maintenance", &m, ErrMaintenanceNotFound); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *jsonStore) PutMaintenance(ctx context.Context, m *MaintenanceState) error {
+	return s.writeDoc(ctx, "settings", "maintenance", m)
+}
+
+func (s *jsonStore) GetShare(ctx context.Context, id string) (*Share, error) {
+	var sh Share
+	if err := s.readDoc(ctx, "shares", id, &sh, ErrShareNotFound); err != nil {
+		return nil, err
+	}
+	return &sh, nil
+}
+
+func (s *jsonStore) PutShare(ctx context.Context, sh *Share) error {
+	return s.writeDoc(ctx, "shares", sh.ID, sh)
+}
+
+func (s *jsonStore) DeleteShare(ctx context.Context, id string) error {
+	return s.deleteDoc(ctx, "shares", id, ErrShareNotFound)
+}
+
+func (s *jsonStore) ListShares(ctx context.Context) ([]*Share, error) {
+	ids, err := s.docIDs(ctx, "shares")
+	if err != nil {
+		return nil, err
+	}
+	var out []*Share
+	for _, id := range ids {
+		sh, err := s.GetShare(ctx, id)
+		if errors.Is(err, ErrShareNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sh)
+	}
+	return out, nil
+}
+
+func (s *jsonStore) GetKey(ctx context.Context, key string) (*ObjectKey, error) {
+	var k ObjectKey
+	if err := s.readDoc(ctx, "keys", keyDocID(key), &k, ErrKeyNotFound); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s *jsonStore) PutKey(ctx context.Context, k *ObjectKey) error {
+	return s.writeDoc(ctx, "keys", keyDocID(k.Key), k)
+}
+
+func (s *jsonStore) DeleteKey(ctx context.Context, key string) error {
+	return s.deleteDoc(ctx, "keys", keyDocID(key), ErrKeyNotFound)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBoundedWriteAbandoned checks that a write the caller gave up on never
+// lands once the stuck filesystem frees up.
+func TestBoundedWriteAbandoned(t *testing.T) {
+	s, err := NewJSONStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := storageTimeout
+	storageTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { storageTimeout = saved })
+
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		write func() error
+		check func() error
+	}{
+		{"put", func() error { return s.Put(ctx, &FileRecord{ID: "aaaa"}) }, func() error {
+			_, err := s.Get(ctx, "aaaa")
+			return err
+		}},
+		{"create", func() error { return s.Create(ctx, &FileRecord{ID: "bbbb"}) }, func() error {
+			_, err := s.Get(ctx, "bbbb")
+			return err
+		}},
+		{"doc", func() error { return s.PutDataset(ctx, &Dataset{ID: "cccc"}) }, func() error {
+			_, err := s.GetDataset(ctx, "cccc")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Holding the store lock stands in for a hung mount.
+			s.mu.Lock()
+			err := tt.write()
+			s.mu.Unlock()
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("write err = %v, want deadline exceeded", err)
+			}
+			waitStorageIdle(t)
+			if err := tt.check(); err == nil {
+				t.Error("abandoned write landed")
+			}
+		})
+	}
+}
+
+func TestBoundedSlots(t *testing.T) {
+	saved := storageTimeout
+	storageTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { storageTimeout = saved })
+
+	release := make(chan struct{})
+	for range cap(storageSlots) {
+		bounded(context.Background(), "stuck", func() (struct{}, error) {
+			<-release
+			return struct{}{}, nil
+		})
+	}
+	ran := false
+	_, err := bounded(context.Background(), "next", func() (struct{}, error) {
+		ran = true
+		return struct{}{}, nil
+	})
+	close(release)
+	if !errors.Is(err, context.DeadlineExceeded) || ran {
+		t.Errorf("err = %v, ran = %v; want the op refused while every slot is held", err, ran)
+	}
+	waitStorageIdle(t)
+}
+
+// A write that committed but then hangs is reported as in doubt rather
+// than waited on for good.
+func TestBoundedInDoubt(t *testing.T) {
+	saved := storageTimeout
+	storageTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { storageTimeout = saved })
+
+	release := make(chan struct{})
+	err := boundedWrite(context.Background(), "stuck", func(commit func() error) error {
+		if err := commit(); err != nil {
+			return err
+		}
+		<-release
+		return nil
+	})
+	close(release)
+	if !errors.Is(err, errInDoubt) {
+		t.Errorf("err = %v, want in doubt", err)
+	}
+	waitStorageIdle(t)
+}
+
+// waitStorageIdle waits for abandoned operations to finish.
+func waitStorageIdle(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(storageSlots) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("storage operations still running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
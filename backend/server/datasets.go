@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrDatasetNotFound = errors.New("dataset not found")
+
+type DatasetStore interface {
+	GetDataset(ctx context.Context, id string) (*Dataset, error)
+	PutDataset(ctx context.Context, ds *Dataset) error
+	GetArchivePlan(ctx context.Context, id string) (*ArchivePlan, error)
+	PutArchivePlan(ctx context.Context, p *ArchivePlan) error
+}
+
+type DatasetEntry struct {
+	FileID   string `json:"fileId"`
+	Filename string `json:"filename"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256"`
+}
+
+type DatasetVersion struct {
+	Version   int            `json:"version"`
+	Files     []DatasetEntry `json:"files"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// Dataset groups files into an ordered manifest. Every change appends a new
+// version; earlier versions stay addressable.
+type Dataset struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Versions  []DatasetVersion `json:"versions"`
+}
+
+type DatasetManifest struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Version   int            `json:"version"`
+	Latest    int            `json:"latestVersion"`
+	Files     []DatasetEntry `json:"files"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+func (d *Dataset) manifest(v DatasetVersion) DatasetManifest {
+	return DatasetManifest{
+		ID:        d.ID,
+		Name:      d.Name,
+		Version:   v.Version,
+		Latest:    len(d.Versions),
+		Files:     v.Files,
+		CreatedAt: v.CreatedAt,
+	}
+}
+
+type Datasets struct {
+	store DatasetStore
+	files MetadataStore
+}
+
+func NewDatasets(store DatasetStore, files MetadataStore) *Datasets {
+	return &Datasets{store: store, files: files}
+}
+
+type createDatasetRequest struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+}
+
+type updateDatasetRequest struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// CreateHandler registers a dataset: POST /v1/datasets.
+func (d *Datasets) CreateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for creating datasets")
+			return
+		}
+		var req createDatasetRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeBadRequest(w, "Invalid JSON body")
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			writeBadRequest(w, "Field 'name' is required")
+			return
+		}
+		entries, ok := d.entries(w, r, nil, req.Files)
+		if !ok {
+			return
+		}
+		id, err := randomHex(16)
+		if err != nil {
+			writeInternalError(w, "Failed to generate dataset ID")
+			return
+		}
+		now := time.Now().UTC()
+		ds := &Dataset{
+			ID:        id,
+			Name:      req.Name,
+			CreatedAt: now,
+			Versions:  []DatasetVersion{{Version: 1, Files: entries, CreatedAt: now}},
+		}
+		if err := d.store.PutDataset(r.Context(), ds); err != nil {
+			writeInternalError(w, "Failed to save dataset")
+			return
+		}
+		w.Header().Set("Location", "/v1/datasets/"+id)
+		writeJSON(w, http.StatusCreated, ds.manifest(ds.Versions[0]))
+	}
+}
+
+// DatasetHandler serves GET (manifest, optionally ?version=N) and PATCH
+// (add/remove files, producing a new version) on /v1/datasets/{id}.
+func (d *Datasets) DatasetHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ds, ok := d.load(w, r, r.PathValue("id"))
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			v, ok := pickVersion(w, r, ds)
+			if !ok {
+				return
+			}
+			writeJSON(w, http.StatusOK, ds.manifest(v))
+
+		case http.MethodPatch:
+			var req updateDatasetRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			latest := ds.Versions[len(ds.Versions)-1]
+			kept := slices.DeleteFunc(slices.Clone(latest.Files), func(e DatasetEntry) bool {
+				return slices.Contains(req.Remove, e.FileID)
+			})
+			files, ok := d.entries(w, r, kept, req.Add)
+			if !ok {
+				return
+			}
+			if slices.Equal(files, latest.Files) {
+				writeJSON(w, http.StatusOK, ds.manifest(latest))
+				return
+			}
+			next := DatasetVersion{Version: latest.Version + 1, Files: files, CreatedAt: time.Now().UTC()}
+			ds.Versions = append(ds.Versions, next)
+			if err := d.store.PutDataset(r.Context(), ds); err != nil {
+				writeInternalError(w, "Failed to save dataset")
+				return
+			}
+			writeJSON(w, http.StatusOK, ds.manifest(next))
+
+		default:
+			writeMethodNotAllowed(w, "Only GET and PATCH methods are allowed for datasets")
+		}
+	}
+}
+
+// ArchiveHandler serves a dataset version as a zip holding manifest.json
+// followed by the files in manifest order: GET /v1/datasets/{id}/archive.
+// The archive's layout is fixed by its ArchivePlan the first time it is
+// requested, so a dropped download resumes with Range and If-Range.
+func (d *Datasets) ArchiveHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w, "Only GET method is allowed for dataset archives")
+			return
+		}
+		ds, ok := d.load(w, r, r.PathValue("id"))
+		if !ok {
+			return
+		}
+		v, ok := pickVersion(w, r, ds)
+		if !ok {
+			return
+		}
+
+		// Resolve every member before the first byte goes out, so
+		// unavailable files surface as an error status rather than a
+		// truncated zip.
+		recs := make(map[string]*FileRecord, len(v.Files))
+		ordered := make([]*FileRecord, 0, len(v.Files))
+		masked := false
+		for _, e := range v.Files {
+			rec, ok := loadRecord(w, r, d.files, e.FileID)
+			if !ok {
+				return
+			}
+			if rec.state() != StateAvailable || rec.storageClass() == StorageCold {
+				writeConflict(w, "File '"+rec.ID+"' in the dataset is not currently downloadable")
+				return
+			}
+			// Callers without PII access get the masked copies, laid
+			// out in a plan of their own.
+			if src := contentRecord(r.Context(), rec); src != rec {
+				rec, masked = src, true
+			}
+			recs[rec.ID] = rec
+			ordered = append(ordered, rec)
+		}
+
+		planID := archivePlanID(ds, v)
+		if masked {
+			planID += "-masked"
+		}
+		plan, err := d.store.GetArchivePlan(r.Context(), planID)
+		if errors.Is(err, ErrArchivePlanNotFound) {
+			manifest, _ := json.MarshalIndent(ds.manifest(v), "", "  ")
+			if plan, err = newArchivePlan(ds, v, ordered, manifest); err == nil {
+				plan.ID = planID
+				err = d.store.PutArchivePlan(r.Context(), plan)
+			}
+		}
+		if err != nil {
+			log.Printf("datasets: archive plan %s v%d: %v", ds.ID, v.Version, err)
+			writeInternalError(w, "Failed to prepare dataset archive")
+			return
+		}
+
+		ar := &archiveReader{plan: plan, open: func(m *ArchiveMember) (io.ReadCloser, error) {
+			rec := recs[m.FileID]
+			if rec == nil {
+				return nil, fmt.Errorf("file %s is not in the dataset", m.FileID)
+			}
+			return openBlob(rec, false)
+		}}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", plan.Filename))
+		w.Header().Set("ETag", plan.ETag)
+		class := CacheImmutable
+		if !r.URL.Query().Has("version") {
+			class = CacheLatest
+		}
+		cachePolicy.apply(w, r, class)
+		uploadDeadline.applyWrite(w, plan.Size)
+		http.ServeContent(w, r, "", plan.CreatedAt, ar)
+		ar.Close()
+		if ar.err != nil {
+			log.Printf("datasets: archive %s v%d: %v", ds.ID, v.Version, ar.err)
+		}
+		if ar.learned {
+			if err := d.store.PutArchivePlan(context.WithoutCancel(r.Context()), plan); err != nil {
+				log.Printf("datasets: save archive plan %s: %v", plan.ID, err)
+			}
+		}
+	}
+}
+
+// entries appends the given file IDs to base, resolving each against the
+// metadata store. It writes the error response itself on failure.
+func (d *Datasets) entries(w http.ResponseWriter, r *http.Request, base []DatasetEntry, ids []string) ([]DatasetEntry, bool) {
+	out := base
+	for _, id := range ids {
+		if slices.ContainsFunc(out, func(e DatasetEntry) bool { return e.FileID == id }) {
+			continue
+		}
+		rec, ok := loadRecord(w, r, d.files, id)
+		if !ok {
+			return nil, false
+		}
+		out = append(out, DatasetEntry{FileID: rec.ID, Filename: rec.Filename, Bytes: rec.Bytes, SHA256: rec.withoutPlaintext().ChecksumSHA})
+	}
+	if out == nil {
+		out = []DatasetEntry{}
+	}
+	return out, true
+}
+
+func (d *Datasets) load(w http.ResponseWriter, r *http.Request, id string) (*Dataset, bool) {
+	ds, err := d.store.GetDataset(r.Context(), id)
+	if errors.Is(err, ErrDatasetNotFound) {
+		writeNotFound(w, "Dataset '"+id+"' not found")
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, "Failed to load dataset")
+		return nil, false
+	}
+	return ds, true
+}
+
+func pickVersion(w http.ResponseWriter, r *http.Request, ds *Dataset) (DatasetVersion, bool) {
+	raw := r.URL.Query().Get("version")
+	if raw == "" {
+		return ds.Versions[len(ds.Versions)-1], true
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 || n > len(ds.Versions) {
+		writeNotFound(w, "Dataset '"+ds.ID+"' has no version '"+raw+"'")
+		return DatasetVersion{}, false
+	}
+	return ds.Versions[n-1], true
+}
+
+func uniqueName(used map[string]bool, name string, i int) string {
+	if used[name] {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(i+1) + ext
+	}
+	used[name] = true
+	return name
+}
+
+func sanitizeArchiveName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" {
+		return "dataset"
+	}
+	return name
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// requestTimeout is how long a request may take to be read and answered
+// when its route does not size the deadline itself; see Deadlines.
+var requestTimeout = 60 * time.Second
+
+// Deadlines gives each request requestTimeout on the connection's read and
+// write deadlines. The server itself only bounds reading the headers, so
+// routes that move a known number of bytes can replace these with
+// UploadDeadline.apply or applyWrite.
+func Deadlines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		at := time.Now().Add(requestTimeout)
+		rc := http.NewResponseController(w)
+		_ = rc.SetReadDeadline(at)
+		_ = rc.SetWriteDeadline(at)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UploadDeadline sizes the time an upload request may take from the bytes
+// it will send: Slack plus the time to send them at MinBytesPerSecond,
+// capped at Max. A 200MB upload at 1MB/s with 30s of slack gets 230s, while
+// a 10KB one gets just over 30s. Downloads are held to the same floor.
+// MinBytesPerSecond of zero leaves requests on requestTimeout.
+type UploadDeadline struct {
+	MinBytesPerSecond int64
+	Slack             time.Duration
+	Max               time.Duration
+}
+
+// uploadDeadline is set from configuration at startup.
+var uploadDeadline UploadDeadline
+
+// For returns the deadline for an upload of size bytes.
+func (d UploadDeadline) For(size int64) time.Duration {
+	t := d.Slack + time.Duration(float64(size)/float64(d.MinBytesPerSecond)*float64(time.Second))
+	if d.Max > 0 && t > d.Max {
+		return d.Max
+	}
+	return t
+}
+
+// apply replaces the connection's read and write deadlines for the rest of
+// r with one sized for size bytes, so the response can still be written
+// once the body is in. Transports that cannot move deadlines keep
+// requestTimeout.
+func (d UploadDeadline) apply(w http.ResponseWriter, size int64) {
+	if d.MinBytesPerSecond <= 0 {
+		return
+	}
+	at := time.Now().Add(d.For(size))
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(at)
+	_ = rc.SetWriteDeadline(at)
+}
+
+// applyWrite is apply for a response of size bytes: only the write
+// deadline moves.
+func (d UploadDeadline) applyWrite(w http.ResponseWriter, size int64) {
+	if d.MinBytesPerSecond <= 0 {
+		return
+	}
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d.For(size)))
+}
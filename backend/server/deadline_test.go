@@ -0,0 +1,81 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadDeadlineFor(t *testing.T) {
+	d := UploadDeadline{MinBytesPerSecond: 1 << 20, Slack: 30 * time.Second, Max: time.Hour}
+	tests := []struct {
+		size int64
+		want time.Duration
+	}{
+		{0, 30 * time.Second},
+		{200 << 20, 230 * time.Second},
+		{10 << 30, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := d.For(tt.size); got != tt.want {
+			t.Errorf("For(%d) = %v, want %v", tt.size, got, tt.want)
+		}
+	}
+}
+
+// TestDeadlines sends a body that stalls past requestTimeout: routes left
+// on the default deadline lose the connection, while a route that sized its
+// own deadline reads the whole body.
+func TestDeadlines(t *testing.T) {
+	saved := requestTimeout
+	requestTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { requestTimeout = saved })
+
+	sized := UploadDeadline{MinBytesPerSecond: 1, Slack: 5 * time.Second}
+	read := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/default", func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		read <- err
+	})
+	mux.HandleFunc("/sized", func(w http.ResponseWriter, r *http.Request) {
+		sized.apply(w, 4)
+		_, err := io.ReadAll(r.Body)
+		read <- err
+	})
+	srv := httptest.NewUnstartedServer(Deadlines(mux))
+	srv.Config.ReadHeaderTimeout = time.Second
+	srv.Start()
+	defer srv.Close()
+
+	tests := []struct {
+		path    string
+		timeout bool
+	}{
+		{"/default", true},
+		{"/sized", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			go func() {
+				pw.Write([]byte("ab"))
+				time.Sleep(3 * requestTimeout)
+				pw.Write([]byte("cd"))
+				pw.Close()
+			}()
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+tt.path, pr)
+			req.ContentLength = 4
+			if resp, err := srv.Client().Do(req); err == nil {
+				resp.Body.Close()
+			}
+			err := <-read
+			if got := err != nil && strings.Contains(err.Error(), "timeout"); got != tt.timeout {
+				t.Errorf("read err = %v, want timeout = %v", err, tt.timeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+}
+
+// DebugMux serves net/http/pprof under /debug/pprof/ and expvar at
+// /debug/vars. With a token, requests must carry it as a bearer token.
+func DebugMux(token *Secret) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	if token.Value() == "" {
+		return mux
+	}
+	return requireAdmin(token, mux.ServeHTTP)
+}
+
+// serveDebug runs the debug listener. It only binds loopback addresses so
+// profiles are never reachable from outside the host.
+func serveDebug(addr string, token *Secret) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug listener must bind a loopback address, got %q", addr)
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           DebugMux(token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("debug endpoints listening on %s", addr)
+	return srv.ListenAndServe()
+}
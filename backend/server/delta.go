@@ -0,0 +1,361 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Delta uploads let a client send a new version of a stored file as
+// references to blocks of the old one plus the bytes that changed, in the
+// manner of rsync. The client fetches the base file's signature, finds
+// matching blocks in its new file with the rolling weak sum, confirms them
+// with the strong sum, and posts the result:
+//
+//	GET  /v1/files/{id}/signature[?blockSize=N]
+//	POST /v1/files/{id}/delta?blockSize=N&sha256=HEX[&filename=][&key=&onConflict=]
+//
+// The delta body is a sequence of operations:
+//
+//	0x01 uvarint(block) uvarint(count)  copy count blocks of the base from block
+//	0x02 uvarint(n) n bytes             literal data
+//
+// The rebuilt file goes through the same checks as any upload, and must hash
+// to the sha256 parameter, which catches a client that matched a block
+// wrongly.
+const (
+	deltaOpCopy    = 0x01
+	deltaOpLiteral = 0x02
+
+	deltaMinBlock = 512
+	deltaMaxBlock = 1 << 20
+)
+
+// BlockSignature describes a stored file block by block for delta uploads.
+// Weak is the rsync rolling checksum of the block: with a the sum of its
+// bytes and b the sum of (len-i)*byte[i], both mod 2^16, it is a | b<<16.
+// Strong is the first 16 bytes of the block's SHA-256, in hex. The last
+// block may be shorter than BlockSize.
+type BlockSignature struct {
+	ID        string     `json:"id"`
+	Size      int64      `json:"size"`
+	SHA256    string     `json:"sha256"`
+	BlockSize int64      `json:"blockSize"`
+	Blocks    []BlockSum `json:"blocks"`
+}
+
+type BlockSum struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// defaultDeltaBlock picks a block size near the square root of the file
+// size, as rsync does, which balances signature size against how much a
+// single changed byte costs to resend.
+func defaultDeltaBlock(size int64) int64 {
+	b := int64(math.Sqrt(float64(size))+7) &^ 7
+	return min(max(b, deltaMinBlock), deltaMaxBlock)
+}
+
+// weakSum is the rsync rolling checksum of block.
+func weakSum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | (b&0xffff)<<16
+}
+
+func parseDeltaBlock(r *http.Request, size int64) (int64, bool) {
+	v := r.URL.Query().Get("blockSize")
+	if v == "" {
+		return defaultDeltaBlock(size), true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < deltaMinBlock || n > deltaMaxBlock {
+		return 0, false
+	}
+	return n, true
+}
+
+// openDeltaBase opens the decoded bytes of rec for random access. Blobs
+// stored compressed or encrypted are decoded to a temporary file, which the
+// returned cleanup removes.
+func openDeltaBase(rec *FileRecord) (*os.File, func(), error) {
+	if rec.Encoding == "" && rec.Encryption == nil {
+		f, err := os.Open(rec.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { f.Close() }, nil
+	}
+	body, err := openBlob(rec, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	tmp, err := os.CreateTemp("", "delta-base-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := io.Copy(tmp, body); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return tmp, cleanup, nil
+}
+
+// loadDeltaBase loads the file a delta refers to, writing the response when
+// it cannot serve as one.
+func loadDeltaBase(w http.ResponseWriter, r *http.Request, store MetadataStore) (*FileRecord, bool) {
+	rec, ok := loadRecord(w, r, store, r.PathValue("id"))
+	if !ok || unavailable(w, rec) || !requireCustomerKey(w, r, rec) {
+		return nil, false
+	}
+	if rec.storageClass() == StorageCold {
+		writeConflict(w, "File '"+rec.ID+"' is archived; restore it before using it as a delta base")
+		return nil, false
+	}
+	// Signatures and deltas work on the content the caller may read.
+	return contentRecord(r.Context(), rec), true
+}
+
+// SignatureHandler serves GET /v1/files/{id}/signature.
+func SignatureHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec, ok := loadDeltaBase(w, r, store)
+		if !ok {
+			return
+		}
+		blockSize, ok := parseDeltaBlock(r, rec.Bytes)
+		if !ok {
+			writeBadRequest(w, "Parameter 'blockSize' must be between "+strconv.Itoa(deltaMinBlock)+" and "+strconv.Itoa(deltaMaxBlock))
+			return
+		}
+		body, err := openBlob(rec, false)
+		if err != nil {
+			writeBlobError(w, err)
+			return
+		}
+		defer body.Close()
+
+		sig := &BlockSignature{ID: rec.ID, Size: rec.Bytes, SHA256: rec.ChecksumSHA, BlockSize: blockSize, Blocks: []BlockSum{}}
+		buf := make([]byte, blockSize)
+		br := bufio.NewReaderSize(body, 1<<20)
+		for {
+			n, err := io.ReadFull(br, buf)
+			if n > 0 {
+				strong := sha256.Sum256(buf[:n])
+				sig.Blocks = append(sig.Blocks, BlockSum{Weak: weakSum(buf[:n]), Strong: hex.EncodeToString(strong[:16])})
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil {
+				writeInternalError(w, "Failed to read file")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, sig)
+	}
+}
+
+// deltaReader rebuilds a file from a delta stream and its base. Errors in
+// the stream are *UploadErrors so Receive reports them to the client; they
+// are sticky, as Receive reads on after a short first read.
+type deltaReader struct {
+	ops       *bufio.Reader
+	base      *os.File
+	baseSize  int64
+	blockSize int64
+
+	cur     io.Reader // remainder of the current operation
+	literal int64     // bytes of a literal still expected from ops
+	copied  int64     // bytes taken from the base
+	err     error
+}
+
+func deltaError(msg string) *UploadError {
+	return newUploadError(http.StatusBadRequest, "bad_request", "Invalid delta: "+msg)
+}
+
+func (d *deltaReader) Read(p []byte) (int, error) {
+	for d.err == nil {
+		if d.cur != nil {
+			n, err := d.cur.Read(p)
+			if d.literal > 0 {
+				d.literal -= int64(n)
+				if errors.Is(err, io.EOF) && d.literal > 0 {
+					err = deltaError("literal is truncated")
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				d.cur, err = nil, nil
+			}
+			if err != nil {
+				d.err = err
+			}
+			if n > 0 || d.err != nil {
+				return n, d.err
+			}
+			continue
+		}
+		op, err := d.ops.ReadByte()
+		if errors.Is(err, io.EOF) {
+			d.err = io.EOF
+			break
+		}
+		if err != nil {
+			d.err = err
+			break
+		}
+		d.err = d.next(op)
+	}
+	return 0, d.err
+}
+
+// next starts the operation op.
+func (d *deltaReader) next(op byte) error {
+	blocks := (d.baseSize + d.blockSize - 1) / d.blockSize
+	switch op {
+	case deltaOpCopy:
+		block, err := binary.ReadUvarint(d.ops)
+		if err != nil {
+			return deltaError("copy operation is truncated")
+		}
+		count, err := binary.ReadUvarint(d.ops)
+		if err != nil {
+			return deltaError("copy operation is truncated")
+		}
+		if count == 0 || block >= uint64(blocks) || count > uint64(blocks)-block {
+			return deltaError("copy of blocks " + strconv.FormatUint(block, 10) + "+" + strconv.FormatUint(count, 10) + " is outside the base file's " + strconv.FormatInt(blocks, 10) + " blocks")
+		}
+		off := int64(block) * d.blockSize
+		n := min(int64(count)*d.blockSize, d.baseSize-off)
+		d.cur = io.NewSectionReader(d.base, off, n)
+		d.copied += n
+	case deltaOpLiteral:
+		n, err := binary.ReadUvarint(d.ops)
+		if err != nil {
+			return deltaError("literal operation is truncated")
+		}
+		if n == 0 || n > math.MaxInt64 {
+			return deltaError("literal length must be positive")
+		}
+		d.literal = int64(n)
+		d.cur = io.LimitReader(d.ops, d.literal)
+	default:
+		return deltaError("unknown operation 0x" + strconv.FormatUint(uint64(op), 16))
+	}
+	return nil
+}
+
+// DeltaUploadResponse adds how much of the new file came from its base.
+type DeltaUploadResponse struct {
+	UploadResponse
+	Base        string `json:"base"`
+	ReusedBytes int64  `json:"reusedBytes"`
+}
+
+// DeltaHandler serves POST /v1/files/{id}/delta, storing the rebuilt file as
+// a new file derived from {id}. With ?key= it is bound to that key like a
+// direct upload, so a delta can publish the next version of an object.
+func DeltaHandler(in *Ingest, keys *Keys) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base, ok := loadDeltaBase(w, r, in.Store)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("blockSize") == "" {
+			writeBadRequest(w, "Parameter 'blockSize' is required and must match the signature the delta was made from")
+			return
+		}
+		blockSize, ok := parseDeltaBlock(r, base.Bytes)
+		if !ok {
+			writeBadRequest(w, "Parameter 'blockSize' must be between "+strconv.Itoa(deltaMinBlock)+" and "+strconv.Itoa(deltaMaxBlock))
+			return
+		}
+		checksum, ok := parseChecksum(q.Get("sha256"))
+		if !ok {
+			writeBadRequest(w, "Parameter 'sha256' must be the hex SHA-256 of the new file")
+			return
+		}
+		filename := q.Get("filename")
+		if filename == "" {
+			filename = base.Filename
+		}
+
+		limit := in.Limits.For(r)
+		if !preflight(w, r, limit, limit) {
+			return
+		}
+		var claim *keyClaim
+		if key := q.Get("key"); key != "" {
+			var uerr *UploadError
+			claim, uerr = keys.Claim(r.Context(), key, q.Get("onConflict"))
+			if uerr != nil {
+				writeUploadError(w, uerr)
+				return
+			}
+			defer claim.Release()
+		}
+
+		f, cleanup, err := openDeltaBase(base)
+		if err != nil {
+			writeBlobError(w, err)
+			return
+		}
+		defer cleanup()
+
+		d := &deltaReader{
+			ops:       bufio.NewReader(http.MaxBytesReader(w, r.Body, limit)),
+			base:      f,
+			baseSize:  base.Bytes,
+			blockSize: blockSize,
+		}
+		meta := UploadMeta{
+			MaxBytes:    limit,
+			Checksum:    checksum,
+			IfNotExists: q.Get("ifNotExists") == "true",
+			NotifyEmail: notifyAddress(r),
+			Folder:      base.Folder,
+			Tags:        base.Tags,
+			Lineage:     &Lineage{Operation: LineageDelta, Sources: []string{base.ID}},
+		}
+		if claim != nil {
+			meta.Key = claim.Key
+		}
+		rec, uerr := in.Receive(r.Context(), &limitFile{r: d, n: limit}, filename, meta)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		resp := DeltaUploadResponse{UploadResponse: newUploadResponse(rec), Base: base.ID, ReusedBytes: d.copied}
+		if claim != nil {
+			resp.Version, err = keys.Bind(context.WithoutCancel(r.Context()), claim, rec)
+			if err != nil {
+				log.Printf("bind key %q to %s: %v", claim.Key, rec.ID, err)
+				writeInternalError(w, "Failed to bind key")
+				return
+			}
+		}
+		metrics.Counter("upload_delta_reused_bytes_total", "Bytes of delta uploads copied from their base file.").Add(float64(d.copied))
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/file-upload-go/config"
+)
+
+func TestWeakSum(t *testing.T) {
+	tests := []struct {
+		block string
+		want  uint32
+	}{
+		{"", 0},
+		{"a", 97 | 97<<16},
+		{"abc", 294 | 586<<16},
+		{strings.Repeat("\xff", 600), (600 * 255 & 0xffff) | (600 * 601 / 2 * 255 & 0xffff) << 16},
+	}
+	for _, tt := range tests {
+		if got := weakSum([]byte(tt.block)); got != tt.want {
+			t.Errorf("weakSum(%d bytes) = %#x, want %#x", len(tt.block), got, tt.want)
+		}
+	}
+}
+
+// deltaOps encodes a delta from copy ([block, count]) and literal
+// ([]byte) operations.
+func deltaOps(ops ...any) []byte {
+	var b []byte
+	for _, op := range ops {
+		switch op := op.(type) {
+		case [2]uint64:
+			b = append(b, deltaOpCopy)
+			b = binary.AppendUvarint(b, op[0])
+			b = binary.AppendUvarint(b, op[1])
+		case []byte:
+			b = append(b, deltaOpLiteral)
+			b = binary.AppendUvarint(b, uint64(len(op)))
+			b = append(b, op...)
+		}
+	}
+	return b
+}
+
+// A file rebuilt from a delta against a compressed base matches the new
+// version byte for byte, and a delta that does not is rejected.
+func TestDeltaUpload(t *testing.T) {
+	in := testIngest(t)
+	in.Config.Compression = EncodingGzip
+	var sb strings.Builder
+	sb.WriteString("id,value\n")
+	for i := range 300 {
+		fmt.Fprintf(&sb, "%d,value-%d\n", i, i)
+	}
+	old := sb.String()
+	resp, uerr := in.Receive(context.Background(), strings.NewReader(old), "values.csv", UploadMeta{MaxBytes: config.DefaultMaxUploadBytes})
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	base, err := in.Store.Get(context.Background(), resp.ID)
+	if err != nil || base.Encoding != EncodingGzip {
+		t.Fatalf("base %+v, %v", base, err)
+	}
+
+	const bs = 512
+	blocks := uint64((len(old) + bs - 1) / bs)
+	changed := []byte(strings.ReplaceAll(old[2*bs:3*bs], "value", "VALUE"))
+	newFile := old[:2*bs] + string(changed) + old[3*bs:]
+	sum := sha256.Sum256([]byte(newFile))
+	newSum := hex.EncodeToString(sum[:])
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/files/{id}/signature", SignatureHandler(in.Store))
+	mux.HandleFunc("POST /v1/files/{id}/delta", DeltaHandler(in, nil))
+
+	t.Run("signature", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/files/"+base.ID+"/signature?blockSize=512", nil))
+		var sig BlockSignature
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &sig) != nil {
+			t.Fatalf("%d %s", w.Code, w.Body)
+		}
+		if sig.Size != int64(len(old)) || sig.SHA256 != base.ChecksumSHA || sig.BlockSize != bs || uint64(len(sig.Blocks)) != blocks {
+			t.Fatalf("signature %+v", sig)
+		}
+		for i, b := range sig.Blocks {
+			block := []byte(old[i*bs : min((i+1)*bs, len(old))])
+			strong := sha256.Sum256(block)
+			if b.Weak != weakSum(block) || b.Strong != hex.EncodeToString(strong[:16]) {
+				t.Errorf("block %d: %+v", i, b)
+			}
+		}
+		for _, size := range []string{"511", "2097152", "x"} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/files/"+base.ID+"/signature?blockSize="+size, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("blockSize=%s: %d", size, w.Code)
+			}
+		}
+	})
+
+	tests := []struct {
+		name, query string
+		ops         []byte
+		status      int
+		want        string
+	}{
+		{"rebuilt", "blockSize=512&sha256=" + newSum, deltaOps([2]uint64{0, 2}, changed, [2]uint64{3, blocks - 3}), http.StatusOK, ""},
+		{"wrong checksum", "blockSize=512&sha256=" + base.ChecksumSHA, deltaOps([2]uint64{0, 2}, changed, [2]uint64{3, blocks - 3}), http.StatusBadRequest, "checksum"},
+		{"copy past the base", "blockSize=512&sha256=" + newSum, deltaOps([2]uint64{0, blocks + 1}), http.StatusBadRequest, "outside the base file"},
+		{"empty copy", "blockSize=512&sha256=" + newSum, deltaOps([2]uint64{0, 0}), http.StatusBadRequest, "outside the base file"},
+		{"truncated literal", "blockSize=512&sha256=" + newSum, deltaOps([2]uint64{0, 2}, changed)[:len(deltaOps([2]uint64{0, 2}, changed))-10], http.StatusBadRequest, "literal is truncated"},
+		{"truncated copy", "blockSize=512&sha256=" + newSum, []byte{deltaOpCopy, 0x80}, http.StatusBadRequest, "copy operation is truncated"},
+		{"unknown op", "blockSize=512&sha256=" + newSum, []byte{0x07}, http.StatusBadRequest, "unknown operation 0x7"},
+		{"no block size", "sha256=" + newSum, deltaOps(changed), http.StatusBadRequest, "'blockSize' is required"},
+		{"no checksum", "blockSize=512", deltaOps(changed), http.StatusBadRequest, "'sha256'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/files/"+base.ID+"/delta?"+tt.query, bytes.NewReader(tt.ops))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+				t.Fatalf("%d %s, want %d with %q", w.Code, w.Body, tt.status, tt.want)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp DeltaUploadResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Base != base.ID || resp.ReusedBytes != int64(len(old)-bs) {
+				t.Errorf("base %s, reused %d bytes; want %s and %d", resp.Base, resp.ReusedBytes, base.ID, len(old)-bs)
+			}
+			rec, err := in.Store.Get(context.Background(), resp.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := openBlob(rec, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			got, _ := io.ReadAll(body)
+			if string(got) != newFile || rec.Lineage == nil || rec.Lineage.Operation != LineageDelta || rec.Lineage.Sources[0] != base.ID {
+				t.Errorf("rebuilt %d bytes (want %d), lineage %+v", len(got), len(newFile), rec.Lineage)
+			}
+		})
+	}
+}
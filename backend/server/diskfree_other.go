@@ -0,0 +1,13 @@
+//go:build !unix
+
+package server
+
+import "errors"
+
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("free space is not available on this platform")
+}
+
+func diskUsage(dir string) (uint64, uint64, error) {
+	return 0, 0, errors.New("disk usage is not available on this platform")
+}
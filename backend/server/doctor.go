@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+// Diagnosis statuses.
+const (
+	DiagOK   = "ok"
+	DiagWarn = "warn"
+	DiagFail = "fail"
+)
+
+// Diagnosis is one finding of Doctor. Fix says what to do about a warning
+// or failure.
+type Diagnosis struct {
+	Check   string `json:"check"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+func (d Diagnosis) String() string {
+	s := fmt.Sprintf("[%-4s] %s: %s", d.Status, d.Check, d.Message)
+	if d.Fix != "" {
+		s += "\n       fix: " + d.Fix
+	}
+	return s
+}
+
+// Doctor checks the environment the server is about to run in: that its
+// directories are writable, there is room for an upload, the metadata store
+// and Redis answer, the clock is sane, and the configuration hangs
+// together. Every check runs, so one pass reports all problems rather than
+// the first upload tripping over one of them.
+func Doctor(ctx context.Context, cfg config.Config) []Diagnosis {
+	d := &doctor{ctx: ctx}
+	d.dirs(cfg)
+	d.disk(cfg)
+	d.metadata()
+	d.redis("UPLOAD_REDIS_CACHE_ADDR", cfg.RedisCacheAddr)
+	d.redis("UPLOAD_LOCK_REDIS_ADDR", cfg.LockRedisAddr)
+	d.clock(cfg)
+	d.config(cfg)
+	return d.out
+}
+
+// diagnosesFailed reports whether any diagnosis is a failure.
+func diagnosesFailed(ds []Diagnosis) bool {
+	for _, d := range ds {
+		if d.Status == DiagFail {
+			return true
+		}
+	}
+	return false
+}
+
+type doctor struct {
+	ctx context.Context
+	out []Diagnosis
+}
+
+func (d *doctor) ok(check, msg string) {
+	d.out = append(d.out, Diagnosis{Check: check, Status: DiagOK, Message: msg})
+}
+
+func (d *doctor) warn(check, msg, fix string) {
+	d.out = append(d.out, Diagnosis{Check: check, Status: DiagWarn, Message: msg, Fix: fix})
+}
+
+func (d *doctor) fail(check, msg, fix string) {
+	d.out = append(d.out, Diagnosis{Check: check, Status: DiagFail, Message: msg, Fix: fix})
+}
+
+func (d *doctor) dirs(cfg config.Config) {
+	for _, dir := range []struct{ path, setting string }{
+		{filepath.Dir(auditLogPath), ""},
+		{uploadDir, ""},
+		{metadataDir, ""},
+		{cfg.SessionDir, "UPLOAD_SESSION_DIR"},
+		{cfg.ArchiveDir, "UPLOAD_ARCHIVE_DIR"},
+	} {
+		fix := "make " + dir.path + " writable by the server's user"
+		if dir.setting != "" {
+			fix += ", or point " + dir.setting + " elsewhere"
+		}
+		if err := probeDir(dir.path); err != nil {
+			d.fail("directories", err.Error(), fix)
+			continue
+		}
+		d.ok("directories", dir.path+" is writable")
+	}
+}
+
+// probeDir creates dir if needed and writes and removes a file in it.
+func probeDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.WriteString("ok")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (d *doctor) disk(cfg config.Config) {
+	free, err := diskFree(uploadDir)
+	if err != nil {
+		d.warn("disk", "cannot determine free space on "+uploadDir+": "+err.Error(), "")
+		return
+	}
+	msg := fmt.Sprintf("%s free on %s", formatBytes(int64(free)), uploadDir)
+	switch {
+	case free < diskReserveBytes:
+		d.fail("disk", msg+", below the "+formatBytes(diskReserveBytes)+" kept in reserve; every upload will get 507", "free up space on the upload volume")
+	case free < diskReserveBytes+uint64(cfg.MaxUploadBytes):
+		d.warn("disk", msg+", not enough for an upload of the maximum size ("+formatBytes(cfg.MaxUploadBytes)+")", "free up space, or lower UPLOAD_MAX_UPLOAD_BYTES")
+	default:
+		d.ok("disk", msg)
+	}
+}
+
+func (d *doctor) metadata() {
+	start := time.Now()
+	db := &jsonStore{dir: metadataDir}
+	if _, err := db.Get(d.ctx, "doctor-probe"); err != nil && !errors.Is(err, ErrNotFound) {
+		d.fail("metadata", "cannot read the metadata store: "+err.Error(), "check the volume holding "+metadataDir+"; UPLOAD_STORAGE_TIMEOUT_SECONDS bounds slow mounts")
+		return
+	}
+	d.ok("metadata", fmt.Sprintf("metadata store answered in %s", time.Since(start).Round(time.Millisecond)))
+}
+
+func (d *doctor) redis(setting, addr string) {
+	if addr == "" {
+		return
+	}
+	c := newRedisClient(addr)
+	defer c.Close()
+	if _, err := c.Do(d.ctx, "PING"); err != nil {
+		d.fail("redis", setting+" "+addr+": "+err.Error(), "start Redis at "+addr+" or fix "+setting)
+		return
+	}
+	d.ok("redis", setting+" "+addr+" answers")
+}
+
+// clock looks for a system clock that is unset or has gone backwards: data
+// written in the future of now, or a Redis server that disagrees. Expiry,
+// signed URLs and lock TTLs all rely on it.
+func (d *doctor) clock(cfg config.Config) {
+	now := time.Now()
+	if now.Year() < 2020 {
+		d.fail("clock", "system time is "+now.Format(time.RFC3339), "set the clock and run NTP")
+		return
+	}
+	var latest time.Time
+	for _, p := range []string{metadataDir, uploadDir, auditLogPath} {
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	if latest.After(now.Add(time.Minute)) {
+		d.fail("clock", "data was written at "+latest.Format(time.RFC3339)+", after the current time "+now.Format(time.RFC3339), "fix the system clock (run NTP) before serving")
+		return
+	}
+	if addr := cfg.LockRedisAddr; addr != "" {
+		if skew, err := redisClockSkew(d.ctx, addr); err == nil && skew.Abs() > 5*time.Second {
+			d.warn("clock", "clock differs from Redis at "+addr+" by "+skew.Round(time.Millisecond).String(), "run NTP on every instance so lock TTLs agree")
+			return
+		}
+	}
+	d.ok("clock", "system time is "+now.UTC().Format(time.RFC3339))
+}
+
+func redisClockSkew(ctx context.Context, addr string) (time.Duration, error) {
+	c := newRedisClient(addr)
+	defer c.Close()
+	reply, err := c.Do(ctx, "TIME")
+	if err != nil {
+		return 0, err
+	}
+	parts, ok := reply.([]any)
+	if !ok || len(parts) != 2 {
+		return 0, errors.New("unexpected TIME reply")
+	}
+	sec, err1 := strconv.ParseInt(fmt.Sprint(parts[0]), 10, 64)
+	usec, err2 := strconv.ParseInt(fmt.Sprint(parts[1]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, errors.New("unexpected TIME reply")
+	}
+	return time.Since(time.Unix(sec, usec*1000)), nil
+}
+
+// config loads everything serve loads from configuration, so a bad file,
+// unreachable secret or KEK shows up here rather than as a fatal error on
+// the way up, and then looks for settings that contradict each other.
+func (d *doctor) config(cfg config.Config) {
+	failed := false
+	check := func(what, fix string, err error) {
+		if err != nil {
+			failed = true
+			d.fail("config", what+": "+err.Error(), fix)
+		}
+	}
+	switch cfg.Compression {
+	case "", EncodingZstd, EncodingGzip:
+	default:
+		check("UPLOAD_COMPRESSION", "set it to zstd, gzip or leave it empty", fmt.Errorf("unsupported value %q", cfg.Compression))
+	}
+	_, err := NewIDGenerator(cfg.IDFormat)
+	check("UPLOAD_ID_FORMAT", "", err)
+	_, err = LoadSizeLimits(cfg.LimitsFile, cfg.MaxUploadBytes)
+	check("UPLOAD_LIMITS_FILE", "", err)
+	_, err = LoadFormulaPolicy(cfg.FormulaPolicyFile, cfg.FormulaPolicy)
+	check("formula policy", "", err)
+	if cfg.SchemasFile != "" {
+		_, err = LoadSchemaCheck(cfg.SchemasFile)
+		check("UPLOAD_SCHEMAS_FILE", "", err)
+	}
+	_, err = LoadMessageCatalog(cfg.MessagesFile)
+	check("UPLOAD_MESSAGES_FILE", "", err)
+	_, err = LoadFeatureFlags(cfg.FeatureFlagsFile, nil, nil)
+	check("UPLOAD_FEATURE_FLAGS_FILE", "", err)
+	_, err = NewReceipts(cfg.ReceiptKey)
+	check("UPLOAD_RECEIPT_KEY_FILE", "", err)
+
+	ctx, cancel := context.WithTimeout(d.ctx, time.Minute)
+	defer cancel()
+	secrets, err := loadSecrets(cfg)
+	check("secrets", "check the secret references and that their providers are reachable", err)
+	if err == nil {
+		_, err = loadBlobKeys(cfg, secrets.GCPToken)
+		check("encryption keys", "check UPLOAD_ENCRYPTION_KEK and access to the KMS", err)
+		if secrets.AdminToken.Value() == "" {
+			d.warn("config", "UPLOAD_ADMIN_TOKEN is not set, so the admin API is disabled", "set UPLOAD_ADMIN_TOKEN to use the admin endpoints")
+		}
+	}
+	if cfg.ClamAVAddr != "" {
+		network := "tcp"
+		if strings.HasPrefix(cfg.ClamAVAddr, "/") {
+			network = "unix"
+		}
+		var dialer net.Dialer
+		if conn, err := dialer.DialContext(ctx, network, cfg.ClamAVAddr); err != nil {
+			d.warn("config", "UPLOAD_CLAMAV_ADDR "+cfg.ClamAVAddr+": "+err.Error(), "start clamd or fix UPLOAD_CLAMAV_ADDR; until then uploads stay in scanning")
+		} else {
+			conn.Close()
+		}
+	}
+	if cfg.MaxChunkBytes > cfg.MaxUploadBytes {
+		d.warn("config", "UPLOAD_MAX_CHUNK_BYTES exceeds UPLOAD_MAX_UPLOAD_BYTES", "lower UPLOAD_MAX_CHUNK_BYTES")
+	}
+	if cfg.MaxBatchBytes < cfg.MaxUploadBytes {
+		d.warn("config", "UPLOAD_MAX_BATCH_BYTES is below UPLOAD_MAX_UPLOAD_BYTES, so a maximum-size file cannot be sent in a batch", "raise UPLOAD_MAX_BATCH_BYTES")
+	}
+	if !failed {
+		d.ok("config", "configuration loads")
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadHandler streams a stored file. Compressed blobs are sent as-is
+// with Content-Encoding when the client accepts that encoding, and are
+// decoded on the fly otherwise.
+//
+// ?sanitize=true sends a copy with formula-like cells neutralized, which is
+// the default for files stored under the "sanitize" formula policy;
+// ?sanitize=false asks for the original bytes.
+//
+// ?downloadAs= names the file sent in place of its stored name, and
+// ?disposition=inline asks for it to be shown in the browser rather than
+// saved. A type the browser would run as a page or script is always sent
+// as an attachment, and no response may be sniffed as something else.
+//
+// A cold file is not served: the request starts its restore and gets 202
+// with Retry-After, as from POST /v1/files/{id}/restore.
+func DownloadHandler(store MetadataStore, access AccessStore, tier *Tierer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w, "Only GET and HEAD methods are allowed for downloads")
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		sanitize := false
+		if v := r.URL.Query().Get("sanitize"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				writeBadRequest(w, "Parameter 'sanitize' must be true or false")
+				return
+			}
+			sanitize = b
+		}
+		disposition := r.URL.Query().Get("disposition")
+		switch disposition {
+		case "":
+			disposition = "attachment"
+		case "attachment", "inline":
+		default:
+			writeBadRequest(w, "Parameter 'disposition' must be attachment or inline")
+			return
+		}
+		downloadAs := r.URL.Query().Get("downloadAs")
+		if downloadAs != "" {
+			name, msg := sanitizeFilename(downloadAs)
+			if msg.Text != "" {
+				writeBadRequest(w, "Parameter 'downloadAs' must be a plain filename")
+				return
+			}
+			downloadAs = name
+		}
+		rec, ok := loadRecord(w, r, store, r.PathValue("id"))
+		if !ok {
+			return
+		}
+		if unavailable(w, rec) {
+			return
+		}
+		if !requireCustomerKey(w, r, rec) {
+			return
+		}
+		if rec.storageClass() == StorageCold {
+			if tier == nil {
+				writeConflict(w, "File '"+rec.ID+"' is archived; restore it before downloading")
+				return
+			}
+			// The download starts the restore; the client comes back for
+			// the content once it is done.
+			id := rec.ID
+			var err error
+			if rec, _, err = tier.StartRestore(r.Context(), id); err != nil {
+				writeUpdateError(w, id, err)
+				return
+			}
+			if rec.storageClass() == StorageCold {
+				writeRestoring(w, rec)
+				return
+			}
+		}
+
+		if err := access.TouchAccess(r.Context(), rec.ID, time.Now().UTC()); err != nil && !errors.Is(err, errReadOnly) {
+			log.Printf("download: touch %s: %v", rec.ID, err)
+		}
+
+		uploadDeadline.applyWrite(w, rec.Bytes)
+		contentType := downloadContentType(rec)
+		w.Header().Set("Content-Type", contentType)
+		if executableType(contentType) {
+			disposition = "attachment"
+		}
+		if downloadAs == "" {
+			downloadAs = rec.Filename
+		}
+		w.Header().Set("Content-Disposition", contentDisposition(disposition, downloadAs))
+		cachePolicy.apply(w, r, cacheClass(r))
+		if !r.URL.Query().Has("sanitize") && rec.Formulas != nil {
+			sanitize = rec.Formulas.Sanitized
+		}
+		if rec.MaskedPath != "" {
+			w.Header().Add("Vary", "X-API-Key")
+		}
+		// src is rec, or its masked copy for callers without PII access.
+		// The copy differs from the upload, so it goes out without the
+		// stored checksum.
+		src := contentRecord(r.Context(), rec)
+		if src != rec {
+			w.Header().Set("X-Content-Masked", "pii")
+		}
+		if sanitize {
+			serveSanitized(w, r, src)
+			return
+		}
+		if src.ChecksumSHA != "" {
+			w.Header().Set("X-Checksum-Sha256", src.ChecksumSHA)
+		}
+
+		if src.Encoding == "" {
+			f, err := boundedOpen(r.Context(), "blob open", func() (io.ReadSeekCloser, error) { return openBlobSeeker(src) })
+			if err != nil {
+				writeBlobError(w, err)
+				return
+			}
+			defer f.Close()
+			http.ServeContent(w, r, "", src.UploadedAt, f)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		raw := acceptsEncoding(r.Header.Get("Accept-Encoding"), src.Encoding)
+		body, err := boundedOpen(r.Context(), "blob open", func() (io.ReadCloser, error) { return openBlob(src, raw) })
+		if err != nil {
+			writeBlobError(w, err)
+			return
+		}
+		defer body.Close()
+
+		if raw {
+			w.Header().Set("Content-Encoding", src.Encoding)
+			if src.Compression != nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(src.Compression.StoredBytes, 10))
+			}
+		} else {
+			w.Header().Set("Content-Length", strconv.FormatInt(src.Bytes, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := io.Copy(w, body); err != nil {
+			log.Printf("download: stream %s: %v", rec.ID, err)
+		}
+	}
+}
+
+// downloadContentType is the type rec is served as: the one its content
+// sniffed as at upload or, for files stored before that was recorded
+// reliably (none, or application/octet-stream for short uploads), the type
+// of its stored extension.
+func downloadContentType(rec *FileRecord) string {
+	if rec.ContentType != "" && rec.ContentType != "application/octet-stream" {
+		return rec.ContentType
+	}
+	if t := mime.TypeByExtension(rec.extension()); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// executableType reports whether a browser shown contentType inline would
+// run it as a page or script in this origin.
+func executableType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	switch mt {
+	case "text/html", "text/xml", "application/xml", "text/javascript", "application/javascript",
+		"application/x-javascript", "text/ecmascript", "application/ecmascript", "application/pdf":
+		return true
+	}
+	return strings.HasSuffix(mt, "+xml")
+}
+
+// serveSanitized streams rec through neutralizeFormulas. The output is
+// re-encoded, so its length and checksum are not known up front.
+func serveSanitized(w http.ResponseWriter, r *http.Request, rec *FileRecord) {
+	body, err := openBlob(rec, false)
+	if err != nil {
+		writeBlobError(w, err)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("X-Content-Sanitized", "formulas")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := neutralizeFormulas(w, body); err != nil {
+		log.Printf("download: sanitize %s: %v", rec.ID, err)
+	}
+}
+
+func writeBlobError(w http.ResponseWriter, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		writeNotFound(w, "Stored file content is missing")
+		return
+	}
+	if errors.Is(err, errCustomerKeyRequired) {
+		writeConflict(w, "The file is encrypted with a customer-provided key, which the server cannot use here")
+		return
+	}
+	log.Printf("open blob: %v", err)
+	writeInternalError(w, "Failed to open stored file")
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Downloads carry the content type sniffed at upload, or the type of the
+// stored extension when none, or only application/octet-stream, was
+// recorded.
+func TestDownloadContentType(t *testing.T) {
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	download := DownloadHandler(db, db, nil)
+	locker := newLocalLocker()
+
+	if rec := testRecord(t, in); rec.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("short upload sniffed as %q", rec.ContentType)
+	}
+	tests := []struct {
+		name, recorded, want string
+	}{
+		{"recorded", "text/tab-separated-values", "text/tab-separated-values"},
+		{"recorded as unknown", "application/octet-stream", "text/csv; charset=utf-8"},
+		{"not recorded", "", "text/csv; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := testRecord(t, in)
+			if _, err := updateRecord(context.Background(), db, locker, rec.ID, func(cur *FileRecord) error {
+				cur.ContentType = tt.recorded
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/v1/files/"+rec.ID, nil)
+			req.SetPathValue("id", rec.ID)
+			w := httptest.NewRecorder()
+			download(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Downloads are never sniffed as another type, and a type the browser
+// would run is sent as an attachment even when inline is asked for.
+func TestDownloadDisposition(t *testing.T) {
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	download := DownloadHandler(db, db, nil)
+	locker := newLocalLocker()
+
+	tests := []struct {
+		recorded, query, want string
+	}{
+		{"text/csv", "", "attachment"},
+		{"text/csv", "?disposition=inline", "inline"},
+		{"text/plain; charset=utf-8", "?disposition=inline", "inline"},
+		{"text/html; charset=utf-8", "?disposition=inline", "attachment"},
+		{"image/svg+xml", "?disposition=inline", "attachment"},
+		{"application/javascript", "?disposition=inline", "attachment"},
+		{"application/xhtml+xml", "?disposition=inline", "attachment"},
+		{"text/xml", "?disposition=inline", "attachment"},
+		{"text/html", "", "attachment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.recorded+tt.query, func(t *testing.T) {
+			rec := testRecord(t, in)
+			if _, err := updateRecord(context.Background(), db, locker, rec.ID, func(cur *FileRecord) error {
+				cur.ContentType = tt.recorded
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/v1/files/"+rec.ID+tt.query, nil)
+			req.SetPathValue("id", rec.ID)
+			w := httptest.NewRecorder()
+			download(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q", got)
+			}
+			if got := w.Header().Get("Content-Disposition"); !strings.HasPrefix(got, tt.want+";") {
+				t.Errorf("Content-Disposition = %q, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// dryRun takes a received upload, staged at rec.Path, through the
+// validation a real upload would get: the upload policies, the formula
+// policy, the PII scan and the async checks, which run here before
+// returning. rec comes back as it would have been recorded, without an ID,
+// with the state it would have reached; a failing check shows as the
+// quarantine it would have caused. Nothing is stored, no events or
+// notifications are sent, and the staged bytes are left for the caller to
+// remove.
+func (in *Ingest) dryRun(ctx context.Context, rec *FileRecord) *UploadError {
+	ctx = context.WithoutCancel(ctx)
+	if uerr := in.Policies.Check(ctx, rec); uerr != nil {
+		return uerr
+	}
+	if mode := in.Formulas.For(rec.Key); mode != FormulaOff {
+		if err := applyFormulaPolicy(rec, mode); err != nil {
+			var uerr *UploadError
+			if errors.As(err, &uerr) {
+				return uerr
+			}
+			log.Printf("dry run: formula scan failed for %s: %v", rec.Filename, err)
+		}
+	}
+	if in.PII != nil {
+		// Report only; the masked copy would be made at commit.
+		if err := applyPIIScan(in.PII, rec, false); err != nil {
+			log.Printf("dry run: pii scan failed for %s: %v", rec.Filename, err)
+		}
+	}
+	rec.State = StateAvailable
+	if in.Checks.Enabled() && in.Flags.Enabled(ctx, FlagAsyncScanning, rec.ID) {
+		rec.State = StateScanning
+		in.scanNow(ctx, rec)
+	}
+	rec.ID = ""
+	rec.Revision = 1
+	return nil
+}
+
+// scanNow runs the async checks on a scanning rec before returning,
+// leaving it available or quarantined.
+func (in *Ingest) scanNow(ctx context.Context, rec *FileRecord) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	if failed, reason := in.Checks.run(ctx, rec, func(int, FileCheck) {}); failed != nil {
+		_ = rec.quarantine(failed.Name(), reason)
+	} else {
+		rec.State = StateAvailable
+	}
+}
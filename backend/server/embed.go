@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+// EmbedConfig configures an Embedded server.
+type EmbedConfig struct {
+	// Store holds the file records; nil means a new MemoryStore.
+	Store MetadataStore
+
+	// Dir holds upload sessions and the other documents kept beside the
+	// records. It must exist. Blobs go under uploadDir; see SetUploadDir.
+	Dir string
+
+	// MaxUploadBytes and MaxChunkBytes default to the server's defaults.
+	MaxUploadBytes int64
+	MaxChunkBytes  int64
+}
+
+// Embedded is the upload API served by the same handlers as the binary but
+// wired to the stores in an EmbedConfig rather than the environment, for
+// tests of code that talks to the API. It serves uploads, downloads,
+// listing, file metadata, upload sessions and capabilities; background
+// jobs, admin routes and optional integrations are left out.
+type Embedded struct {
+	http.Handler
+
+	store MetadataStore
+	in    *Ingest
+}
+
+// NewEmbedded builds an Embedded server.
+func NewEmbedded(c EmbedConfig) (*Embedded, error) {
+	if c.Dir == "" {
+		return nil, errors.New("embed: Dir is required")
+	}
+	if c.Store == nil {
+		c.Store = NewMemoryStore()
+	}
+	cfg := config.Config{
+		MaxUploadBytes:  c.MaxUploadBytes,
+		MaxChunkBytes:   c.MaxChunkBytes,
+		SessionTTLHours: 24,
+	}
+	if cfg.MaxUploadBytes <= 0 {
+		cfg.MaxUploadBytes = config.DefaultMaxUploadBytes
+	}
+	if cfg.MaxChunkBytes <= 0 {
+		cfg.MaxChunkBytes = 16 << 20
+	}
+	docs, err := NewJSONStore(filepath.Join(c.Dir, "metadata"))
+	if err != nil {
+		return nil, err
+	}
+	limits, err := LoadSizeLimits("", cfg.MaxUploadBytes)
+	if err != nil {
+		return nil, err
+	}
+	store := c.Store
+	locker := newLocalLocker()
+	audit := &AuditLog{}
+	in := &Ingest{Store: store, Config: cfg, IDs: hexIDs{}, Limits: limits}
+
+	mux := NewRouter()
+	api := mux.Group(IdentifyUploader)
+	keys := NewKeys(docs, store, locker, nil)
+	upload := UploadHandler(in, keys)
+	download := DownloadHandler(store, docs, nil)
+	file := FileHandler(store, locker, audit, nil)
+	api.HandleFunc("GET /v1/files", ListHandler(store))
+	api.HandleFunc("GET /v1/files/{$}", ListHandler(store))
+	api.HandleFunc("POST /v1/files/{$}", upload)
+	api.HandleFunc("OPTIONS /v1/files/{$}", upload)
+	api.HandleFunc(downloadPattern, download)
+	api.HandleFunc("GET /v1/files/{id}/metadata", file)
+	api.HandleFunc("PATCH /v1/files/{id}", file)
+	api.HandleFunc("DELETE /v1/files/{id}", file)
+	sessions := NewSessions(docs, locker, in, filepath.Join(c.Dir, "sessions"), time.Duration(cfg.SessionTTLHours)*time.Hour, cfg.MaxChunkBytes)
+	createSession := sessions.CreateHandler()
+	session := sessions.SessionHandler()
+	api.HandleFunc("POST /v1/uploads", createSession)
+	api.HandleFunc("OPTIONS /v1/uploads", createSession)
+	api.HandleFunc("POST /v1/uploads/{$}", createSession)
+	api.HandleFunc("GET /v1/uploads/{id}", session)
+	api.HandleFunc("PATCH /v1/uploads/{id}", session)
+	api.HandleFunc("DELETE /v1/uploads/{id}", session)
+	api.HandleFunc("POST /v1/uploads/{id}/complete", sessions.CompleteHandler())
+	api.HandleFunc("GET /v1/capabilities", CapabilitiesHandler(in))
+
+	reporter, err := NewErrorReporter("", nil)
+	if err != nil {
+		return nil, err
+	}
+	h := Chain{Deadlines, RequestID, messages.Middleware, Recoverer(reporter)}.Then(mux)
+	return &Embedded{Handler: h, store: store, in: in}, nil
+}
+
+// Store returns the store holding the file records.
+func (e *Embedded) Store() MetadataStore {
+	return e.store
+}
+
+// Put stores data as an upload named filename, for tests that start with
+// existing files.
+func (e *Embedded) Put(ctx context.Context, filename string, data []byte) (*FileRecord, error) {
+	rec, uerr := e.in.Receive(ctx, bytes.NewReader(data), filename, UploadMeta{MaxBytes: e.in.Limits.Default})
+	if uerr != nil {
+		return nil, uerr
+	}
+	return rec, nil
+}
+
+// Content returns the bytes of rec as a client without PII access
+// downloads them: the upload, or its masked copy.
+func (e *Embedded) Content(rec *FileRecord) ([]byte, error) {
+	body, err := openContent(context.Background(), rec)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
@@ -0,0 +1,523 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+// Blobs can be encrypted at rest with envelope encryption. Every blob gets
+// its own random 256-bit data key, and only that data key, wrapped by a
+// key-encryption key (KEK) held in AWS KMS, GCP KMS or an age identity, is
+// kept with the record. Rotating the KEK therefore means re-wrapping a few
+// dozen bytes per file; the blobs themselves are never rewritten.
+//
+// The blob is the stored bytes (after compression, if any) cut into 64 KiB
+// segments, each sealed with AES-256-GCM under a nonce made of the segment
+// number and a last-segment flag, so segments cannot be reordered or the
+// blob truncated unnoticed, and any byte range can be read without
+// decrypting what comes before it.
+const (
+	BlobCipherAES256GCM = "AES-256-GCM-SEG64K"
+
+	encSegmentSize = 64 << 10
+	encTagSize     = 16
+)
+
+// BlobEncryption records how a blob is encrypted. KeySHA256 identifies
+// the key of a blob encrypted with a customer-provided key.
+type BlobEncryption struct {
+	Algorithm  string `json:"algorithm"`
+	KEK        string `json:"kek"`
+	WrappedKey []byte `json:"wrappedKey"`
+	KeySHA256  string `json:"keySha256,omitempty"`
+}
+
+// KeyWrapper wraps and unwraps data keys with one KEK. ID names the KEK
+// and is recorded with every key it wraps.
+type KeyWrapper interface {
+	ID() string
+	Wrap(ctx context.Context, dek []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// BlobKeys is the keyring for encryption at rest: the primary KEK wraps new
+// data keys, and former KEKs stay available to unwrap keys not yet
+// re-wrapped. Unwrapped data keys are cached briefly so a busy file does not
+// cost a KMS call per download.
+type BlobKeys struct {
+	primary KeyWrapper
+	byID    map[string]KeyWrapper
+
+	mu    sync.Mutex
+	cache map[string]cachedDataKey
+}
+
+type cachedDataKey struct {
+	key     []byte
+	expires time.Time
+}
+
+const (
+	dataKeyCacheTTL  = 5 * time.Minute
+	dataKeyCacheSize = 4096
+)
+
+// blobKeys is set at startup when UPLOAD_ENCRYPTION_KEK is configured; nil
+// leaves new blobs unencrypted.
+var blobKeys *BlobKeys
+
+// NewBlobKeys builds the keyring from KEK specs (see parseKEK).
+func NewBlobKeys(primary string, former []string, gcpToken *Secret) (*BlobKeys, error) {
+	k := &BlobKeys{byID: map[string]KeyWrapper{}, cache: map[string]cachedDataKey{}}
+	for i, spec := range append([]string{primary}, former...) {
+		w, err := parseKEK(spec, gcpToken)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.primary = w
+		}
+		k.byID[w.ID()] = w
+	}
+	return k, nil
+}
+
+// loadBlobKeys builds the keyring configured by UPLOAD_ENCRYPTION_KEK and
+// UPLOAD_ENCRYPTION_OLD_KEKS and checks the primary KEK works. It returns
+// nil when no KEK is configured.
+func loadBlobKeys(cfg config.Config, gcpToken *Secret) (*BlobKeys, error) {
+	if cfg.EncryptionKEK == "" {
+		if len(cfg.EncryptionOldKEKs) > 0 {
+			return nil, errors.New("UPLOAD_ENCRYPTION_OLD_KEKS requires UPLOAD_ENCRYPTION_KEK")
+		}
+		return nil, nil
+	}
+	keys, err := NewBlobKeys(cfg.EncryptionKEK, cfg.EncryptionOldKEKs, gcpToken)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), keyTimeout)
+	defer cancel()
+	if err := keys.Check(ctx); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Check wraps and unwraps a throwaway key with the primary KEK, so a
+// missing permission shows up at startup instead of on the first upload.
+func (k *BlobKeys) Check(ctx context.Context) error {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	wrapped, err := k.primary.Wrap(ctx, dek)
+	if err != nil {
+		return fmt.Errorf("wrap with %s: %w", k.primary.ID(), err)
+	}
+	if _, err := k.primary.Unwrap(ctx, wrapped); err != nil {
+		return fmt.Errorf("unwrap with %s: %w", k.primary.ID(), err)
+	}
+	return nil
+}
+
+// newDataKey returns a fresh data key and its wrapped form.
+func (k *BlobKeys) newDataKey(ctx context.Context) ([]byte, *BlobEncryption, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := k.primary.Wrap(ctx, dek)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrap data key with %s: %w", k.primary.ID(), err)
+	}
+	return dek, &BlobEncryption{Algorithm: BlobCipherAES256GCM, KEK: k.primary.ID(), WrappedKey: wrapped}, nil
+}
+
+// dataKey unwraps the data key of enc.
+func (k *BlobKeys) dataKey(ctx context.Context, enc *BlobEncryption) ([]byte, error) {
+	if k == nil {
+		return nil, errors.New("blob is encrypted but no UPLOAD_ENCRYPTION_KEK is configured")
+	}
+	cacheKey := enc.KEK + "\x00" + string(enc.WrappedKey)
+	k.mu.Lock()
+	c, ok := k.cache[cacheKey]
+	k.mu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.key, nil
+	}
+	w := k.byID[enc.KEK]
+	if w == nil {
+		return nil, fmt.Errorf("KEK %s is not configured; add it to UPLOAD_ENCRYPTION_OLD_KEKS", enc.KEK)
+	}
+	dek, err := w.Unwrap(ctx, enc.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key with %s: %w", enc.KEK, err)
+	}
+	if len(dek) != 32 {
+		return nil, fmt.Errorf("unwrap data key with %s: got %d bytes", enc.KEK, len(dek))
+	}
+	k.mu.Lock()
+	if len(k.cache) >= dataKeyCacheSize {
+		clear(k.cache)
+	}
+	k.cache[cacheKey] = cachedDataKey{key: dek, expires: time.Now().Add(dataKeyCacheTTL)}
+	k.mu.Unlock()
+	return dek, nil
+}
+
+// rewrap re-wraps enc's data key with the primary KEK. It reports false
+// when the key is already wrapped by it and force is not set.
+func (k *BlobKeys) rewrap(ctx context.Context, enc *BlobEncryption, force bool) (bool, error) {
+	if enc.KEK == k.primary.ID() && !force {
+		return false, nil
+	}
+	dek, err := k.dataKey(ctx, enc)
+	if err != nil {
+		return false, err
+	}
+	wrapped, err := k.primary.Wrap(ctx, dek)
+	if err != nil {
+		return false, fmt.Errorf("wrap data key with %s: %w", k.primary.ID(), err)
+	}
+	enc.KEK, enc.WrappedKey = k.primary.ID(), wrapped
+	return true, nil
+}
+
+// keyTimeout bounds KMS calls made on behalf of a blob read, which has no
+// request context of its own.
+const keyTimeout = 30 * time.Second
+
+// encryptBlob replaces rec's stored blob with an encrypted copy under a new
+// data key. Like compressBlob it leaves the old file for the caller.
+func encryptBlob(ctx context.Context, keys *BlobKeys, rec *FileRecord) error {
+	dek, enc, err := keys.newDataKey(ctx)
+	if err != nil {
+		return err
+	}
+	return sealBlob(rec, dek, enc)
+}
+
+// sealBlob writes rec's blob encrypted with dek next to it and points rec
+// at the copy.
+func sealBlob(rec *FileRecord, dek []byte, enc *BlobEncryption) error {
+	dst := rec.Path + ".enc"
+	seal := func(w io.Writer) (io.WriteCloser, error) { return newSegmentWriter(w, dek) }
+	if err := copyFile(dst, rec.Path, seal, nil); err != nil {
+		return err
+	}
+	rec.Path, rec.Encryption = dst, enc
+	return nil
+}
+
+// openEncrypted opens the blob at path, encrypted as enc, for reading the
+// bytes it was encrypted from. customer is the key of a blob encrypted
+// with a customer-provided key, nil when the request did not send one.
+func openEncrypted(path string, enc *BlobEncryption, customer []byte) (*segmentReader, error) {
+	if enc.Algorithm != BlobCipherAES256GCM {
+		return nil, fmt.Errorf("unsupported blob cipher %q", enc.Algorithm)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var dek []byte
+	if enc.customer() {
+		dek, err = customerDataKey(enc, customer)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), keyTimeout)
+		dek, err = blobKeys.dataKey(ctx, enc)
+		cancel()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := newSegmentReader(f, fi.Size(), dek)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// openBlobSeeker opens a hot, uncompressed blob for random access.
+func openBlobSeeker(rec *FileRecord) (io.ReadSeekCloser, error) {
+	if rec.Encryption != nil {
+		return openEncrypted(rec.Path, rec.Encryption, rec.customerKey)
+	}
+	return os.Open(rec.Path)
+}
+
+func segmentNonce(i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentWriter seals what is written to it segment by segment. A full
+// segment is only sealed once more data arrives, since the final segment,
+// sealed by Close, must carry the last-segment flag.
+type segmentWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	out  []byte
+	i    int64
+}
+
+func newSegmentWriter(w io.Writer, key []byte) (*segmentWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentWriter{w: w, aead: aead, buf: make([]byte, 0, encSegmentSize), out: make([]byte, 0, encSegmentSize+encTagSize)}, nil
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(s.buf) == encSegmentSize {
+			if err := s.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		k := copy(s.buf[len(s.buf):encSegmentSize], p)
+		s.buf, p = s.buf[:len(s.buf)+k], p[k:]
+	}
+	return n, nil
+}
+
+func (s *segmentWriter) seal(last bool) error {
+	s.out = s.aead.Seal(s.out[:0], segmentNonce(s.i, last), s.buf, nil)
+	s.i++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(s.out)
+	return err
+}
+
+func (s *segmentWriter) Close() error {
+	return s.seal(true)
+}
+
+// segmentReader decrypts a segmented blob with random access, keeping the
+// current segment in plaintext.
+type segmentReader struct {
+	f        *os.File
+	aead     cipher.AEAD
+	segments int64
+	size     int64 // of the plaintext
+
+	off   int64
+	seg   int64 // index of plain, or -1
+	plain []byte
+	ct    []byte
+}
+
+func newSegmentReader(f *os.File, stored int64, key []byte) (*segmentReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	segments := (stored + encSegmentSize + encTagSize - 1) / (encSegmentSize + encTagSize)
+	if segments == 0 || stored-segments*encTagSize < 0 {
+		return nil, errors.New("encrypted blob is truncated")
+	}
+	return &segmentReader{
+		f:        f,
+		aead:     aead,
+		segments: segments,
+		size:     stored - segments*encTagSize,
+		seg:      -1,
+		ct:       make([]byte, encSegmentSize+encTagSize),
+	}, nil
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	if s.off >= s.size {
+		return 0, io.EOF
+	}
+	i := s.off / encSegmentSize
+	if i != s.seg {
+		n, err := s.f.ReadAt(s.ct, i*(encSegmentSize+encTagSize))
+		if err != nil && !(errors.Is(err, io.EOF) && i == s.segments-1) {
+			return 0, err
+		}
+		s.plain, err = s.aead.Open(s.plain[:0], segmentNonce(i, i == s.segments-1), s.ct[:n], nil)
+		if err != nil {
+			s.seg = -1
+			return 0, fmt.Errorf("decrypt segment %d: %w", i, err)
+		}
+		s.seg = i
+	}
+	n := copy(p, s.plain[s.off-i*encSegmentSize:])
+	s.off += int64(n)
+	return n, nil
+}
+
+func (s *segmentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("encrypted blob: negative position")
+	}
+	s.off = offset
+	return offset, nil
+}
+
+func (s *segmentReader) Close() error {
+	return s.f.Close()
+}
+
+// RewrapReport is the outcome of re-wrapping data keys with the primary KEK.
+type RewrapReport struct {
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	KEK        string         `json:"kek"`
+	Encrypted  int            `json:"encrypted"`
+	Rewrapped  int            `json:"rewrapped"`
+	Failed     []RewrapFailed `json:"failed"`
+}
+
+type RewrapFailed struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// Rewrap re-wraps the data key of every encrypted file not already under
+// the primary KEK, or of every encrypted file with force. Blob contents are
+// not touched, nor are keys wrapped with a customer-provided key. Once it reports no failures, former KEKs can be retired.
+func Rewrap(ctx context.Context, store MetadataStore, locker Locker, keys *BlobKeys, force bool) (*RewrapReport, error) {
+	report := &RewrapReport{StartedAt: time.Now().UTC(), KEK: keys.primary.ID(), Failed: []RewrapFailed{}}
+	recs, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, listed := range recs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if listed.Encryption == nil || listed.Encryption.customer() {
+			continue
+		}
+		report.Encrypted++
+		// Re-wrap the record as it is now, not as listed.
+		changed := false
+		_, err := updateRecord(ctx, store, locker, listed.ID, func(rec *FileRecord) error {
+			if rec.Encryption == nil {
+				return errNoChange
+			}
+			var err error
+			if changed, err = keys.rewrap(ctx, rec.Encryption, force); err != nil {
+				return err
+			}
+			// The masked copy has a data key of its own.
+			if rec.MaskedEncryption != nil {
+				masked, err := keys.rewrap(ctx, rec.MaskedEncryption, force)
+				if err != nil {
+					return err
+				}
+				changed = changed || masked
+			}
+			if !changed {
+				return errNoChange
+			}
+			return nil
+		})
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("rewrap %s: %v", listed.ID, err)
+			report.Failed = append(report.Failed, RewrapFailed{ID: listed.ID, Error: err.Error()})
+			continue
+		}
+		if changed {
+			report.Rewrapped++
+		}
+	}
+	report.FinishedAt = time.Now().UTC()
+	return report, nil
+}
+
+// RewrapHandler serves POST /v1/admin/encryption/rewrap. With ?force=true
+// keys already under the primary KEK are wrapped again too, e.g. after the
+// KEK's own material was rotated.
+func RewrapHandler(store MetadataStore, keys *BlobKeys, locker Locker, audit *AuditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok, err := locker.TryLock(r.Context(), "rewrap", time.Hour)
+		if err != nil {
+			writeInternalError(w, "Failed to lock key re-wrapping")
+			return
+		}
+		if !ok {
+			writeConflict(w, "A key re-wrap is already running")
+			return
+		}
+		defer release()
+
+		report, err := Rewrap(r.Context(), store, locker, keys, r.URL.Query().Get("force") == "true")
+		if err != nil {
+			log.Printf("rewrap: %v", err)
+			writeInternalError(w, "Key re-wrapping failed")
+			return
+		}
+		audit.Record(AuditEvent{Action: "keys_rewrapped", Actor: "admin", Detail: fmt.Sprintf("%d of %d data keys re-wrapped with %s", report.Rewrapped, report.Encrypted, report.KEK)})
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// parseKEK builds the wrapper for a KEK spec:
+//
+//	awskms:<key ID, ARN or alias>
+//	gcpkms:projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>
+//	age:<path to an age identity file>
+func parseKEK(spec string, gcpToken *Secret) (KeyWrapper, error) {
+	scheme, rest, _ := strings.Cut(spec, ":")
+	if rest == "" {
+		return nil, fmt.Errorf("invalid KEK %q", spec)
+	}
+	switch scheme {
+	case "awskms":
+		return awsKMS{keyID: rest}, nil
+	case "gcpkms":
+		return &gcpKMS{name: rest, token: gcpToken}, nil
+	case "age":
+		return loadAgeIdentity(rest)
+	}
+	return nil, fmt.Errorf("unsupported KEK %q (want awskms:, gcpkms: or age:)", spec)
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKEK writes an age identity derived from seed and returns its KEK
+// spec.
+func testKEK(tb testing.TB, seed byte) string {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "kek.txt")
+	identity := strings.ToUpper(bech32Encode("age-secret-key-", bytes.Repeat([]byte{seed}, 32)))
+	if err := os.WriteFile(path, []byte("# created: test\n"+identity+"\n"), 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	return "age:" + path
+}
+
+// testBlobKeys turns on encryption at rest for the test under a keyring
+// of the given KEK specs, the first primary, or a throwaway age identity
+// when none are given.
+func testBlobKeys(tb testing.TB, specs ...string) *BlobKeys {
+	tb.Helper()
+	if len(specs) == 0 {
+		specs = []string{testKEK(tb, 3)}
+	}
+	keys, err := NewBlobKeys(specs[0], specs[1:], nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	prev := blobKeys
+	blobKeys = keys
+	tb.Cleanup(func() { blobKeys = prev })
+	return keys
+}
+
+func TestAgeIdentity(t *testing.T) {
+	ctx := context.Background()
+	a, err := loadAgeIdentity(strings.TrimPrefix(testKEK(t, 1), "age:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadAgeIdentity(strings.TrimPrefix(testKEK(t, 2), "age:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(a.ID(), "age:age1") || a.ID() == b.ID() {
+		t.Errorf("IDs %q and %q", a.ID(), b.ID())
+	}
+	if hrp, pub, err := bech32Decode(strings.TrimPrefix(a.ID(), "age:")); err != nil || hrp != "age" || !bytes.Equal(pub, a.recipient) {
+		t.Errorf("recipient does not decode: %q %x %v", hrp, pub, err)
+	}
+
+	dek := bytes.Repeat([]byte{9}, 32)
+	wrapped, err := a.Wrap(ctx, dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := a.Wrap(ctx, dek); bytes.Equal(again, wrapped) {
+		t.Error("wrapping twice gave the same ciphertext")
+	}
+	tampered := bytes.Clone(wrapped)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name    string
+		id      *ageIdentity
+		wrapped []byte
+		ok      bool
+	}{
+		{"own key", a, wrapped, true},
+		{"other identity", b, wrapped, false},
+		{"tampered", a, tampered, false},
+		{"too short", a, wrapped[:40], false},
+	}
+	for _, tt := range tests {
+		got, err := tt.id.Unwrap(ctx, tt.wrapped)
+		if (err == nil) != tt.ok || tt.ok && !bytes.Equal(got, dek) {
+			t.Errorf("%s: Unwrap = %x, %v; want ok = %v", tt.name, got, err, tt.ok)
+		}
+	}
+}
+
+func TestParseKEK(t *testing.T) {
+	dir := t.TempDir()
+	noKey := filepath.Join(dir, "empty.txt")
+	badKey := filepath.Join(dir, "bad.txt")
+	_ = os.WriteFile(noKey, []byte("# nothing here\n"), 0o600)
+	_ = os.WriteFile(badKey, []byte("AGE-SECRET-KEY-1QQQQQQQQ\n"), 0o600)
+	tests := []struct {
+		spec, id string
+		ok       bool
+	}{
+		{"awskms:alias/uploads", "awskms:alias/uploads", true},
+		{"gcpkms:projects/p/locations/l/keyRings/r/cryptoKeys/k", "gcpkms:projects/p/locations/l/keyRings/r/cryptoKeys/k", true},
+		{"age:" + noKey, "", false},
+		{"age:" + badKey, "", false},
+		{"age:" + filepath.Join(dir, "missing.txt"), "", false},
+		{"awskms:", "", false},
+		{"vault:transit/uploads", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		w, err := parseKEK(tt.spec, nil)
+		if (err == nil) != tt.ok || tt.ok && w.ID() != tt.id {
+			t.Errorf("parseKEK(%q) = %v, %v; want ID %q, ok = %v", tt.spec, w, err, tt.id, tt.ok)
+		}
+	}
+}
+
+// Encrypted blobs read back, at any offset, as what was written, and
+// reject any segment that was changed, moved or cut off.
+func TestSegmentedBlob(t *testing.T) {
+	key := bytes.Repeat([]byte{5}, 32)
+	plain := make([]byte, 2*encSegmentSize+100)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+	var sealed bytes.Buffer
+	sw, err := newSegmentWriter(&sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stored := sealed.Bytes()
+	seg := encSegmentSize + encTagSize
+
+	open := func(t *testing.T, b []byte, key []byte) (*segmentReader, error) {
+		path := filepath.Join(t.TempDir(), "blob.enc")
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return newSegmentReader(f, int64(len(b)), key)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		r, err := open(t, stored, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("read %d bytes, %v", len(got), err)
+		}
+		if _, err := r.Seek(encSegmentSize+10, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		part := make([]byte, 20)
+		if _, err := io.ReadFull(r, part); err != nil || !bytes.Equal(part, plain[encSegmentSize+10:encSegmentSize+30]) {
+			t.Errorf("read after seek = %x, %v", part, err)
+		}
+	})
+
+	flipped := bytes.Clone(stored)
+	flipped[seg+3] ^= 1
+	swapped := append(append(bytes.Clone(stored[seg:2*seg]), stored[:seg]...), stored[2*seg:]...)
+	tests := []struct {
+		name   string
+		stored []byte
+		key    []byte
+	}{
+		{"changed byte", flipped, key},
+		{"segments swapped", swapped, key},
+		{"last segment cut off", stored[:2*seg], key},
+		{"other key", stored, bytes.Repeat([]byte{6}, 32)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := open(t, tt.stored, tt.key)
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if err == nil {
+				t.Error("read succeeded")
+			}
+		})
+	}
+}
+
+// Rewrap moves every data key, masked copies' included, to the primary
+// KEK, after which the former KEK is no longer needed to read the files.
+func TestRewrap(t *testing.T) {
+	ctx := context.Background()
+	oldKEK, newKEK := testKEK(t, 1), testKEK(t, 2)
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	locker := newLocalLocker()
+	oldID := testBlobKeys(t, oldKEK).primary.ID()
+	in.PII = NewPIIScanner(100)
+	in.Config.PIIMask = true
+	rec := testRecord(t, in)
+	in.Config.PIIMask = false
+	stale := testRecord(t, in)
+	if rec.Encryption == nil || rec.MaskedEncryption == nil {
+		t.Fatalf("upload not encrypted: %+v", rec)
+	}
+	// A key under a KEK that is no longer configured cannot be re-wrapped.
+	if _, err := updateRecord(ctx, db, locker, stale.ID, func(cur *FileRecord) error {
+		cur.Encryption.KEK = "age:age1gone"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testBlobKeys(t, newKEK, oldKEK)
+	newID := keys.primary.ID()
+	report, err := Rewrap(ctx, db, locker, keys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.KEK != newID || report.Encrypted != 2 || report.Rewrapped != 1 || len(report.Failed) != 1 || report.Failed[0].ID != stale.ID {
+		t.Errorf("report %+v", report)
+	}
+	got, err := db.Get(ctx, rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Encryption.KEK != newID || got.MaskedEncryption.KEK != newID {
+		t.Errorf("keys wrapped by %s and %s, want %s", got.Encryption.KEK, got.MaskedEncryption.KEK, newID)
+	}
+
+	testBlobKeys(t, newKEK)
+	for _, r := range []*FileRecord{got, got.masked()} {
+		body, err := openBlob(r, false)
+		if err != nil {
+			t.Fatalf("open %s without the former KEK: %v", r.Path, err)
+		}
+		b, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || !strings.HasPrefix(string(b), "name,email\n") {
+			t.Errorf("read %s: %q, %v", r.Path, b, err)
+		}
+	}
+
+	tests := []struct {
+		force     bool
+		rewrapped int
+	}{
+		{false, 0},
+		{true, 1},
+	}
+	for _, tt := range tests {
+		report, err := Rewrap(ctx, db, locker, blobKeys, tt.force)
+		if err != nil || report.Rewrapped != tt.rewrapped {
+			t.Errorf("Rewrap(force = %v) = %+v, %v; want %d re-wrapped", tt.force, report, err, tt.rewrapped)
+		}
+	}
+	// The key as it was wrapped before needs the former KEK.
+	if rec.Encryption.KEK != oldID {
+		t.Fatalf("upload key wrapped by %s, want %s", rec.Encryption.KEK, oldID)
+	}
+	if _, err := blobKeys.dataKey(ctx, rec.Encryption); err == nil {
+		t.Error("unwrapped a data key without its KEK")
+	}
+}
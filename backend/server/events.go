@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventFileUploaded = "file.uploaded"
+	EventFileDeleted  = "file.deleted"
+	EventFileUpdated  = "file.updated"
+
+	EventFileAvailable   = "file.available"
+	EventFileQuarantined = "file.quarantined"
+)
+
+type Event struct {
+	ID     string      `json:"id"`
+	Type   string      `json:"type"`
+	FileID string      `json:"fileId"`
+	Time   time.Time   `json:"time"`
+	File   *FileRecord `json:"file,omitempty"`
+	// Purged marks a file.deleted event for a purge, after which nothing
+	// but the file's ID may be kept about it.
+	Purged bool `json:"purged,omitempty"`
+}
+
+// Outbox holds events that have been committed alongside metadata changes
+// but not yet acknowledged by the message bus.
+type Outbox interface {
+	Enqueue(ctx context.Context, ev Event) error
+	Pending(ctx context.Context, limit int) ([]Event, error)
+	Ack(ctx context.Context, id string) error
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, ev Event) error
+	Close() error
+}
+
+// NewPublisher builds the bus client named by kind. addr is host:port for
+// nats and redis, and the REST proxy base URL for kafka-rest.
+func NewPublisher(kind, addr, topic string) (Publisher, error) {
+	switch kind {
+	case "nats":
+		return &natsPublisher{addr: addr, subject: topic}, nil
+	case "redis":
+		return &redisStreamPublisher{client: newRedisClient(addr), stream: topic}, nil
+	case "kafka-rest":
+		return &kafkaRESTPublisher{url: strings.TrimSuffix(addr, "/") + "/topics/" + topic, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unsupported event bus %q (want nats, redis or kafka-rest)", kind)
+}
+
+// EventRelay writes events to the outbox and forwards them to the bus in
+// order. A nil *EventRelay is valid and drops everything, which is how
+// event publishing is disabled.
+type EventRelay struct {
+	outbox Outbox
+	pub    Publisher
+	locker Locker
+	wake   chan struct{}
+}
+
+func NewEventRelay(outbox Outbox, pub Publisher, locker Locker) *EventRelay {
+	return &EventRelay{outbox: outbox, pub: pub, locker: locker, wake: make(chan struct{}, 1)}
+}
+
+func (e *EventRelay) Emit(typ string, rec *FileRecord) {
+	if e == nil {
+		return
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		log.Printf("events: generate id: %v", err)
+		return
+	}
+	ev := Event{ID: id, Type: typ, FileID: rec.ID, Time: time.Now().UTC(), File: rec.withoutPlaintext()}
+	if typ == EventFileDeleted {
+		ev.File = nil
+	}
+	e.enqueue(ev)
+}
+
+// EmitPurged records the file.deleted event for a purge of the file id,
+// which carries the ID and the purge marker and nothing else.
+func (e *EventRelay) EmitPurged(id string) {
+	if e == nil {
+		return
+	}
+	evID, err := randomHex(16)
+	if err != nil {
+		log.Printf("events: generate id: %v", err)
+		return
+	}
+	e.enqueue(Event{ID: evID, Type: EventFileDeleted, FileID: id, Time: time.Now().UTC(), Purged: true})
+}
+
+func (e *EventRelay) enqueue(ev Event) {
+	// The change has already happened, so recording it is not tied to the
+	// request that caused it; only the storage deadline applies.
+	if err := e.outbox.Enqueue(context.Background(), ev); err != nil {
+		log.Printf("events: enqueue %s for %s: %v", ev.Type, ev.FileID, err)
+		return
+	}
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run drains the outbox until ctx is cancelled. A failed publish leaves the
+// event in place and the relay backs off before retrying, so ordering is
+// preserved and nothing is dropped across restarts.
+func (e *EventRelay) Run(ctx context.Context) {
+	const maxBackoff = time.Minute
+	backoff := time.Second
+	for {
+		wait := 30 * time.Second
+		var err error
+		runExclusive(ctx, e.locker, "event-relay", func(ctx context.Context) { err = e.drain(ctx) })
+		if err != nil {
+			log.Printf("events: publish: %v", err)
+			wait = backoff
+			backoff = min(backoff*2, maxBackoff)
+		} else {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			_ = e.pub.Close()
+			return
+		case <-e.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (e *EventRelay) drain(ctx context.Context) error {
+	for {
+		evs, err := e.outbox.Pending(ctx, 100)
+		if err != nil {
+			return err
+		}
+		if len(evs) == 0 {
+			return nil
+		}
+		for _, ev := range evs {
+			if err := e.pub.Publish(ctx, ev); err != nil {
+				return err
+			}
+			if err := e.outbox.Ack(ctx, ev.ID); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// natsPublisher speaks the core NATS text protocol. Each publish is followed
+// by a PING so a PONG confirms the server has processed it.
+type natsPublisher struct {
+	mu      sync.Mutex
+	addr    string
+	subject string
+	conn    net.Conn
+	rd      *bufio.Reader
+}
+
+func (p *natsPublisher) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	rd := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := rd.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting %q: %v", line, err)
+	}
+	if _, err := conn.Write([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"file-upload\"}\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+	p.conn, p.rd = conn, rd
+	return nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if err := p.publish(payload); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (p *natsPublisher) publish(payload []byte) error {
+	_ = p.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PUB %s %d\r\n", p.subject, len(payload))
+	buf.Write(payload)
+	buf.WriteString("\r\nPING\r\n")
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for {
+		line, err := p.rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "PING"):
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.TrimSpace(line))
+		}
+	}
+}
+
+func (p *natsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// redisStreamPublisher appends events to a Redis stream with XADD.
+type redisStreamPublisher struct {
+	client *redisClient
+	stream string
+}
+
+func (p *redisStreamPublisher) Publish(ctx context.Context, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.Do(ctx, "XADD", p.stream, "*", "type", ev.Type, "fileId", ev.FileID, "event", string(payload))
+	return err
+}
+
+func (p *redisStreamPublisher) Close() error { return p.client.Close() }
+
+// kafkaRESTPublisher produces to Kafka through a Confluent-compatible REST
+// proxy, keyed by file ID so events for one file stay on one partition.
+type kafkaRESTPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (p *kafkaRESTPublisher) Publish(ctx context.Context, ev Event) error {
+	body, err := json.Marshal(map[string]any{
+		"records": []map[string]any{{"key": ev.FileID, "value": ev}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("kafka-rest: %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) Close() error { return nil }
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type existsRequest struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+type existsResponse struct {
+	Exists bool          `json:"exists"`
+	File   *FileMetadata `json:"file,omitempty"`
+}
+
+// ExistsHandler serves POST /v1/files/exists, which asks whether content
+// is already stored before sending it: {"sha256": "...", "size": N}. It
+// answers 200 either way, with the stored file when there is one; a size,
+// when given, must match as well. It reads only the checksum index.
+func ExistsHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req existsRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+			writeBadRequest(w, "Invalid JSON body")
+			return
+		}
+		sum, ok := parseChecksum(req.SHA256)
+		if !ok {
+			writeBadRequest(w, "Field 'sha256' must be a hex SHA-256 digest")
+			return
+		}
+		if req.Size < 0 {
+			writeBadRequest(w, "Field 'size' must not be negative")
+			return
+		}
+		rec, err := findStored(r.Context(), store, sum)
+		if err != nil {
+			writeInternalError(w, "Failed to check for stored files")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if rec == nil || req.Size > 0 && rec.Bytes != req.Size {
+			writeJSON(w, http.StatusOK, existsResponse{})
+			return
+		}
+		writeJSON(w, http.StatusOK, existsResponse{Exists: true, File: &FileMetadata{UploadResponse: newUploadResponse(rec), UploadedAt: rec.UploadedAt}})
+	}
+}
+
+// uploadChecksum parses X-Upload-Checksum, the SHA-256 a client declares
+// before the body, returning "" when it is absent.
+func uploadChecksum(w http.ResponseWriter, r *http.Request) (string, bool) {
+	v := r.Header.Get("X-Upload-Checksum")
+	if v == "" {
+		return "", true
+	}
+	sum, ok := parseChecksum(v)
+	if !ok {
+		writeBadRequest(w, "Header 'X-Upload-Checksum' must be a hex SHA-256 digest")
+		return "", false
+	}
+	return sum, true
+}
+
+// rejectStored answers 409 with the stored file, before any of the body
+// is read, when content with the declared checksum already exists. The
+// connection is closed rather than drained of a body nobody wants.
+func rejectStored(w http.ResponseWriter, r *http.Request, store MetadataStore, checksum string) bool {
+	rec, err := findStored(r.Context(), store, checksum)
+	if err != nil {
+		writeInternalError(w, "Failed to check for duplicate files")
+		return true
+	}
+	if rec == nil {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	writeUploadError(w, duplicateError(rec))
+	return true
+}
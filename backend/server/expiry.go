@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Expirer purges files whose ExpiresAt has passed. Files under legal hold
+// are kept until the hold is lifted.
+type Expirer struct {
+	store  MetadataStore
+	events *EventRelay
+	locker Locker
+	audit  *AuditLog
+}
+
+func NewExpirer(store MetadataStore, events *EventRelay, locker Locker, audit *AuditLog) *Expirer {
+	return &Expirer{store: store, events: events, locker: locker, audit: audit}
+}
+
+// Run sweeps for expired files every interval until ctx is cancelled.
+func (e *Expirer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		runExclusive(ctx, e.locker, "expiry-sweep", e.sweep)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Expirer) sweep(ctx context.Context) {
+	if maintenance.ReadOnly() {
+		return
+	}
+	recs, err := e.store.List(ctx)
+	if err != nil {
+		log.Printf("expiry: list records: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, rec := range recs {
+		if rec.ExpiresAt == nil || now.Before(*rec.ExpiresAt) || rec.Hold.Active(now) {
+			continue
+		}
+		if _, err := purgeFile(ctx, e.store, rec); err != nil {
+			log.Printf("expiry: purge %s: %v", rec.ID, err)
+			continue
+		}
+		e.audit.Record(AuditEvent{Action: "expired", FileID: rec.ID, Actor: "expiry"})
+		e.events.Emit(EventFileDeleted, rec)
+	}
+}
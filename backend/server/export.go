@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportColumns are the CSV columns of a catalog export, in order.
+var exportColumns = []string{
+	"id", "filename", "key", "folder", "sha256", "bytes", "contentType",
+	"uploadedAt", "state", "storageClass", "rowCount", "tags", "source",
+	"duplicateOf", "expiresAt", "revision",
+}
+
+func exportRow(rec *FileRecord) []string {
+	var expires string
+	if rec.ExpiresAt != nil {
+		expires = rec.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		rec.ID, rec.Filename, rec.Key, rec.Folder, rec.ChecksumSHA,
+		strconv.FormatInt(rec.Bytes, 10), rec.ContentType,
+		rec.UploadedAt.UTC().Format(time.RFC3339Nano), rec.state(), rec.storageClass(),
+		strconv.FormatInt(rec.RowCount, 10), strings.Join(rec.Tags, ";"), rec.Source,
+		rec.DuplicateOf, expires, strconv.FormatInt(rec.Revision, 10),
+	}
+}
+
+// ExportHandler serves GET /v1/admin/export, the whole metadata catalog for
+// reconciling against source systems offline. ?format=csv writes one row per
+// file with the columns in exportColumns; the default, ndjson, writes each
+// stored record as a line of JSON. It takes the same filters as the file
+// list, oldest file first.
+func ExportHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		format := q.Get("format")
+		if format == "" {
+			format = "ndjson"
+		}
+		if format != "csv" && format != "ndjson" {
+			writeBadRequest(w, "Parameter 'format' must be csv or ndjson")
+			return
+		}
+		filter, msg := parseFileFilter(q)
+		if msg != "" {
+			writeBadRequest(w, msg)
+			return
+		}
+		recs, err := findFiles(r.Context(), store, &filter)
+		if err != nil {
+			writeInternalError(w, "Failed to read the catalog")
+			return
+		}
+
+		name := "catalog-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Header().Set("Cache-Control", "no-store")
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			cw := csv.NewWriter(w)
+			cw.Write(exportColumns)
+			for _, rec := range recs {
+				cw.Write(exportRow(rec.withoutPlaintext()))
+			}
+			cw.Flush()
+			err = cw.Error()
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			enc := json.NewEncoder(w)
+			for _, rec := range recs {
+				if err = enc.Encode(rec.withoutPlaintext()); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("export: %v", err)
+			return
+		}
+		metrics.Counter("catalog_exported_files_total", "Files written by catalog exports.", "format", format).Add(float64(len(recs)))
+	}
+}
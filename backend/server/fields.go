@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fieldSelection is a parsed ?fields=, the JSON fields of each object to
+// send, in the order asked for. A nil selection sends every field.
+type fieldSelection []string
+
+// fileMetadataFields are the fields a file's metadata can be narrowed to.
+var fileMetadataFields = jsonFieldNames(reflect.TypeOf(FileMetadata{}))
+
+// jsonFieldNames lists the JSON names of t's fields, including those of
+// embedded structs.
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" {
+			names = append(names, jsonFieldNames(f.Type)...)
+			continue
+		}
+		if name != "" && name != "-" && f.IsExported() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseFields reads ?fields=id,sha256, checking each name against known.
+func parseFields(q url.Values, known []string) (fieldSelection, string) {
+	v := q.Get("fields")
+	if v == "" {
+		return nil, ""
+	}
+	var fs fieldSelection
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || slices.Contains(fs, name) {
+			continue
+		}
+		if !slices.Contains(known, name) {
+			return nil, "Unknown field '" + name + "' in parameter 'fields'"
+		}
+		fs = append(fs, name)
+	}
+	return fs, ""
+}
+
+// pick encodes v keeping only the selected fields. Fields v omits when
+// empty stay omitted.
+func (fs fieldSelection) pick(v any) (json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range fs {
+		raw, ok := all[name]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Quote(name))
+		buf.WriteByte(':')
+		buf.Write(raw)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// apply returns v narrowed to the selection, or v itself when nothing was
+// selected.
+func (fs fieldSelection) apply(v any) (any, error) {
+	if fs == nil {
+		return v, nil
+	}
+	return fs.pick(v)
+}
+
+// applyEach narrows every element of items.
+func applyEach[T any](fs fieldSelection, items []T) (any, error) {
+	if fs == nil {
+		return items, nil
+	}
+	out := make([]json.RawMessage, len(items))
+	for i, item := range items {
+		var err error
+		if out[i], err = fs.pick(item); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Envelopes a paginated response can be sent in, chosen with ?envelope=.
+// The legacy envelope names the items after the resource and is the
+// default; "data" wraps every paginated response the same way, with the
+// paging state under meta; "none" sends the bare array and moves the
+// paging state to headers.
+const (
+	envelopeLegacy = "legacy"
+	envelopeData   = "data"
+	envelopeNone   = "none"
+)
+
+func parseEnvelope(q url.Values) (string, string) {
+	switch v := q.Get("envelope"); v {
+	case "":
+		return envelopeLegacy, ""
+	case envelopeLegacy, envelopeData, envelopeNone:
+		return v, ""
+	default:
+		return "", "Parameter 'envelope' must be legacy, data or none"
+	}
+}
+
+// PageMeta is the paging state of a "data" envelope. NextCursor is set
+// when more items follow; pass it back as ?cursor= for the next page.
+type PageMeta struct {
+	Count      int    `json:"count"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type dataEnvelope struct {
+	Data any      `json:"data"`
+	Meta PageMeta `json:"meta"`
+}
+
+// writePage sends one page of items in the requested envelope. key names
+// the items in the legacy envelope. Without an envelope, the next page is
+// announced with X-Next-Cursor and a Link header.
+func writePage(w http.ResponseWriter, r *http.Request, envelope, key string, items any, meta PageMeta) {
+	switch envelope {
+	case envelopeData:
+		writeJSON(w, http.StatusOK, dataEnvelope{Data: items, Meta: meta})
+	case envelopeNone:
+		if meta.NextCursor != "" {
+			q := r.URL.Query()
+			q.Set("cursor", meta.NextCursor)
+			next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+			w.Header().Set("X-Next-Cursor", meta.NextCursor)
+			w.Header().Set("Link", "<"+next.String()+`>; rel="next"`)
+		}
+		writeJSON(w, http.StatusOK, items)
+	default:
+		body := map[string]any{key: items}
+		if meta.NextCursor != "" {
+			body["nextCursor"] = meta.NextCursor
+		}
+		writeJSON(w, http.StatusOK, body)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxFilenameBytes matches the common filesystem limit so a stored name can
+// always be written back out by clients.
+const maxFilenameBytes = 255
+
+// sanitizeFilename turns a client-supplied name into the display name kept
+// in metadata: directory components are dropped (for both / and \
+// separators), the result is NFC-normalized and trimmed, and names longer
+// than maxFilenameBytes are shortened while keeping their extension. The
+// name is never used to build a server path. Like checkCSV, a second result
+// with text is the client-facing reason the name was rejected.
+func sanitizeFilename(name string) (string, Message) {
+	if !utf8.ValidString(name) {
+		return "", Message{Text: "Filename must be valid UTF-8"}
+	}
+	name = strings.ReplaceAll(name, `\`, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(norm.NFC.String(name))
+	for _, r := range name {
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return "", Message{Text: "Filename must not contain control characters"}
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		return "", newMessage("no_filename")
+	}
+
+	if len(name) > maxFilenameBytes {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := name[:maxFilenameBytes-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+	return name, Message{}
+}
+
+// contentDisposition formats a Content-Disposition header per RFC 6266. A
+// name that is not plain ASCII is sent twice: as an RFC 5987 filename*
+// parameter, and as an ASCII filename for clients that do not read it,
+// with accents stripped and other characters replaced by '_'.
+func contentDisposition(disposition, name string) string {
+	v := mime.FormatMediaType(disposition, map[string]string{"filename": name})
+	if v == "" {
+		return disposition
+	}
+	fallback := asciiFilename(name)
+	if fallback == name {
+		return v
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": fallback}) + strings.TrimPrefix(v, disposition)
+}
+
+func asciiFilename(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r < utf8.RuneSelf && !unicode.IsControl(r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// partFilename is the filename of a multipart part, or "" when it has
+// none. Unlike Part.FileName it reads headers that mime.ParseMediaType
+// rejects, such as unquoted names with spaces or raw UTF-8, prefers an
+// RFC 2231 filename* in UTF-8 or ISO-8859-1 (split into continuations or
+// not) over the plain one, decodes RFC 2047 encoded words and %22 for a
+// quote as some clients send them, reads a plain name that is not UTF-8 as
+// ISO-8859-1, and keeps backslashes rather than taking them as escapes, so
+// a Windows path still ends in its filename. Directories are left for
+// sanitizeFilename to drop.
+func partFilename(p *multipart.Part) string {
+	return dispositionParams(p.Header.Get("Content-Disposition"))["filename"]
+}
+
+// partFormName is the form field name of a part, read as partFilename
+// reads the filename.
+func partFormName(p *multipart.Part) string {
+	return dispositionParams(p.Header.Get("Content-Disposition"))["name"]
+}
+
+// dispositionParams parses the parameters of a Content-Disposition value,
+// with RFC 2231 extended and continued parameters merged into their plain
+// names.
+func dispositionParams(v string) map[string]string {
+	plain := map[string]string{}
+	type section struct {
+		value    string
+		extended bool
+	}
+	sections := map[string]map[int]section{}
+	if i := strings.IndexByte(v, ';'); i >= 0 {
+		v = v[i+1:]
+	} else {
+		v = ""
+	}
+	for v != "" {
+		var key, value string
+		var quoted bool
+		key, value, quoted, v = nextDispositionParam(v)
+		if key == "" {
+			continue
+		}
+		base, rest, cont := strings.Cut(key, "*")
+		switch {
+		case !cont:
+			if !quoted {
+				value = strings.TrimSpace(value)
+			}
+			if _, ok := plain[base]; !ok {
+				plain[base] = decodePlainParam(value)
+			}
+		case rest == "":
+			sections[base] = map[int]section{0: {value, true}}
+		default:
+			n, err := strconv.Atoi(strings.TrimSuffix(rest, "*"))
+			if err != nil || n < 0 || n > 100 {
+				continue
+			}
+			if sections[base] == nil {
+				sections[base] = map[int]section{}
+			}
+			sections[base][n] = section{value, strings.HasSuffix(rest, "*")}
+		}
+	}
+
+	for base, parts := range sections {
+		var raw strings.Builder
+		charset := ""
+		for n := 0; ; n++ {
+			s, ok := parts[n]
+			if !ok {
+				break
+			}
+			value := s.value
+			if n == 0 && s.extended {
+				cs, tail, ok := strings.Cut(value, "'")
+				_, data, ok2 := strings.Cut(tail, "'")
+				if !ok || !ok2 {
+					break
+				}
+				charset, value = strings.ToLower(cs), data
+			}
+			if s.extended {
+				dec, err := url.PathUnescape(value)
+				if err != nil {
+					break
+				}
+				value = dec
+			}
+			raw.WriteString(value)
+		}
+		if raw.Len() == 0 {
+			continue
+		}
+		switch charset {
+		case "", "utf-8", "us-ascii":
+			if utf8.ValidString(raw.String()) {
+				plain[base] = raw.String()
+			}
+		case "iso-8859-1", "latin1":
+			plain[base] = latin1(raw.String())
+		}
+	}
+	return plain
+}
+
+// nextDispositionParam reads one key=value pair off the front of v. A
+// quoted value ends at the next unescaped quote, a bare one at ';'.
+func nextDispositionParam(v string) (key, value string, quoted bool, rest string) {
+	v = strings.TrimLeft(v, " \t;")
+	eq := strings.IndexAny(v, "=;")
+	if eq < 0 || v[eq] == ';' {
+		if eq < 0 {
+			return "", "", false, ""
+		}
+		return "", "", false, v[eq+1:]
+	}
+	key = strings.ToLower(strings.TrimSpace(v[:eq]))
+	v = strings.TrimLeft(v[eq+1:], " \t")
+	if !strings.HasPrefix(v, `"`) {
+		value, rest, _ = strings.Cut(v, ";")
+		return key, value, false, rest
+	}
+	var b strings.Builder
+	for i := 1; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '"':
+			rest = v[i+1:]
+			if j := strings.IndexByte(rest, ';'); j >= 0 {
+				rest = rest[j+1:]
+			} else {
+				rest = ""
+			}
+			return key, b.String(), true, rest
+		case c == '\\' && i+1 < len(v) && (v[i+1] == '"' || v[i+1] == '\\'):
+			i++
+			b.WriteByte(v[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return key, b.String(), true, ""
+}
+
+// decodePlainParam undoes the encodings clients apply to a plain
+// parameter in place of RFC 2231.
+func decodePlainParam(s string) string {
+	if strings.Contains(s, "=?") {
+		if dec, err := new(mime.WordDecoder).DecodeHeader(s); err == nil {
+			s = dec
+		}
+	}
+	s = strings.ReplaceAll(s, "%22", `"`)
+	if !utf8.ValidString(s) {
+		s = latin1(s)
+	}
+	return s
+}
+
+func latin1(s string) string {
+	r := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		r[i] = rune(s[i])
+	}
+	return string(r)
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileMetadata is the client view of a stored file's metadata.
+type FileMetadata struct {
+	UploadResponse
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+// updateFileRequest edits a file's metadata; absent fields are left alone.
+// An empty expiresAt clears the expiry.
+type updateFileRequest struct {
+	Tags        *[]string `json:"tags"`
+	Description *string   `json:"description"`
+	Folder      *string   `json:"folder"`
+	ExpiresAt   *string   `json:"expiresAt"`
+}
+
+// revisionETag is the entity tag of a record's editable metadata.
+func revisionETag(rec *FileRecord) string {
+	return strconv.Quote(strconv.FormatInt(rec.Revision, 10))
+}
+
+// ifMatch reports whether the request's If-Match header, when present,
+// names the record's current revision, writing a 412 when it does not.
+func ifMatch(w http.ResponseWriter, r *http.Request, rec *FileRecord) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	etag := revisionETag(rec)
+	for _, v := range strings.Split(header, ",") {
+		if v = strings.TrimSpace(v); v == "*" || v == etag {
+			return true
+		}
+	}
+	w.Header().Set("ETag", etag)
+	writePreconditionFailed(w, "File '"+rec.ID+"' is at revision "+strconv.FormatInt(rec.Revision, 10)+"; reload it and retry")
+	return false
+}
+
+// errRecordBusy is returned when another change holds a record's lock for
+// longer than lockRecord waits.
+var errRecordBusy = errors.New("file record is being changed by another request")
+
+// errNoChange, returned by an edit, leaves the record as it was without
+// failing the update.
+var errNoChange = errors.New("no change to file record")
+
+// recordLockWait is how long a change waits for another to finish with the
+// same record.
+const recordLockWait = 5 * time.Second
+
+// lockRecord takes the "file:"+id lock held by every change to a stored
+// record, waiting up to recordLockWait for the current holder.
+func lockRecord(ctx context.Context, locker Locker, id string) (func(), error) {
+	deadline := time.Now().Add(recordLockWait)
+	for {
+		release, ok, err := locker.TryLock(ctx, "file:"+id, time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return release, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errRecordBusy
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(25 * time.Millisecond):
+		}
+	}
+}
+
+// updateRecord is how a stored record is changed. Holding the record's
+// lock, it reads the record as stored, applies edit, bumps the revision and
+// writes it back, so every edit is made to the latest revision and none is
+// lost to a concurrent one. An error from edit leaves the record unchanged
+// and is returned, except errNoChange, which returns the record.
+func updateRecord(ctx context.Context, store MetadataStore, locker Locker, id string, edit func(*FileRecord) error) (*FileRecord, error) {
+	release, err := lockRecord(ctx, locker, id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return updateLocked(ctx, store, id, edit)
+}
+
+// updateLocked is updateRecord for a caller already holding the lock.
+func updateLocked(ctx context.Context, store MetadataStore, id string, edit func(*FileRecord) error) (*FileRecord, error) {
+	rec, err := store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	revision := rec.Revision
+	if err := edit(rec); errors.Is(err, errNoChange) {
+		return rec, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rec.ID, rec.Revision = id, revision+1
+	if err := store.Put(ctx, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// writeUpdateError writes the response for a failed updateRecord.
+func writeUpdateError(w http.ResponseWriter, id string, err error) {
+	var uerr *UploadError
+	switch {
+	case errors.As(err, &uerr):
+		writeUploadError(w, uerr)
+	case errors.Is(err, ErrNotFound):
+		writeMessage(w, http.StatusNotFound, "not_found", newMessage("file_not_found", "id", id))
+	case errors.Is(err, errRecordBusy):
+		writeConflict(w, "Another request is updating file '"+id+"'")
+	case errors.Is(err, errReadOnly):
+		writeReadOnly(w)
+	default:
+		log.Printf("update %s: %v", id, err)
+		writeInternalError(w, "Failed to update file metadata")
+	}
+}
+
+// FileHandler serves a file's metadata: GET /v1/files/{id}/metadata, which
+// like the file list takes ?fields= to send only some fields, and
+// PATCH (edit tags, description, folder and expiry) and DELETE on
+// /v1/files/{id}. Every edit bumps the record's revision, which is sent as
+// the ETag; with If-Match the change only applies to that revision, so
+// concurrent editors get a 412 instead of overwriting each other.
+func FileHandler(store MetadataStore, locker Locker, audit *AuditLog, events *EventRelay) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			rec, ok := loadRecord(w, r, store, id)
+			if !ok {
+				return
+			}
+			// Only with its key is what the file's plaintext shows served.
+			if r.Header.Get(customerKeyHeader) != "" && !requireCustomerKey(w, r, rec) {
+				return
+			}
+			fields, msg := parseFields(r.URL.Query(), fileMetadataFields)
+			if msg != "" {
+				writeBadRequest(w, msg)
+				return
+			}
+			body, err := fields.apply(FileMetadata{UploadResponse: newUploadResponse(rec), UploadedAt: rec.UploadedAt})
+			if err != nil {
+				writeInternalError(w, "Failed to encode file metadata")
+				return
+			}
+			w.Header().Set("ETag", revisionETag(rec))
+			w.Header().Set("Cache-Control", "no-cache")
+			writeJSON(w, http.StatusOK, body)
+			return
+		}
+		if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+			writeMethodNotAllowed(w, "Only GET, PATCH and DELETE methods are allowed for file metadata")
+			return
+		}
+
+		var req updateFileRequest
+		if r.Method == http.MethodPatch {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+		}
+		if r.Method == http.MethodPatch {
+			rec, err := updateRecord(r.Context(), store, locker, id, func(rec *FileRecord) error {
+				if !ifMatch(w, r, rec) {
+					return errPreconditionWritten
+				}
+				if msg := req.apply(rec); msg != "" {
+					return newUploadError(http.StatusBadRequest, "bad_request", msg)
+				}
+				return nil
+			})
+			if errors.Is(err, errPreconditionWritten) {
+				return
+			}
+			if err != nil {
+				writeUpdateError(w, id, err)
+				return
+			}
+			events.Emit(EventFileUpdated, rec)
+			w.Header().Set("ETag", revisionETag(rec))
+			writeJSON(w, http.StatusOK, FileMetadata{UploadResponse: newUploadResponse(rec), UploadedAt: rec.UploadedAt})
+			return
+		}
+
+		release, err := lockRecord(r.Context(), locker, id)
+		if err != nil {
+			writeUpdateError(w, id, err)
+			return
+		}
+		defer release()
+		rec, ok := loadRecord(w, r, store, id)
+		if !ok || !ifMatch(w, r, rec) {
+			return
+		}
+		if rec.Hold.Active(time.Now()) {
+			writeConflict(w, "File '"+rec.ID+"' is under legal hold")
+			return
+		}
+		if _, err := purgeFile(r.Context(), store, rec); err != nil {
+			log.Printf("delete %s: %v", rec.ID, err)
+			writeInternalError(w, "Failed to delete file")
+			return
+		}
+		audit.Record(AuditEvent{Action: "deleted", FileID: rec.ID, Actor: "api"})
+		events.Emit(EventFileDeleted, rec)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// errPreconditionWritten stops an update whose 412 ifMatch already wrote.
+var errPreconditionWritten = errors.New("precondition failed")
+
+// apply validates the edits against the same limits as upload form fields
+// and applies them to rec, returning a client-facing message on failure.
+func (req *updateFileRequest) apply(rec *FileRecord) string {
+	if req.Tags != nil {
+		var tags []string
+		size := 0
+		for _, tag := range *req.Tags {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+				size += len(tag) + 1
+			}
+		}
+		if int64(size) > uploadFieldLimits["tags"] {
+			return "Field 'tags' exceeds " + strconv.FormatInt(uploadFieldLimits["tags"], 10) + " bytes"
+		}
+		rec.Tags = tags
+	}
+	if req.Description != nil {
+		if int64(len(*req.Description)) > uploadFieldLimits["description"] {
+			return "Field 'description' exceeds " + strconv.FormatInt(uploadFieldLimits["description"], 10) + " bytes"
+		}
+		rec.Description = strings.TrimSpace(*req.Description)
+	}
+	if req.Folder != nil {
+		folder, ok := cleanFolder(*req.Folder)
+		if !ok {
+			return "Invalid folder '" + *req.Folder + "'"
+		}
+		rec.Folder = folder
+	}
+	if req.ExpiresAt != nil {
+		if *req.ExpiresAt == "" {
+			rec.ExpiresAt = nil
+		} else {
+			t, err := time.Parse(time.RFC3339, *req.ExpiresAt)
+			if err != nil {
+				return "Field 'expiresAt' must be an RFC 3339 timestamp"
+			}
+			if !t.After(time.Now()) {
+				return "Field 'expiresAt' must be in the future"
+			}
+			t = t.UTC()
+			rec.ExpiresAt = &t
+		}
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+// testRecord stores a small CSV through in and returns its record.
+func testRecord(tb testing.TB, in *Ingest) *FileRecord {
+	tb.Helper()
+	meta := UploadMeta{MaxBytes: config.DefaultMaxUploadBytes}
+	resp, uerr := in.Receive(context.Background(), strings.NewReader("name,email\nbob,bob@example.com\n"), "people.csv", meta)
+	if uerr != nil {
+		tb.Fatal(uerr)
+	}
+	rec, err := in.Store.Get(context.Background(), resp.ID)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return rec
+}
+
+// Concurrent edits each see the one before, so none is lost.
+func TestUpdateRecordConcurrent(t *testing.T) {
+	in := testIngest(t)
+	rec := testRecord(t, in)
+	locker := newLocalLocker()
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := updateRecord(context.Background(), in.Store, locker, rec.ID, func(r *FileRecord) error {
+				r.Tags = append(r.Tags, strconv.Itoa(i))
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := in.Store.Get(context.Background(), rec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Tags) != n || got.Revision != rec.Revision+n {
+		t.Errorf("tags %v at revision %d, want %d tags at revision %d", got.Tags, got.Revision, n, rec.Revision+n)
+	}
+}
+
+func TestUpdateRecordNoChange(t *testing.T) {
+	in := testIngest(t)
+	rec := testRecord(t, in)
+	got, err := updateRecord(context.Background(), in.Store, newLocalLocker(), rec.ID, func(*FileRecord) error { return errNoChange })
+	if err != nil || got.Revision != rec.Revision {
+		t.Errorf("revision %d, err %v; want %d unchanged", got.Revision, err, rec.Revision)
+	}
+}
+
+func TestFilePatchIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch func(rec *FileRecord) string
+		status  int
+	}{
+		{"no precondition", func(*FileRecord) string { return "" }, http.StatusOK},
+		{"current revision", revisionETag, http.StatusOK},
+		{"any revision", func(*FileRecord) string { return "*" }, http.StatusOK},
+		{"stale revision", func(rec *FileRecord) string { return strconv.Quote(strconv.FormatInt(rec.Revision-1, 10)) }, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := testIngest(t)
+			rec := testRecord(t, in)
+			// Move the record past revision 1 so a stale tag still parses.
+			rec, err := updateRecord(context.Background(), in.Store, newLocalLocker(), rec.ID, func(*FileRecord) error { return nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux := http.NewServeMux()
+			mux.HandleFunc("PATCH /v1/files/{id}", FileHandler(in.Store, newLocalLocker(), &AuditLog{}, nil))
+
+			req := httptest.NewRequest(http.MethodPatch, "/v1/files/"+rec.ID, strings.NewReader(`{"description":"edited"}`))
+			if v := tt.ifMatch(rec); v != "" {
+				req.Header.Set("If-Match", v)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			got, err := in.Store.Get(context.Background(), rec.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			edited := got.Description == "edited"
+			if edited != (tt.status == http.StatusOK) {
+				t.Errorf("description %q after status %d", got.Description, w.Code)
+			}
+			if w.Header().Get("ETag") != revisionETag(got) {
+				t.Errorf("ETag %s, stored revision %d", w.Header().Get("ETag"), got.Revision)
+			}
+		})
+	}
+}
+
+func TestUpdateFileRequestApply(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tags := func(t ...string) *[]string { return &t }
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name  string
+		req   updateFileRequest
+		msg   string
+		check func(*FileRecord) bool
+	}{
+		{"tags trimmed", updateFileRequest{Tags: tags(" a ", "", "b")}, "", func(r *FileRecord) bool { return strings.Join(r.Tags, ",") == "a,b" }},
+		{"tags too long", updateFileRequest{Tags: tags(strings.Repeat("x", 1<<10))}, "Field 'tags' exceeds 1024 bytes", nil},
+		{"description", updateFileRequest{Description: str("  monthly export ")}, "", func(r *FileRecord) bool { return r.Description == "monthly export" }},
+		{"description too long", updateFileRequest{Description: str(strings.Repeat("x", 4<<10+1))}, "Field 'description' exceeds 4096 bytes", nil},
+		{"folder cleaned", updateFileRequest{Folder: str(`reports\2024/./q1/`)}, "", func(r *FileRecord) bool { return r.Folder == "reports/2024/q1" }},
+		{"folder escapes", updateFileRequest{Folder: str("reports/../../etc")}, "Invalid folder 'reports/../../etc'", nil},
+		{"expiry set", updateFileRequest{ExpiresAt: str(future)}, "", func(r *FileRecord) bool { return r.ExpiresAt != nil }},
+		{"expiry cleared", updateFileRequest{ExpiresAt: str("")}, "", func(r *FileRecord) bool { return r.ExpiresAt == nil }},
+		{"expiry malformed", updateFileRequest{ExpiresAt: str("tomorrow")}, "Field 'expiresAt' must be an RFC 3339 timestamp", nil},
+		{"expiry past", updateFileRequest{ExpiresAt: str("2001-01-01T00:00:00Z")}, "Field 'expiresAt' must be in the future", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			past := time.Now().Add(-time.Hour)
+			rec := &FileRecord{Tags: []string{"old"}, Folder: "old", ExpiresAt: &past}
+			if msg := tt.req.apply(rec); msg != tt.msg {
+				t.Fatalf("apply = %q, want %q", msg, tt.msg)
+			}
+			if tt.check != nil && !tt.check(rec) {
+				t.Errorf("record after apply: %+v", rec)
+			}
+		})
+	}
+}
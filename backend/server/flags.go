@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Feature flags gate subsystems that ship dark and are rolled out
+// gradually. Each gates a subsystem that must also be configured: the
+// encryption flag does nothing without a KEK, nor async scanning without a
+// scanner.
+const (
+	FlagDedup         = "dedup"
+	FlagEncryption    = "encryption"
+	FlagAsyncScanning = "async_scanning"
+)
+
+var featureFlags = []string{FlagDedup, FlagEncryption, FlagAsyncScanning}
+
+var ErrFlagNotFound = errors.New("feature flag not found")
+
+type FlagStore interface {
+	ListFlags(ctx context.Context) ([]*FeatureFlag, error)
+	PutFlag(ctx context.Context, f *FeatureFlag) error
+	DeleteFlag(ctx context.Context, name string) error
+}
+
+// FeatureFlag decides per upload whether a subsystem is used. Tenants in
+// ExcludeTenants never get it and those in Tenants always do; anyone else
+// gets it when Enabled, or else when their tenant hashes into the first
+// Percent of 100 buckets. A tenant's bucket is fixed, so raising Percent
+// only ever adds tenants. Uploads without a tenant are bucketed by file,
+// so the percentage then applies to uploads instead.
+type FeatureFlag struct {
+	Name           string     `json:"name"`
+	Enabled        bool       `json:"enabled"`
+	Percent        int        `json:"percent,omitempty"`
+	Tenants        []string   `json:"tenants,omitempty"`
+	ExcludeTenants []string   `json:"excludeTenants,omitempty"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty"`
+}
+
+func (f *FeatureFlag) validate() error {
+	if !slices.Contains(featureFlags, f.Name) {
+		return errors.New("Unknown feature flag '" + f.Name + "'")
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		return errors.New("Field 'percent' must be between 0 and 100")
+	}
+	return nil
+}
+
+func (f *FeatureFlag) on(tenant, unit string) bool {
+	if tenant != "" {
+		if slices.Contains(f.ExcludeTenants, tenant) {
+			return false
+		}
+		if slices.Contains(f.Tenants, tenant) {
+			return true
+		}
+		unit = tenant
+	}
+	if f.Enabled {
+		return true
+	}
+	return f.Percent > 0 && int(crc32.ChecksumIEEE([]byte(f.Name+"/"+unit))%100) < f.Percent
+}
+
+// FeatureFlags resolves flags from the flags file, overridden per flag by
+// the admin API. A flag set in neither is on, so configuring a subsystem
+// keeps enabling it for everyone as before flags existed. As with upload
+// policies, Run picks up overrides made through other instances.
+type FeatureFlags struct {
+	store FlagStore
+	audit *AuditLog
+	base  map[string]*FeatureFlag
+
+	mu        sync.RWMutex
+	overrides map[string]*FeatureFlag
+}
+
+// LoadFeatureFlags reads the flags file, a JSON object from flag name to
+// flag, e.g. {"encryption": {"percent": 10, "tenants": ["acme"]}}.
+func LoadFeatureFlags(path string, store FlagStore, audit *AuditLog) (*FeatureFlags, error) {
+	f := &FeatureFlags{store: store, audit: audit, base: map[string]*FeatureFlag{}}
+	if path == "" {
+		return f, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &f.base); err != nil {
+		return nil, err
+	}
+	for name, flag := range f.base {
+		flag.Name = name
+		if err := flag.validate(); err != nil {
+			return nil, errors.New(path + ": " + err.Error())
+		}
+	}
+	return f, nil
+}
+
+// Reload reads the stored overrides.
+func (f *FeatureFlags) Reload(ctx context.Context) error {
+	stored, err := f.store.ListFlags(ctx)
+	if err != nil {
+		return err
+	}
+	overrides := make(map[string]*FeatureFlag, len(stored))
+	for _, flag := range stored {
+		if err := flag.validate(); err != nil {
+			log.Printf("flags: %s: %v", flag.Name, err)
+			continue
+		}
+		overrides[flag.Name] = flag
+	}
+	f.mu.Lock()
+	f.overrides = overrides
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *FeatureFlags) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := f.Reload(ctx); err != nil {
+				log.Printf("flags: reload: %v", err)
+			}
+		}
+	}
+}
+
+// lookup returns the flag in effect and where it comes from: "override",
+// "config" or "default".
+func (f *FeatureFlags) lookup(name string) (*FeatureFlag, string) {
+	f.mu.RLock()
+	flag := f.overrides[name]
+	f.mu.RUnlock()
+	if flag != nil {
+		return flag, "override"
+	}
+	if flag := f.base[name]; flag != nil {
+		return flag, "config"
+	}
+	return &FeatureFlag{Name: name, Enabled: true}, "default"
+}
+
+// Enabled reports whether the named flag is on for the tenant of the
+// request in ctx, bucketing by unit when there is none. Nil flags are all
+// on.
+func (f *FeatureFlags) Enabled(ctx context.Context, name, unit string) bool {
+	if f == nil {
+		return true
+	}
+	u, _ := ctx.Value(uploaderKey{}).(Uploader)
+	flag, _ := f.lookup(name)
+	on := flag.on(u.Tenant, unit)
+	metrics.Counter("feature_flag_evaluations_total", "Feature flag evaluations by result.", "flag", name, "enabled", strconv.FormatBool(on)).Inc()
+	return on
+}
+
+type flagStatus struct {
+	*FeatureFlag
+	Source string `json:"source"`
+}
+
+// ListHandler serves GET /v1/admin/flags: every flag as in effect, with
+// its source.
+func (f *FeatureFlags) ListHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out := make([]flagStatus, 0, len(featureFlags))
+		for _, name := range featureFlags {
+			flag, source := f.lookup(name)
+			out = append(out, flagStatus{flag, source})
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"flags": out})
+	}
+}
+
+// FlagHandler serves PUT (override) and DELETE (revert to the flags file)
+// on /v1/admin/flags/{name}. An override replaces the configured flag
+// whole.
+func (f *FeatureFlags) FlagHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !slices.Contains(featureFlags, name) {
+			writeNotFound(w, "Unknown feature flag '"+name+"'")
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			var flag FeatureFlag
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&flag); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			if flag.Name != "" && flag.Name != name {
+				writeBadRequest(w, "Field 'name' does not match the URL")
+				return
+			}
+			flag.Name = name
+			if err := flag.validate(); err != nil {
+				writeBadRequest(w, err.Error())
+				return
+			}
+			now := time.Now().UTC()
+			flag.UpdatedAt = &now
+			if err := f.store.PutFlag(r.Context(), &flag); err != nil {
+				writeInternalError(w, "Failed to save feature flag")
+				return
+			}
+			f.audit.Record(AuditEvent{Action: "flag_set", Actor: "admin", Detail: name})
+			f.reloadAfterChange(r.Context())
+			writeJSON(w, http.StatusOK, flagStatus{&flag, "override"})
+
+		case http.MethodDelete:
+			err := f.store.DeleteFlag(r.Context(), name)
+			if errors.Is(err, ErrFlagNotFound) {
+				writeNotFound(w, "Feature flag '"+name+"' has no override")
+				return
+			}
+			if err != nil {
+				writeInternalError(w, "Failed to delete feature flag override")
+				return
+			}
+			f.audit.Record(AuditEvent{Action: "flag_reset", Actor: "admin", Detail: name})
+			f.reloadAfterChange(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeMethodNotAllowed(w, "Only PUT and DELETE methods are allowed for feature flags")
+		}
+	}
+}
+
+func (f *FeatureFlags) reloadAfterChange(ctx context.Context) {
+	if err := f.Reload(context.WithoutCancel(ctx)); err != nil {
+		log.Printf("flags: reload: %v", err)
+	}
+}
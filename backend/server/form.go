@@ -0,0 +1,213 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadFieldLimits bounds each non-file field an upload form may carry.
+// Other fields are skipped.
+var uploadFieldLimits = map[string]int64{
+	"description": 4 << 10,
+	"tags":        1 << 10,
+	"expiresAt":   64,
+	"schemaId":    128,
+	"checksum":    128,
+	"size":        32,
+	"rows":        32,
+}
+
+// uploadFormMaxFields bounds how many non-file parts one form may have.
+const uploadFormMaxFields = 64
+
+// uploadForm collects the non-file fields of a single-file upload, which may
+// come before or after the file part.
+type uploadForm struct {
+	Description string
+	Tags        []string
+	ExpiresAt   *time.Time
+	SchemaID    string
+	Checksum    string
+	Size        int64
+	Rows        *int64
+
+	schemas    *SchemaCheck
+	fileFields []string
+	fields     int
+	seen       map[string]bool
+}
+
+// newUploadForm returns a form whose file arrives in one of fileFields; "*"
+// takes the first part with a filename whatever it is called.
+func newUploadForm(schemas *SchemaCheck, fileFields []string) *uploadForm {
+	return &uploadForm{schemas: schemas, fileFields: fileFields, seen: map[string]bool{}}
+}
+
+// parseFileFields splits a comma-separated UPLOAD_FILE_FIELDS value,
+// falling back to "file" when it names nothing.
+func parseFileFields(s string) []string {
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		return []string{"file"}
+	}
+	return fields
+}
+
+// isFilePart reports whether p carries the uploaded file.
+func (f *uploadForm) isFilePart(p *multipart.Part) bool {
+	for _, field := range f.fileFields {
+		if field == partFormName(p) || (field == "*" && partFilename(p) != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// missingFileMessage explains which parts were searched for the file.
+func (f *uploadForm) missingFileMessage() Message {
+	var names []string
+	for _, field := range f.fileFields {
+		if field == "*" {
+			return Message{Text: "No file provided; expected a part with a filename"}
+		}
+		names = append(names, "'"+field+"'")
+	}
+	if len(names) == 1 {
+		return newMessage("no_file", "field", f.fileFields[0])
+	}
+	return Message{Text: "No file provided in any of the " + strings.Join(names, ", ") + " fields"}
+}
+
+func formError(msg string) *UploadError {
+	return newUploadError(http.StatusBadRequest, "bad_request", msg)
+}
+
+// readField parses one non-file part. Tags may repeat and hold several
+// comma-separated values; every other field may appear once.
+func (f *uploadForm) readField(p *multipart.Part) error {
+	defer p.Close()
+	name := partFormName(p)
+	limit, ok := uploadFieldLimits[name]
+	if !ok {
+		return nil
+	}
+	if f.fields++; f.fields > uploadFormMaxFields {
+		return formError("Too many form fields; at most " + strconv.Itoa(uploadFormMaxFields) + " are allowed")
+	}
+	if f.seen[name] && name != "tags" {
+		return formError("Field '" + name + "' may only be given once")
+	}
+	f.seen[name] = true
+
+	b, err := io.ReadAll(io.LimitReader(p, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) > limit {
+		return formError("Field '" + name + "' exceeds " + strconv.FormatInt(limit, 10) + " bytes")
+	}
+	v := strings.TrimSpace(string(b))
+
+	switch name {
+	case "description":
+		f.Description = v
+	case "tags":
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				f.Tags = append(f.Tags, tag)
+			}
+		}
+	case "expiresAt":
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return formError("Field 'expiresAt' must be an RFC 3339 timestamp")
+		}
+		if !t.After(time.Now()) {
+			return formError("Field 'expiresAt' must be in the future")
+		}
+		t = t.UTC()
+		f.ExpiresAt = &t
+	case "schemaId":
+		if !f.schemas.Has(v) {
+			return newUploadErrorMessage(http.StatusBadRequest, "bad_request", newMessage("unknown_schema", "schema", v))
+		}
+		f.SchemaID = v
+	case "checksum":
+		sum, ok := parseChecksum(v)
+		if !ok {
+			return formError("Field 'checksum' must be a hex SHA-256 digest")
+		}
+		f.Checksum = sum
+	case "size":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return formError("Field 'size' must be a positive integer")
+		}
+		f.Size = n
+	case "rows":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return formError("Field 'rows' must be a non-negative integer")
+		}
+		f.Rows = &n
+	}
+	return nil
+}
+
+// parseChecksum normalizes a hex SHA-256 digest, optionally prefixed with
+// "sha256:".
+func parseChecksum(v string) (string, bool) {
+	sum := strings.ToLower(strings.TrimPrefix(v, "sha256:"))
+	if len(sum) != 64 || strings.Trim(sum, "0123456789abcdef") != "" {
+		return "", false
+	}
+	return sum, true
+}
+
+// readRest reads the fields after the file part. Further file parts are
+// skipped.
+func (f *uploadForm) readRest(mr *multipart.Reader) error {
+	for {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if partFilename(p) != "" {
+			p.Close()
+			continue
+		}
+		if err := f.readField(p); err != nil {
+			return err
+		}
+	}
+}
+
+// apply copies the collected fields into meta. A declared size or checksum
+// in the form takes the place of one from X-Upload-Length or
+// X-Upload-Checksum.
+func (f *uploadForm) apply(meta *UploadMeta) {
+	meta.Description = f.Description
+	meta.Tags = append(meta.Tags, f.Tags...)
+	meta.ExpiresAt = f.ExpiresAt
+	meta.SchemaID = f.SchemaID
+	if f.Checksum != "" {
+		meta.Checksum = f.Checksum
+	}
+	if f.Size > 0 {
+		meta.DeclaredSize = f.Size
+	}
+	meta.DeclaredRows = f.Rows
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Formula injection policies. A cell starting with =, +, -, @, tab or
+// carriage return is run as a formula by spreadsheet applications when the
+// CSV is opened; numbers such as -12.5 are left alone.
+const (
+	FormulaOff      = "off"
+	FormulaFlag     = "flag"
+	FormulaReject   = "reject"
+	FormulaSanitize = "sanitize"
+)
+
+// formulaExamples is how many offending cells a report lists.
+const formulaExamples = 10
+
+// FormulaPolicy picks what happens to uploads containing formula-like
+// cells: nothing (off), a report on the record (flag), refusal (reject),
+// or a report plus downloads that neutralize those cells (sanitize).
+// Buckets, the first segment of the object key, override Default.
+type FormulaPolicy struct {
+	Default string            `json:"default"`
+	Buckets map[string]string `json:"buckets,omitempty"`
+}
+
+// LoadFormulaPolicy reads per-bucket overrides from path, a JSON
+// FormulaPolicy document, with def as the default mode. An empty path
+// applies def to every upload.
+func LoadFormulaPolicy(path, def string) (*FormulaPolicy, error) {
+	p := &FormulaPolicy{Default: def}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, p); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if p.Default == "" {
+			p.Default = def
+		}
+	}
+	for _, mode := range append([]string{p.Default}, mapValues(p.Buckets)...) {
+		switch mode {
+		case FormulaOff, FormulaFlag, FormulaReject, FormulaSanitize:
+		default:
+			return nil, fmt.Errorf("unknown formula policy %q (want off, flag, reject or sanitize)", mode)
+		}
+	}
+	return p, nil
+}
+
+func mapValues(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for _, v := range m {
+		out = append(out, v)
+	}
+	return out
+}
+
+// For returns the mode for a file bound to key. A nil policy is off.
+func (p *FormulaPolicy) For(key string) string {
+	if p == nil {
+		return FormulaOff
+	}
+	bucket, _, _ := strings.Cut(key, "/")
+	if mode, ok := p.Buckets[bucket]; ok && bucket != "" {
+		return mode
+	}
+	return p.Default
+}
+
+// FormulaReport records formula-like cells found in an upload.
+type FormulaReport struct {
+	Cells     int           `json:"cells"`
+	Examples  []FormulaCell `json:"examples"`
+	Sanitized bool          `json:"sanitized,omitempty"`
+}
+
+type FormulaCell struct {
+	Row    int    `json:"row"` // 1-based, counting the header
+	Column string `json:"column"`
+	Value  string `json:"value"`
+}
+
+func isFormulaCell(s string) bool {
+	if len(s) < 2 {
+		return s == "=" || s == "@"
+	}
+	switch s[0] {
+	case '=', '@', '\t', '\r':
+		return true
+	case '+', '-':
+		_, err := strconv.ParseFloat(s, 64)
+		return err != nil
+	}
+	return false
+}
+
+// scanFormulas reports the formula-like cells in the CSV at path, or nil
+// when there are none.
+func scanFormulas(path string) (*FormulaReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cr := newLenientCSVReader(f)
+	var header []string
+	report := &FormulaReport{}
+	for row := 1; ; row++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if row == 1 {
+			header = append([]string(nil), rec...)
+		}
+		for i, cell := range rec {
+			if !isFormulaCell(cell) {
+				continue
+			}
+			report.Cells++
+			if len(report.Examples) < formulaExamples {
+				if len(cell) > 64 {
+					cell = cell[:64] + "…"
+				}
+				report.Examples = append(report.Examples, FormulaCell{Row: row, Column: columnName(header, i), Value: cell})
+			}
+		}
+	}
+	if report.Cells == 0 {
+		return nil, nil
+	}
+	return report, nil
+}
+
+// applyFormulaPolicy scans rec under mode. A rejected upload comes back as
+// an *UploadError.
+func applyFormulaPolicy(rec *FileRecord, mode string) error {
+	report, err := scanFormulas(rec.Path)
+	if err != nil || report == nil {
+		return err
+	}
+	if mode == FormulaReject {
+		c := report.Examples[0]
+		return newUploadError(400, "bad_request", fmt.Sprintf(
+			"File contains %d cell(s) that would run as spreadsheet formulas, first at row %d column '%s'", report.Cells, c.Row, c.Column))
+	}
+	report.Sanitized = mode == FormulaSanitize
+	rec.Formulas = report
+	return nil
+}
+
+// neutralizeFormulas copies the CSV in src to dst, prefixing formula-like
+// cells with a single quote so spreadsheets show them as text.
+func neutralizeFormulas(dst io.Writer, src io.Reader) error {
+	cr := newLenientCSVReader(src)
+	cw := csv.NewWriter(dst)
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for i, cell := range row {
+			if isFormulaCell(cell) {
+				row[i] = "'" + cell
+			}
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
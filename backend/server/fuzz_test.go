@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func FuzzMpProc(f *testing.F) {
+	f.Add("X", "--X\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.csv\"\r\n\r\na,b\n1,2\r\n--X--\r\n")
+	f.Add("X", "--X\r\nContent-Disposition: form-data; name=\"note\"\r\n\r\nhi\r\n--X\r\nContent-Disposition: form-data; name=\"file\"; filename=\"\"\r\n\r\n\r\n--X--\r\n")
+	f.Add("X", "--X\r\nContent-Disposition: form-data; name=\"tags\"\r\n\r\na, b\r\n--X\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.csv\"\r\n\r\na,b\r\n--X--\r\n")
+	f.Add("b", "--b\r\n\r\n--b--")
+	f.Add("", "")
+
+	f.Fuzz(func(t *testing.T, boundary, body string) {
+		mr := multipart.NewReader(strings.NewReader(body), boundary)
+		part, err := mpProc(mr, newUploadForm(nil, []string{"file"}))
+		if err != nil {
+			if part.Part != nil {
+				t.Fatalf("mpProc returned a part with error %v", err)
+			}
+			return
+		}
+		defer part.Close()
+		if partFormName(part.Part) != "file" || partFilename(part.Part) == "" {
+			t.Fatalf("mpProc selected field %q filename %q", partFormName(part.Part), partFilename(part.Part))
+		}
+		_, _ = io.Copy(io.Discard, part)
+	})
+}
+
+func FuzzCheckCSV(f *testing.F) {
+	f.Add([]byte("name,email\nbob,bob@x.com\n"), "a.csv")
+	f.Add([]byte("\x89PNG\r\n\x1a\n"), "a.csv")
+	f.Add([]byte("<html><body>"), "page.csv")
+	f.Add([]byte("a,b"), "a.txt")
+	f.Add([]byte{}, "")
+
+	f.Fuzz(func(t *testing.T, head []byte, filename string) {
+		contentType, ext, msg := checkCSV(head, filename)
+		if contentType == "" {
+			t.Fatal("empty content type")
+		}
+		if (msg.Text == "") == (ext == "") {
+			t.Fatalf("ext %q and msg %q must be exclusive", ext, msg)
+		}
+	})
+}
+
+func FuzzPIIScan(f *testing.F) {
+	f.Add([]byte("name,email,ssn\nbob,bob@x.com,123-45-6789\n"))
+	f.Add([]byte("a,\"b\nc\",d\n\"unterminated"))
+	f.Add([]byte("card\n4111 1111 1111 1111\n"))
+	f.Add([]byte("\xff\xfe,\x00\n"))
+
+	s := NewPIIScanner(100)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		report, err := s.Scan(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if report.ScannedRows > 100 {
+			t.Fatalf("scanned %d rows, limit is 100", report.ScannedRows)
+		}
+		// Mask may reject input Scan tolerated past the sample; it
+		// just must not panic.
+		_ = s.Mask(io.Discard, bytes.NewReader(data))
+	})
+}
+
+func FuzzSanitizeFilename(f *testing.F) {
+	f.Add("report.csv")
+	f.Add(`..\..\windows\system32\x.csv`)
+	f.Add("a\x00b.csv")
+	f.Add(strings.Repeat("é", 300) + ".csv")
+
+	f.Fuzz(func(t *testing.T, name string) {
+		got, msg := sanitizeFilename(name)
+		if msg.Text != "" {
+			return
+		}
+		if got == "" || strings.ContainsAny(got, `/\`) || len(got) > maxFilenameBytes {
+			t.Fatalf("sanitizeFilename(%q) = %q", name, got)
+		}
+	})
+}
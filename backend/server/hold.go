@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// LegalHold marks a file as immutable. A hold without Until stays in place
+// until an admin lifts it.
+type LegalHold struct {
+	Reason string     `json:"reason,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+	SetAt  time.Time  `json:"setAt"`
+}
+
+func (h *LegalHold) Active(now time.Time) bool {
+	return h != nil && (h.Until == nil || now.Before(*h.Until))
+}
+
+type HoldRequest struct {
+	ID     string     `json:"id"`
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
+// HoldHandler places (POST) or lifts (DELETE ?id=) a legal hold. Both
+// directions are written to the audit log.
+func HoldHandler(store MetadataStore, locker Locker, audit *AuditLog, events *EventRelay) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			var req HoldRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			if req.Until != nil && !req.Until.After(time.Now()) {
+				writeBadRequest(w, "Field 'until' must be in the future")
+				return
+			}
+			if req.ID == "" {
+				writeBadRequest(w, "Field 'id' is required")
+				return
+			}
+			rec, err := updateRecord(r.Context(), store, locker, req.ID, func(rec *FileRecord) error {
+				rec.Hold = &LegalHold{Reason: req.Reason, Until: req.Until, SetAt: time.Now().UTC()}
+				return nil
+			})
+			if err != nil {
+				writeUpdateError(w, req.ID, err)
+				return
+			}
+			detail := req.Reason
+			if req.Until != nil {
+				detail += " (until " + req.Until.UTC().Format(time.RFC3339) + ")"
+			}
+			audit.Record(AuditEvent{Action: "hold_set", FileID: rec.ID, Actor: "admin", Detail: detail})
+			events.Emit(EventFileUpdated, rec)
+			writeJSON(w, http.StatusOK, rec)
+
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				writeBadRequest(w, "Field 'id' is required")
+				return
+			}
+			rec, err := updateRecord(r.Context(), store, locker, id, func(rec *FileRecord) error {
+				if rec.Hold == nil {
+					return newUploadError(http.StatusNotFound, "not_found", "File '"+rec.ID+"' has no legal hold")
+				}
+				rec.Hold = nil
+				return nil
+			})
+			if err != nil {
+				writeUpdateError(w, id, err)
+				return
+			}
+			audit.Record(AuditEvent{Action: "hold_lifted", FileID: rec.ID, Actor: "admin"})
+			events.Emit(EventFileUpdated, rec)
+			writeJSON(w, http.StatusOK, rec)
+
+		default:
+			writeMethodNotAllowed(w, "Only POST and DELETE methods are allowed for legal holds")
+		}
+	}
+}
+
+// loadRecord fetches a record by ID and writes the error response itself
+// when that fails.
+func loadRecord(w http.ResponseWriter, r *http.Request, store MetadataStore, id string) (*FileRecord, bool) {
+	if id == "" {
+		writeBadRequest(w, "Field 'id' is required")
+		return nil, false
+	}
+	rec, err := store.Get(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeMessage(w, http.StatusNotFound, "not_found", newMessage("file_not_found", "id", id))
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, "Failed to load file metadata")
+		return nil, false
+	}
+	return rec, true
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP2Config tunes the HTTP/2 server. The default flow-control windows in
+// net/http (1MB per connection) stall a single large upload long before the
+// link is saturated, so the windows are sized for streaming bodies.
+type HTTP2Config struct {
+	Enabled bool
+
+	// H2C serves HTTP/2 over cleartext (prior knowledge or Upgrade: h2c)
+	// for internal deployments without TLS.
+	H2C bool
+
+	MaxConcurrentStreams uint32
+	StreamWindowBytes    int32
+	ConnWindowBytes      int32
+}
+
+// configureHTTP2 applies c to srv. Over TLS HTTP/2 is negotiated by ALPN; with
+// H2C the server handler is wrapped so cleartext connections can speak it too.
+func configureHTTP2(srv *http.Server, c HTTP2Config) error {
+	if !c.Enabled {
+		if c.H2C {
+			return errors.New("h2c requires HTTP/2 to be enabled")
+		}
+		// A non-nil empty map turns off the automatic HTTP/2 upgrade.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+	if c.StreamWindowBytes > c.ConnWindowBytes {
+		return errors.New("HTTP/2 stream window must not exceed the connection window")
+	}
+	h2 := &http2.Server{
+		MaxConcurrentStreams:         c.MaxConcurrentStreams,
+		MaxUploadBufferPerStream:     c.StreamWindowBytes,
+		MaxUploadBufferPerConnection: c.ConnWindowBytes,
+	}
+	if err := http2.ConfigureServer(srv, h2); err != nil {
+		return err
+	}
+	if c.H2C {
+		srv.Handler = h2c.NewHandler(srv.Handler, h2)
+	}
+	return nil
+}
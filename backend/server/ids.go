@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	IDFormatHex    = "hex"
+	IDFormatUUIDv7 = "uuidv7"
+	IDFormatULID   = "ulid"
+)
+
+// IDGenerator mints new file IDs. Every format produces IDs that validID
+// accepts, so files stored under one format stay reachable after the
+// setting changes.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+func NewIDGenerator(format string) (IDGenerator, error) {
+	switch format {
+	case "", IDFormatHex:
+		return hexIDs{}, nil
+	case IDFormatUUIDv7:
+		return uuidV7IDs{}, nil
+	case IDFormatULID:
+		return ulidIDs{}, nil
+	default:
+		return nil, fmt.Errorf("unknown id format %q (want hex, uuidv7 or ulid)", format)
+	}
+}
+
+// hexIDs are 128 random bits, hex encoded; the original format.
+type hexIDs struct{}
+
+func (hexIDs) NewID() (string, error) { return randomHex(16) }
+
+// timeOrderedBytes returns a 48-bit big-endian millisecond timestamp followed
+// by 80 random bits, the layout shared by UUIDv7 and ULID.
+func timeOrderedBytes(now time.Time) ([16]byte, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return b, err
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(now.UnixMilli()))
+	copy(b[:6], ts[2:])
+	return b, nil
+}
+
+// uuidV7IDs are RFC 9562 version 7 UUIDs: time-sortable, canonical form.
+type uuidV7IDs struct{}
+
+func (uuidV7IDs) NewID() (string, error) {
+	b, err := timeOrderedBytes(time.Now())
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidIDs are 26-character ULIDs in Crockford base32. IDs minted within the
+// same millisecond sort randomly relative to each other.
+type ulidIDs struct{}
+
+func (ulidIDs) NewID() (string, error) {
+	b, err := timeOrderedBytes(time.Now())
+	if err != nil {
+		return "", err
+	}
+	// 26 five-bit groups cover 130 bits; the first two are always zero.
+	out := make([]byte, 26)
+	for i := range out {
+		var v byte
+		for j := 0; j < 5; j++ {
+			v <<= 1
+			if bit := i*5 + j - 2; bit >= 0 && b[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out), nil
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	ImportGoogleDrive = "google_drive"
+	ImportOneDrive    = "onedrive"
+
+	googleSheetMIME = "application/vnd.google-apps.spreadsheet"
+)
+
+// importClient fetches documents from cloud drives. Imports can be large,
+// so there is no overall timeout; the request context bounds them.
+var importClient = &http.Client{}
+
+type importRequest struct {
+	Provider    string   `json:"provider"`
+	FileID      string   `json:"fileId"`
+	DriveID     string   `json:"driveId,omitempty"`
+	AccessToken string   `json:"accessToken"`
+	Folder      string   `json:"folder,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// importDoc is a document resolved on the provider, ready to stream.
+type importDoc struct {
+	Name       string
+	Size       int64 // -1 when the provider does not know, as for exports
+	ContentURL string
+	Source     string
+}
+
+// Importer pulls documents straight from Google Drive or OneDrive into the
+// store. Callers complete the OAuth flow with the provider themselves and
+// pass the resulting access token, which is used for this request only and
+// never stored.
+type Importer struct {
+	in       *Ingest
+	driveAPI string
+	graphAPI string
+}
+
+func NewImporter(in *Ingest) *Importer {
+	return &Importer{
+		in:       in,
+		driveAPI: "https://www.googleapis.com/drive/v3",
+		graphAPI: "https://graph.microsoft.com/v1.0",
+	}
+}
+
+// Handler serves POST /v1/files/import. Google Sheets are exported as CSV
+// (the first sheet); other documents are fetched as they are and must pass
+// the same checks as a direct upload.
+func (im *Importer) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req importRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeBadRequest(w, "Invalid JSON body")
+			return
+		}
+		if req.FileID == "" || req.AccessToken == "" {
+			writeBadRequest(w, "Fields 'fileId' and 'accessToken' are required")
+			return
+		}
+		folder, ok := cleanFolder(req.Folder)
+		if !ok {
+			writeBadRequest(w, "Invalid folder '"+req.Folder+"'")
+			return
+		}
+
+		var doc *importDoc
+		var uerr *UploadError
+		switch req.Provider {
+		case ImportGoogleDrive:
+			doc, uerr = im.googleDoc(r.Context(), req)
+		case ImportOneDrive:
+			doc, uerr = im.oneDriveDoc(r.Context(), req)
+		default:
+			writeBadRequest(w, fmt.Sprintf("Field 'provider' must be %q or %q", ImportGoogleDrive, ImportOneDrive))
+			return
+		}
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+
+		limit := im.in.Limits.For(r)
+		if doc.Size > limit {
+			writeFileTooLarge(w, limit)
+			return
+		}
+		resp, uerr := im.fetch(r.Context(), req, doc.ContentURL)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		defer resp.Body.Close()
+
+		// A remote body shorter than its Content-Length is a failed fetch,
+		// not a smaller file.
+		meta := UploadMeta{
+			Folder:       folder,
+			Tags:         req.Tags,
+			MaxBytes:     limit,
+			NotifyEmail:  notifyAddress(r),
+			Source:       doc.Source,
+			DeclaredSize: max(resp.ContentLength, 0),
+		}
+		rec, uerr := im.in.Receive(r.Context(), &limitFile{r: resp.Body, n: limit}, doc.Name, meta)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		writeJSON(w, http.StatusOK, newUploadResponse(rec))
+	}
+}
+
+func (im *Importer) googleDoc(ctx context.Context, req importRequest) (*importDoc, *UploadError) {
+	base := im.driveAPI + "/files/" + url.PathEscape(req.FileID)
+	var meta struct {
+		Name     string `json:"name"`
+		MimeType string `json:"mimeType"`
+		Size     string `json:"size"`
+	}
+	if uerr := im.getJSON(ctx, req, base+"?fields=name,mimeType,size&supportsAllDrives=true", &meta); uerr != nil {
+		return nil, uerr
+	}
+	doc := &importDoc{Name: meta.Name, Size: -1, Source: "gdrive://" + req.FileID}
+	switch {
+	case meta.MimeType == googleSheetMIME:
+		doc.Name = strings.TrimSuffix(doc.Name, ".csv") + ".csv"
+		doc.ContentURL = base + "/export?mimeType=text%2Fcsv"
+	case strings.HasPrefix(meta.MimeType, "application/vnd.google-apps."):
+		return nil, newUploadError(http.StatusUnsupportedMediaType, "unsupported_media_type", "Only Google Sheets can be imported from Google Docs formats")
+	default:
+		fmt.Sscan(meta.Size, &doc.Size)
+		doc.ContentURL = base + "?alt=media&supportsAllDrives=true"
+	}
+	return doc, nil
+}
+
+func (im *Importer) oneDriveDoc(ctx context.Context, req importRequest) (*importDoc, *UploadError) {
+	base := im.graphAPI + "/me/drive/items/" + url.PathEscape(req.FileID)
+	source := "onedrive://me/" + req.FileID
+	if req.DriveID != "" {
+		base = im.graphAPI + "/drives/" + url.PathEscape(req.DriveID) + "/items/" + url.PathEscape(req.FileID)
+		source = "onedrive://" + path.Join(req.DriveID, req.FileID)
+	}
+	var meta struct {
+		Name   string    `json:"name"`
+		Size   int64     `json:"size"`
+		Folder *struct{} `json:"folder"`
+	}
+	if uerr := im.getJSON(ctx, req, base+"?$select=name,size,folder", &meta); uerr != nil {
+		return nil, uerr
+	}
+	if meta.Folder != nil {
+		return nil, newUploadError(http.StatusBadRequest, "bad_request", "The OneDrive item is a folder")
+	}
+	return &importDoc{Name: meta.Name, Size: meta.Size, ContentURL: base + "/content", Source: source}, nil
+}
+
+func (im *Importer) getJSON(ctx context.Context, req importRequest, u string, v any) *UploadError {
+	resp, uerr := im.fetch(ctx, req, u)
+	if uerr != nil {
+		return uerr
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return newUploadError(http.StatusBadGateway, "bad_gateway", "Unexpected response from "+providerName(req.Provider))
+	}
+	return nil
+}
+
+// fetch issues an authorised GET and maps provider failures onto upload
+// errors. OneDrive answers content requests with a redirect to a
+// pre-authorised URL; the client drops the token when following it.
+func (im *Importer) fetch(ctx context.Context, req importRequest, u string) (*http.Response, *UploadError) {
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, newUploadError(http.StatusBadRequest, "bad_request", "Invalid file ID")
+	}
+	hreq.Header.Set("Authorization", "Bearer "+req.AccessToken)
+	resp, err := importClient.Do(hreq)
+	if err != nil {
+		log.Printf("import from %s: %v", req.Provider, err)
+		return nil, newUploadError(http.StatusBadGateway, "bad_gateway", "Could not reach "+providerName(req.Provider))
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	resp.Body.Close()
+	name := providerName(req.Provider)
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return nil, newUploadError(http.StatusUnauthorized, "unauthorized", name+" rejected the access token")
+	case http.StatusForbidden:
+		return nil, newUploadError(http.StatusForbidden, "forbidden", name+" denied access to the file")
+	case http.StatusNotFound:
+		return nil, newUploadError(http.StatusNotFound, "not_found", "File not found in "+name)
+	}
+	log.Printf("import from %s: %s", req.Provider, resp.Status)
+	return nil, newUploadError(http.StatusBadGateway, "bad_gateway", name+" returned "+resp.Status)
+}
+
+func providerName(provider string) string {
+	if provider == ImportOneDrive {
+		return "OneDrive"
+	}
+	return "Google Drive"
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The checksum index lets the store find files by content without reading
+// every record. It lives beside the records as an empty marker file per
+// file, <dir>/index/sha256/<checksum>/<id>, so every instance sharing the
+// metadata directory sees the same index. It is built from the records the
+// first time a store opens a directory without one.
+
+func (s *jsonStore) indexDir() string {
+	return filepath.Join(s.dir, "index", "sha256")
+}
+
+func (s *jsonStore) indexPath(checksum, id string) string {
+	return filepath.Join(s.indexDir(), checksum, id)
+}
+
+// validChecksum guards index paths the way validID guards record paths.
+func validChecksum(sum string) bool {
+	v, ok := parseChecksum(sum)
+	return ok && v == sum
+}
+
+// indexAdd records rec in the index. The caller holds s.mu.
+func (s *jsonStore) indexAdd(rec *FileRecord) error {
+	if !validChecksum(rec.ChecksumSHA) {
+		return nil
+	}
+	dir := filepath.Join(s.indexDir(), rec.ChecksumSHA)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, rec.ID), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// indexRemove drops id from the index. The caller holds s.mu.
+func (s *jsonStore) indexRemove(checksum, id string) {
+	if !validChecksum(checksum) {
+		return
+	}
+	if err := os.Remove(s.indexPath(checksum, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("index: remove %s: %v", id, err)
+		return
+	}
+	// Fails harmlessly while other files share the checksum.
+	_ = os.Remove(filepath.Join(s.indexDir(), checksum))
+}
+
+// buildIndex indexes every record when the directory has no index yet. The
+// index is assembled under a temporary name and renamed into place, so an
+// interrupted build is simply redone.
+func (s *jsonStore) buildIndex() error {
+	if _, err := os.Stat(s.indexDir()); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	recs, err := s.list()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, "index", "sha256.tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if !validChecksum(rec.ChecksumSHA) {
+			continue
+		}
+		dir := filepath.Join(tmp, rec.ChecksumSHA)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, rec.ID), nil, 0o644); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp, s.indexDir()); err != nil {
+		return err
+	}
+	log.Printf("index: indexed %d files by checksum", len(recs))
+	return nil
+}
+
+// FindByChecksum returns the files whose content hashes to checksum, oldest
+// first.
+func (s *jsonStore) FindByChecksum(ctx context.Context, checksum string) ([]*FileRecord, error) {
+	return bounded(ctx, "metadata find", func() ([]*FileRecord, error) { return s.findByChecksum(checksum) })
+}
+
+func (s *jsonStore) findByChecksum(checksum string) ([]*FileRecord, error) {
+	checksum, ok := parseChecksum(checksum)
+	if !ok {
+		return nil, nil
+	}
+	s.mu.RLock()
+	entries, err := os.ReadDir(filepath.Join(s.indexDir(), checksum))
+	s.mu.RUnlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recs []*FileRecord
+	for _, e := range entries {
+		rec, err := s.get(e.Name())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A marker left by a record whose write failed, or a checksum
+		// that changed.
+		if rec.ChecksumSHA != checksum {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].UploadedAt.Before(recs[j].UploadedAt) })
+	return recs, nil
+}
@@ -0,0 +1,575 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+// Ingest holds what every upload path needs once a blob has been written:
+// post-processing, the metadata write, and event emission.
+type Ingest struct {
+	Store  MetadataStore
+	Config config.Config
+	PII    *PIIScanner
+	Events *EventRelay
+	IDs    IDGenerator
+	Limits *SizeLimits
+
+	Formulas *FormulaPolicy
+	Checks   *Checker
+	Schemas  *SchemaCheck
+	Notifier *Notifier
+	Receipts *Receipts
+	Policies *PolicyEngine
+	Flags    *FeatureFlags
+}
+
+// Commit post-processes the blob at rec.Path and records it. On failure all
+// files belonging to rec are removed so nothing is left without metadata.
+// Once the bytes are in, the client going away no longer cancels the
+// commit; only the storage deadline does.
+func (in *Ingest) Commit(ctx context.Context, rec *FileRecord) error {
+	ctx = context.WithoutCancel(ctx)
+	stagedPath := rec.Path
+	if rec.UploadedAt.IsZero() {
+		rec.UploadedAt = time.Now()
+	}
+	rec.StorageClass = StorageHot
+	rec.Revision = 1
+	rec.State = StateAvailable
+	if in.Checks.Enabled() && in.Flags.Enabled(ctx, FlagAsyncScanning, rec.ID) {
+		rec.State = StateScanning
+	}
+	if uerr := in.Policies.Check(ctx, rec); uerr != nil {
+		_ = os.Remove(stagedPath)
+		return uerr
+	}
+
+	// Under reject, a file that cannot be scanned is refused rather than
+	// let through.
+	if mode := in.Formulas.For(rec.Key); mode != FormulaOff {
+		if err := applyFormulaPolicy(rec, mode); err != nil {
+			var uerr *UploadError
+			if errors.As(err, &uerr) || mode == FormulaReject {
+				_ = os.Remove(stagedPath)
+				return err
+			}
+			log.Printf("formula scan failed for %s: %v", rec.ID, err)
+		}
+	}
+	if in.PII != nil {
+		if err := applyPIIScan(in.PII, rec, in.Config.PIIMask && rec.customerKey == nil); err != nil {
+			log.Printf("pii scan failed for %s: %v", rec.ID, err)
+		}
+	}
+	// The checks cannot read a blob under a customer key later on.
+	if rec.State == StateScanning && rec.customerKey != nil {
+		in.scanNow(ctx, rec)
+	}
+	shared := in.shareBlob(ctx, rec)
+	if !shared && in.Config.Compression != "" {
+		if err := compressBlob(rec, in.Config.Compression); err != nil {
+			log.Printf("compress %s: %v", rec.ID, err)
+		}
+	}
+	discard := func() {
+		_ = os.Remove(stagedPath)
+		_ = os.Remove(rec.Path)
+		if rec.MaskedPath != "" {
+			_ = os.Remove(rec.MaskedPath)
+		}
+	}
+	// Unlike compression, encryption is not best effort: a blob that
+	// should be encrypted is never kept in the clear.
+	if !shared && (rec.customerKey != nil || (blobKeys != nil && in.Flags.Enabled(ctx, FlagEncryption, rec.ID))) {
+		plainPath := rec.Path
+		encrypt := func() error { return encryptBlob(ctx, blobKeys, rec) }
+		if rec.customerKey != nil {
+			encrypt = func() error { return encryptBlobWithCustomerKey(rec, rec.customerKey) }
+		}
+		if err := encrypt(); err != nil {
+			discard()
+			return fmt.Errorf("encrypt %s: %w", rec.ID, err)
+		}
+		if plainPath != stagedPath {
+			_ = os.Remove(plainPath)
+		}
+	}
+	if err := storeMaskedLikeBlob(ctx, blobKeys, rec); err != nil {
+		discard()
+		return fmt.Errorf("store masked copy of %s: %w", rec.ID, err)
+	}
+	// The blob is read back as it will be kept, so a write lost on the way
+	// to storage is caught whichever step made it.
+	if verifyWrites {
+		if _, err := bounded(ctx, "blob verify", func() (struct{}, error) { return struct{}{}, verifyBlob(rec) }); err != nil {
+			log.Printf("ingest: verify %s: %v", rec.Path, err)
+			discard()
+			return newUploadError(http.StatusInternalServerError, "internal_server_error", "The stored file did not match the upload; retry it")
+		}
+	}
+	receipt, err := in.Receipts.Issue(rec)
+	if err != nil {
+		log.Printf("issue receipt for %s: %v", rec.ID, err)
+	}
+	rec.Receipt = receipt
+	if err := in.Store.Create(ctx, rec); err != nil {
+		discard()
+		return err
+	}
+	if rec.Path != stagedPath {
+		_ = os.Remove(stagedPath)
+	}
+	in.Events.Emit(EventFileUploaded, rec)
+	if rec.State == StateScanning {
+		go in.Checks.Scan(rec.ID)
+	}
+	return nil
+}
+
+// UploadError is a client-facing upload failure. Code reuses the error
+// types written by writeError so single and batch responses agree.
+type UploadError struct {
+	Status   int           `json:"-"`
+	Code     string        `json:"code"`
+	Message  string        `json:"message"`
+	Existing *FileMetadata `json:"existing,omitempty"`
+
+	// msg is Message with its catalog ID, for writeUploadError to
+	// translate.
+	msg Message
+}
+
+func (e *UploadError) Error() string { return e.Message }
+
+func newUploadError(status int, code, message string) *UploadError {
+	return newUploadErrorMessage(status, code, Message{Text: message})
+}
+
+// newUploadErrorMessage is newUploadError for a message that may be in the
+// catalog.
+func newUploadErrorMessage(status int, code string, m Message) *UploadError {
+	return &UploadError{Status: status, Code: code, Message: m.Text, msg: m}
+}
+
+func writeUploadError(w http.ResponseWriter, e *UploadError) {
+	resp := errorResponse(w, e.Status, e.Code, e.msg)
+	resp.Existing = e.Existing
+	writeJSON(w, e.Status, resp)
+}
+
+// duplicateError is the 409 for content that is already stored as rec.
+func duplicateError(rec *FileRecord) *UploadError {
+	uerr := newUploadErrorMessage(http.StatusConflict, "conflict", newMessage("duplicate_file", "id", rec.ID))
+	uerr.Existing = &FileMetadata{UploadResponse: newUploadResponse(rec), UploadedAt: rec.UploadedAt}
+	return uerr
+}
+
+// UploadMeta carries client-supplied attributes recorded with the file.
+type UploadMeta struct {
+	Folder string
+	Tags   []string
+	Key    string
+
+	// MaxBytes is the size limit src is held to; it only shapes the error
+	// message, callers enforce it on the reader.
+	MaxBytes int64
+
+	// IfNotExists rejects the upload with 409 when a stored file already
+	// has the same checksum.
+	IfNotExists bool
+
+	// NotifyEmail is the uploader's address for notifications.
+	NotifyEmail string
+
+	// Source records where a pulled file came from, such as an SFTP path.
+	Source string
+
+	// Lineage links a derived file to the files it was made from.
+	Lineage *Lineage
+
+	// Description is free text kept with the file.
+	Description string
+
+	// ExpiresAt schedules the file for deletion.
+	ExpiresAt *time.Time
+
+	// SchemaID names the schema the async checks validate the file against.
+	SchemaID string
+
+	// Checksum is the hex SHA-256 the client expects; a mismatch rejects
+	// the upload.
+	Checksum string
+
+	// DeclaredSize and DeclaredRows are the byte and data row counts the
+	// client said to expect, 0 and nil when it said nothing; see
+	// checkDeclared.
+	DeclaredSize int64
+	DeclaredRows *int64
+
+	// Intent, when set, is checked against the received file before it is
+	// committed.
+	Intent *UploadIntent
+
+	// DryRun validates the upload as far as it would be before and after
+	// commit, including the async checks, then discards it; see dryRun.
+	DryRun bool
+
+	// CustomerKey, when set, is the client's key to encrypt the file with;
+	// see customerKey.
+	CustomerKey []byte
+
+	// BeforeCommit runs once the bytes are in but before anything is
+	// recorded, so intent that arrived after the file, such as trailing
+	// form fields, can still be added to meta.
+	BeforeCommit func(meta *UploadMeta) *UploadError
+}
+
+var errFileTooLarge = errors.New("file exceeds maximum upload size")
+
+// checkDeclared rejects a file whose size or row count is not what the
+// client declared. A transfer cut short can still end cleanly, such as a
+// proxy closing the body at a buffer boundary or a client that stopped
+// reading its source early, and would otherwise be stored as a smaller,
+// valid-looking file.
+func (meta *UploadMeta) checkDeclared(size, rows int64) *UploadError {
+	if meta.DeclaredSize > 0 && size != meta.DeclaredSize {
+		metrics.Counter("upload_declared_mismatches_total", "Uploads rejected for differing from their declared size or row count.", "kind", "size").Inc()
+		return newUploadErrorMessage(http.StatusBadRequest, "size_mismatch", newMessage("size_mismatch",
+			"declared", strconv.FormatInt(meta.DeclaredSize, 10), "received", strconv.FormatInt(size, 10)))
+	}
+	if meta.DeclaredRows != nil && rows != *meta.DeclaredRows {
+		metrics.Counter("upload_declared_mismatches_total", "Uploads rejected for differing from their declared size or row count.", "kind", "rows").Inc()
+		return newUploadErrorMessage(http.StatusBadRequest, "row_count_mismatch", newMessage("row_count_mismatch",
+			"declared", strconv.FormatInt(*meta.DeclaredRows, 10), "rows", strconv.FormatInt(rows, 10)))
+	}
+	return nil
+}
+
+// isTooLarge reports whether err came from a size limit, either
+// http.MaxBytesReader on the request body or limitFile on one file.
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr) || errors.Is(err, errFileTooLarge)
+}
+
+// newCSVStats returns a csvStats that enforces the configured row, column
+// and cell size limits.
+func (in *Ingest) newCSVStats() *csvStats {
+	return &csvStats{limits: csvLimits{
+		Rows:      in.Config.MaxRows,
+		Columns:   in.Config.MaxColumns,
+		CellBytes: in.Config.MaxCellBytes,
+	}}
+}
+
+// Receive streams src into a new blob, validating that it is a CSV, and
+// commits it. It is shared by every endpoint that accepts file bytes.
+func (in *Ingest) Receive(ctx context.Context, src io.Reader, filename string, meta UploadMeta) (*FileRecord, *UploadError) {
+	rec, uerr := in.receive(ctx, src, filename, meta)
+	if !meta.DryRun {
+		in.notifyUpload(filename, meta.Key, meta.NotifyEmail, rec, uerr)
+	}
+	return rec, uerr
+}
+
+func (in *Ingest) receive(ctx context.Context, src io.Reader, filename string, meta UploadMeta) (*FileRecord, *UploadError) {
+	if uerr := maintenance.Refusal(); uerr != nil {
+		return nil, uerr
+	}
+	filename, msg := sanitizeFilename(filename)
+	if msg.Text != "" {
+		return nil, newUploadErrorMessage(http.StatusBadRequest, "bad_request", msg)
+	}
+	id, err := in.IDs.NewID()
+	if err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to generate file ID")
+	}
+
+	head := make([]byte, 512)
+	nHead, err := io.ReadFull(src, head)
+	head = head[:nHead]
+	// Readers that rebuild a file, such as delta uploads, report a bad
+	// request as an *UploadError.
+	var uerr *UploadError
+	if errors.As(err, &uerr) {
+		return nil, uerr
+	}
+	contentType, ext, msg := checkCSV(head, filename)
+	if msg.Text != "" {
+		return nil, newUploadErrorMessage(http.StatusUnsupportedMediaType, "unsupported_media_type", msg)
+	}
+
+	now := time.Now()
+	finalPath, err := blobPath(id, ext, now)
+	if err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to create upload directory")
+	}
+	dstFile, err := runBounded(ctx, "blob create", func(o *storageOp) (*os.File, error) {
+		f, err := createTemp(finalPath)
+		if err == nil && o.commit() != nil {
+			f.Close()
+			_ = os.Remove(f.Name())
+			return nil, errAbandoned
+		}
+		return f, err
+	})
+	if err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to create temporary file")
+	}
+	tmpPath := dstFile.Name()
+	published := false
+	defer func() {
+		dstFile.Close()
+		if !published {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	bufWriter := bufio.NewWriterSize(boundedWriter{ctx, "blob write", dstFile}, 1<<20)
+
+	h := sha256.New()
+	stats := in.newCSVStats()
+	var chunks chunkHasher
+	mw := io.MultiWriter(bufWriter, h, &chunks, stats)
+
+	var written int64
+	var limitErr *csvLimitError
+	if nHead > 0 {
+		if _, err := mw.Write(head); err != nil {
+			if errors.As(err, &limitErr) {
+				return nil, newUploadError(http.StatusBadRequest, "bad_request", limitErr.Error())
+			}
+			return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to write file data")
+		}
+		written += int64(nHead)
+	}
+
+	n, err := io.Copy(mw, src)
+	written += n
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			if errors.As(err, &uerr) {
+				return nil, uerr
+			}
+			if errors.As(err, &limitErr) {
+				return nil, newUploadError(http.StatusBadRequest, "bad_request", limitErr.Error())
+			}
+			if isTooLarge(err) {
+				return nil, newUploadErrorMessage(http.StatusRequestEntityTooLarge, "request_entity_too_large", fileTooLargeMessage(meta.MaxBytes))
+			}
+			return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to copy file data")
+		}
+	}
+
+	if written == 0 {
+		return nil, newUploadErrorMessage(http.StatusBadRequest, "bad_request", newMessage("empty_file"))
+	}
+
+	if err := bufWriter.Flush(); err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to flush file buffer")
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if meta.BeforeCommit != nil {
+		if uerr := meta.BeforeCommit(&meta); uerr != nil {
+			return nil, uerr
+		}
+	}
+	if uerr := meta.checkDeclared(written, stats.rowCount()); uerr != nil {
+		return nil, uerr
+	}
+	if meta.Checksum != "" && meta.Checksum != checksum {
+		return nil, newUploadErrorMessage(http.StatusBadRequest, "bad_request", newMessage("checksum_mismatch", "expected", meta.Checksum, "actual", checksum))
+	}
+	duplicateOf, uerr := in.checkDuplicate(ctx, checksum, meta.IfNotExists)
+	if uerr != nil {
+		return nil, uerr
+	}
+	if err := dstFile.Close(); err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to close file")
+	}
+
+	rec := &FileRecord{
+		ID:          id,
+		Filename:    filename,
+		Path:        finalPath,
+		Bytes:       written,
+		ChecksumSHA: checksum,
+		ContentType: contentType,
+		Extension:   ext,
+		UploadedAt:  now,
+		DuplicateOf: duplicateOf,
+		Folder:      meta.Folder,
+		Tags:        meta.Tags,
+		Key:         meta.Key,
+		Source:      meta.Source,
+		Lineage:     meta.Lineage,
+		Description: meta.Description,
+		ExpiresAt:   meta.ExpiresAt,
+		SchemaID:    meta.SchemaID,
+		Chunks:      chunks.Sum(),
+		RowCount:    stats.rowCount(),
+		Columns:     stats.columns(),
+		customerKey: meta.CustomerKey,
+	}
+	if meta.Intent != nil {
+		if uerr := meta.Intent.verify(ctx, in.Schemas, rec); uerr != nil {
+			return nil, uerr
+		}
+	}
+	if meta.DryRun {
+		rec.Path = tmpPath
+		if uerr := in.dryRun(ctx, rec); uerr != nil {
+			return nil, uerr
+		}
+		return rec, nil
+	}
+	// A blob already at finalPath means the ID was handed out twice; take
+	// a fresh one rather than overwrite it.
+	for attempt := 0; ; attempt++ {
+		err = boundedWrite(ctx, "blob publish", func(commit func() error) error {
+			if err := commit(); err != nil {
+				return err
+			}
+			return publishBlob(tmpPath, finalPath)
+		})
+		if !errors.Is(err, errBlobExists) || attempt == 2 {
+			break
+		}
+		log.Printf("ingest: blob %s already exists; choosing a new ID", finalPath)
+		if id, err = in.IDs.NewID(); err != nil {
+			break
+		}
+		if finalPath, err = blobPath(id, ext, now); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to finalize file")
+	}
+	published = true
+	rec.ID, rec.Path = id, finalPath
+	if err := in.Commit(ctx, rec); err != nil {
+		var uerr *UploadError
+		if errors.As(err, &uerr) {
+			return nil, uerr
+		}
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to record file metadata")
+	}
+	return rec, nil
+}
+
+// checkDuplicate returns the ID of the oldest stored file with the given
+// checksum, or a 409 when one exists and rejectDuplicate is set. Duplicates
+// are looked for whether or not dedup is on; the flag only decides whether
+// Commit shares the stored blob.
+func (in *Ingest) checkDuplicate(ctx context.Context, checksum string, rejectDuplicate bool) (string, *UploadError) {
+	rec, err := findStored(ctx, in.Store, checksum)
+	if err != nil {
+		return "", newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to check for duplicate files")
+	}
+	if rec == nil {
+		return "", nil
+	}
+	if rejectDuplicate {
+		return "", duplicateError(rec)
+	}
+	return rec.ID, nil
+}
+
+// shareBlob, with dedup on, stores rec as a hard link to the blob of the
+// file it duplicates instead of a copy of its own, taking on that blob's
+// compression and encryption. Each file keeps its own link, and blobs are
+// only ever replaced by rename, so deleting, archiving or rewriting either
+// file leaves the other's blob alone. Blobs under a customer key are
+// sealed with different keys and never shared. It reports whether rec now
+// points at the shared blob.
+func (in *Ingest) shareBlob(ctx context.Context, rec *FileRecord) bool {
+	if rec.DuplicateOf == "" || rec.customerKey != nil || !in.Flags.Enabled(ctx, FlagDedup, rec.ID) {
+		return false
+	}
+	dup, err := in.Store.Get(ctx, rec.DuplicateOf)
+	if err != nil || dup.storageClass() != StorageHot || dup.Encryption.customer() || dup.ChecksumSHA != rec.ChecksumSHA {
+		return false
+	}
+	// The duplicate's blob is named for its ID and extension, followed
+	// by the suffixes of its encoding and encryption.
+	suffix, ok := strings.CutPrefix(filepath.Base(dup.Path), dup.ID+dup.extension())
+	if !ok {
+		return false
+	}
+	// The link replaces the copy when their names agree, as they do for
+	// a plain blob.
+	linked := rec.Path + suffix
+	tmp := linked + ".link"
+	if err := os.Link(dup.Path, tmp); err != nil {
+		log.Printf("dedup: link %s to %s: %v", rec.ID, dup.ID, err)
+		return false
+	}
+	if err := os.Rename(tmp, linked); err != nil {
+		log.Printf("dedup: link %s to %s: %v", rec.ID, dup.ID, err)
+		_ = os.Remove(tmp)
+		return false
+	}
+	rec.Path, rec.Encoding = linked, dup.Encoding
+	if dup.Compression != nil {
+		c := *dup.Compression
+		rec.Compression = &c
+	}
+	if dup.Encryption != nil {
+		e := *dup.Encryption
+		rec.Encryption = &e
+	}
+	metrics.Counter("upload_dedup_shared_total", "Uploads stored as a link to an identical file's blob.").Inc()
+	return true
+}
+
+// findStored returns the oldest stored file with the given checksum that
+// is neither quarantined nor under a customer key, or nil.
+func findStored(ctx context.Context, store MetadataStore, checksum string) (*FileRecord, error) {
+	recs, err := store.FindByChecksum(ctx, checksum)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		if rec.ChecksumSHA == checksum && rec.state() != StateQuarantined && !rec.Encryption.customer() {
+			return rec, nil
+		}
+	}
+	return nil, nil
+}
+
+// limitFile fails with errFileTooLarge once more than n bytes are read.
+type limitFile struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitFile) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errFileTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"example.com/file-upload-go/config"
+)
+
+func TestReceiveDuplicate(t *testing.T) {
+	const csv = "name,email\nbob,bob@example.com\n"
+	tests := []struct {
+		name        string
+		dedup       bool
+		ifNotExists bool
+		status      int  // 0 for stored
+		shared      bool // whether the blob is a link to the first one's
+	}{
+		{"dedup off", false, false, 0, false},
+		{"dedup on", true, false, 0, true},
+		{"dedup off, ifNotExists", false, true, http.StatusConflict, false},
+		{"dedup on, ifNotExists", true, true, http.StatusConflict, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := testIngest(t)
+			in.Flags = &FeatureFlags{base: map[string]*FeatureFlag{FlagDedup: {Name: FlagDedup, Enabled: tt.dedup}}}
+			first := testRecord(t, in)
+
+			meta := UploadMeta{MaxBytes: config.DefaultMaxUploadBytes, IfNotExists: tt.ifNotExists}
+			resp, uerr := in.Receive(context.Background(), strings.NewReader(csv), "again.csv", meta)
+			if tt.status != 0 {
+				if uerr == nil || uerr.Status != tt.status || uerr.Existing == nil || uerr.Existing.ID != first.ID {
+					t.Fatalf("got %+v, %v; want %d naming %s", resp, uerr, tt.status, first.ID)
+				}
+				return
+			}
+			if uerr != nil {
+				t.Fatal(uerr)
+			}
+			if resp.DuplicateOf != first.ID {
+				t.Errorf("duplicateOf = %q, want %q", resp.DuplicateOf, first.ID)
+			}
+			rec, err := in.Store.Get(context.Background(), resp.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := os.Stat(first.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.Stat(rec.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if os.SameFile(a, b) != tt.shared {
+				t.Errorf("blob shared = %v, want %v", os.SameFile(a, b), tt.shared)
+			}
+
+			// Deleting the first file leaves the duplicate readable.
+			if _, err := purgeFile(context.Background(), in.Store, first); err != nil {
+				t.Fatal(err)
+			}
+			f, err := openBlob(rec, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if got, _ := io.ReadAll(f); string(got) != csv {
+				t.Errorf("duplicate reads %q after the original was deleted", got)
+			}
+		})
+	}
+}
+
+// With verifyWrites on, a blob is checked as it is kept, compressed and
+// encrypted, and one that does not decode to the upload fails the check.
+func TestVerifyWrites(t *testing.T) {
+	in := testIngest(t)
+	testBlobKeys(t)
+	in.Config.Compression = EncodingGzip
+	verifyWrites = true
+	t.Cleanup(func() { verifyWrites = false })
+
+	rec := testRecord(t, in)
+	if rec.Encoding != EncodingGzip || rec.Encryption == nil {
+		t.Fatalf("stored as %q, %+v", rec.Encoding, rec.Encryption)
+	}
+	if err := verifyBlob(rec); err != nil {
+		t.Fatalf("verify stored blob: %v", err)
+	}
+
+	stored, err := os.ReadFile(rec.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[len(stored)/2] ^= 1
+	if err := os.WriteFile(rec.Path, stored, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyBlob(rec); err == nil {
+		t.Error("tampered blob verified")
+	}
+
+	// An upload of the same content would share the damaged blob.
+	_, uerr := in.Receive(context.Background(), strings.NewReader("name,email\nbob,bob@example.com\n"), "people.csv", UploadMeta{MaxBytes: config.DefaultMaxUploadBytes})
+	if uerr == nil || uerr.Status != http.StatusInternalServerError {
+		t.Errorf("upload sharing the tampered blob: %+v", uerr)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UploadIntent is what a client declares about a file before sending it:
+// where it goes and what it should look like. The target fields (bucket or
+// key, schema, tags, description, expiry) are applied as if given as form
+// fields; the expectations (checksum, size, rows) and the schema are
+// checked against the file as received, and any mismatch rejects the
+// upload before anything is recorded or bound to the key.
+type UploadIntent struct {
+	Bucket      string     `json:"bucket,omitempty"`
+	Key         string     `json:"key,omitempty"`
+	OnConflict  string     `json:"onConflict,omitempty"`
+	SchemaID    string     `json:"schemaId,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Description string     `json:"description,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	Checksum    string     `json:"checksum,omitempty"`
+	Size        *int64     `json:"size,omitempty"`
+	Rows        *int64     `json:"rows,omitempty"`
+}
+
+const intentMaxBytes = 64 << 10
+
+// validate checks the intent on its own and normalizes its checksum.
+func (it *UploadIntent) validate(schemas *SchemaCheck, limit int64) *UploadError {
+	if it.Bucket != "" && (strings.Contains(it.Bucket, "/") || !validKeyPart(it.Bucket)) {
+		return formError("Intent field 'bucket' must be a single key segment")
+	}
+	if it.Key != "" {
+		key, ok := cleanKey(it.Key)
+		if !ok {
+			return formError("Intent field 'key' is not a valid key")
+		}
+		if bucket, _, _ := strings.Cut(key, "/"); it.Bucket != "" && bucket != it.Bucket {
+			return formError("Intent field 'key' is not in bucket '" + it.Bucket + "'")
+		}
+		it.Key = key
+	}
+	if it.SchemaID != "" && !schemas.Has(it.SchemaID) {
+		return newUploadErrorMessage(http.StatusBadRequest, "bad_request", newMessage("unknown_schema", "schema", it.SchemaID))
+	}
+	if it.Checksum != "" {
+		sum, ok := parseChecksum(it.Checksum)
+		if !ok {
+			return formError("Intent field 'checksum' must be a hex SHA-256 digest")
+		}
+		it.Checksum = sum
+	}
+	if it.Size != nil && (*it.Size <= 0 || *it.Size > limit) {
+		return formError("Intent field 'size' must be between 1 and " + strconv.FormatInt(limit, 10))
+	}
+	if it.Rows != nil && *it.Rows < 0 {
+		return formError("Intent field 'rows' must not be negative")
+	}
+	if it.ExpiresAt != nil && !it.ExpiresAt.After(time.Now()) {
+		return formError("Intent field 'expiresAt' must be in the future")
+	}
+	return nil
+}
+
+func validKeyPart(s string) bool {
+	clean, ok := cleanKey(s)
+	return ok && clean == s
+}
+
+// targetKey is the key the file is bound to: the intent's key, or the
+// filename under its bucket.
+func (it *UploadIntent) targetKey(filename string) string {
+	if it.Key != "" || it.Bucket == "" {
+		return it.Key
+	}
+	return it.Bucket + "/" + filename
+}
+
+// verify checks the received file in rec against the intent's schema. It
+// is checked here rather than left to the async checks, so a file that
+// does not match is refused instead of quarantined; the declared size and
+// rows are checked by Receive like any other declaration.
+func (it *UploadIntent) verify(ctx context.Context, schemas *SchemaCheck, rec *FileRecord) *UploadError {
+	if schemas != nil {
+		if reason, _ := schemas.Check(ctx, rec); reason != "" {
+			return formError("Schema mismatch: " + reason)
+		}
+	}
+	return nil
+}
+
+// IntentUploadHandler accepts a multipart body whose first part, "intent",
+// is a JSON UploadIntent, followed by the file part: POST
+// /v1/files/intent[?dryRun=true]. The intent is validated before any file
+// bytes are read.
+func IntentUploadHandler(in *Ingest, keys *Keys) http.HandlerFunc {
+	fileFields := parseFileFields(in.Config.FileFields)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for intent uploads")
+			return
+		}
+		limit := in.Limits.For(r)
+		if !preflight(w, r, limit+intentMaxBytes, limit) {
+			return
+		}
+		customer, uerr := customerKey(r)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit+intentMaxBytes)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeMessage(w, http.StatusBadRequest, "bad_request", newMessage("invalid_multipart"))
+			return
+		}
+
+		p, err := mr.NextPart()
+		if err != nil || partFormName(p) != "intent" || partFilename(p) != "" {
+			writeBadRequest(w, "The first part must be the JSON 'intent' field")
+			return
+		}
+		var intent UploadIntent
+		b, err := io.ReadAll(io.LimitReader(p, intentMaxBytes+1))
+		p.Close()
+		if err != nil || len(b) > intentMaxBytes {
+			writeBadRequest(w, "Field 'intent' exceeds "+strconv.Itoa(intentMaxBytes)+" bytes")
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&intent); err != nil {
+			writeBadRequest(w, "Invalid JSON in 'intent' field: "+err.Error())
+			return
+		}
+		if uerr := intent.validate(in.Schemas, limit); uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		declared := uploadLength(r)
+		if intent.Size != nil {
+			if declared > 0 && declared != *intent.Size {
+				writeBadRequest(w, "Intent field 'size' does not match header 'X-Upload-Length'")
+				return
+			}
+			declared = *intent.Size
+		}
+
+		form := newUploadForm(in.Schemas, fileFields)
+		part, err := mr.NextPart()
+		if err != nil || !form.isFilePart(part) {
+			if isTooLarge(err) {
+				writeFileTooLarge(w, limit)
+				return
+			}
+			writeBadRequest(w, "The 'intent' field must be followed by the file part")
+			return
+		}
+		defer part.Close()
+		filename, msg := sanitizeFilename(partFilename(part))
+		if msg.Text != "" {
+			writeMessage(w, http.StatusBadRequest, "bad_request", msg)
+			return
+		}
+
+		var claim *keyClaim
+		if key := intent.targetKey(filename); key != "" {
+			var uerr *UploadError
+			claim, uerr = keys.Claim(r.Context(), key, intent.OnConflict)
+			if uerr != nil {
+				writeUploadError(w, uerr)
+				return
+			}
+			defer claim.Release()
+		}
+
+		meta := UploadMeta{
+			MaxBytes:     limit,
+			NotifyEmail:  notifyAddress(r),
+			Tags:         intent.Tags,
+			Description:  intent.Description,
+			ExpiresAt:    intent.ExpiresAt,
+			SchemaID:     intent.SchemaID,
+			Checksum:     intent.Checksum,
+			DeclaredSize: declared,
+			DeclaredRows: intent.Rows,
+			Intent:       &intent,
+			DryRun:       r.URL.Query().Get("dryRun") == "true",
+			CustomerKey:  customer,
+		}
+		if claim != nil {
+			meta.Key = claim.Key
+		}
+		rec, uerr := in.Receive(r.Context(), &limitFile{r: part, n: limit}, filename, meta)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		resp := newUploadResponse(rec)
+		resp.DryRun = meta.DryRun
+		if claim != nil && !meta.DryRun {
+			resp.Version, err = keys.Bind(context.WithoutCancel(r.Context()), claim, rec)
+			if err != nil {
+				log.Printf("bind key %q to %s: %v", claim.Key, rec.ID, err)
+				writeInternalError(w, "Failed to bind key")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrKeyNotFound = errors.New("object key not found")
+
+const (
+	ConflictReject    = "reject"
+	ConflictOverwrite = "overwrite"
+	ConflictVersion   = "version"
+)
+
+// ObjectKey binds a client-chosen key to the file currently stored under it.
+// Versions holds every file ever bound to the key, oldest first; with the
+// overwrite policy replaced files are purged and dropped from the list.
+type ObjectKey struct {
+	Key       string       `json:"key"`
+	FileID    string       `json:"fileId"`
+	Versions  []KeyVersion `json:"versions"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+type KeyVersion struct {
+	Version    int       `json:"version"`
+	FileID     string    `json:"fileId"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+type KeyStore interface {
+	GetKey(ctx context.Context, key string) (*ObjectKey, error)
+	PutKey(ctx context.Context, k *ObjectKey) error
+}
+
+// keyDocID maps a key, which may contain slashes, to a store-safe ID.
+func keyDocID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// cleanKey normalises a client key with the same rules as folders, and
+// rejects keys that could not be echoed back safely.
+func cleanKey(key string) (string, bool) {
+	if !utf8.ValidString(key) || len(key) > 1024 {
+		return "", false
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return "", false
+		}
+	}
+	key, ok := cleanFolder(key)
+	return key, ok && key != ""
+}
+
+type Keys struct {
+	store  KeyStore
+	files  MetadataStore
+	locker Locker
+	events *EventRelay
+}
+
+func NewKeys(store KeyStore, files MetadataStore, locker Locker, events *EventRelay) *Keys {
+	return &Keys{store: store, files: files, locker: locker, events: events}
+}
+
+// keyClaim is held for the duration of an upload to a key so concurrent
+// uploads to the same key are serialised.
+type keyClaim struct {
+	Key     string
+	Policy  string
+	prev    *ObjectKey
+	release func()
+}
+
+// Claim validates key and policy, locks the key and checks the policy
+// against the file currently bound to it. The caller must Release the claim.
+func (k *Keys) Claim(ctx context.Context, key, policy string) (*keyClaim, *UploadError) {
+	key, ok := cleanKey(key)
+	if !ok {
+		return nil, newUploadError(http.StatusBadRequest, "bad_request", "Invalid key")
+	}
+	switch policy {
+	case "":
+		policy = ConflictReject
+	case ConflictReject, ConflictOverwrite, ConflictVersion:
+	default:
+		return nil, newUploadError(http.StatusBadRequest, "bad_request", "Parameter 'onConflict' must be reject, overwrite or version")
+	}
+
+	release, ok, err := k.locker.TryLock(ctx, "key:"+keyDocID(key), 10*time.Minute)
+	if err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to lock key")
+	}
+	if !ok {
+		return nil, newUploadError(http.StatusConflict, "conflict", "Another upload to key '"+key+"' is in progress")
+	}
+	c := &keyClaim{Key: key, Policy: policy, release: release}
+
+	prev, err := k.store.GetKey(ctx, key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return c, nil
+	}
+	if err != nil {
+		release()
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to load key")
+	}
+	c.prev = prev
+
+	cur, err := k.files.Get(ctx, prev.FileID)
+	if errors.Is(err, ErrNotFound) {
+		return c, nil
+	}
+	if err != nil {
+		release()
+		return nil, newUploadError(http.StatusInternalServerError, "internal_server_error", "Failed to load file metadata")
+	}
+	switch policy {
+	case ConflictReject:
+		release()
+		return nil, newUploadError(http.StatusConflict, "conflict", "Key '"+key+"' already exists as file '"+cur.ID+"'")
+	case ConflictOverwrite:
+		if cur.Hold.Active(time.Now()) {
+			release()
+			return nil, newUploadError(http.StatusConflict, "conflict", "Key '"+key+"' refers to file '"+cur.ID+"' which is under legal hold")
+		}
+	}
+	return c, nil
+}
+
+func (c *keyClaim) Release() {
+	c.release()
+}
+
+// Bind points the claimed key at rec, which must already be committed, and
+// returns the version number rec was stored as.
+func (k *Keys) Bind(ctx context.Context, c *keyClaim, rec *FileRecord) (int, error) {
+	obj := &ObjectKey{Key: c.Key}
+	if c.prev != nil {
+		obj = c.prev
+	}
+	version := 1
+	if n := len(obj.Versions); n > 0 {
+		version = obj.Versions[n-1].Version + 1
+	}
+
+	var replaced []*FileRecord
+	if c.Policy == ConflictOverwrite {
+		// Files under legal hold cannot be purged, so they stay listed.
+		kept := obj.Versions[:0]
+		now := time.Now()
+		for _, v := range obj.Versions {
+			old, err := k.files.Get(ctx, v.FileID)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil || old.Hold.Active(now) {
+				kept = append(kept, v)
+				continue
+			}
+			replaced = append(replaced, old)
+		}
+		obj.Versions = kept
+	}
+	obj.Versions = append(obj.Versions, KeyVersion{Version: version, FileID: rec.ID, UploadedAt: rec.UploadedAt})
+	obj.FileID = rec.ID
+	obj.UpdatedAt = time.Now().UTC()
+	if err := k.store.PutKey(ctx, obj); err != nil {
+		return 0, err
+	}
+
+	for _, old := range replaced {
+		if _, err := purgeFile(ctx, k.files, old); err != nil {
+			log.Printf("keys: purge replaced %s: %v", old.ID, err)
+			continue
+		}
+		k.events.Emit(EventFileDeleted, old)
+	}
+	return version, nil
+}
+
+// ObjectHandler serves GET/HEAD /v1/objects/{key}[?version=N] by resolving
+// the key to a file ID and delegating to download.
+func (k *Keys) ObjectHandler(download http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := cleanKey(r.PathValue("key"))
+		if !ok {
+			writeNotFound(w, "No route for "+r.URL.Path)
+			return
+		}
+		obj, err := k.store.GetKey(r.Context(), key)
+		if errors.Is(err, ErrKeyNotFound) {
+			writeNotFound(w, "Key '"+key+"' not found")
+			return
+		}
+		if err != nil {
+			writeInternalError(w, "Failed to load key")
+			return
+		}
+		id, class := obj.FileID, CacheLatest
+		if v := r.URL.Query().Get("version"); v != "" {
+			class = CacheImmutable
+			id = ""
+			for _, kv := range obj.Versions {
+				if strconv.Itoa(kv.Version) == v {
+					id = kv.FileID
+				}
+			}
+			if id == "" {
+				writeNotFound(w, "Key '"+key+"' has no version "+v)
+				return
+			}
+		}
+		download(w, withCacheClass(withFileID(r, id), class))
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// awsKMS wraps data keys with AWS KMS Encrypt and Decrypt; see awsCall for
+// credentials.
+type awsKMS struct {
+	keyID string
+}
+
+func (k awsKMS) ID() string { return "awskms:" + k.keyID }
+
+func (k awsKMS) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	var out struct {
+		CiphertextBlob []byte
+	}
+	err := awsCall(ctx, "kms", "TrentService.Encrypt", map[string]any{"KeyId": k.keyID, "Plaintext": dek}, &out)
+	return out.CiphertextBlob, err
+}
+
+func (k awsKMS) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	err := awsCall(ctx, "kms", "TrentService.Decrypt", map[string]any{"KeyId": k.keyID, "CiphertextBlob": wrapped}, &out)
+	return out.Plaintext, err
+}
+
+// gcpKMS wraps data keys with Cloud KMS encrypt and decrypt. It
+// authenticates with UPLOAD_GCP_ACCESS_TOKEN when set, which may be a
+// secret reference kept fresh by a sidecar, and otherwise with the
+// service account of the instance from the metadata server.
+type gcpKMS struct {
+	name  string
+	token *Secret
+
+	mu      sync.Mutex
+	cached  string
+	expires time.Time
+}
+
+func (k *gcpKMS) ID() string { return "gcpkms:" + k.name }
+
+func (k *gcpKMS) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	var out struct {
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	err := k.call(ctx, "encrypt", map[string][]byte{"plaintext": dek}, &out)
+	return out.Ciphertext, err
+}
+
+func (k *gcpKMS) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	err := k.call(ctx, "decrypt", map[string][]byte{"ciphertext": wrapped}, &out)
+	return out.Plaintext, err
+}
+
+func (k *gcpKMS) call(ctx context.Context, method string, in, out any) error {
+	token, err := k.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://cloudkms.googleapis.com/v1/"+k.name+":"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func (k *gcpKMS) accessToken(ctx context.Context) (string, error) {
+	if v := k.token.Value(); v != "" {
+		return v, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cached != "" && time.Now().Before(k.expires) {
+		return k.cached, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("GCP metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GCP metadata server: %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("GCP metadata server: %w", err)
+	}
+	k.cached = tok.AccessToken
+	k.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return k.cached, nil
+}
+
+// ageIdentity wraps data keys to an age X25519 identity the way age wraps
+// file keys: an ephemeral X25519 share, and the key sealed with
+// ChaCha20-Poly1305 under an HKDF of the shared secret. The wrapped form is
+// the 32-byte share followed by the sealed key. The ID is the identity's
+// public age1... recipient.
+type ageIdentity struct {
+	scalar    []byte
+	recipient []byte
+}
+
+const ageX25519Label = "age-encryption.org/v1/X25519"
+
+// loadAgeIdentity reads the first AGE-SECRET-KEY-1 line of an age identity
+// file, as written by age-keygen.
+func loadAgeIdentity(path string) (*ageIdentity, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "AGE-SECRET-KEY-1") {
+			continue
+		}
+		hrp, scalar, err := bech32Decode(line)
+		if err != nil || hrp != "age-secret-key-" || len(scalar) != curve25519.ScalarSize {
+			return nil, fmt.Errorf("%s: malformed age identity", path)
+		}
+		pub, err := curve25519.X25519(scalar, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		return &ageIdentity{scalar: scalar, recipient: pub}, nil
+	}
+	return nil, fmt.Errorf("%s: no AGE-SECRET-KEY-1 identity found", path)
+}
+
+func (a *ageIdentity) ID() string {
+	return "age:" + bech32Encode("age", a.recipient)
+}
+
+func (a *ageIdentity) wrapKey(share, shared []byte) ([]byte, error) {
+	salt := append(append([]byte{}, share...), a.recipient...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(ageX25519Label)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (a *ageIdentity) Wrap(_ context.Context, dek []byte) ([]byte, error) {
+	eph := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(eph); err != nil {
+		return nil, err
+	}
+	share, err := curve25519.X25519(eph, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(eph, a.recipient)
+	if err != nil {
+		return nil, err
+	}
+	key, err := a.wrapKey(share, shared)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(share, make([]byte, chacha20poly1305.NonceSize), dek, nil), nil
+}
+
+func (a *ageIdentity) Unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < curve25519.PointSize+chacha20poly1305.Overhead {
+		return nil, errors.New("wrapped key is too short")
+	}
+	share := wrapped[:curve25519.PointSize]
+	shared, err := curve25519.X25519(a.scalar, share)
+	if err != nil {
+		return nil, err
+	}
+	key, err := a.wrapKey(share, shared)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped[curve25519.PointSize:], nil)
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range 5 {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+	for _, c := range hrp {
+		out = append(out, byte(c>>5))
+	}
+	out = append(out, 0)
+	for _, c := range hrp {
+		out = append(out, byte(c&31))
+	}
+	return out
+}
+
+// convertBits regroups data from groups of from bits into groups of to.
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc, bits uint
+	var out []byte
+	maxv := uint(1)<<to - 1
+	for _, v := range data {
+		acc = acc<<from | uint(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("bech32: invalid padding")
+	}
+	return out, nil
+}
+
+// bech32Decode decodes a Bech32 string of any length (age keys exceed the
+// 90 characters BIP 173 allows).
+func bech32Decode(s string) (string, []byte, error) {
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("bech32: malformed")
+	}
+	hrp := s[:pos]
+	data := make([]byte, 0, len(s)-pos-1)
+	for _, c := range s[pos+1:] {
+		i := strings.IndexRune(bech32Charset, c)
+		if i < 0 {
+			return "", nil, errors.New("bech32: invalid character")
+		}
+		data = append(data, byte(i))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), data...)) != 1 {
+		return "", nil, errors.New("bech32: bad checksum")
+	}
+	b, err := convertBits(data[:len(data)-6], 5, 8, false)
+	return hrp, b, err
+}
+
+func bech32Encode(hrp string, b []byte) string {
+	data, _ := convertBits(b, 8, 5, true)
+	values := append(bech32HRPExpand(hrp), data...)
+	mod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ 1
+	var sb strings.Builder
+	sb.WriteString(hrp + "1")
+	for _, v := range data {
+		sb.WriteByte(bech32Charset[v])
+	}
+	for i := range 6 {
+		sb.WriteByte(bech32Charset[(mod>>(5*(5-i)))&31])
+	}
+	return sb.String()
+}
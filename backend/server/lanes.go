@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	LaneSmall = "small"
+	LaneLarge = "large"
+)
+
+// Lanes caps concurrent uploads at a fixed number of worker slots, holding
+// some back for small uploads so interactive users are not queued behind
+// bulk transfers. Small uploads may take any free slot; large uploads (and
+// uploads of unknown size) only the shared ones.
+type Lanes struct {
+	shared    chan struct{}
+	reserved  chan struct{}
+	threshold int64
+	maxWait   time.Duration
+}
+
+func NewLanes(slots, reservedSmall int, threshold int64, maxWait time.Duration) *Lanes {
+	reservedSmall = min(reservedSmall, slots-1)
+	return &Lanes{
+		shared:    make(chan struct{}, slots-reservedSmall),
+		reserved:  make(chan struct{}, reservedSmall),
+		threshold: threshold,
+		maxWait:   maxWait,
+	}
+}
+
+// lane classifies a request by its declared size, from X-Upload-Length or
+// Content-Length.
+func (l *Lanes) lane(r *http.Request) string {
+	size := r.ContentLength
+	if n, err := strconv.ParseInt(r.Header.Get("X-Upload-Length"), 10, 64); err == nil {
+		size = n
+	}
+	if size >= 0 && size < l.threshold {
+		return LaneSmall
+	}
+	return LaneLarge
+}
+
+// acquire waits for a slot in lane and returns its release func.
+func (l *Lanes) acquire(ctx context.Context, lane string) (func(), error) {
+	depth := metrics.Gauge("upload_lane_queue_depth", "Uploads waiting for a worker slot.", "lane", lane)
+	active := metrics.Gauge("upload_lane_active", "Uploads holding a worker slot.", "lane", lane)
+	depth.Inc()
+	defer depth.Add(-1)
+
+	reserved := l.reserved
+	if lane != LaneSmall {
+		reserved = nil
+	}
+	var slot chan struct{}
+	select {
+	case l.shared <- struct{}{}:
+		slot = l.shared
+	case reserved <- struct{}{}:
+		slot = reserved
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	active.Inc()
+	return func() {
+		active.Add(-1)
+		<-slot
+	}, nil
+}
+
+// Wrap schedules POST, PUT and PATCH requests through the lanes; other
+// methods pass straight through. A request that waits longer than maxWait
+// gets a 503 with Retry-After.
+func (l *Lanes) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			next(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), l.maxWait)
+		release, err := l.acquire(ctx, l.lane(r))
+		cancel()
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			w.Header().Set("Retry-After", "5")
+			writeError(w, http.StatusServiceUnavailable, "service_unavailable", "All upload slots are busy; retry later")
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// File lifecycle states. A resumable upload is "uploading" until it is
+// completed; a committed file is "scanning" while async checks run and
+// "available" once they pass. Failing a check moves it to "quarantined",
+// where it stays out of downloads until an admin releases or purges it.
+// Purged records are removed, so "deleted" only appears in events.
+const (
+	StateUploading   = "uploading"
+	StateScanning    = "scanning"
+	StateAvailable   = "available"
+	StateQuarantined = "quarantined"
+	StateDeleted     = "deleted"
+)
+
+var stateTransitions = map[string][]string{
+	StateUploading:   {StateScanning, StateAvailable, StateDeleted},
+	StateScanning:    {StateAvailable, StateQuarantined, StateDeleted},
+	StateAvailable:   {StateQuarantined, StateDeleted},
+	StateQuarantined: {StateAvailable, StateDeleted},
+}
+
+// checkTimeout bounds the async checks for one file.
+const checkTimeout = 10 * time.Minute
+
+type Quarantine struct {
+	Check  string    `json:"check"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// state reports the lifecycle state, treating records written before it was
+// tracked as available unless the scrubber had flagged them.
+func (r *FileRecord) state() string {
+	if r.State != "" {
+		return r.State
+	}
+	if r.Quarantined {
+		return StateQuarantined
+	}
+	return StateAvailable
+}
+
+func (r *FileRecord) transition(to string) error {
+	from := r.state()
+	if !slices.Contains(stateTransitions[from], to) {
+		return fmt.Errorf("file %s cannot move from %s to %s", r.ID, from, to)
+	}
+	r.State = to
+	r.Quarantined = false
+	if to != StateQuarantined {
+		r.Quarantine = nil
+	}
+	return nil
+}
+
+func (r *FileRecord) quarantine(check, reason string) error {
+	if err := r.transition(StateQuarantined); err != nil {
+		return err
+	}
+	r.Quarantine = &Quarantine{Check: check, Reason: reason, At: time.Now().UTC()}
+	return nil
+}
+
+// unavailable writes the response for a file that cannot be served in its
+// current state and reports whether it did.
+func unavailable(w http.ResponseWriter, rec *FileRecord) bool {
+	switch rec.state() {
+	case StateQuarantined:
+		writeMessage(w, http.StatusConflict, "conflict", newMessage("file_quarantined", "id", rec.ID))
+	case StateScanning:
+		writeMessage(w, http.StatusConflict, "conflict", newMessage("file_scanning", "id", rec.ID))
+	default:
+		return false
+	}
+	return true
+}
+
+// FileCheck inspects a committed file. A non-empty reason fails the check
+// and quarantines the file; an error means the check could not run, which
+// quarantines it too rather than let an unchecked file through.
+type FileCheck interface {
+	Name() string
+	Check(ctx context.Context, rec *FileRecord) (reason string, err error)
+}
+
+// Checker runs the async checks on newly committed files, a few at a time,
+// and moves each to available or quarantined. It keeps the progress of
+// files it is working on and wakes anyone waiting for a change.
+type Checker struct {
+	store  MetadataStore
+	locker Locker
+	events *EventRelay
+	audit  *AuditLog
+	checks []FileCheck
+	sem    chan struct{}
+
+	mu       sync.Mutex
+	progress map[string]*CheckProgress
+	changed  chan struct{}
+}
+
+// CheckProgress is how far the checks for one file have got.
+type CheckProgress struct {
+	Total     int    `json:"total"`
+	Completed int    `json:"completed"`
+	Current   string `json:"current,omitempty"`
+	Queued    bool   `json:"queued,omitempty"`
+}
+
+func NewChecker(store MetadataStore, locker Locker, events *EventRelay, audit *AuditLog, checks ...FileCheck) *Checker {
+	return &Checker{
+		store:    store,
+		locker:   locker,
+		events:   events,
+		audit:    audit,
+		checks:   checks,
+		sem:      make(chan struct{}, 4),
+		progress: map[string]*CheckProgress{},
+		changed:  make(chan struct{}),
+	}
+}
+
+// Progress returns a copy of the file's check progress, or nil when this
+// process is not checking it.
+func (c *Checker) Progress(id string) *CheckProgress {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.progress[id]; ok {
+		cp := *p
+		return &cp
+	}
+	return nil
+}
+
+// Changed returns a channel that is closed the next time any file's
+// progress or state moves.
+func (c *Checker) Changed() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changed
+}
+
+// setProgress records p for id, or forgets id when p is nil, and wakes
+// waiters.
+func (c *Checker) setProgress(id string, p *CheckProgress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p == nil {
+		delete(c.progress, id)
+	} else {
+		c.progress[id] = p
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Enabled reports whether new files need scanning. A nil *Checker has no
+// checks.
+func (c *Checker) Enabled() bool {
+	return c != nil && len(c.checks) > 0
+}
+
+// Scan checks the file with the given ID if it is still scanning.
+func (c *Checker) Scan(id string) {
+	c.setProgress(id, &CheckProgress{Total: len(c.checks), Queued: true})
+	defer c.setProgress(id, nil)
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	rec, err := c.store.Get(ctx, id)
+	if err != nil {
+		log.Printf("checks: load %s: %v", id, err)
+		return
+	}
+	if rec.state() != StateScanning {
+		return
+	}
+	failed, reason := c.run(ctx, rec, func(i int, fc FileCheck) {
+		c.setProgress(id, &CheckProgress{Total: len(c.checks), Completed: i, Current: fc.Name()})
+	})
+
+	// A file no longer scanning was released, quarantined or purged while
+	// the checks ran; its outcome stands.
+	event := EventFileAvailable
+	scanned := false
+	rec, err = updateRecord(ctx, c.store, c.locker, id, func(rec *FileRecord) error {
+		if rec.state() != StateScanning {
+			return errNoChange
+		}
+		scanned = true
+		if failed != nil {
+			event = EventFileQuarantined
+			return rec.quarantine(failed.Name(), reason)
+		}
+		return rec.transition(StateAvailable)
+	})
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("checks: update %s: %v", id, err)
+		}
+		return
+	}
+	if !scanned {
+		return
+	}
+	if failed != nil {
+		metrics.Counter("upload_checks_quarantined_total", "Files quarantined by async checks, by check.", "check", failed.Name()).Inc()
+		c.audit.Record(AuditEvent{Action: "quarantined", FileID: id, Actor: failed.Name(), Detail: reason})
+	}
+	c.events.Emit(event, rec)
+}
+
+// run runs the checks on rec in order, calling started before each, and
+// returns the first that fails with its reason, or nil.
+func (c *Checker) run(ctx context.Context, rec *FileRecord, started func(i int, fc FileCheck)) (FileCheck, string) {
+	for i, fc := range c.checks {
+		started(i, fc)
+		r, err := fc.Check(ctx, rec)
+		if err != nil {
+			log.Printf("checks: %s %s: %v", fc.Name(), rec.ID, err)
+			r = "check could not run: " + err.Error()
+		}
+		if r != "" {
+			return fc, r
+		}
+	}
+	return nil, ""
+}
+
+// Resume restarts the checks for files left scanning by a previous process.
+func (c *Checker) Resume(ctx context.Context) {
+	recs, err := c.store.List(ctx)
+	if err != nil {
+		log.Printf("checks: list: %v", err)
+		return
+	}
+	for _, rec := range recs {
+		if rec.state() == StateScanning {
+			if c.Enabled() {
+				go c.Scan(rec.ID)
+				continue
+			}
+			// Checks were switched off while it waited.
+			_, err := updateRecord(ctx, c.store, c.locker, rec.ID, func(rec *FileRecord) error {
+				if rec.state() != StateScanning {
+					return errNoChange
+				}
+				return rec.transition(StateAvailable)
+			})
+			if err != nil {
+				log.Printf("checks: update %s: %v", rec.ID, err)
+			}
+		}
+	}
+}
+
+type ReleaseRequest struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// QuarantineHandler lists quarantined files (GET) or releases one back to
+// available (POST). Quarantined files are removed for good through the
+// purge endpoint.
+func QuarantineHandler(store MetadataStore, locker Locker, audit *AuditLog, events *EventRelay) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			recs, err := store.List(r.Context())
+			if err != nil {
+				writeInternalError(w, "Failed to list files")
+				return
+			}
+			out := []*FileRecord{}
+			for _, rec := range recs {
+				if rec.state() == StateQuarantined {
+					out = append(out, rec)
+				}
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i].UploadedAt.Before(out[j].UploadedAt) })
+			writeJSON(w, http.StatusOK, out)
+
+		case http.MethodPost:
+			var req ReleaseRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			if req.ID == "" {
+				writeBadRequest(w, "Field 'id' is required")
+				return
+			}
+			detail := req.Reason
+			rec, err := updateRecord(r.Context(), store, locker, req.ID, func(rec *FileRecord) error {
+				if rec.state() != StateQuarantined {
+					return newUploadError(http.StatusConflict, "conflict", "File '"+rec.ID+"' is not quarantined")
+				}
+				if rec.Quarantine != nil {
+					detail = rec.Quarantine.Check + ": " + rec.Quarantine.Reason + "; " + req.Reason
+				}
+				if err := rec.transition(StateAvailable); err != nil {
+					return newUploadError(http.StatusConflict, "conflict", err.Error())
+				}
+				return nil
+			})
+			if err != nil {
+				writeUpdateError(w, req.ID, err)
+				return
+			}
+			audit.Record(AuditEvent{Action: "released", FileID: rec.ID, Actor: "admin", Detail: detail})
+			events.Emit(EventFileAvailable, rec)
+			writeJSON(w, http.StatusOK, rec)
+
+		default:
+			writeMethodNotAllowed(w, "Only GET and POST methods are allowed for quarantine")
+		}
+	}
+}
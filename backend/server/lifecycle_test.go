@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+	}{
+		{StateUploading, StateScanning, true},
+		{StateScanning, StateAvailable, true},
+		{StateScanning, StateQuarantined, true},
+		{StateQuarantined, StateAvailable, true},
+		{"", StateQuarantined, true},
+		{StateAvailable, StateScanning, false},
+		{StateQuarantined, StateScanning, false},
+		{StateUploading, StateQuarantined, false},
+	}
+	for _, tt := range tests {
+		rec := &FileRecord{ID: "f", State: tt.from, Quarantine: &Quarantine{Check: "old"}}
+		err := rec.transition(tt.to)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q -> %q: err = %v, want ok = %v", tt.from, tt.to, err, tt.ok)
+			continue
+		}
+		if tt.ok && (rec.State != tt.to || (tt.to != StateQuarantined) != (rec.Quarantine == nil)) {
+			t.Errorf("%q -> %q: got %+v", tt.from, tt.to, rec)
+		}
+	}
+}
+
+type stubCheck struct {
+	reason string
+	err    error
+}
+
+func (stubCheck) Name() string { return "stub" }
+
+func (c stubCheck) Check(context.Context, *FileRecord) (string, error) { return c.reason, c.err }
+
+// A scanning file becomes available when every check passes and is
+// quarantined, and kept from downloads, when one fails or cannot run.
+func TestCheckerScan(t *testing.T) {
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	locker := newLocalLocker()
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := DownloadHandler(db, db, nil)
+
+	tests := []struct {
+		name   string
+		check  stubCheck
+		state  string
+		status int
+	}{
+		{"passes", stubCheck{}, StateAvailable, http.StatusOK},
+		{"fails", stubCheck{reason: "looks malicious"}, StateQuarantined, http.StatusConflict},
+		{"cannot run", stubCheck{err: errors.New("scanner down")}, StateQuarantined, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			rec := testRecord(t, in)
+			if _, err := updateRecord(ctx, db, locker, rec.ID, func(cur *FileRecord) error {
+				cur.State = StateScanning
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			NewChecker(db, locker, nil, audit, tt.check).Scan(rec.ID)
+			got, err := db.Get(ctx, rec.ID)
+			if err != nil || got.state() != tt.state {
+				t.Fatalf("after scan: %+v, %v; want state %s", got, err, tt.state)
+			}
+			if tt.state == StateQuarantined && (got.Quarantine == nil || got.Quarantine.Check != "stub") {
+				t.Errorf("quarantine = %+v", got.Quarantine)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/v1/files/"+rec.ID, nil)
+			req.SetPathValue("id", rec.ID)
+			w := httptest.NewRecorder()
+			download(w, req)
+			if w.Code != tt.status {
+				t.Errorf("download: %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+		})
+	}
+}
+
+// A quarantined file is kept out of listings and downloads until an admin
+// releases it, and an admin can purge it instead.
+func TestQuarantineWorkflow(t *testing.T) {
+	ctx := context.Background()
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	locker := newLocalLocker()
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantine := QuarantineHandler(db, locker, audit, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/files", ListHandler(db))
+	mux.HandleFunc("GET /v1/files/{id}", DownloadHandler(db, db, nil))
+	mux.HandleFunc("GET /v1/admin/quarantine", quarantine)
+	mux.HandleFunc("POST /v1/admin/quarantine/release", quarantine)
+	mux.HandleFunc("POST /v1/admin/purge", PurgeHandler(NewPurger(db, db, locker, audit), NewSigner(StaticSecret("k")), audit, nil))
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	quarantineFile := func(id string) {
+		t.Helper()
+		if _, err := updateRecord(ctx, db, locker, id, func(rec *FileRecord) error { return rec.quarantine("virus", "EICAR test file") }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The two files have the same content, so one names the other as what
+	// it duplicates; only the IDs of the files listed count.
+	visible := func(id string) (listed, quarantined bool, download int) {
+		var page struct{ Files []FileMetadata }
+		var held []*FileRecord
+		if err := json.Unmarshal(do(http.MethodGet, "/v1/files", "").Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(do(http.MethodGet, "/v1/admin/quarantine", "").Body.Bytes(), &held); err != nil {
+			t.Fatal(err)
+		}
+		return slices.ContainsFunc(page.Files, func(f FileMetadata) bool { return f.ID == id }),
+			slices.ContainsFunc(held, func(rec *FileRecord) bool { return rec.ID == id }),
+			do(http.MethodGet, "/v1/files/"+id, "").Code
+	}
+
+	clean := testRecord(t, in)
+	rec := testRecord(t, in)
+	quarantineFile(rec.ID)
+	if listed, quarantined, download := visible(rec.ID); listed || !quarantined || download != http.StatusConflict {
+		t.Errorf("quarantined: listed %v, in quarantine %v, download %d", listed, quarantined, download)
+	}
+	if listed, quarantined, download := visible(clean.ID); !listed || quarantined || download != http.StatusOK {
+		t.Errorf("available: listed %v, in quarantine %v, download %d", listed, quarantined, download)
+	}
+
+	for _, tt := range []struct {
+		name, body string
+		status     int
+	}{
+		{"not quarantined", `{"id": "` + clean.ID + `"}`, http.StatusConflict},
+		{"no ID", `{"reason": "x"}`, http.StatusBadRequest},
+		{"unknown file", `{"id": "nosuch"}`, http.StatusNotFound},
+	} {
+		if w := do(http.MethodPost, "/v1/admin/quarantine/release", tt.body); w.Code != tt.status {
+			t.Errorf("release %s: %d %s, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+	}
+	if w := do(http.MethodPost, "/v1/admin/quarantine/release", `{"id": "`+rec.ID+`", "reason": "false positive"}`); w.Code != http.StatusOK {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+	if got, err := db.Get(ctx, rec.ID); err != nil || got.state() != StateAvailable || got.Quarantine != nil {
+		t.Errorf("after release: %+v, %v", got, err)
+	}
+	if listed, quarantined, download := visible(rec.ID); !listed || quarantined || download != http.StatusOK {
+		t.Errorf("released: listed %v, in quarantine %v, download %d", listed, quarantined, download)
+	}
+
+	quarantineFile(rec.ID)
+	if w := do(http.MethodPost, "/v1/admin/purge", `{"id": "`+rec.ID+`", "reason": "malware"}`); w.Code != http.StatusOK {
+		t.Fatalf("purge: %d %s", w.Code, w.Body)
+	}
+	if _, err := db.Get(ctx, rec.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("purged record: %v", err)
+	}
+	if _, quarantined, download := visible(rec.ID); quarantined || download != http.StatusNotFound {
+		t.Errorf("purged: in quarantine %v, download %d", quarantined, download)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SizeLimits resolves the maximum file size for a request. Overrides are
+// keyed by tenant (X-Tenant-ID), API key (X-API-Key) and bucket, the first
+// segment of the object key. Identity headers are taken as sent; pair them
+// with an authenticating proxy before granting raised limits. When several
+// overrides apply the smallest wins; Default applies when none do.
+type SizeLimits struct {
+	Default int64            `json:"default"`
+	Tenants map[string]int64 `json:"tenants,omitempty"`
+	APIKeys map[string]int64 `json:"apiKeys,omitempty"`
+	Buckets map[string]int64 `json:"buckets,omitempty"`
+
+	// BucketLimit, when set, adds the limits of buckets declared through
+	// the admin API.
+	BucketLimit func(bucket string) (int64, bool) `json:"-"`
+}
+
+// LoadSizeLimits reads overrides from path, a JSON SizeLimits document. An
+// empty path yields def for every request.
+func LoadSizeLimits(path string, def int64) (*SizeLimits, error) {
+	l := &SizeLimits{Default: def}
+	if path == "" {
+		return l, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil, err
+	}
+	if l.Default <= 0 {
+		l.Default = def
+	}
+	return l, nil
+}
+
+func (l *SizeLimits) For(r *http.Request) int64 {
+	var limit int64
+	apply := func(m map[string]int64, k string) {
+		if n, ok := m[k]; ok && k != "" && (limit == 0 || n < limit) {
+			limit = n
+		}
+	}
+	apply(l.Tenants, r.Header.Get("X-Tenant-ID"))
+	apply(l.APIKeys, r.Header.Get("X-API-Key"))
+	if key, ok := cleanKey(r.URL.Query().Get("key")); ok {
+		bucket, _, _ := strings.Cut(key, "/")
+		apply(l.Buckets, bucket)
+		if l.BucketLimit != nil {
+			if n, ok := l.BucketLimit(bucket); ok && bucket != "" && (limit == 0 || n < limit) {
+				limit = n
+			}
+		}
+	}
+	if limit == 0 {
+		return l.Default
+	}
+	return limit
+}
+
+func fileTooLargeMessage(limit int64) Message {
+	size := strconv.FormatInt(limit, 10) + " bytes"
+	if limit%(1<<20) == 0 {
+		size = strconv.FormatInt(limit>>20, 10) + "MB"
+	}
+	return newMessage("file_too_large", "limit", size)
+}
+
+func writeFileTooLarge(w http.ResponseWriter, limit int64) {
+	writeMessage(w, http.StatusRequestEntityTooLarge, "request_entity_too_large", fileTooLargeMessage(limit))
+}
+
+// writeUploadOptions answers OPTIONS on an upload route with the methods it
+// accepts and the size limit that applies to the caller.
+func writeUploadOptions(w http.ResponseWriter, allow string, limit int64) {
+	w.Header().Set("Allow", allow)
+	w.Header().Set("X-Upload-Max-Bytes", strconv.FormatInt(limit, 10))
+	writeJSON(w, http.StatusOK, map[string]int64{"maxUploadBytes": limit})
+}
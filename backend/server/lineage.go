@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Lineage operations. Derivations between stored files carry Lineage;
+// files pulled from outside (imports, SFTP, the drop folder) record where
+// they came from in FileRecord.Source instead, and show up in the graph
+// as an import edge from an external node.
+const (
+	LineageQuery  = "query"
+	LineageImport = "import"
+	LineageDelta  = "delta"
+)
+
+// Lineage records how a file was derived from other stored files, so an
+// extract can be traced back to what it was cut from.
+type Lineage struct {
+	Operation string   `json:"operation"`
+	Sources   []string `json:"sources"`
+	Query     string   `json:"query,omitempty"`
+}
+
+// lineageMaxNodes bounds the graph returned for one file.
+const lineageMaxNodes = 500
+
+type LineageNode struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"` // "file" or "external"
+	Filename   string     `json:"filename,omitempty"`
+	UploadedAt *time.Time `json:"uploadedAt,omitempty"`
+	Missing    bool       `json:"missing,omitempty"`
+}
+
+type LineageEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Operation string `json:"operation"`
+	Query     string `json:"query,omitempty"`
+}
+
+type LineageGraph struct {
+	Root      string        `json:"root"`
+	Nodes     []LineageNode `json:"nodes"`
+	Edges     []LineageEdge `json:"edges"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+type lineageBuilder struct {
+	g     LineageGraph
+	nodes map[string]bool
+	edges map[LineageEdge]bool
+}
+
+func (b *lineageBuilder) full() bool {
+	if len(b.g.Nodes) >= lineageMaxNodes {
+		b.g.Truncated = true
+		return true
+	}
+	return false
+}
+
+// addFile adds rec as a node and reports whether it was new.
+func (b *lineageBuilder) addFile(rec *FileRecord) bool {
+	if b.nodes[rec.ID] {
+		return false
+	}
+	b.nodes[rec.ID] = true
+	at := rec.UploadedAt
+	b.g.Nodes = append(b.g.Nodes, LineageNode{ID: rec.ID, Kind: "file", Filename: rec.Filename, UploadedAt: &at})
+	if rec.Source != "" && !b.nodes[rec.Source] {
+		b.nodes[rec.Source] = true
+		b.g.Nodes = append(b.g.Nodes, LineageNode{ID: rec.Source, Kind: "external"})
+	}
+	if rec.Source != "" {
+		b.addEdge(LineageEdge{From: rec.Source, To: rec.ID, Operation: LineageImport})
+	}
+	return true
+}
+
+func (b *lineageBuilder) addEdge(e LineageEdge) {
+	if !b.edges[e] {
+		b.edges[e] = true
+		b.g.Edges = append(b.g.Edges, e)
+	}
+}
+
+func derivedEdge(src string, rec *FileRecord) LineageEdge {
+	return LineageEdge{From: src, To: rec.ID, Operation: rec.Lineage.Operation, Query: rec.Lineage.Query}
+}
+
+// LineageHandler returns the derivation graph around a file:
+// GET /v1/files/{id}/lineage. ?direction= picks "upstream" (what the file
+// was made from, the default), "downstream" (what was made from it) or
+// "both"; ?depth= limits how many derivation steps are followed.
+func LineageHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		direction := r.URL.Query().Get("direction")
+		if direction == "" {
+			direction = "upstream"
+		}
+		if direction != "upstream" && direction != "downstream" && direction != "both" {
+			writeBadRequest(w, "Parameter 'direction' must be upstream, downstream or both")
+			return
+		}
+		depth := 10
+		if v := r.URL.Query().Get("depth"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 100 {
+				writeBadRequest(w, "Parameter 'depth' must be between 1 and 100")
+				return
+			}
+			depth = n
+		}
+		root, ok := loadRecord(w, r, store, r.PathValue("id"))
+		if !ok {
+			return
+		}
+
+		b := &lineageBuilder{
+			g:     LineageGraph{Root: root.ID, Nodes: []LineageNode{}, Edges: []LineageEdge{}},
+			nodes: map[string]bool{},
+			edges: map[LineageEdge]bool{},
+		}
+		b.addFile(root)
+
+		if direction != "downstream" {
+			level := []*FileRecord{root}
+			for d := 0; d < depth && len(level) > 0 && !b.g.Truncated; d++ {
+				var next []*FileRecord
+				for _, rec := range level {
+					if rec.Lineage == nil {
+						continue
+					}
+					for _, src := range rec.Lineage.Sources {
+						b.addEdge(derivedEdge(src, rec))
+						if b.nodes[src] || b.full() {
+							continue
+						}
+						parent, err := store.Get(r.Context(), src)
+						if errors.Is(err, ErrNotFound) {
+							b.nodes[src] = true
+							b.g.Nodes = append(b.g.Nodes, LineageNode{ID: src, Kind: "file", Missing: true})
+							continue
+						}
+						if err != nil {
+							writeInternalError(w, "Failed to load file metadata")
+							return
+						}
+						b.addFile(parent)
+						next = append(next, parent)
+					}
+				}
+				level = next
+			}
+		}
+
+		if direction != "upstream" {
+			// Derivations only point at their sources, so finding what was
+			// made from a file means looking at every record.
+			recs, err := store.List(r.Context())
+			if err != nil {
+				writeInternalError(w, "Failed to list files")
+				return
+			}
+			children := map[string][]*FileRecord{}
+			for _, rec := range recs {
+				if rec.Lineage != nil {
+					for _, src := range rec.Lineage.Sources {
+						children[src] = append(children[src], rec)
+					}
+				}
+			}
+			level := []string{root.ID}
+			seen := map[string]bool{root.ID: true}
+			for d := 0; d < depth && len(level) > 0 && !b.g.Truncated; d++ {
+				var next []string
+				for _, id := range level {
+					for _, child := range children[id] {
+						if !b.nodes[child.ID] && b.full() {
+							break
+						}
+						b.addFile(child)
+						b.addEdge(derivedEdge(id, child))
+						if !seen[child.ID] {
+							seen[child.ID] = true
+							next = append(next, child.ID)
+						}
+					}
+				}
+				level = next
+			}
+		}
+		writeJSON(w, http.StatusOK, b.g)
+	}
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	listDefaultLimit = 100
+	listMaxLimit     = 1000
+)
+
+// fileFilter is the parsed query of a list request.
+type fileFilter struct {
+	SHA256         string
+	MinSize        int64
+	MaxSize        int64 // zero means no upper bound
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+	ContentType    string
+}
+
+func parseFileFilter(q url.Values) (fileFilter, string) {
+	var f fileFilter
+	if v := q.Get("sha256"); v != "" {
+		sum, ok := parseChecksum(v)
+		if !ok {
+			return f, "Parameter 'sha256' must be a hex SHA-256 digest"
+		}
+		f.SHA256 = sum
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"minSize", &f.MinSize}, {"maxSize", &f.MaxSize}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return f, "Parameter '" + p.name + "' must be a non-negative number of bytes"
+			}
+			*p.dst = n
+		}
+	}
+	if f.MaxSize > 0 && f.MaxSize < f.MinSize {
+		return f, "Parameter 'maxSize' must not be less than 'minSize'"
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"uploadedAfter", &f.UploadedAfter}, {"uploadedBefore", &f.UploadedBefore}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, "Parameter '" + p.name + "' must be an RFC 3339 timestamp"
+			}
+			*p.dst = t
+		}
+	}
+	if v := q.Get("contentType"); v != "" {
+		mt, _, err := mime.ParseMediaType(v)
+		if err != nil {
+			return f, "Parameter 'contentType' must be a media type such as text/csv or text/*"
+		}
+		f.ContentType = mt
+	}
+	return f, ""
+}
+
+func (f *fileFilter) match(rec *FileRecord) bool {
+	if rec.state() == StateQuarantined {
+		return false
+	}
+	if f.SHA256 != "" && rec.withoutPlaintext().ChecksumSHA != f.SHA256 {
+		return false
+	}
+	if rec.Bytes < f.MinSize || (f.MaxSize > 0 && rec.Bytes > f.MaxSize) {
+		return false
+	}
+	if !f.UploadedAfter.IsZero() && !rec.UploadedAt.After(f.UploadedAfter) {
+		return false
+	}
+	if !f.UploadedBefore.IsZero() && !rec.UploadedAt.Before(f.UploadedBefore) {
+		return false
+	}
+	if f.ContentType != "" {
+		mt, _, _ := mime.ParseMediaType(rec.ContentType)
+		if prefix, ok := strings.CutSuffix(f.ContentType, "/*"); ok {
+			return strings.HasPrefix(mt, prefix+"/")
+		}
+		return mt == f.ContentType
+	}
+	return true
+}
+
+// findFiles returns the files matching f ordered by upload time and ID,
+// using the checksum index when f names a checksum.
+func findFiles(ctx context.Context, store MetadataStore, f *fileFilter) ([]*FileRecord, error) {
+	var recs []*FileRecord
+	var err error
+	if f.SHA256 != "" {
+		recs, err = store.FindByChecksum(ctx, f.SHA256)
+	} else {
+		recs, err = store.List(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	matched := recs[:0]
+	for _, rec := range recs {
+		if f.match(rec) {
+			matched = append(matched, rec)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if !matched[i].UploadedAt.Equal(matched[j].UploadedAt) {
+			return matched[i].UploadedAt.Before(matched[j].UploadedAt)
+		}
+		return matched[i].ID < matched[j].ID
+	})
+	return matched, nil
+}
+
+// recordWalker is implemented by stores that can visit every record
+// without loading them all first.
+type recordWalker interface {
+	Walk(ctx context.Context, fn func(*FileRecord) error) error
+}
+
+// walkRecords calls fn with every record in store, one at a time when the
+// store can walk and from a full listing otherwise.
+func walkRecords(ctx context.Context, store MetadataStore, fn func(*FileRecord) error) error {
+	if wk, ok := store.(recordWalker); ok {
+		return wk.Walk(ctx, fn)
+	}
+	recs, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamFiles writes every file matching f as a line of JSON, in storage
+// order and without paging, flushing as it goes. Once the first line is
+// out an error can no longer be reported with a status, so the connection
+// is aborted instead and the client sees an incomplete response rather
+// than a short catalog.
+func streamFiles(w http.ResponseWriter, r *http.Request, store MetadataStore, f *fileFilter, fields fieldSelection) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Now().Add(time.Minute))
+	enc := json.NewEncoder(w)
+	n := 0
+	emit := func(rec *FileRecord) error {
+		if !f.match(rec) {
+			return nil
+		}
+		v, err := fields.apply(FileMetadata{UploadResponse: newUploadResponse(rec), UploadedAt: rec.UploadedAt})
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if n++; n%100 == 0 {
+			// The stream may outlast requestTimeout; keep it
+			// open as long as it makes progress.
+			_ = rc.SetWriteDeadline(time.Now().Add(time.Minute))
+			rc.Flush()
+		}
+		return nil
+	}
+	var err error
+	if f.SHA256 != "" {
+		var recs []*FileRecord
+		if recs, err = findFiles(r.Context(), store, f); err == nil {
+			for _, rec := range recs {
+				if err = emit(rec); err != nil {
+					break
+				}
+			}
+		}
+	} else {
+		err = walkRecords(r.Context(), store, emit)
+	}
+	if err != nil {
+		if n == 0 {
+			writeInternalError(w, "Failed to list files")
+			return
+		}
+		log.Printf("list: stream aborted after %d files: %v", n, err)
+		panic(http.ErrAbortHandler)
+	}
+	metrics.Counter("list_streamed_files_total", "Files sent by streaming file listings.").Add(float64(n))
+}
+
+// listCursor marks the last file of a page by upload time and ID, which
+// is the order files are listed in.
+func listCursor(rec *FileRecord) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(rec.UploadedAt.UnixNano(), 10) + ":" + rec.ID))
+}
+
+func parseListCursor(v string) (int64, string, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return 0, "", false
+	}
+	ts, id, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return 0, "", false
+	}
+	n, err := strconv.ParseInt(ts, 10, 64)
+	return n, id, err == nil
+}
+
+// ListHandler serves GET /v1/files, oldest first. ?sha256= is answered from
+// the checksum index, so asking whether a file was already uploaded does not
+// read every record; minSize, maxSize (bytes), uploadedAfter,
+// uploadedBefore (RFC 3339) and contentType (text/csv or text/*) narrow the
+// listing further. ?limit= sets the page size, at most 1000. The page is
+// {"files": [...], "nextCursor": ...} unless ?envelope= asks for another
+// shape (see writePage), and ?fields=id,sha256 trims each file to the
+// fields named. ?format=ndjson instead streams every matching file, one
+// per line, without paging; see streamFiles. Quarantined files are left
+// out; admins list them at /v1/admin/quarantine.
+func ListHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter, msg := parseFileFilter(q)
+		if msg != "" {
+			writeBadRequest(w, msg)
+			return
+		}
+		fields, msg := parseFields(q, fileMetadataFields)
+		if msg != "" {
+			writeBadRequest(w, msg)
+			return
+		}
+		switch q.Get("format") {
+		case "", "json":
+		case "ndjson":
+			if q.Has("limit") || q.Has("cursor") || q.Has("envelope") {
+				writeBadRequest(w, "Parameters 'limit', 'cursor' and 'envelope' do not apply to format=ndjson")
+				return
+			}
+			streamFiles(w, r, store, &filter, fields)
+			return
+		default:
+			writeBadRequest(w, "Parameter 'format' must be json or ndjson")
+			return
+		}
+		limit := listDefaultLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > listMaxLimit {
+				writeBadRequest(w, "Parameter 'limit' must be between 1 and "+strconv.Itoa(listMaxLimit))
+				return
+			}
+			limit = n
+		}
+		envelope, msg := parseEnvelope(q)
+		if msg != "" {
+			writeBadRequest(w, msg)
+			return
+		}
+		var afterTS int64
+		var afterID string
+		if v := q.Get("cursor"); v != "" {
+			var ok bool
+			if afterTS, afterID, ok = parseListCursor(v); !ok {
+				writeBadRequest(w, "Parameter 'cursor' is not a cursor from a previous page")
+				return
+			}
+		}
+
+		recs, err := findFiles(r.Context(), store, &filter)
+		if err != nil {
+			writeInternalError(w, "Failed to list files")
+			return
+		}
+		files := []FileMetadata{}
+		meta := PageMeta{Limit: limit}
+		var last *FileRecord
+		for _, rec := range recs {
+			if afterID != "" {
+				ts := rec.UploadedAt.UnixNano()
+				if ts < afterTS || (ts == afterTS && rec.ID <= afterID) {
+					continue
+				}
+			}
+			if len(files) == limit {
+				meta.NextCursor = listCursor(last)
+				break
+			}
+			files = append(files, FileMetadata{UploadResponse: newUploadResponse(rec), UploadedAt: rec.UploadedAt})
+			last = rec
+		}
+		meta.Count = len(files)
+		items, err := applyEach(fields, files)
+		if err != nil {
+			writeInternalError(w, "Failed to encode files")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writePage(w, r, envelope, "files", items, meta)
+	}
+}
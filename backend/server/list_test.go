@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFileFilter(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	tests := []struct {
+		query string
+		msg   string
+		want  fileFilter
+	}{
+		{"", "", fileFilter{}},
+		{"sha256=" + strings.ToUpper(sum), "", fileFilter{SHA256: sum}},
+		{"sha256=abc", "Parameter 'sha256' must be a hex SHA-256 digest", fileFilter{}},
+		{"minSize=10&maxSize=20", "", fileFilter{MinSize: 10, MaxSize: 20}},
+		{"minSize=-1", "Parameter 'minSize' must be a non-negative number of bytes", fileFilter{}},
+		{"minSize=20&maxSize=10", "Parameter 'maxSize' must not be less than 'minSize'", fileFilter{}},
+		{"uploadedAfter=2024-01-02T03:04:05Z", "", fileFilter{UploadedAfter: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}},
+		{"uploadedBefore=yesterday", "Parameter 'uploadedBefore' must be an RFC 3339 timestamp", fileFilter{}},
+		{"contentType=text/csv%3Bcharset=utf-8", "", fileFilter{ContentType: "text/csv"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, msg := parseFileFilter(q)
+			if msg != tt.msg {
+				t.Fatalf("message %q, want %q", msg, tt.msg)
+			}
+			if msg == "" && !(got.SHA256 == tt.want.SHA256 && got.MinSize == tt.want.MinSize && got.MaxSize == tt.want.MaxSize &&
+				got.UploadedAfter.Equal(tt.want.UploadedAfter) && got.UploadedBefore.Equal(tt.want.UploadedBefore) && got.ContentType == tt.want.ContentType) {
+				t.Errorf("filter %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
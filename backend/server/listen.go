@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to an activated
+// service (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// Listen opens a listener for each comma-separated address in spec:
+//
+//	:8080, 127.0.0.1:8080    TCP
+//	unix:/run/fup/api.sock   Unix domain socket, created with the given mode
+//	systemd                  every socket passed by systemd socket activation
+//
+// so a deployment can, for example, keep TCP for health checks while the
+// reverse proxy talks to a permission-restricted socket. A process started
+// by a graceful restart ignores spec and takes over its parent's listeners.
+func Listen(spec string, socketMode os.FileMode) ([]net.Listener, error) {
+	listeners, err := inheritedListeners()
+	if err != nil || listeners != nil {
+		return listeners, err
+	}
+	fail := func(err error) ([]net.Listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	for _, addr := range strings.Split(spec, ",") {
+		addr = strings.TrimSpace(addr)
+		switch {
+		case addr == "":
+			continue
+		case addr == "systemd":
+			ls, err := systemdListeners()
+			if err != nil {
+				return fail(err)
+			}
+			listeners = append(listeners, ls...)
+		case strings.HasPrefix(addr, "unix:"):
+			l, err := listenUnix(strings.TrimPrefix(addr, "unix:"), socketMode)
+			if err != nil {
+				return fail(err)
+			}
+			listeners = append(listeners, l)
+		default:
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fail(err)
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listen addresses in %q", spec)
+	}
+	return listeners, nil
+}
+
+// listenUnix binds a Unix socket at path, replacing a stale socket left by a
+// previous run, and applies mode so access is governed by file permissions.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("unix listen address needs a path")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListeners returns the sockets handed over by systemd via LISTEN_PID
+// and LISTEN_FDS. The variables are cleared afterwards so child processes do
+// not try to claim the same descriptors.
+func systemdListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("systemd listen address requested but LISTEN_PID does not name this process")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("systemd listen address requested but LISTEN_FDS is not set")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "systemd-fd-" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LoadGenConfig drives the loadgen subcommand: Requests uploads of Size
+// bytes each, Concurrency at a time, against URL.
+type LoadGenConfig struct {
+	URL         string
+	Size        int64
+	Concurrency int
+	Requests    int
+}
+
+type LoadGenResult struct {
+	Requests   int
+	Failures   int
+	Bytes      int64
+	Elapsed    time.Duration
+	Latencies  []time.Duration
+	FirstError error
+}
+
+func (r LoadGenResult) String() string {
+	mbps := float64(r.Bytes) / (1 << 20) / r.Elapsed.Seconds()
+	return fmt.Sprintf("requests=%d failures=%d elapsed=%s throughput=%.1fMB/s p50=%s p95=%s p99=%s",
+		r.Requests, r.Failures, r.Elapsed.Round(time.Millisecond), mbps,
+		r.percentile(50), r.percentile(95), r.percentile(99))
+}
+
+func (r LoadGenResult) percentile(p int) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	return r.Latencies[(len(r.Latencies)-1)*p/100].Round(time.Millisecond)
+}
+
+// syntheticCSV returns size bytes of CSV rows. The payload is deterministic
+// so runs are comparable.
+func syntheticCSV(size int64) []byte {
+	const row = "1234567,alpha,beta,gamma,2024-01-01T00:00:00Z,42.5\n"
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	buf.WriteString("id,a,b,c,ts,value\n")
+	for int64(buf.Len()) < size {
+		buf.WriteString(row)
+	}
+	return buf.Bytes()[:size]
+}
+
+func multipartUpload(data []byte) ([]byte, string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "loadgen.csv")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), mw.FormDataContentType(), nil
+}
+
+// LoadGen runs the configured load and reports throughput and latency. The
+// request body is built once and shared by all workers.
+func LoadGen(ctx context.Context, cfg LoadGenConfig) (LoadGenResult, error) {
+	body, contentType, err := multipartUpload(syntheticCSV(cfg.Size))
+	if err != nil {
+		return LoadGenResult{}, err
+	}
+	client := &http.Client{}
+
+	var (
+		mu  sync.Mutex
+		res LoadGenResult
+		wg  sync.WaitGroup
+	)
+	jobs := make(chan struct{})
+	start := time.Now()
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				t := time.Now()
+				err := postUpload(ctx, client, cfg.URL, body, contentType)
+				d := time.Since(t)
+
+				mu.Lock()
+				res.Requests++
+				res.Latencies = append(res.Latencies, d)
+				if err != nil {
+					res.Failures++
+					if res.FirstError == nil {
+						res.FirstError = err
+					}
+				} else {
+					res.Bytes += cfg.Size
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < cfg.Requests && ctx.Err() == nil; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	sort.Slice(res.Latencies, func(i, j int) bool { return res.Latencies[i] < res.Latencies[j] })
+	return res, nil
+}
+
+func postUpload(ctx context.Context, client *http.Client, url string, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload: %s", resp.Status)
+	}
+	return nil
+}
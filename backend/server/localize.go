@@ -0,0 +1,309 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errorMessages are the error messages a frontend is likely to show, each
+// with a stable ID and its English wording as sent. A {name} stands for a
+// part of the message that varies, such as a file ID. Messages not listed
+// here are sent in English only and without an ID.
+var errorMessages = []struct{ id, en string }{
+	{"file_too_large", "File size exceeds maximum allowed size of {limit}"},
+	{"request_too_large", "Request body of {size} bytes exceeds the limit of {limit} bytes"},
+	{"empty_file", "Uploaded file is empty"},
+	{"no_filename", "No filename provided for uploaded file"},
+	{"no_file", "No file provided in '{field}' field"},
+	{"unsupported_file_type", "Only CSV files are allowed. File extension '{ext}' is not supported"},
+	{"invalid_multipart", "Invalid multipart form data"},
+	{"checksum_mismatch", "Checksum mismatch: expected {expected}, received content hashes to {actual}"},
+	{"size_mismatch", "Size mismatch: declared {declared} bytes, received {received}"},
+	{"row_count_mismatch", "Row count mismatch: declared {declared} rows, file has {rows}"},
+	{"unknown_schema", "Unknown schema '{schema}'"},
+	{"duplicate_file", "An identical file already exists as '{id}'"},
+	{"file_not_found", "File '{id}' not found"},
+	{"file_scanning", "File '{id}' is still being scanned"},
+	{"file_quarantined", "File '{id}' is quarantined"},
+	{"insufficient_storage", "Not enough storage space for an upload of {size} bytes"},
+	{"rate_limited", "Rate limit exceeded; retry later"},
+	{"invalid_api_key", "Invalid API key"},
+	{"missing_credentials", "Missing API key or valid download token"},
+	{"read_only", defaultMaintenanceMessage},
+	{"share_expired", "Share link has expired"},
+	{"share_limit_reached", "Share link has reached its download limit"},
+	{"share_password_required", "Share link requires a valid password"},
+	{"share_unavailable", "Shared file is no longer available"},
+}
+
+// builtinTranslations are the languages shipped with the server, by
+// message ID. UPLOAD_MESSAGES_FILE adds languages and overrides entries.
+var builtinTranslations = map[string]map[string]string{
+	"de": {
+		"file_too_large":          "Die Datei überschreitet die maximal zulässige Größe von {limit}",
+		"request_too_large":       "Der Anfragetext von {size} Bytes überschreitet das Limit von {limit} Bytes",
+		"empty_file":              "Die hochgeladene Datei ist leer",
+		"no_filename":             "Für die hochgeladene Datei wurde kein Dateiname angegeben",
+		"no_file":                 "Im Feld '{field}' wurde keine Datei übermittelt",
+		"unsupported_file_type":   "Nur CSV-Dateien sind erlaubt. Die Dateiendung '{ext}' wird nicht unterstützt",
+		"invalid_multipart":       "Ungültige Multipart-Formulardaten",
+		"checksum_mismatch":       "Prüfsumme stimmt nicht überein: erwartet {expected}, der empfangene Inhalt ergibt {actual}",
+		"size_mismatch":           "Größe stimmt nicht überein: {declared} Bytes angegeben, {received} empfangen",
+		"row_count_mismatch":      "Zeilenzahl stimmt nicht überein: {declared} Zeilen angegeben, die Datei hat {rows}",
+		"unknown_schema":          "Unbekanntes Schema '{schema}'",
+		"duplicate_file":          "Eine identische Datei existiert bereits als '{id}'",
+		"file_not_found":          "Datei '{id}' nicht gefunden",
+		"file_scanning":           "Datei '{id}' wird noch geprüft",
+		"file_quarantined":        "Datei '{id}' steht unter Quarantäne",
+		"insufficient_storage":    "Nicht genügend Speicherplatz für einen Upload von {size} Bytes",
+		"rate_limited":            "Anfragelimit überschritten; bitte später erneut versuchen",
+		"invalid_api_key":         "Ungültiger API-Schlüssel",
+		"missing_credentials":     "API-Schlüssel oder gültiges Download-Token fehlt",
+		"read_only":               "Der Dienst ist wegen Wartungsarbeiten schreibgeschützt; Uploads und Löschungen sind nicht möglich",
+		"share_expired":           "Der Freigabelink ist abgelaufen",
+		"share_limit_reached":     "Der Freigabelink hat sein Download-Limit erreicht",
+		"share_password_required": "Der Freigabelink erfordert ein gültiges Passwort",
+		"share_unavailable":       "Die freigegebene Datei ist nicht mehr verfügbar",
+	},
+	"es": {
+		"file_too_large":          "El archivo supera el tamaño máximo permitido de {limit}",
+		"request_too_large":       "El cuerpo de la solicitud de {size} bytes supera el límite de {limit} bytes",
+		"empty_file":              "El archivo subido está vacío",
+		"no_filename":             "No se indicó un nombre para el archivo subido",
+		"no_file":                 "No se recibió ningún archivo en el campo '{field}'",
+		"unsupported_file_type":   "Solo se permiten archivos CSV. La extensión '{ext}' no es compatible",
+		"invalid_multipart":       "Datos de formulario multipart no válidos",
+		"checksum_mismatch":       "La suma de verificación no coincide: se esperaba {expected} y el contenido recibido da {actual}",
+		"size_mismatch":           "El tamaño no coincide: se declararon {declared} bytes y se recibieron {received}",
+		"row_count_mismatch":      "El número de filas no coincide: se declararon {declared} filas y el archivo tiene {rows}",
+		"unknown_schema":          "Esquema desconocido '{schema}'",
+		"duplicate_file":          "Ya existe un archivo idéntico como '{id}'",
+		"file_not_found":          "No se encontró el archivo '{id}'",
+		"file_scanning":           "El archivo '{id}' todavía se está analizando",
+		"file_quarantined":        "El archivo '{id}' está en cuarentena",
+		"insufficient_storage":    "No hay espacio de almacenamiento suficiente para subir {size} bytes",
+		"rate_limited":            "Se superó el límite de solicitudes; inténtelo más tarde",
+		"invalid_api_key":         "Clave de API no válida",
+		"missing_credentials":     "Falta la clave de API o un token de descarga válido",
+		"read_only":               "El servicio está en modo de solo lectura por mantenimiento; no se pueden subir ni eliminar archivos",
+		"share_expired":           "El enlace compartido ha caducado",
+		"share_limit_reached":     "El enlace compartido alcanzó su límite de descargas",
+		"share_password_required": "El enlace compartido requiere una contraseña válida",
+		"share_unavailable":       "El archivo compartido ya no está disponible",
+	},
+	"fr": {
+		"file_too_large":          "La taille du fichier dépasse le maximum autorisé de {limit}",
+		"request_too_large":       "Le corps de la requête de {size} octets dépasse la limite de {limit} octets",
+		"empty_file":              "Le fichier envoyé est vide",
+		"no_filename":             "Aucun nom de fichier n'a été fourni pour le fichier envoyé",
+		"no_file":                 "Aucun fichier fourni dans le champ '{field}'",
+		"unsupported_file_type":   "Seuls les fichiers CSV sont acceptés. L'extension '{ext}' n'est pas prise en charge",
+		"invalid_multipart":       "Données de formulaire multipart invalides",
+		"checksum_mismatch":       "Somme de contrôle différente : {expected} attendu, le contenu reçu donne {actual}",
+		"size_mismatch":           "Taille différente : {declared} octets annoncés, {received} reçus",
+		"row_count_mismatch":      "Nombre de lignes différent : {declared} lignes annoncées, le fichier en contient {rows}",
+		"unknown_schema":          "Schéma inconnu '{schema}'",
+		"duplicate_file":          "Un fichier identique existe déjà sous '{id}'",
+		"file_not_found":          "Fichier '{id}' introuvable",
+		"file_scanning":           "Le fichier '{id}' est encore en cours d'analyse",
+		"file_quarantined":        "Le fichier '{id}' est en quarantaine",
+		"insufficient_storage":    "Espace de stockage insuffisant pour un envoi de {size} octets",
+		"rate_limited":            "Limite de requêtes dépassée ; réessayez plus tard",
+		"invalid_api_key":         "Clé d'API invalide",
+		"missing_credentials":     "Clé d'API ou jeton de téléchargement valide manquant",
+		"read_only":               "Le service est en lecture seule pour maintenance ; les envois et suppressions sont indisponibles",
+		"share_expired":           "Le lien de partage a expiré",
+		"share_limit_reached":     "Le lien de partage a atteint sa limite de téléchargements",
+		"share_password_required": "Le lien de partage exige un mot de passe valide",
+		"share_unavailable":       "Le fichier partagé n'est plus disponible",
+	},
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// Message is an error message as built where the error is created: the
+// catalog ID and placeholder values of a catalogued message, and its
+// English text. Messages not in the catalog have only the text.
+type Message struct {
+	ID   string
+	Args map[string]string
+	Text string
+}
+
+// englishMessages holds the English template of each catalogued message.
+var englishMessages = func() map[string]string {
+	m := make(map[string]string, len(errorMessages))
+	for _, msg := range errorMessages {
+		m[msg.id] = msg.en
+	}
+	return m
+}()
+
+// newMessage builds the catalogued message id with its placeholders set
+// from name, value pairs.
+func newMessage(id string, args ...string) Message {
+	m := Message{ID: id, Args: make(map[string]string, len(args)/2)}
+	for i := 0; i+1 < len(args); i += 2 {
+		m.Args[args[i]] = args[i+1]
+	}
+	m.Text = m.render(englishMessages[id])
+	return m
+}
+
+// render fills the placeholders of tmpl with the message's arguments.
+func (m Message) render(tmpl string) string {
+	return placeholderPattern.ReplaceAllStringFunc(tmpl, func(ph string) string {
+		if v, ok := m.Args[ph[1:len(ph)-1]]; ok {
+			return v
+		}
+		return ph
+	})
+}
+
+// MessageCatalog localizes error messages. Errors carry the ID and
+// arguments of their message from where they are created (see newMessage),
+// and writeMessage sends the message in the language negotiated from the
+// request's Accept-Language, along with its ID. The "error" field stays the
+// stable, untranslated error code clients should branch on.
+type MessageCatalog struct {
+	langs map[string]map[string]string
+}
+
+// messages is set at startup.
+var messages = mustMessageCatalog()
+
+func mustMessageCatalog() *MessageCatalog {
+	c, err := LoadMessageCatalog("")
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// LoadMessageCatalog builds the catalog from the built-in translations and
+// the messages file, a JSON object from language to message ID to
+// template, e.g. {"nl": {"empty_file": "Het geüploade bestand is leeg"}}.
+// A template may use the placeholders of the English message.
+func LoadMessageCatalog(path string) (*MessageCatalog, error) {
+	c := &MessageCatalog{langs: map[string]map[string]string{}}
+	for lang, msgs := range builtinTranslations {
+		c.langs[lang] = maps.Clone(msgs)
+	}
+	if path == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]map[string]string
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	for lang, msgs := range file {
+		lang = strings.ToLower(lang)
+		if c.langs[lang] == nil {
+			c.langs[lang] = map[string]string{}
+		}
+		for id, tmpl := range msgs {
+			en, ok := englishMessages[id]
+			if !ok {
+				return nil, errors.New(path + ": " + lang + ": unknown message ID '" + id + "'")
+			}
+			for _, sub := range placeholderPattern.FindAllString(tmpl, -1) {
+				if !strings.Contains(en, sub) {
+					return nil, errors.New(path + ": " + lang + "." + id + ": unknown placeholder " + sub)
+				}
+			}
+			c.langs[lang][id] = tmpl
+		}
+	}
+	return c, nil
+}
+
+// localize returns the wording of m in lang, which is its English text when
+// lang is English or has no translation for it.
+func (c *MessageCatalog) localize(lang string, m Message) string {
+	if c == nil || m.ID == "" {
+		return m.Text
+	}
+	tmpl, ok := c.langs[lang][m.ID]
+	if !ok {
+		return m.Text
+	}
+	return m.render(tmpl)
+}
+
+// negotiate picks the language for an Accept-Language header: the most
+// preferred language the catalog has, matching "de-CH" to "de", or English.
+func (c *MessageCatalog) negotiate(accept string) string {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(accept, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag != "" && q > 0 {
+			prefs = append(prefs, pref{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		primary, _, _ := strings.Cut(p.tag, "-")
+		if primary == "en" || primary == "*" {
+			return "en"
+		}
+		for _, lang := range []string{p.tag, primary} {
+			if _, ok := c.langs[lang]; ok {
+				return lang
+			}
+		}
+	}
+	return "en"
+}
+
+// Middleware makes the request's Accept-Language available to writeError,
+// which only has the ResponseWriter.
+func (c *MessageCatalog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&localeWriter{ResponseWriter: w, accept: r.Header.Get("Accept-Language")}, r)
+	})
+}
+
+type localeWriter struct {
+	http.ResponseWriter
+	accept string
+}
+
+func (lw *localeWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// acceptLanguage finds the Accept-Language recorded by Middleware under any
+// wrappers added since.
+func acceptLanguage(w http.ResponseWriter) (string, bool) {
+	for {
+		switch v := w.(type) {
+		case *localeWriter:
+			return v.accept, true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return "", false
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Messages are translated by the ID they were created with, whatever their
+// arguments contain.
+func TestErrorLocalized(t *testing.T) {
+	tests := []struct {
+		name, accept string
+		msg          Message
+		want, wantID string
+	}{
+		{"english", "", newMessage("file_not_found", "id", "abc"), "File 'abc' not found", "file_not_found"},
+		{"german", "de-CH, en;q=0.5", newMessage("file_not_found", "id", "abc"), "Datei 'abc' nicht gefunden", "file_not_found"},
+		{"french", "fr", newMessage("unsupported_file_type", "ext", ".txt"), "Seuls les fichiers CSV sont acceptés. L'extension '.txt' n'est pas prise en charge", "unsupported_file_type"},
+		{"spanish", "es", newMessage("empty_file"), "El archivo subido está vacío", "empty_file"},
+		{"argument looks like another message", "de", newMessage("file_not_found", "id", "x' is quarantined"), "Datei 'x' is quarantined' nicht gefunden", "file_not_found"},
+		{"not catalogued", "de", Message{Text: "Something else"}, "Something else", ""},
+		{"no translation", "nl", newMessage("empty_file"), "Uploaded file is empty", "empty_file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := messages.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeMessage(w, http.StatusNotFound, "not_found", tt.msg)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Language", tt.accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Message != tt.want || resp.MessageID != tt.wantID || resp.Error != "not_found" {
+				t.Errorf("got %+v, want message %q with ID %q", resp, tt.want, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestLoadMessageCatalog(t *testing.T) {
+	tests := []struct {
+		name, file string
+		ok         bool
+	}{
+		{"new language", `{"nl": {"file_not_found": "Bestand '{id}' niet gevonden"}}`, true},
+		{"unknown ID", `{"nl": {"no_such_message": "x"}}`, false},
+		{"unknown placeholder", `{"nl": {"file_not_found": "Bestand '{name}' niet gevonden"}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "messages.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := LoadMessageCatalog(path)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok = %v", err, tt.ok)
+			}
+			if tt.ok {
+				if got := c.localize("nl", newMessage("file_not_found", "id", "abc")); got != "Bestand 'abc' niet gevonden" {
+					t.Errorf("localize = %q", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Locker hands out named, expiring locks shared by every instance pointed at
+// the same backend. TryLock never blocks: ok is false when another holder
+// has the lock.
+type Locker interface {
+	TryLock(ctx context.Context, name string, ttl time.Duration) (release func(), ok bool, err error)
+}
+
+// localLocker is used when no shared lock backend is configured; it only
+// provides exclusion within this process.
+type localLocker struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func newLocalLocker() *localLocker {
+	return &localLocker{held: map[string]bool{}}
+}
+
+func (l *localLocker) TryLock(_ context.Context, name string, _ time.Duration) (func(), bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[name] {
+		return nil, false, nil
+	}
+	l.held[name] = true
+	return func() {
+		l.mu.Lock()
+		delete(l.held, name)
+		l.mu.Unlock()
+	}, true, nil
+}
+
+// redisLocker implements the single-instance Redis lock recipe: SET NX PX
+// with a random token, renewed while held and released only by its owner.
+type redisLocker struct {
+	redis *redisClient
+}
+
+func NewRedisLocker(addr string) *redisLocker {
+	return &redisLocker{redis: newRedisClient(addr)}
+}
+
+const (
+	unlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	renewScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+func (l *redisLocker) TryLock(ctx context.Context, name string, ttl time.Duration) (func(), bool, error) {
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, false, err
+	}
+	key := "lock:" + name
+	ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+	_, err = l.redis.Do(ctx, "SET", key, token, "NX", "PX", ms)
+	if errors.Is(err, errRedisNil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if _, err := l.redis.Do(context.Background(), "EVAL", renewScript, "1", key, token, ms); err != nil {
+					log.Printf("lock: renew %s: %v", name, err)
+				}
+			}
+		}
+	}()
+
+	release := func() {
+		close(stop)
+		if _, err := l.redis.Do(context.Background(), "EVAL", unlockScript, "1", key, token); err != nil {
+			log.Printf("lock: release %s: %v", name, err)
+		}
+	}
+	return release, true, nil
+}
+
+// runExclusive runs fn only if this instance wins the named lock, so
+// background jobs execute on one instance at a time.
+func runExclusive(ctx context.Context, l Locker, name string, fn func(context.Context)) {
+	release, ok, err := l.TryLock(ctx, name, 30*time.Second)
+	if err != nil {
+		log.Printf("lock: acquire %s: %v", name, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	defer release()
+	fn(ctx)
+}
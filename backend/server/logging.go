@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+// RotationPolicy rolls a log file over once it reaches MaxBytes or has been
+// open for Interval, keeping the Keep most recent rotated files. Zero values
+// disable the corresponding trigger.
+type RotationPolicy struct {
+	MaxBytes int64
+	Interval time.Duration
+	Keep     int
+}
+
+// logRotation is the rotation policy shared by the log and access-log files.
+func logRotation(cfg config.Config) RotationPolicy {
+	return RotationPolicy{
+		MaxBytes: int64(cfg.LogMaxMB) << 20,
+		Interval: time.Duration(cfg.LogRotateHours) * time.Hour,
+		Keep:     cfg.LogKeep,
+	}
+}
+
+// LogSink is one log destination with its own minimum level.
+type LogSink struct {
+	Kind  string // stdout, stderr, file or syslog
+	Path  string
+	Level slog.Level
+}
+
+// ParseLogSinks reads sink specs of the form kind[:path][:level], separated
+// by commas, e.g. "stdout:info,file:/var/log/upload.log:debug,syslog:warn".
+// syslog reaches journald through its syslog socket.
+func ParseLogSinks(spec string) ([]LogSink, error) {
+	var sinks []LogSink
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		sink := LogSink{Kind: parts[0], Level: slog.LevelInfo}
+		rest := parts[1:]
+		if sink.Kind == "file" {
+			if len(rest) == 0 || rest[0] == "" {
+				return nil, fmt.Errorf("log sink %q: file sink needs a path", item)
+			}
+			sink.Path, rest = rest[0], rest[1:]
+		}
+		switch sink.Kind {
+		case "stdout", "stderr", "file", "syslog":
+		default:
+			return nil, fmt.Errorf("log sink %q: unknown kind %q", item, sink.Kind)
+		}
+		if len(rest) > 1 {
+			return nil, fmt.Errorf("log sink %q: too many fields", item)
+		}
+		if len(rest) == 1 {
+			if err := sink.Level.UnmarshalText([]byte(rest[0])); err != nil {
+				return nil, fmt.Errorf("log sink %q: %w", item, err)
+			}
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// SetupLogging routes application logs to every sink. Messages written with
+// the standard log package are recorded at INFO.
+func SetupLogging(sinks []LogSink, rot RotationPolicy) error {
+	if len(sinks) == 0 {
+		return nil
+	}
+	var handlers []slog.Handler
+	for _, s := range sinks {
+		opts := &slog.HandlerOptions{Level: s.Level}
+		switch s.Kind {
+		case "stdout":
+			handlers = append(handlers, slog.NewTextHandler(os.Stdout, opts))
+		case "stderr":
+			handlers = append(handlers, slog.NewTextHandler(os.Stderr, opts))
+		case "file":
+			f, err := newRotatingFile(s.Path, rot)
+			if err != nil {
+				return err
+			}
+			handlers = append(handlers, slog.NewTextHandler(f, opts))
+		case "syslog":
+			h, err := newSyslogHandler(s.Level)
+			if err != nil {
+				return err
+			}
+			handlers = append(handlers, h)
+		}
+	}
+	slog.SetDefault(slog.New(fanoutHandler(handlers)))
+	log.SetFlags(0)
+	return nil
+}
+
+// fanoutHandler passes each record to every handler whose level admits it.
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanoutHandler, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	out := make(fanoutHandler, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// rotatingFile is an append-only log file that renames itself to
+// <path>.<timestamp> when the rotation policy triggers.
+type rotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	rot    RotationPolicy
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, rot RotationPolicy) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, rot: rot}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	full := rf.rot.MaxBytes > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.rot.MaxBytes
+	stale := rf.rot.Interval > 0 && time.Since(rf.opened) >= rf.rot.Interval
+	if full || stale {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed for %s: %v\n", rf.path, err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rotated := rf.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(rf.path, rotated); err != nil {
+		_ = rf.open()
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.prune()
+	return nil
+}
+
+// prune removes rotated files beyond the Keep most recent. The timestamp
+// suffix sorts lexically in time order.
+func (rf *rotatingFile) prune() {
+	if rf.rot.Keep <= 0 {
+		return
+	}
+	old, err := filepath.Glob(rf.path + ".*")
+	if err != nil || len(old) <= rf.rot.Keep {
+		return
+	}
+	sort.Strings(old)
+	for _, p := range old[:len(old)-rf.rot.Keep] {
+		_ = os.Remove(p)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package server
+
+import (
+	"errors"
+	"log/slog"
+)
+
+func newSyslogHandler(level slog.Level) (slog.Handler, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
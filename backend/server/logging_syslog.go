@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+
+package server
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+func newSyslogHandler(level slog.Level) (slog.Handler, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "file-upload")
+	if err != nil {
+		return nil, err
+	}
+	return slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}), nil
+}
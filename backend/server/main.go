@@ -0,0 +1,853 @@
+// Package server is the file upload API: its handlers, the ingest pipeline
+// behind them, blob storage and the metadata stores. Main runs it as
+// configured by UPLOAD_* environment variables; the stores are interfaces
+// (MetadataStore and those of each feature), implemented on disk by the
+// JSON store and in memory by MemoryStore.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+// uploadDir is where blobs are stored. It is relative to the working
+// directory unless SetUploadDir moves it.
+var uploadDir = "./data/uploads"
+
+// SetUploadDir moves blob storage to dir for the whole process. It is for
+// embedding and must be called before any request is served.
+func SetUploadDir(dir string) {
+	uploadDir = dir
+}
+
+type UploadResponse struct {
+	ID          string         `json:"id"`
+	Bytes       int64          `json:"bytesWritten"`
+	ChecksumSHA string         `json:"sha256"`
+	ContentType string         `json:"contentType"`
+	Filename    string         `json:"filename"`
+	DuplicateOf string         `json:"duplicateOf,omitempty"`
+	Folder      string         `json:"folder,omitempty"`
+	Tags        []string       `json:"tags,omitempty"`
+	Key         string         `json:"key,omitempty"`
+	Description string         `json:"description,omitempty"`
+	ExpiresAt   *time.Time     `json:"expiresAt,omitempty"`
+	SchemaID    string         `json:"schemaId,omitempty"`
+	Version     int            `json:"version,omitempty"`
+	State       string         `json:"state"`
+	Revision    int64          `json:"revision"`
+	PII         *PIIReport     `json:"pii,omitempty"`
+	Formulas    *FormulaReport `json:"formulas,omitempty"`
+	Lineage     *Lineage       `json:"lineage,omitempty"`
+	RowCount    int64          `json:"rowCount"`
+	Columns     []string       `json:"columns"`
+	ChunkRoot   string         `json:"chunkRoot,omitempty"`
+	Receipt     string         `json:"receipt,omitempty"`
+	DryRun      bool           `json:"dryRun,omitempty"`
+	Quarantine  *Quarantine    `json:"quarantine,omitempty"`
+
+	// StorageClass is hot or cold; a cold file is restored before it can
+	// be downloaded, and RestoreStatus tracks that.
+	StorageClass  string `json:"storageClass"`
+	RestoreStatus string `json:"restoreStatus,omitempty"`
+
+	// EncryptionKeySHA256 identifies the customer-provided key the file
+	// is encrypted with; see customerKey.
+	EncryptionKeySHA256 string `json:"encryptionKeySha256,omitempty"`
+}
+
+// ErrorResponse is the body of every error. Error is a stable code to
+// branch on; MessageID, when present, names the specific message, which is
+// translated per Accept-Language (see MessageCatalog).
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+	MessageID string `json:"messageId,omitempty"`
+	Code      int    `json:"code"`
+
+	// Existing is the stored file a duplicate upload was rejected for.
+	Existing *FileMetadata `json:"existing,omitempty"`
+}
+
+// UploadHandler accepts a single multipart file, sent in the part named by
+// UPLOAD_FILE_FIELDS ("file" by default). With ?key= the file is also
+// bound to that key, and ?onConflict= (reject, overwrite, version) decides
+// what happens when the key is already taken. ?ifNotExists=true rejects
+// content that is already stored, with the stored file in the 409; when the
+// checksum is declared up front in X-Upload-Checksum that is decided before
+// the body is read. ?dryRun=true validates the upload, key
+// conflicts included, and reports the outcome without storing anything.
+// A size declared in X-Upload-Length or the "size" field, or a row count in
+// the "rows" field, must match the file received.
+func UploadHandler(in *Ingest, keys *Keys) http.HandlerFunc {
+	fileFields := parseFileFields(in.Config.FileFields)
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := in.Limits.For(r)
+		if r.Method == http.MethodOptions {
+			writeUploadOptions(w, "POST, OPTIONS", limit)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for file uploads")
+			return
+		}
+
+		if !preflight(w, r, limit, limit) {
+			return
+		}
+		checksum, ok := uploadChecksum(w, r)
+		if !ok {
+			return
+		}
+		customer, uerr := customerKey(r)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		ifNotExists := r.URL.Query().Get("ifNotExists") == "true"
+		if ifNotExists && checksum != "" && rejectStored(w, r, in.Store, checksum) {
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeMessage(w, http.StatusBadRequest, "bad_request", newMessage("invalid_multipart"))
+			return
+		}
+
+		form := newUploadForm(in.Schemas, fileFields)
+		part, err := mpProc(mr, form)
+		if err != nil {
+			var uerr *UploadError
+			if errors.As(err, &uerr) {
+				writeUploadError(w, uerr)
+			} else if isTooLarge(err) {
+				writeFileTooLarge(w, limit)
+			} else if errors.Is(err, http.ErrMissingFile) {
+				writeMessage(w, http.StatusBadRequest, "bad_request", form.missingFileMessage())
+			} else if err.Error() == "no filename provided" {
+				writeMessage(w, http.StatusBadRequest, "bad_request", newMessage("no_filename"))
+			} else {
+				writeBadRequest(w, "Error processing multipart data: "+err.Error())
+			}
+			return
+		}
+		defer part.Close()
+
+		var claim *keyClaim
+		if key := r.URL.Query().Get("key"); key != "" {
+			var uerr *UploadError
+			claim, uerr = keys.Claim(r.Context(), key, r.URL.Query().Get("onConflict"))
+			if uerr != nil {
+				writeUploadError(w, uerr)
+				return
+			}
+			defer claim.Release()
+		}
+
+		meta := UploadMeta{MaxBytes: limit, IfNotExists: ifNotExists, Checksum: checksum, NotifyEmail: notifyAddress(r), DryRun: r.URL.Query().Get("dryRun") == "true", DeclaredSize: uploadLength(r), CustomerKey: customer}
+		if claim != nil {
+			meta.Key = claim.Key
+		}
+		meta.BeforeCommit = func(m *UploadMeta) *UploadError {
+			if err := form.readRest(mr); err != nil {
+				var uerr *UploadError
+				if errors.As(err, &uerr) {
+					return uerr
+				}
+				if isTooLarge(err) {
+					return newUploadErrorMessage(http.StatusRequestEntityTooLarge, "request_entity_too_large", fileTooLargeMessage(limit))
+				}
+				return newUploadError(http.StatusBadRequest, "bad_request", "Error processing multipart data: "+err.Error())
+			}
+			form.apply(m)
+			return nil
+		}
+		rec, uerr := in.Receive(r.Context(), part, partFilename(part.Part), meta)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		resp := newUploadResponse(rec)
+		resp.DryRun = meta.DryRun
+		if claim != nil && !meta.DryRun {
+			resp.Version, err = keys.Bind(context.WithoutCancel(r.Context()), claim, rec)
+			if err != nil {
+				log.Printf("bind key %q to %s: %v", claim.Key, rec.ID, err)
+				writeInternalError(w, "Failed to bind key")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func newUploadResponse(rec *FileRecord) UploadResponse {
+	if rec.customerKey == nil {
+		rec = rec.withoutPlaintext()
+	}
+	resp := UploadResponse{
+		ID:          rec.ID,
+		Bytes:       rec.Bytes,
+		ChecksumSHA: rec.ChecksumSHA,
+		ContentType: rec.ContentType,
+		Filename:    rec.Filename,
+		DuplicateOf: rec.DuplicateOf,
+		Folder:      rec.Folder,
+		Tags:        rec.Tags,
+		Key:         rec.Key,
+		Description: rec.Description,
+		ExpiresAt:   rec.ExpiresAt,
+		SchemaID:    rec.SchemaID,
+		State:       rec.state(),
+		Revision:    rec.Revision,
+		PII:         rec.PII,
+		Formulas:    rec.Formulas,
+		Lineage:     rec.Lineage,
+		RowCount:    rec.RowCount,
+		Columns:     rec.Columns,
+		Receipt:     rec.Receipt,
+		Quarantine:  rec.Quarantine,
+
+		StorageClass:  rec.storageClass(),
+		RestoreStatus: rec.RestoreStatus,
+	}
+	if rec.Chunks != nil {
+		resp.ChunkRoot = rec.Chunks.Root
+	}
+	if rec.Encryption.customer() {
+		resp.EncryptionKeySHA256 = rec.Encryption.KeySHA256
+	}
+	return resp
+}
+
+// checkCSV sniffs the first bytes of an upload and returns its content type
+// and the extension it will be stored under, or a client-facing message when
+// the file is not an acceptable CSV.
+func checkCSV(head []byte, filename string) (string, string, Message) {
+	contentType := http.DetectContentType(head)
+	if ext := detectFileType(contentType, filename); ext != "" {
+		return contentType, ext, Message{}
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if !allowedExtension(ext) {
+		return contentType, "", newMessage("unsupported_file_type", "ext", ext)
+	}
+	return contentType, "", Message{Text: "File content type '" + contentType + "' is not supported for CSV files"}
+}
+
+type multipartPart struct {
+	*multipart.Part
+}
+
+// mpProc reads parts up to the file part named by form, collecting the
+// non-file fields before it into form.
+func mpProc(mr *multipart.Reader, form *uploadForm) (*multipartPart, error) {
+	for {
+		p, perr := mr.NextPart()
+		if errors.Is(perr, io.EOF) {
+			break
+		}
+
+		if perr != nil {
+			return &multipartPart{Part: nil}, perr
+		}
+
+		if form.isFilePart(p) {
+			if partFilename(p) == "" {
+				p.Close()
+				return &multipartPart{Part: nil}, errors.New("no filename provided")
+			}
+			return &multipartPart{Part: p}, nil
+		}
+		if partFilename(p) == "" {
+			if err := form.readField(p); err != nil {
+				return &multipartPart{Part: nil}, err
+			}
+			continue
+		}
+		_ = p.Close()
+	}
+	return &multipartPart{Part: nil}, http.ErrMissingFile
+}
+
+func randomHex(nBytes int) (string, error) {
+	b := make([]byte, nBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	writeMessage(w, status, errorType, Message{Text: message})
+}
+
+// writeMessage is writeError for a message that may be in the catalog.
+func writeMessage(w http.ResponseWriter, status int, errorType string, m Message) {
+	writeJSON(w, status, errorResponse(w, status, errorType, m))
+}
+
+// errorResponse builds the body of an error response in the request's
+// language and sets the headers that go with it.
+func errorResponse(w http.ResponseWriter, status int, errorType string, m Message) ErrorResponse {
+	if status == http.StatusRequestEntityTooLarge {
+		// The client may still be sending the rest of the body; close the
+		// connection instead of draining it.
+		w.Header().Set("Connection", "close")
+	}
+	lang := "en"
+	if accept, ok := acceptLanguage(w); ok {
+		lang = messages.negotiate(accept)
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	errResp := ErrorResponse{
+		Error:     errorType,
+		Message:   messages.localize(lang, m),
+		MessageID: m.ID,
+		Code:      status,
+	}
+	w.Header().Set("Content-Language", lang)
+	return errResp
+}
+
+func writeInternalError(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusInternalServerError, "internal_server_error", message)
+}
+
+func writeBadRequest(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusBadRequest, "bad_request", message)
+}
+
+func writeUnsupportedMediaType(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", message)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", message)
+}
+
+func writeNotFound(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusNotFound, "not_found", message)
+}
+
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusUnauthorized, "unauthorized", message)
+}
+
+func writeForbidden(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusForbidden, "forbidden", message)
+}
+
+func writeConflict(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusConflict, "conflict", message)
+}
+
+func writePreconditionFailed(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusPreconditionFailed, "precondition_failed", message)
+}
+
+func writeRequestEntityTooLarge(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusRequestEntityTooLarge, "request_entity_too_large", message)
+}
+
+func writeInsufficientStorage(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusInsufficientStorage, "insufficient_storage", message)
+}
+
+// Main runs the subcommand named on the command line, or else the server
+// as configured by the environment.
+func Main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	serve(config.Load())
+}
+
+func serve(cfg config.Config) {
+	sinks, err := ParseLogSinks(cfg.LogSinks)
+	if err != nil {
+		log.Fatalf("configure logging: %v", err)
+	}
+	if err := SetupLogging(sinks, logRotation(cfg)); err != nil {
+		log.Fatalf("configure logging: %v", err)
+	}
+
+	storageTimeout = time.Duration(cfg.StorageTimeoutSeconds) * time.Second
+	if cfg.StartupChecks {
+		ds := Doctor(context.Background(), cfg)
+		for _, d := range ds {
+			if d.Status != DiagOK {
+				log.Printf("startup check: %s", d)
+			}
+		}
+		if diagnosesFailed(ds) {
+			log.Fatalf("startup checks failed; fix the problems above (UPLOAD_STARTUP_CHECKS=false skips the checks)")
+		}
+	}
+	if cfg.PIIRoles != nil {
+		piiRoles = cfg.PIIRoles
+	}
+	uploadDeadline = UploadDeadline{
+		MinBytesPerSecond: int64(cfg.UploadDeadlineMinThroughputKBps) << 10,
+		Slack:             time.Duration(cfg.UploadDeadlineSlackSeconds) * time.Second,
+		Max:               time.Duration(cfg.UploadDeadlineMaxSeconds) * time.Second,
+	}
+	verifyWrites = cfg.VerifyWrites
+	cachePolicy = CachePolicy{
+		Public:          cfg.CachePublic,
+		ImmutableMaxAge: time.Duration(cfg.CacheImmutableMaxAgeSeconds) * time.Second,
+		LatestMaxAge:    time.Duration(cfg.CacheLatestMaxAgeSeconds) * time.Second,
+	}
+	db, err := NewJSONStore(metadataDir)
+	if err != nil {
+		log.Fatalf("open metadata store: %v", err)
+	}
+	var store MetadataStore = db
+	if cfg.RedisCacheAddr != "" {
+		store = NewCachedStore(db, cfg.RedisCacheAddr, time.Duration(cfg.RedisCacheTTLSeconds)*time.Second)
+	}
+
+	var pii *PIIScanner
+	if cfg.PIIScan {
+		pii = NewPIIScanner(cfg.PIISampleRows)
+	}
+
+	mux := NewRouter()
+	audit, err := OpenAuditLog(auditLogPath)
+	if err != nil {
+		log.Fatalf("open audit log: %v", err)
+	}
+	secrets, err := loadSecrets(cfg)
+	if err != nil {
+		log.Fatalf("load secrets: %v", err)
+	}
+	if cfg.SecretsRefreshSeconds > 0 {
+		go secrets.Run(context.Background(), time.Duration(cfg.SecretsRefreshSeconds)*time.Second)
+	}
+	signer := NewSigner(secrets.SigningKey)
+	receipts, err := NewReceipts(cfg.ReceiptKey)
+	if err != nil {
+		log.Fatalf("load receipt key: %v", err)
+	}
+
+	switch cfg.Compression {
+	case "", EncodingZstd, EncodingGzip:
+	default:
+		log.Fatalf("unsupported UPLOAD_COMPRESSION %q (want zstd or gzip)", cfg.Compression)
+	}
+	if blobKeys, err = loadBlobKeys(cfg, secrets.GCPToken); err != nil {
+		log.Fatalf("load encryption keys: %v", err)
+	}
+
+	var locker Locker = newLocalLocker()
+	if cfg.LockRedisAddr != "" {
+		locker = NewRedisLocker(cfg.LockRedisAddr)
+	}
+
+	var events *EventRelay
+	if cfg.EventsBus != "" {
+		pub, err := NewPublisher(cfg.EventsBus, cfg.EventsAddr, cfg.EventsTopic)
+		if err != nil {
+			log.Fatalf("configure event bus: %v", err)
+		}
+		events = NewEventRelay(db, pub, locker)
+		go events.Run(context.Background())
+	}
+
+	maintenance = NewMaintenance(db, audit)
+	if err := maintenance.Reload(context.Background()); err != nil {
+		log.Fatalf("load maintenance state: %v", err)
+	}
+	go maintenance.Run(context.Background(), 15*time.Second)
+
+	tierer := NewTierer(store, db, events, locker, cfg.ArchiveDir, time.Duration(cfg.ArchiveAfterDays)*24*time.Hour)
+	if cfg.ArchiveAfterDays > 0 {
+		go tierer.Run(context.Background(), time.Hour)
+	}
+
+	ids, err := NewIDGenerator(cfg.IDFormat)
+	if err != nil {
+		log.Fatalf("configure ids: %v", err)
+	}
+	limits, err := LoadSizeLimits(cfg.LimitsFile, cfg.MaxUploadBytes)
+	if err != nil {
+		log.Fatalf("load size limits: %v", err)
+	}
+	formulas, err := LoadFormulaPolicy(cfg.FormulaPolicyFile, cfg.FormulaPolicy)
+	if err != nil {
+		log.Fatalf("load formula policy: %v", err)
+	}
+	if messages, err = LoadMessageCatalog(cfg.MessagesFile); err != nil {
+		log.Fatalf("load messages: %v", err)
+	}
+	email, err := newEmailNotifier(SMTPConfig{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: secrets.SMTPPassword, From: cfg.SMTPFrom},
+		cfg.NotifyTo, cfg.NotifyEvents, cfg.NotifyUploader, cfg.NotifyTemplates)
+	if err != nil {
+		log.Fatalf("configure email notifications: %v", err)
+	}
+	webhooks, err := loadWebhooks(cfg.NotifyWebhooks, cfg.PublicURL)
+	if err != nil {
+		log.Fatalf("load notification webhooks: %v", err)
+	}
+	notifier := NewNotifier(email, webhooks)
+	var checks []FileCheck
+	if cfg.ClamAVAddr != "" {
+		checks = append(checks, &ClamAVCheck{Addr: cfg.ClamAVAddr})
+	}
+	var schemas *SchemaCheck
+	if cfg.SchemasFile != "" {
+		schemas, err = LoadSchemaCheck(cfg.SchemasFile)
+		if err != nil {
+			log.Fatalf("load schemas: %v", err)
+		}
+		checks = append(checks, schemas)
+	}
+	if cfg.PIIQuarantine && pii != nil {
+		checks = append(checks, PIICheck{})
+	}
+	checker := NewChecker(store, locker, events, audit, checks...)
+	go checker.Resume(context.Background())
+	policies := NewPolicyEngine(db, audit)
+	if err := policies.Reload(context.Background()); err != nil {
+		log.Fatalf("load upload policies: %v", err)
+	}
+	go policies.Run(context.Background(), time.Minute)
+	provisioning := NewProvisioning(db, audit)
+	if err := provisioning.Reload(context.Background()); err != nil {
+		log.Fatalf("load provisioned buckets and API keys: %v", err)
+	}
+	go provisioning.Run(context.Background(), time.Minute)
+	limits.BucketLimit = provisioning.BucketLimit
+	flags, err := LoadFeatureFlags(cfg.FeatureFlagsFile, db, audit)
+	if err != nil {
+		log.Fatalf("load feature flags: %v", err)
+	}
+	if err := flags.Reload(context.Background()); err != nil {
+		log.Fatalf("load feature flag overrides: %v", err)
+	}
+	go flags.Run(context.Background(), time.Minute)
+	in := &Ingest{Store: store, Config: cfg, PII: pii, Events: events, IDs: ids, Limits: limits, Formulas: formulas, Checks: checker, Schemas: schemas, Notifier: notifier, Receipts: receipts, Policies: policies, Flags: flags}
+
+	sftpSources, err := LoadSFTPSources(cfg.SFTPSources)
+	if err != nil {
+		log.Fatalf("load SFTP sources: %v", err)
+	}
+	if len(sftpSources) > 0 {
+		NewSFTPIngest(in, locker, sftpSources).Run(context.Background())
+	}
+	if cfg.WatchDir != "" {
+		watcher, err := NewWatcher(in, cfg.WatchDir, cfg.WatchQuarantineDir, time.Duration(cfg.WatchSettleSeconds)*time.Second)
+		if err != nil {
+			log.Fatalf("watch folder: %v", err)
+		}
+		go func() {
+			if err := watcher.Run(context.Background()); err != nil {
+				log.Printf("watch folder: %v", err)
+			}
+		}()
+	}
+
+	// schedule passes handlers through unchanged unless UPLOAD_SLOTS
+	// enables the priority lanes.
+	schedule := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if cfg.UploadSlots > 1 {
+		lanes := NewLanes(cfg.UploadSlots, cfg.SmallLaneSlots, cfg.SmallUploadBytes, time.Duration(cfg.LaneMaxWaitSeconds)*time.Second)
+		schedule = lanes.Wrap
+	}
+
+	// Cross-cutting behaviour is layered per route group: API routes are
+	// metered, rate limited and need an API key when UPLOAD_API_KEYS is set
+	// or keys are declared through the admin API; admin routes need the
+	// admin token.
+	tokens := NewDownloadTokens(signer, time.Duration(cfg.DownloadTokenTTLSeconds)*time.Second)
+	cdnSigner := signer
+	if secrets.CDNSigningKey.Value() != "" {
+		cdnSigner = NewSigner(secrets.CDNSigningKey)
+	}
+	cdn := NewCDNSigner(cfg.CDNBaseURL, cfg.CDNKeyPairID, cdnSigner, time.Duration(cfg.CDNURLTTLSeconds)*time.Second, cfg.CDNCookieDomain)
+	history := NewUploadHistory(db, time.Duration(cfg.StatsRetentionDays)*24*time.Hour)
+	go history.Run(context.Background(), time.Minute)
+	if cfg.AlertWindowMinutes < 1 || cfg.AlertWindowMinutes > 60 {
+		log.Fatalf("UPLOAD_ALERT_WINDOW_MINUTES must be between 1 and 60")
+	}
+	alerts := NewAlertMonitor(AlertConfig{
+		FailureRate:     float64(cfg.AlertFailurePercent) / 100,
+		MinRequests:     int64(cfg.AlertMinRequests),
+		Window:          time.Duration(cfg.AlertWindowMinutes) * time.Minute,
+		DiskUsedPercent: float64(cfg.AlertDiskPercent),
+	}, history, notifier, uploadDir)
+	if alerts != nil {
+		go alerts.Run(context.Background(), time.Minute)
+	}
+	if cfg.ClientQuotaMinutes < 1 || cfg.ClientQuotaMinutes > 60 {
+		log.Fatalf("UPLOAD_CLIENT_QUOTA_MINUTES must be between 1 and 60")
+	}
+	traffic := NewClientTraffic(cfg.APIKeys, provisioning, int64(cfg.ClientQuotaMB)<<20, time.Duration(cfg.ClientQuotaMinutes)*time.Minute)
+	apiChain := Chain{RequestMetrics, history.Middleware, RateLimit(float64(cfg.RateLimitRPS), cfg.RateLimitBurst), APIKeyAuth(cfg.APIKeys, provisioning, tokens, cdn), IdentifyUploader, traffic.Middleware}
+	api := mux.Group(apiChain...)
+	// Routes that write go through writes, which refuses them in
+	// read-only maintenance mode.
+	writes := mux.Group(apiChain.Append(maintenance.Guard)...)
+	keys := NewKeys(db, store, locker, events)
+	upload := schedule(UploadHandler(in, keys))
+	batch := schedule(BatchUploadHandler(in))
+	download := DownloadHandler(store, db, tierer)
+	api.HandleFunc("GET /v1/files", ListHandler(store))
+	api.HandleFunc("GET /v1/files/{$}", ListHandler(store))
+	api.HandleFunc("POST /v1/files/exists", ExistsHandler(store))
+	writes.HandleFunc("POST /v1/files/{$}", upload)
+	api.HandleFunc("OPTIONS /v1/files/{$}", upload)
+	writes.HandleFunc("POST /v1/files/batch", batch)
+	api.HandleFunc("OPTIONS /v1/files/batch", batch)
+	writes.HandleFunc("POST /v1/files/intent", schedule(IntentUploadHandler(in, keys)))
+	writes.HandleFunc("POST /v1/files/import", NewImporter(in).Handler())
+	api.HandleFunc(downloadPattern, download)
+	api.HandleFunc("POST /v1/files/{id}/download-token", tokens.MintHandler(store))
+	if cdn != nil {
+		api.HandleFunc("POST /v1/files/{id}/cdn-url", cdn.MintHandler(store))
+	}
+	file := FileHandler(store, locker, audit, events)
+	api.HandleFunc("GET /v1/files/{id}/metadata", file)
+	writes.HandleFunc("PATCH /v1/files/{id}", file)
+	writes.HandleFunc("DELETE /v1/files/{id}", file)
+	api.HandleFunc("GET /v1/files/{id}/lineage", LineageHandler(store))
+	api.HandleFunc("GET /v1/files/{id}/chunks", ChunksHandler(store))
+	api.HandleFunc("GET /v1/files/{id}/signature", SignatureHandler(store))
+	writes.HandleFunc("POST /v1/files/{id}/delta", schedule(DeltaHandler(in, keys)))
+	api.HandleFunc("GET /v1/files/{id}/status", StatusHandler(store, db, checker))
+	api.HandleFunc("POST /v1/files/{id}/query", QueryHandler(in, cfg.QueryMaxRows, time.Duration(cfg.QueryTimeoutSeconds)*time.Second))
+	shares := NewShares(db, store, locker, notifier)
+	shareCollection := shares.CollectionHandler()
+	share := shares.ShareHandler()
+	writes.HandleFunc("POST /v1/files/{id}/shares", shareCollection)
+	api.HandleFunc("GET /v1/files/{id}/shares", shareCollection)
+	api.HandleFunc("GET /v1/files/{id}/shares/{share}", share)
+	writes.HandleFunc("PATCH /v1/files/{id}/shares/{share}", share)
+	writes.HandleFunc("DELETE /v1/files/{id}/shares/{share}", share)
+	// Share links are opened by people without an API key, so they sit
+	// outside the API key check but keep the rate limit, which also slows
+	// password guessing.
+	public := mux.Group(RequestMetrics, RateLimit(float64(cfg.RateLimitRPS), cfg.RateLimitBurst))
+	public.HandleFunc("GET /v1/shares/{share}", shares.DownloadHandler(download))
+	writes.HandleFunc("POST /v1/files/{id}/restore", RestoreHandler(tierer))
+	api.HandleFunc("GET /v1/objects/{key...}", keys.ObjectHandler(download))
+	sessions := NewSessions(db, locker, in, cfg.SessionDir, time.Duration(cfg.SessionTTLHours)*time.Hour, cfg.MaxChunkBytes)
+	// After a graceful restart the old process may still be writing to
+	// sessions, so its part files are left alone.
+	if !restarted() {
+		sessions.Recover(context.Background())
+	}
+	go sessions.Reap(context.Background(), 10*time.Minute)
+	createSession := sessions.CreateHandler()
+	session := schedule(sessions.SessionHandler())
+	writes.HandleFunc("POST /v1/uploads", createSession)
+	api.HandleFunc("OPTIONS /v1/uploads", createSession)
+	writes.HandleFunc("POST /v1/uploads/{$}", createSession)
+	api.HandleFunc("GET /v1/uploads/{id}", session)
+	writes.HandleFunc("PATCH /v1/uploads/{id}", session)
+	writes.HandleFunc("DELETE /v1/uploads/{id}", session)
+	writes.HandleFunc("POST /v1/uploads/{id}/complete", sessions.CompleteHandler())
+	if cfg.DirectS3Bucket != "" {
+		direct := NewDirectUploads(in, db, locker, &S3Bucket{Name: cfg.DirectS3Bucket, Prefix: cfg.DirectS3Prefix}, time.Duration(cfg.DirectURLTTLSeconds)*time.Second)
+		go direct.Reap(context.Background(), 10*time.Minute)
+		writes.HandleFunc("POST /v1/uploads/direct", direct.CreateHandler())
+		writes.HandleFunc("POST /v1/uploads/direct/{id}/complete", direct.CompleteHandler())
+	}
+	datasets := NewDatasets(db, store)
+	dataset := datasets.DatasetHandler()
+	writes.HandleFunc("POST /v1/datasets", datasets.CreateHandler())
+	writes.HandleFunc("POST /v1/datasets/{$}", datasets.CreateHandler())
+	api.HandleFunc("GET /v1/datasets/{id}", dataset)
+	writes.HandleFunc("PATCH /v1/datasets/{id}", dataset)
+	api.HandleFunc("GET /v1/datasets/{id}/archive", datasets.ArchiveHandler())
+	scrubber := NewScrubber(store, locker, audit, cfg.ScrubQuarantine)
+	if cfg.ScrubIntervalHours > 0 {
+		go scrubber.Run(context.Background(), time.Duration(cfg.ScrubIntervalHours)*time.Hour)
+	}
+	go NewExpirer(store, events, locker, audit).Run(context.Background(), 10*time.Minute)
+
+	api.HandleFunc("GET /v1/capabilities", CapabilitiesHandler(in))
+	api.HandleFunc("GET /v1/receipts/keys", receipts.KeysHandler())
+
+	// With UPLOAD_ADMIN_LISTEN the admin API, metrics and debug endpoints
+	// move to their own server; otherwise they share the public one.
+	adminMux := mux
+	if cfg.AdminListen != "" {
+		adminMux = NewRouter()
+		adminMux.Handle("/debug/", DebugMux(secrets.DebugToken))
+	}
+	adminMux.HandleFunc("GET /metrics", MetricsHandler())
+	admin := adminMux.Group(RequestMetrics, AdminAuth(secrets.AdminToken))
+	// Admin routes that change files are refused in read-only mode too;
+	// the maintenance switch itself and operator settings are not.
+	adminWrites := adminMux.Group(RequestMetrics, AdminAuth(secrets.AdminToken), maintenance.Guard)
+	scrub := ScrubHandler(scrubber)
+	holds := HoldHandler(store, locker, audit, events)
+	admin.HandleFunc("GET /v1/admin/scrub", scrub)
+	adminWrites.HandleFunc("POST /v1/admin/scrub", scrub)
+	admin.HandleFunc("GET /v1/admin/export", ExportHandler(store))
+	admin.HandleFunc("GET /v1/admin/stats/timeseries", history.TimeseriesHandler(store))
+	admin.HandleFunc("GET /v1/admin/stats/top-talkers", traffic.TopTalkersHandler())
+	admin.HandleFunc("GET /v1/admin/alerts", alerts.Handler())
+	admin.HandleFunc("POST /v1/admin/reconcile", ReconcileHandler(NewReconciler(store, locker, audit, events, cfg.ArchiveDir)))
+	if blobKeys != nil {
+		adminWrites.HandleFunc("POST /v1/admin/encryption/rewrap", RewrapHandler(store, blobKeys, locker, audit))
+	}
+	admin.HandleFunc("GET /v1/admin/policies", policies.ListHandler())
+	admin.HandleFunc("GET /v1/admin/policies/{id}", policies.PolicyHandler())
+	admin.HandleFunc("PUT /v1/admin/policies/{id}", policies.PolicyHandler())
+	admin.HandleFunc("DELETE /v1/admin/policies/{id}", policies.PolicyHandler())
+	admin.HandleFunc("GET /v1/admin/buckets", provisioning.BucketsHandler())
+	admin.HandleFunc("GET /v1/admin/buckets/{name}", provisioning.BucketHandler())
+	admin.HandleFunc("PUT /v1/admin/buckets/{name}", provisioning.BucketHandler())
+	admin.HandleFunc("DELETE /v1/admin/buckets/{name}", provisioning.BucketHandler())
+	admin.HandleFunc("GET /v1/admin/api-keys", provisioning.APIKeysHandler())
+	admin.HandleFunc("GET /v1/admin/api-keys/{id}", provisioning.APIKeyHandler())
+	admin.HandleFunc("PUT /v1/admin/api-keys/{id}", provisioning.APIKeyHandler())
+	admin.HandleFunc("DELETE /v1/admin/api-keys/{id}", provisioning.APIKeyHandler())
+	admin.HandleFunc("GET /v1/admin/flags", flags.ListHandler())
+	admin.HandleFunc("GET /v1/admin/maintenance", maintenance.Handler())
+	recorder := NewRequestRecorder(cfg.RequestRecording, cfg.RequestRecordingSize, cfg.AccessLogRedact)
+	admin.HandleFunc("GET /v1/admin/requests", recorder.Handler())
+	admin.HandleFunc("PUT /v1/admin/requests", recorder.Handler())
+	admin.HandleFunc("DELETE /v1/admin/requests", recorder.Handler())
+	admin.HandleFunc("PUT /v1/admin/maintenance", maintenance.Handler())
+	admin.HandleFunc("PUT /v1/admin/flags/{name}", flags.FlagHandler())
+	admin.HandleFunc("DELETE /v1/admin/flags/{name}", flags.FlagHandler())
+	adminWrites.HandleFunc("POST /v1/admin/purge", PurgeHandler(NewPurger(store, db, locker, audit), signer, audit, events))
+	adminWrites.HandleFunc("POST /v1/admin/holds", holds)
+	adminWrites.HandleFunc("DELETE /v1/admin/holds", holds)
+	quarantine := QuarantineHandler(store, locker, audit, events)
+	admin.HandleFunc("GET /v1/admin/quarantine", quarantine)
+	adminWrites.HandleFunc("POST /v1/admin/quarantine/release", quarantine)
+
+	versions := NewVersionRouter(mux)
+	versions.Register(APIVersion{Name: "v1", Handler: mux})
+
+	reporter, err := NewErrorReporter(secrets.SentryDSN.Value(), secrets.ErrorWebhook)
+	if err != nil {
+		log.Fatalf("configure error reporting: %v", err)
+	}
+
+	var chaos, compress, throttle, logRequests Middleware
+	if cfg.Chaos {
+		log.Printf("WARNING: chaos fault injection is enabled for %s", cfg.ChaosPathPrefix)
+		chaos = func(next http.Handler) http.Handler {
+			return Chaos(ChaosConfig{
+				LatencyRate:  cfg.ChaosLatencyRate,
+				MaxLatency:   time.Duration(cfg.ChaosMaxLatencyMS) * time.Millisecond,
+				ErrorRate:    cfg.ChaosErrorRate,
+				TruncateRate: cfg.ChaosTruncateRate,
+				PathPrefix:   cfg.ChaosPathPrefix,
+			}, next)
+		}
+	}
+	if cfg.ResponseCompression {
+		compress = func(next http.Handler) http.Handler { return CompressResponses(cfg.CompressMinBytes, next) }
+	}
+	var bandwidth *Bandwidth
+	if cfg.BandwidthGlobalKBps > 0 || cfg.BandwidthConnKBps > 0 {
+		bandwidth = NewBandwidth(int64(cfg.BandwidthGlobalKBps)<<10, int64(cfg.BandwidthConnKBps)<<10)
+		throttle = bandwidth.Middleware
+	}
+	if cfg.AccessLogFormat != "" {
+		out, err := OpenAccessLogOutput(cfg.AccessLogPath, logRotation(cfg))
+		if err != nil {
+			log.Fatalf("open access log: %v", err)
+		}
+		accessLog, err := NewAccessLog(out, cfg.AccessLogFormat, cfg.AccessLogSample, cfg.AccessLogRedact)
+		if err != nil {
+			log.Fatalf("configure access log: %v", err)
+		}
+		logRequests = accessLog.Middleware
+	}
+	// Throttle outside compression so limits apply to bytes on the wire.
+	handler := Chain{Deadlines, logRequests, throttle, compress, CORS(cfg.CORSOrigins), RequestID, recorder.Middleware, messages.Middleware, Recoverer(reporter), chaos}.Then(versions)
+
+	if cfg.DebugAddr != "" {
+		go func() {
+			if err := serveDebug(cfg.DebugAddr, secrets.DebugToken); err != nil {
+				log.Fatalf("debug listener: %v", err)
+			}
+		}()
+	}
+
+	listeners, err := Listen(cfg.ListenAddr, cfg.SocketMode)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	if bandwidth != nil {
+		srv.ConnContext = bandwidth.ConnContext
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		log.Fatal("UPLOAD_TLS_CERT and UPLOAD_TLS_KEY must be set together")
+	}
+	err = configureHTTP2(srv, HTTP2Config{
+		Enabled:              cfg.HTTP2,
+		H2C:                  cfg.H2C,
+		MaxConcurrentStreams: uint32(cfg.H2MaxConcurrentStreams),
+		StreamWindowBytes:    int32(cfg.H2StreamWindowKB) << 10,
+		ConnWindowBytes:      int32(cfg.H2ConnWindowKB) << 10,
+	})
+	if err != nil {
+		log.Fatalf("configure http2: %v", err)
+	}
+	endpoints := []*Endpoint{{Name: "api", Server: srv, Listeners: listeners, TLSCert: cfg.TLSCert, TLSKey: cfg.TLSKey}}
+
+	if cfg.AdminListen != "" {
+		allow, err := parseNetworks(cfg.AdminAllow)
+		if err != nil {
+			log.Fatalf("UPLOAD_ADMIN_ALLOW: %v", err)
+		}
+		if (cfg.AdminTLSCert == "") != (cfg.AdminTLSKey == "") {
+			log.Fatal("UPLOAD_ADMIN_TLS_CERT and UPLOAD_ADMIN_TLS_KEY must be set together")
+		}
+		adminHandler := Chain{logRequests, RequestID, Recoverer(reporter), requireNetwork(allow)}.Then(adminMux)
+		adminListeners, err := Listen(cfg.AdminListen, cfg.SocketMode)
+		if err != nil {
+			log.Fatalf("admin listen: %v", err)
+		}
+		endpoints = append(endpoints, &Endpoint{
+			Name:      "admin",
+			Server:    &http.Server{Handler: adminHandler, ReadHeaderTimeout: 10 * time.Second},
+			Listeners: adminListeners,
+			TLSCert:   cfg.AdminTLSCert,
+			TLSKey:    cfg.AdminTLSKey,
+		})
+	}
+
+	if err := runServers(endpoints, time.Duration(cfg.DrainSeconds)*time.Second); err != nil {
+		log.Fatal(err)
+	}
+	history.Flush(context.Background())
+}
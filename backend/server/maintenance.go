@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var ErrMaintenanceNotFound = errors.New("maintenance state not found")
+
+// errReadOnly is returned by metadata writes refused in read-only mode.
+var errReadOnly = errors.New("metadata is read-only for maintenance")
+
+// readOnlyKinds are the documents about files that the JSON store, like
+// file records themselves, refuses to change in read-only mode. Shares
+// (whose downloads are counted), archive plans and the operator's own
+// settings stay writable.
+var readOnlyKinds = map[string]bool{"access": true, "datasets": true, "keys": true, "sessions": true, "direct": true}
+
+type MaintenanceStore interface {
+	GetMaintenance(ctx context.Context) (*MaintenanceState, error)
+	PutMaintenance(ctx context.Context, m *MaintenanceState) error
+}
+
+// MaintenanceState is the read-only switch an operator flips before a
+// storage migration or backup.
+type MaintenanceState struct {
+	ReadOnly bool       `json:"readOnly"`
+	Message  string     `json:"message,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+const defaultMaintenanceMessage = "The service is in read-only mode for maintenance; uploads and deletes are unavailable"
+
+// Maintenance puts the service into read-only mode. While it is on,
+// downloads and listings keep working but every route that writes files
+// or their metadata answers 503, and so do uploads arriving by watch folder
+// or SFTP, which retry later. The expiry, tiering, scrub and reaper jobs
+// pause so the blobs and records stay as they were, and downloads stop
+// recording access times. Behind all of these the metadata stores refuse
+// writes to records with errReadOnly, so nothing that slips past them
+// changes a file either. The state lives in the store so all
+// instances follow it; Run picks up a change made through another
+// instance.
+type Maintenance struct {
+	store MaintenanceStore
+	audit *AuditLog
+	state atomic.Pointer[MaintenanceState]
+}
+
+// maintenance is set at startup.
+var maintenance *Maintenance
+
+func NewMaintenance(store MaintenanceStore, audit *AuditLog) *Maintenance {
+	m := &Maintenance{store: store, audit: audit}
+	m.state.Store(&MaintenanceState{})
+	return m
+}
+
+func (m *Maintenance) Reload(ctx context.Context) error {
+	st, err := m.store.GetMaintenance(ctx)
+	if errors.Is(err, ErrMaintenanceNotFound) {
+		st, err = &MaintenanceState{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	m.set(st)
+	return nil
+}
+
+func (m *Maintenance) set(st *MaintenanceState) {
+	old := m.state.Swap(st)
+	if old.ReadOnly != st.ReadOnly {
+		log.Printf("maintenance: read-only mode %s", onOff(st.ReadOnly))
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func (m *Maintenance) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := m.Reload(ctx); err != nil {
+				log.Printf("maintenance: reload: %v", err)
+			}
+		}
+	}
+}
+
+// ReadOnly reports whether writes are refused. A nil Maintenance never
+// refuses.
+func (m *Maintenance) ReadOnly() bool {
+	return m != nil && m.state.Load().ReadOnly
+}
+
+// writable returns errReadOnly in read-only mode. The metadata stores call
+// it before each write they refuse during maintenance.
+func (m *Maintenance) writable() error {
+	if m.ReadOnly() {
+		return errReadOnly
+	}
+	return nil
+}
+
+// Refusal returns the 503 for a write attempted in read-only mode, or nil.
+func (m *Maintenance) Refusal() *UploadError {
+	if !m.ReadOnly() {
+		return nil
+	}
+	msg := newMessage("read_only")
+	if text := m.state.Load().Message; text != "" {
+		msg = Message{Text: text}
+	}
+	return newUploadErrorMessage(http.StatusServiceUnavailable, "service_unavailable", msg)
+}
+
+// Guard refuses requests while in read-only mode. It wraps the routes
+// that write.
+func (m *Maintenance) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.ReadOnly() {
+			writeReadOnly(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeReadOnly writes the 503 for a write refused in read-only mode.
+func writeReadOnly(w http.ResponseWriter) {
+	uerr := maintenance.Refusal()
+	if uerr == nil {
+		// Switched off since the write was refused.
+		uerr = newUploadErrorMessage(http.StatusServiceUnavailable, "service_unavailable", newMessage("read_only"))
+	}
+	w.Header().Set("Retry-After", "60")
+	writeUploadError(w, uerr)
+}
+
+// Handler serves GET and PUT on /v1/admin/maintenance.
+func (m *Maintenance) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, m.state.Load())
+
+		case http.MethodPut:
+			var st MaintenanceState
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&st); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			st.Since = nil
+			if cur := m.state.Load(); st.ReadOnly && cur.ReadOnly {
+				st.Since = cur.Since
+			} else if st.ReadOnly {
+				now := time.Now().UTC()
+				st.Since = &now
+			}
+			if !st.ReadOnly {
+				st.Message = ""
+			}
+			if err := m.store.PutMaintenance(r.Context(), &st); err != nil {
+				writeInternalError(w, "Failed to save maintenance state")
+				return
+			}
+			m.set(&st)
+			m.audit.Record(AuditEvent{Action: "maintenance", Actor: "admin", Detail: "read-only " + onOff(st.ReadOnly)})
+			writeJSON(w, http.StatusOK, &st)
+
+		default:
+			writeMethodNotAllowed(w, "Only GET and PUT methods are allowed for maintenance")
+		}
+	}
+}
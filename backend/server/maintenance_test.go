@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readOnly switches the process into read-only mode for the rest of t.
+func readOnly(t *testing.T) {
+	t.Helper()
+	m := NewMaintenance(nil, nil)
+	m.set(&MaintenanceState{ReadOnly: true, Message: "migrating"})
+	maintenance = m
+	t.Cleanup(func() { maintenance = nil })
+}
+
+func TestReadOnlyStoreWrites(t *testing.T) {
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	rec := testRecord(t, in)
+	readOnly(t)
+
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		write   func() error
+		refused bool
+	}{
+		{"record put", func() error { return db.Put(ctx, rec) }, true},
+		{"record delete", func() error { return db.Delete(ctx, rec.ID) }, true},
+		{"memory store put", func() error { return NewMemoryStore().Put(ctx, rec) }, true},
+		{"record update", func() error {
+			_, err := updateRecord(ctx, db, newLocalLocker(), rec.ID, func(*FileRecord) error { return nil })
+			return err
+		}, true},
+		{"access touch", func() error { return db.TouchAccess(ctx, rec.ID, time.Now()) }, true},
+		{"dataset", func() error { return db.PutDataset(ctx, &Dataset{ID: "d1"}) }, true},
+		{"share download count", func() error { return db.PutShare(ctx, &Share{ID: "s1", FileID: rec.ID, Downloads: 1}) }, false},
+		{"maintenance switch", func() error { return db.PutMaintenance(ctx, &MaintenanceState{}) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.write(); errors.Is(err, errReadOnly) != tt.refused {
+				t.Errorf("err = %v, want refused = %v", err, tt.refused)
+			}
+		})
+	}
+	if got, err := db.Get(ctx, rec.ID); err != nil || got.Revision != rec.Revision {
+		t.Errorf("record changed in read-only mode: %+v, %v", got, err)
+	}
+}
+
+func TestReadOnlyRoutes(t *testing.T) {
+	in := testIngest(t)
+	rec := testRecord(t, in)
+	readOnly(t)
+
+	mux := http.NewServeMux()
+	file := FileHandler(in.Store, newLocalLocker(), &AuditLog{}, nil)
+	// PATCH goes straight to the handler, as if a route missed the guard.
+	mux.HandleFunc("PATCH /v1/files/{id}", file)
+	mux.Handle("DELETE /v1/files/{id}", maintenance.Guard(file))
+	mux.HandleFunc("GET /v1/files/{id}", DownloadHandler(in.Store, in.Store.(*jsonStore), nil))
+	mux.HandleFunc("POST /v1/admin/reconcile", ReconcileHandler(NewReconciler(in.Store, newLocalLocker(), &AuditLog{}, nil, "")))
+
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPatch, "/v1/files/" + rec.ID, `{"description":"x"}`, http.StatusServiceUnavailable},
+		{http.MethodDelete, "/v1/files/" + rec.ID, "", http.StatusServiceUnavailable},
+		{http.MethodPost, "/v1/admin/reconcile?repair=true", "", http.StatusServiceUnavailable},
+		{http.MethodGet, "/v1/files/" + rec.ID, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if w.Code == http.StatusServiceUnavailable && (w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "migrating")) {
+				t.Errorf("refusal without Retry-After or message: %v %s", w.Header(), w.Body)
+			}
+		})
+	}
+	if at, _ := in.Store.(*jsonStore).LastAccess(context.Background(), rec.ID); !at.IsZero() {
+		t.Error("download recorded an access time in read-only mode")
+	}
+}
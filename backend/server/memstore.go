@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// MemoryStore is a MetadataStore kept in memory, for tests and for
+// embedding the server without a metadata directory. Records go in and
+// come out through JSON, as with the JSON store, so callers never share
+// them with the store and unexported fields are dropped the same way; it
+// refuses writes in read-only mode the same way too.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	recs map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{recs: map[string][]byte{}}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id string) (*FileRecord, error) {
+	s.mu.RLock()
+	b, ok := s.recs[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var rec FileRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, rec *FileRecord) error {
+	if err := maintenance.writable(); err != nil {
+		return err
+	}
+	if !validID(rec.ID) {
+		return errors.New("invalid record id")
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recs[rec.ID] = b
+	return nil
+}
+
+func (s *MemoryStore) Create(ctx context.Context, rec *FileRecord) error {
+	if err := maintenance.writable(); err != nil {
+		return err
+	}
+	if !validID(rec.ID) {
+		return errors.New("invalid record id")
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.recs[rec.ID]; ok {
+		return ErrExists
+	}
+	s.recs[rec.ID] = b
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	if err := maintenance.writable(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.recs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.recs, id)
+	return nil
+}
+
+// List returns the records in ID order.
+func (s *MemoryStore) List(ctx context.Context) ([]*FileRecord, error) {
+	s.mu.RLock()
+	ids := slices.Sorted(maps.Keys(s.recs))
+	s.mu.RUnlock()
+	var out []*FileRecord
+	for _, id := range ids {
+		rec, err := s.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) FindByChecksum(ctx context.Context, checksum string) ([]*FileRecord, error) {
+	checksum, ok := parseChecksum(checksum)
+	if !ok {
+		return nil, nil
+	}
+	recs, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recs = slices.DeleteFunc(recs, func(rec *FileRecord) bool { return rec.ChecksumSHA != checksum })
+	sort.Slice(recs, func(i, j int) bool { return recs[i].UploadedAt.Before(recs[j].UploadedAt) })
+	return recs, nil
+}
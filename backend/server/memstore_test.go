@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMetadataStores holds both MetadataStore implementations to the same
+// contract.
+func TestMetadataStores(t *testing.T) {
+	stores := []struct {
+		name string
+		new  func(t *testing.T) MetadataStore
+	}{
+		{"memory", func(*testing.T) MetadataStore { return NewMemoryStore() }},
+		{"json", func(t *testing.T) MetadataStore {
+			s, err := NewJSONStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := st.new(t)
+			sum := strings.Repeat("0f", 32)
+			now := time.Now().UTC()
+			newer := &FileRecord{ID: "bbbb", ChecksumSHA: sum, UploadedAt: now}
+			older := &FileRecord{ID: "aaaa", ChecksumSHA: sum, UploadedAt: now.Add(-time.Hour)}
+			for _, rec := range []*FileRecord{newer, older} {
+				if err := s.Create(ctx, rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Create(ctx, newer); !errors.Is(err, ErrExists) {
+				t.Errorf("second create: %v, want ErrExists", err)
+			}
+
+			got, err := s.Get(ctx, newer.ID)
+			if err != nil || got.ChecksumSHA != sum {
+				t.Fatalf("get: %+v, %v", got, err)
+			}
+			got.Tags = append(got.Tags, "edited")
+			if again, _ := s.Get(ctx, newer.ID); len(again.Tags) != 0 {
+				t.Error("a returned record shares state with the store")
+			}
+
+			found, err := s.FindByChecksum(ctx, strings.ToUpper(sum))
+			if err != nil || len(found) != 2 || found[0].ID != older.ID {
+				t.Errorf("find by checksum: %v, %v; want oldest first", found, err)
+			}
+
+			if err := s.Delete(ctx, older.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ctx, older.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second delete: %v, want ErrNotFound", err)
+			}
+			if _, err := s.Get(ctx, older.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("get deleted: %v, want ErrNotFound", err)
+			}
+			recs, err := s.List(ctx)
+			if err != nil || len(recs) != 1 || recs[0].ID != newer.ID {
+				t.Errorf("list: %v, %v", recs, err)
+			}
+		})
+	}
+}
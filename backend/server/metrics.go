@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics is the process-wide registry rendered at /metrics in the
+// Prometheus text exposition format.
+var metrics = &registry{families: map[string]*family{}}
+
+type registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name, help, kind string
+	series           map[string]*Metric
+}
+
+// Metric is a float64 value stored as bits so it can be updated atomically.
+type Metric struct {
+	bits atomic.Uint64
+}
+
+func (m *Metric) Add(v float64) {
+	for {
+		old := m.bits.Load()
+		if m.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (m *Metric) Inc()           { m.Add(1) }
+func (m *Metric) Set(v float64)  { m.bits.Store(math.Float64bits(v)) }
+func (m *Metric) Value() float64 { return math.Float64frombits(m.bits.Load()) }
+
+// Counter and Gauge return the series for name with the given label pairs,
+// creating it on first use.
+func (r *registry) Counter(name, help string, labels ...string) *Metric {
+	return r.get("counter", name, help, labels)
+}
+
+func (r *registry) Gauge(name, help string, labels ...string) *Metric {
+	return r.get("gauge", name, help, labels)
+}
+
+func (r *registry) get(kind, name, help string, labels []string) *Metric {
+	key := labelString(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, series: map[string]*Metric{}}
+		r.families[name] = f
+	}
+	m, ok := f.series[key]
+	if !ok {
+		m = &Metric{}
+		f.series[key] = m
+	}
+	return m
+}
+
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, labels[i]+`="`+v+`"`)
+	}
+	sort.Strings(parts)
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.mu.Lock()
+		names := make([]string, 0, len(metrics.families))
+		for name := range metrics.families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var b strings.Builder
+		for _, name := range names {
+			f := metrics.families[name]
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+			keys := make([]string, 0, len(f.series))
+			for k := range f.series {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(&b, "%s%s %g\n", f.name, k, f.series[k].Value())
+			}
+		}
+		metrics.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte(b.String()))
+	}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Chain is an ordered middleware stack; the first entry is outermost. Nil
+// entries are skipped, so optional middleware can be listed unconditionally.
+type Chain []Middleware
+
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i] != nil {
+			h = c[i](h)
+		}
+	}
+	return h
+}
+
+// Append returns a new chain with mw added innermost.
+func (c Chain) Append(mw ...Middleware) Chain {
+	return append(slices.Clip(c), mw...)
+}
+
+// RouteGroup registers routes on a Router behind a shared chain.
+type RouteGroup struct {
+	rt    *Router
+	chain Chain
+}
+
+func (rt *Router) Group(mw ...Middleware) *RouteGroup {
+	return &RouteGroup{rt: rt, chain: mw}
+}
+
+func (g *RouteGroup) Handle(pattern string, h http.Handler) {
+	g.rt.Handle(pattern, g.chain.Then(h))
+}
+
+func (g *RouteGroup) HandleFunc(pattern string, h http.HandlerFunc) {
+	g.Handle(pattern, h)
+}
+
+type requestIDKey struct{}
+
+// RequestID assigns every request an ID, reusing a valid X-Request-ID from
+// the client, and echoes it in the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validID(id) {
+			id, _ = randomHex(8)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID assigned by RequestID, if any.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Recoverer adapts Recover to a Middleware.
+func Recoverer(reporter ErrorReporter) Middleware {
+	return func(next http.Handler) http.Handler { return Recover(reporter, next) }
+}
+
+// AdminAuth requires the admin bearer token; see requireAdmin.
+func AdminAuth(token *Secret) Middleware {
+	return func(next http.Handler) http.Handler { return requireAdmin(token, next.ServeHTTP) }
+}
+
+// RequestMetrics counts requests and their latency per route pattern.
+func RequestMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.Counter("http_requests_total", "HTTP requests by route, method and status.",
+			"route", route, "method", r.Method, "code", strconv.Itoa(status)).Inc()
+		metrics.Counter("http_request_duration_seconds_sum", "Total time spent serving requests, by route.",
+			"route", route).Add(time.Since(start).Seconds())
+		metrics.Counter("http_request_duration_seconds_count", "Requests timed in http_request_duration_seconds_sum, by route.",
+			"route", route).Inc()
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+// CORS lets browsers on the listed origins ("*" for any) call the API
+// directly, answering preflight requests itself. It returns nil, disabling
+// the middleware, when no origins are configured.
+func CORS(origins []string) Middleware {
+	if len(origins) == 0 {
+		return nil
+	}
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[strings.TrimSpace(o)] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !(allowed["*"] || allowed[origin]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+				if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+					h.Set("Access-Control-Allow-Headers", req)
+				}
+				h.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			h.Set("Access-Control-Expose-Headers", "X-Request-ID, Location, Upload-Offset, Upload-Length, Retry-After, ETag, Link, X-Next-Cursor")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimit allows each client rps requests per second with bursts of up
+// to burst, answering 429 beyond that. Clients are told apart by X-API-Key,
+// falling back to the remote address. It returns nil when rps is 0.
+func RateLimit(rps float64, burst int) Middleware {
+	if rps <= 0 {
+		return nil
+	}
+	l := &rateLimiter{rate: rps, burst: math.Max(float64(burst), 1), clients: map[string]*clientBucket{}}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, wait := l.allow(rateLimitKey(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeMessage(w, http.StatusTooManyRequests, "too_many_requests", newMessage("rate_limited"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func rateLimitKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return "key:" + k
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "addr:" + r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token for key, or reports how long until one is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+	b, ok := l.clients[key]
+	if !ok {
+		b = &clientBucket{tokens: l.burst, last: now}
+		l.clients[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets clients whose buckets have refilled, keeping the map
+// bounded by the number of recently active clients.
+func (l *rateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.clients {
+		if now.Sub(b.last) > full {
+			delete(l.clients, k)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Notification events. Email picks them with UPLOAD_NOTIFY_EVENTS and gives
+// each its own template; webhooks list theirs in the webhook config.
+const (
+	NotifyUploadCompleted = "upload.completed"
+	NotifyUploadRejected  = "upload.rejected"
+	NotifyShareAccessed   = "share.accessed"
+	NotifyAlertFired      = "alert.fired"
+	NotifyAlertResolved   = "alert.resolved"
+)
+
+var notifyEvents = []string{NotifyUploadCompleted, NotifyUploadRejected, NotifyShareAccessed, NotifyAlertFired, NotifyAlertResolved}
+
+// defaultNotifyTemplates render a subject on the first line and the body
+// after it. A file named <event>.tmpl in the template directory replaces
+// the default for that event.
+var defaultNotifyTemplates = map[string]string{
+	NotifyUploadCompleted: `Upload complete: {{.Filename}}
+{{.Filename}} was uploaded at {{.Time.Format "2006-01-02 15:04:05 MST"}}.
+
+File ID:  {{.File.ID}}
+Size:     {{.File.Bytes}} bytes
+SHA-256:  {{.File.ChecksumSHA}}
+{{- if .File.DuplicateOf}}
+Duplicate of: {{.File.DuplicateOf}}{{end}}
+`,
+	NotifyUploadRejected: `Upload rejected: {{.Filename}}
+{{.Filename}} was rejected at {{.Time.Format "2006-01-02 15:04:05 MST"}}.
+
+Reason: {{.Error.Message}} ({{.Error.Code}})
+`,
+	NotifyShareAccessed: `Share link accessed: {{.Share.ID}}
+Share link {{.Share.ID}} for file {{.Share.FileID}} was accessed at {{.Time.Format "2006-01-02 15:04:05 MST"}}.
+
+Outcome:    {{.Access.Outcome}}
+From:       {{.Access.RemoteAddr}}
+User agent: {{.Access.UserAgent}}
+Downloads:  {{.Share.Downloads}}{{if .Share.MaxDownloads}} of {{.Share.MaxDownloads}}{{end}}
+`,
+	NotifyAlertFired: `Alert: {{.Alert.Name}}
+{{.Alert.Summary}}.
+
+The alert threshold is {{.Alert.Threshold}}; the value at {{.Time.Format "2006-01-02 15:04:05 MST"}} was {{printf "%.3g" .Alert.Value}}.
+`,
+	NotifyAlertResolved: `Resolved: {{.Alert.Name}}
+{{.Alert.Summary}}.
+
+The alert fired at {{.Alert.Since.Format "2006-01-02 15:04:05 MST"}} and resolved at {{.Time.Format "2006-01-02 15:04:05 MST"}}.
+`,
+}
+
+// NotifyData is what notification templates see. Bucket is the first
+// segment of the object key the upload targeted, if any; Uploader is the
+// address from X-Notify-Email. Alert is set for the alert events.
+type NotifyData struct {
+	Event    string
+	Time     time.Time
+	Filename string
+	Bucket   string
+	Uploader string
+	File     *FileRecord
+	Error    *UploadError
+	Share    *Share
+	Access   *ShareAccess
+	Alert    *Alert
+}
+
+type SMTPConfig struct {
+	Addr     string
+	Username string
+	Password *Secret
+	From     string
+}
+
+// Notifier delivers notification events by email and to chat webhooks.
+// Delivery happens in the background from a bounded queue so a slow SMTP
+// server or webhook never holds up a request; when the queue is full
+// notifications are dropped and logged. A nil *Notifier is valid and sends
+// nothing.
+type Notifier struct {
+	email    *emailNotifier
+	webhooks []*webhookNotifier
+	queue    chan NotifyData
+}
+
+// NewNotifier starts the sender for whichever of email and webhooks are
+// configured, or returns nil when neither is.
+func NewNotifier(email *emailNotifier, webhooks []*webhookNotifier) *Notifier {
+	if email == nil && len(webhooks) == 0 {
+		return nil
+	}
+	n := &Notifier{email: email, webhooks: webhooks, queue: make(chan NotifyData, 100)}
+	go n.run()
+	return n
+}
+
+// Notify queues data for every channel that wants its event.
+func (n *Notifier) Notify(data NotifyData) {
+	if n == nil {
+		return
+	}
+	if data.Time.IsZero() {
+		data.Time = time.Now().UTC()
+	}
+	select {
+	case n.queue <- data:
+	default:
+		log.Printf("notify: queue full; dropping %s notification", data.Event)
+	}
+}
+
+func (n *Notifier) run() {
+	for data := range n.queue {
+		if n.email != nil {
+			if err := n.email.send(data); err != nil {
+				log.Printf("notify: email %s: %v", data.Event, err)
+			}
+		}
+		for _, wh := range n.webhooks {
+			if !wh.wants(data) {
+				continue
+			}
+			if err := wh.send(data); err != nil {
+				log.Printf("notify: %s webhook %s: %v", wh.Kind, data.Event, err)
+			}
+		}
+	}
+}
+
+// emailNotifier emails configured recipients, and optionally the uploader.
+type emailNotifier struct {
+	smtp      SMTPConfig
+	to        []string
+	events    map[string]bool
+	uploader  bool
+	templates map[string]*template.Template
+}
+
+// newEmailNotifier parses the templates, or returns nil when no SMTP server
+// is configured. events limits which notifications are mailed; empty means
+// all of them. Templates in templateDir, when set, override the built-in
+// ones.
+func newEmailNotifier(cfg SMTPConfig, to, events []string, uploader bool, templateDir string) (*emailNotifier, error) {
+	if cfg.Addr == "" {
+		return nil, nil
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return nil, fmt.Errorf("invalid notification sender %q: %w", cfg.From, err)
+	}
+	n := &emailNotifier{
+		smtp:      cfg,
+		events:    map[string]bool{},
+		uploader:  uploader,
+		templates: map[string]*template.Template{},
+	}
+	for _, addr := range to {
+		a, err := mail.ParseAddress(strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid notification recipient %q: %w", addr, err)
+		}
+		n.to = append(n.to, a.Address)
+	}
+	for _, ev := range events {
+		ev, err := checkNotifyEvent(ev)
+		if err != nil {
+			return nil, err
+		}
+		n.events[ev] = true
+	}
+	for _, ev := range notifyEvents {
+		if len(events) == 0 {
+			n.events[ev] = true
+		}
+		text := defaultNotifyTemplates[ev]
+		if templateDir != "" {
+			b, err := os.ReadFile(filepath.Join(templateDir, ev+".tmpl"))
+			if err == nil {
+				text = string(b)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		tmpl, err := template.New(ev).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s template: %w", ev, err)
+		}
+		n.templates[ev] = tmpl
+	}
+	return n, nil
+}
+
+func checkNotifyEvent(ev string) (string, error) {
+	ev = strings.TrimSpace(ev)
+	if !slices.Contains(notifyEvents, ev) {
+		return "", fmt.Errorf("unknown notification event %q (want %s)", ev, strings.Join(notifyEvents, ", "))
+	}
+	return ev, nil
+}
+
+// send mails data to the configured recipients plus the uploader when
+// uploader notifications are on.
+func (n *emailNotifier) send(data NotifyData) error {
+	if !n.events[data.Event] {
+		return nil
+	}
+	to := slices.Clone(n.to)
+	if n.uploader && data.Uploader != "" && !slices.Contains(to, data.Uploader) {
+		to = append(to, data.Uploader)
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	var out bytes.Buffer
+	if err := n.templates[data.Event].Execute(&out, data); err != nil {
+		return err
+	}
+	subject, body, _ := strings.Cut(out.String(), "\n")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.smtp.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(strings.TrimLeft(body, "\n"), "\n", "\r\n"))); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if n.smtp.Username != "" {
+		host, _, _ := net.SplitHostPort(n.smtp.Addr)
+		auth = smtp.PlainAuth("", n.smtp.Username, n.smtp.Password.Value(), host)
+	}
+	from, _ := mail.ParseAddress(n.smtp.From)
+	return smtp.SendMail(n.smtp.Addr, auth, from.Address, to, b.Bytes())
+}
+
+// notifyAddress is the uploader's address from X-Notify-Email, or "" when
+// it is missing or not a valid address.
+func notifyAddress(r *http.Request) string {
+	v := r.Header.Get("X-Notify-Email")
+	if v == "" {
+		return ""
+	}
+	a, err := mail.ParseAddress(v)
+	if err != nil {
+		return ""
+	}
+	return a.Address
+}
+
+// notifyUpload reports the outcome of one upload. Server-side failures are
+// not the uploader's doing and are left to error reporting.
+func (in *Ingest) notifyUpload(filename, key, uploader string, rec *FileRecord, uerr *UploadError) {
+	bucket, _, _ := strings.Cut(key, "/")
+	switch {
+	case uerr != nil && uerr.Status < http.StatusInternalServerError:
+		in.Notifier.Notify(NotifyData{Event: NotifyUploadRejected, Filename: filename, Bucket: bucket, Uploader: uploader, Error: uerr})
+	case rec != nil:
+		in.Notifier.Notify(NotifyData{Event: NotifyUploadCompleted, Filename: rec.Filename, Bucket: bucket, Uploader: uploader, File: rec.withoutPlaintext()})
+	}
+}
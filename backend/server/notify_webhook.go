@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WebhookSlack = "slack"
+	WebhookTeams = "teams"
+	WebhookJSON  = "json"
+)
+
+// webhookNotifier posts notifications to a Slack or Microsoft Teams
+// incoming webhook, or as plain JSON (webhookEvent) to any other endpoint.
+// Events and Buckets narrow what it receives; either left empty matches
+// everything. Alerts concern no bucket and pass Buckets.
+type webhookNotifier struct {
+	Kind    string   `json:"kind"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events,omitempty"`
+	Buckets []string `json:"buckets,omitempty"`
+
+	baseURL string
+}
+
+type webhookConfig struct {
+	Webhooks []*webhookNotifier `json:"webhooks"`
+}
+
+// loadWebhooks reads path, a JSON document of the form
+//
+//	{"webhooks": [{"kind": "slack", "url": "https://hooks.slack.com/...",
+//	  "events": ["upload.completed"], "buckets": ["reports"]}]}
+//
+// baseURL, the server's public address, turns file IDs into links; without
+// it messages carry no link. An empty path yields no webhooks.
+func loadWebhooks(path, baseURL string) ([]*webhookNotifier, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg webhookConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, wh := range cfg.Webhooks {
+		if wh.Kind != WebhookSlack && wh.Kind != WebhookTeams && wh.Kind != WebhookJSON {
+			return nil, fmt.Errorf("webhook %d: unsupported kind %q (want slack, teams or json)", i, wh.Kind)
+		}
+		if !strings.HasPrefix(wh.URL, "https://") && !strings.HasPrefix(wh.URL, "http://") {
+			return nil, fmt.Errorf("webhook %d: url must be http(s)", i)
+		}
+		for j, ev := range wh.Events {
+			if wh.Events[j], err = checkNotifyEvent(ev); err != nil {
+				return nil, fmt.Errorf("webhook %d: %w", i, err)
+			}
+		}
+		wh.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+	return cfg.Webhooks, nil
+}
+
+func (wh *webhookNotifier) wants(data NotifyData) bool {
+	if len(wh.Events) > 0 && !slices.Contains(wh.Events, data.Event) {
+		return false
+	}
+	return len(wh.Buckets) == 0 || data.Alert != nil || slices.Contains(wh.Buckets, data.Bucket)
+}
+
+// webhookFact is one labelled value in a chat message.
+type webhookFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// summary reduces data to a title, facts and an optional link, which the
+// Slack and Teams formats then lay out in their own way.
+func (wh *webhookNotifier) summary(data NotifyData) (title string, facts []webhookFact, link string) {
+	add := func(name, value string) {
+		if value != "" {
+			facts = append(facts, webhookFact{name, value})
+		}
+	}
+	fileLink := func(id string) string {
+		if wh.baseURL == "" {
+			return ""
+		}
+		return wh.baseURL + "/v1/files/" + id
+	}
+	switch data.Event {
+	case NotifyUploadCompleted:
+		title = "Upload complete: " + data.Filename
+		add("File", data.Filename)
+		add("Size", formatBytes(data.File.Bytes))
+		add("Uploader", data.Uploader)
+		add("Bucket", data.Bucket)
+		add("File ID", data.File.ID)
+		link = fileLink(data.File.ID)
+	case NotifyUploadRejected:
+		title = "Upload rejected: " + data.Filename
+		add("File", data.Filename)
+		add("Reason", data.Error.Message)
+		add("Uploader", data.Uploader)
+		add("Bucket", data.Bucket)
+	case NotifyShareAccessed:
+		title = "Share link accessed: " + data.Share.ID
+		add("File ID", data.Share.FileID)
+		add("Outcome", data.Access.Outcome)
+		add("From", data.Access.RemoteAddr)
+		downloads := strconv.Itoa(data.Share.Downloads)
+		if data.Share.MaxDownloads > 0 {
+			downloads += " of " + strconv.Itoa(data.Share.MaxDownloads)
+		}
+		add("Downloads", downloads)
+		link = fileLink(data.Share.FileID)
+	case NotifyAlertFired, NotifyAlertResolved:
+		title = "Alert: " + data.Alert.Name
+		if data.Event == NotifyAlertResolved {
+			title = "Resolved: " + data.Alert.Name
+		}
+		add("Summary", data.Alert.Summary)
+		add("Value", strconv.FormatFloat(data.Alert.Value, 'g', 3, 64))
+		add("Threshold", strconv.FormatFloat(data.Alert.Threshold, 'g', -1, 64))
+	}
+	return title, facts, link
+}
+
+// webhookEvent is the body of a json webhook, data as it is with the
+// event's title.
+type webhookEvent struct {
+	Event    string       `json:"event"`
+	Time     time.Time    `json:"time"`
+	Title    string       `json:"title"`
+	Filename string       `json:"filename,omitempty"`
+	Bucket   string       `json:"bucket,omitempty"`
+	Uploader string       `json:"uploader,omitempty"`
+	File     *FileRecord  `json:"file,omitempty"`
+	Error    *UploadError `json:"error,omitempty"`
+	Share    *Share       `json:"share,omitempty"`
+	Access   *ShareAccess `json:"access,omitempty"`
+	Alert    *Alert       `json:"alert,omitempty"`
+}
+
+func (wh *webhookNotifier) payload(data NotifyData) any {
+	title, facts, link := wh.summary(data)
+	if wh.Kind == WebhookJSON {
+		return webhookEvent{
+			Event: data.Event, Time: data.Time, Title: title, Filename: data.Filename, Bucket: data.Bucket,
+			Uploader: data.Uploader, File: data.File, Error: data.Error, Share: data.Share, Access: data.Access, Alert: data.Alert,
+		}
+	}
+	if wh.Kind == WebhookTeams {
+		card := map[string]any{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  title,
+			"title":    title,
+			"sections": []map[string]any{{"facts": facts}},
+		}
+		if link != "" {
+			card["potentialAction"] = []map[string]any{{
+				"@type":   "OpenUri",
+				"name":    "Open file",
+				"targets": []map[string]string{{"os": "default", "uri": link}},
+			}}
+		}
+		return card
+	}
+
+	heading := "*" + slackEscape(title) + "*"
+	if link != "" {
+		heading = "*<" + link + "|" + slackEscape(title) + ">*"
+	}
+	var fields []map[string]string
+	for _, f := range facts {
+		fields = append(fields, map[string]string{"type": "mrkdwn", "text": "*" + f.Name + "*\n" + slackEscape(f.Value)})
+	}
+	blocks := []map[string]any{{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": heading}}}
+	// Slack allows at most ten fields per section.
+	for len(fields) > 0 {
+		n := min(len(fields), 10)
+		blocks = append(blocks, map[string]any{"type": "section", "fields": fields[:n]})
+		fields = fields[n:]
+	}
+	return map[string]any{"text": title, "blocks": blocks}
+}
+
+func (wh *webhookNotifier) send(data NotifyData) error {
+	body, err := json.Marshal(wh.payload(data))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := reportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// slackEscape escapes the characters Slack treats as markup in mrkdwn text.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
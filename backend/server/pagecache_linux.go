@@ -0,0 +1,18 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPageCache flushes f to storage and evicts its pages from the page
+// cache, so the next read comes from the storage rather than memory.
+func dropPageCache(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
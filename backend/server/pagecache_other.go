@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import "os"
+
+// dropPageCache flushes f to storage. Only Linux can also evict its pages,
+// so elsewhere a read may still be served from memory.
+func dropPageCache(f *os.File) error {
+	return f.Sync()
+}
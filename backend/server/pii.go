@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PIIDetector recognises a single kind of personal data in a CSV cell.
+// Detectors are matched against the whole trimmed cell value.
+type PIIDetector interface {
+	Kind() string
+	Match(value string) bool
+}
+
+type regexDetector struct {
+	kind  string
+	re    *regexp.Regexp
+	check func(string) bool
+}
+
+func (d regexDetector) Kind() string { return d.kind }
+
+func (d regexDetector) Match(value string) bool {
+	if !d.re.MatchString(value) {
+		return false
+	}
+	return d.check == nil || d.check(value)
+}
+
+// DefaultPIIDetectors returns the built-in detectors. Order matters: the
+// first detector that matches a cell wins, so narrower patterns go first.
+func DefaultPIIDetectors() []PIIDetector {
+	return []PIIDetector{
+		regexDetector{kind: "email", re: regexp.MustCompile(`^[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}$`)},
+		regexDetector{kind: "ssn", re: regexp.MustCompile(`^\d{3}-\d{2}-\d{4}$`)},
+		regexDetector{kind: "credit_card", re: regexp.MustCompile(`^(?:\d[ -]?){12,18}\d$`), check: luhnValid},
+		regexDetector{kind: "phone", re: regexp.MustCompile(`^\+?(?:\d{1,3}[\s.-]?)?\(?\d{3}\)?[\s.-]?\d{3}[\s.-]?\d{4}$`)},
+	}
+}
+
+type PIIFinding struct {
+	Column  string `json:"column"`
+	Kind    string `json:"kind"`
+	Matches int    `json:"matches"`
+}
+
+type PIIReport struct {
+	ScannedRows int          `json:"scannedRows"`
+	Findings    []PIIFinding `json:"findings"`
+}
+
+func (r *PIIReport) Detected() bool {
+	return r != nil && len(r.Findings) > 0
+}
+
+type PIIScanner struct {
+	detectors  []PIIDetector
+	sampleRows int
+}
+
+func NewPIIScanner(sampleRows int, detectors ...PIIDetector) *PIIScanner {
+	if len(detectors) == 0 {
+		detectors = DefaultPIIDetectors()
+	}
+	return &PIIScanner{detectors: detectors, sampleRows: sampleRows}
+}
+
+func (s *PIIScanner) detect(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", false
+	}
+	for _, d := range s.detectors {
+		if d.Match(value) {
+			return d.Kind(), true
+		}
+	}
+	return "", false
+}
+
+// Scan samples up to sampleRows data rows (the first row is taken as the
+// header) and reports, per column, how many cells matched each detector.
+func (s *PIIScanner) Scan(src io.Reader) (*PIIReport, error) {
+	cr := newLenientCSVReader(src)
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return &PIIReport{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	header = append([]string(nil), header...)
+
+	type key struct {
+		col  int
+		kind string
+	}
+	counts := map[key]int{}
+	var order []key
+
+	report := &PIIReport{}
+	for s.sampleRows <= 0 || report.ScannedRows < s.sampleRows {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.ScannedRows++
+		for i, cell := range row {
+			kind, ok := s.detect(cell)
+			if !ok {
+				continue
+			}
+			k := key{col: i, kind: kind}
+			if counts[k] == 0 {
+				order = append(order, k)
+			}
+			counts[k]++
+		}
+	}
+
+	for _, k := range order {
+		report.Findings = append(report.Findings, PIIFinding{
+			Column:  columnName(header, k.col),
+			Kind:    k.kind,
+			Matches: counts[k],
+		})
+	}
+	return report, nil
+}
+
+// Mask copies src to dst, replacing every cell that matches a detector.
+// The header row is passed through untouched.
+func (s *PIIScanner) Mask(dst io.Writer, src io.Reader) error {
+	cr := newLenientCSVReader(src)
+	cw := csv.NewWriter(dst)
+
+	first := true
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !first {
+			for i, cell := range row {
+				if kind, ok := s.detect(cell); ok {
+					row[i] = "[REDACTED:" + kind + "]"
+				}
+			}
+		}
+		first = false
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func newLenientCSVReader(src io.Reader) *csv.Reader {
+	cr := csv.NewReader(src)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.ReuseRecord = true
+	return cr
+}
+
+func columnName(header []string, i int) string {
+	if i < len(header) && strings.TrimSpace(header[i]) != "" {
+		return header[i]
+	}
+	return "col_" + strconv.Itoa(i+1)
+}
+
+func luhnValid(value string) bool {
+	sum, n := 0, 0
+	for i := len(value) - 1; i >= 0; i-- {
+		c := value[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
+
+// applyPIIScan scans the stored blob for rec and records the findings on it.
+// When mask is set and anything was found, a redacted sibling copy is written
+// next to the blob for consumers that must not see the raw values.
+func applyPIIScan(s *PIIScanner, rec *FileRecord, mask bool) error {
+	f, err := os.Open(rec.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, err := s.Scan(f)
+	if err != nil {
+		return err
+	}
+	rec.PII = report
+	if !mask || !report.Detected() {
+		return nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	maskedPath := strings.TrimSuffix(rec.Path, filepath.Ext(rec.Path)) + ".masked" + filepath.Ext(rec.Path)
+	dst, err := createTemp(maskedPath)
+	if err != nil {
+		return err
+	}
+	tmpPath := dst.Name()
+	if err := s.Mask(dst, f); err != nil {
+		dst.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	fi, err := os.Stat(tmpPath)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, maskedPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	rec.MaskedPath, rec.MaskedBytes = maskedPath, fi.Size()
+	return nil
+}
+
+// storeMaskedLikeBlob compresses and encrypts rec's masked copy as its blob
+// is stored and points rec at the result. As for the blob, encryption is
+// not best effort: on error the plain copy is left for the caller to
+// discard.
+func storeMaskedLikeBlob(ctx context.Context, keys *BlobKeys, rec *FileRecord) error {
+	if rec.MaskedPath == "" || (rec.Encoding == "" && rec.Encryption == nil) {
+		return nil
+	}
+	m := rec.masked()
+	written := []string{}
+	removeWritten := func() {
+		for _, p := range written {
+			_ = os.Remove(p)
+		}
+	}
+	if rec.Encoding != "" {
+		if err := compressBlob(m, rec.Encoding); err != nil {
+			return err
+		}
+		written = append(written, m.Path)
+	}
+	if rec.Encryption != nil {
+		if rec.Encryption.customer() || keys == nil {
+			removeWritten()
+			return errors.New("no key to encrypt the masked copy with")
+		}
+		if err := encryptBlob(ctx, keys, m); err != nil {
+			removeWritten()
+			return err
+		}
+		written = append(written, m.Path)
+	}
+	_ = os.Remove(rec.MaskedPath)
+	for _, p := range written[:len(written)-1] {
+		_ = os.Remove(p)
+	}
+	rec.MaskedPath, rec.MaskedEncoding, rec.MaskedEncryption = m.Path, m.Encoding, m.Encryption
+	return nil
+}
+
+// piiRoles are the API key roles allowed the unmasked content of a file the
+// PII scan masked. Everyone else, including requests made with a key
+// without a role, download tokens and share links, reads the masked copy.
+var piiRoles = []string{"admin"}
+
+// seesPII reports whether the request of ctx may read rec's unmasked
+// content. The role is that of the declared API key it authenticated with;
+// identity headers the client sends are not trusted for this.
+func seesPII(ctx context.Context, rec *FileRecord) bool {
+	if rec.MaskedPath == "" {
+		return true
+	}
+	k := authenticatedKey(ctx)
+	return k != nil && k.Role != "" && slices.Contains(piiRoles, k.Role)
+}
+
+// contentRecord returns the record whose content the request of ctx may
+// read: rec, or its masked copy. Every read of file content for a client
+// goes through it or openContent.
+func contentRecord(ctx context.Context, rec *FileRecord) *FileRecord {
+	if seesPII(ctx, rec) {
+		return rec
+	}
+	return rec.masked()
+}
+
+// openContent opens the decoded content of rec the request of ctx may
+// read.
+func openContent(ctx context.Context, rec *FileRecord) (io.ReadCloser, error) {
+	return openBlob(contentRecord(ctx, rec), false)
+}
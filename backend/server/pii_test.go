@@ -0,0 +1,210 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withKey runs h as a request authenticated with a declared API key in
+// role, or with no key when role is "-".
+func withKey(role string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if role != "-" {
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, &APIKey{ID: "k", Role: role}))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// testMaskedIngest returns an ingest that masks PII, compresses and
+// encrypts, and a record stored through it with a masked copy.
+func testMaskedIngest(t *testing.T) (*Ingest, *FileRecord) {
+	t.Helper()
+	in := testIngest(t)
+	testBlobKeys(t)
+	in.PII = NewPIIScanner(100)
+	in.Config.PIIMask = true
+	in.Config.Compression = EncodingGzip
+	rec := testRecord(t, in)
+	if rec.MaskedPath == "" {
+		t.Fatal("no masked copy written")
+	}
+	return in, rec
+}
+
+const piiRaw = "name,email\nbob,bob@example.com\n"
+
+// The masked copy is stored like its upload: compressed and encrypted.
+func TestMaskedCopyStored(t *testing.T) {
+	_, rec := testMaskedIngest(t)
+	if rec.MaskedEncoding != EncodingGzip || rec.MaskedEncryption == nil || bytes.Equal(rec.MaskedEncryption.WrappedKey, rec.Encryption.WrappedKey) {
+		t.Fatalf("masked copy stored as %q, %+v", rec.MaskedEncoding, rec.MaskedEncryption)
+	}
+	stored, err := os.ReadFile(rec.MaskedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("name,email")) {
+		t.Errorf("masked copy stored as plaintext: %q", stored)
+	}
+	body, err := openContent(context.Background(), rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	got, _ := io.ReadAll(body)
+	if string(got) == piiRaw || strings.Contains(string(got), "bob@example.com") || !strings.HasPrefix(string(got), "name,email\n") {
+		t.Errorf("masked content = %q", got)
+	}
+}
+
+// Keys without a PII role download the masked copy, whatever role the
+// request claims in its headers; keys with one, and files without a masked
+// copy, get the upload as stored.
+func TestDownloadMasked(t *testing.T) {
+	in, masked := testMaskedIngest(t)
+	in.Config.PIIMask = false
+	plain := testRecord(t, in)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/files/{id}", DownloadHandler(in.Store, in.Store.(*jsonStore), nil))
+
+	tests := []struct {
+		name, id, key, header string
+		masked                bool
+	}{
+		{"no key", masked.ID, "-", "", true},
+		{"spoofed role header", masked.ID, "-", "admin", true},
+		{"key without role", masked.ID, "", "admin", true},
+		{"other role", masked.ID, "analyst", "", true},
+		{"pii role", masked.ID, "admin", "", false},
+		{"nothing masked", plain.ID, "-", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/files/"+tt.id, nil)
+			req.Header.Set("X-User-Role", tt.header)
+			w := httptest.NewRecorder()
+			IdentifyUploader(withKey(tt.key, mux)).ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d %s", w.Code, w.Body)
+			}
+			body, _ := io.ReadAll(w.Body)
+			if got := string(body) != piiRaw; got != tt.masked {
+				t.Errorf("body %q, want masked = %v", body, tt.masked)
+			}
+			if tt.masked && (strings.Contains(string(body), "bob@example.com") || w.Header().Get("X-Checksum-Sha256") != "") {
+				t.Errorf("masked download leaks the original: %q %v", body, w.Header())
+			}
+		})
+	}
+}
+
+// Queries, saved query results, dataset archives and embedded reads see
+// the same content as a download by the same caller.
+func TestMaskedContentReads(t *testing.T) {
+	in, rec := testMaskedIngest(t)
+	db := in.Store.(*jsonStore)
+	datasets := NewDatasets(db, db)
+	ds := &Dataset{ID: "ds", Name: "people", CreatedAt: time.Now(), Versions: []DatasetVersion{{
+		Version: 1, Files: []DatasetEntry{{FileID: rec.ID, Filename: "people.csv"}}, CreatedAt: time.Now(),
+	}}}
+	if err := db.PutDataset(context.Background(), ds); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/files/{id}/query", QueryHandler(in, 100, time.Minute))
+	mux.HandleFunc("GET /v1/datasets/{id}/archive", datasets.ArchiveHandler())
+
+	query := func(t *testing.T, h http.Handler, body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/files/"+rec.ID+"/query", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("query: %d %s", w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+	archive := func(t *testing.T, h http.Handler) string {
+		req := httptest.NewRequest(http.MethodGet, "/v1/datasets/ds/archive", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("archive: %d %s", w.Code, w.Body)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			if f.Name == "people.csv" {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rc.Close()
+				b, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatalf("read member: %v", err)
+				}
+				return string(b)
+			}
+		}
+		t.Fatal("people.csv not in archive")
+		return ""
+	}
+	saved := func(t *testing.T, h http.Handler) string {
+		var resp struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(query(t, h, `{"sql": "SELECT email FROM people", "save": {"filename": "emails.csv"}}`)), &resp); err != nil || resp.ID == "" {
+			t.Fatalf("save response: %v", err)
+		}
+		out, err := in.Store.Get(context.Background(), resp.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := openBlob(out, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer body.Close()
+		b, _ := io.ReadAll(body)
+		return string(b)
+	}
+
+	tests := []struct {
+		name string
+		read func(t *testing.T, h http.Handler) string
+	}{
+		{"query", func(t *testing.T, h http.Handler) string { return query(t, h, `{"sql": "SELECT email FROM people"}`) }},
+		{"saved query", saved},
+		{"dataset archive", archive},
+	}
+	for _, tt := range tests {
+		for _, role := range []string{"-", "", "analyst", "admin"} {
+			t.Run(tt.name+"/"+role, func(t *testing.T) {
+				got := tt.read(t, withKey(role, mux))
+				if leaked := strings.Contains(got, "bob@example.com"); leaked != (role == "admin") {
+					t.Errorf("read %q, want the original = %v", got, role == "admin")
+				}
+			})
+		}
+	}
+
+	t.Run("embedded", func(t *testing.T) {
+		got, err := (&Embedded{}).Content(rec)
+		if err != nil || strings.Contains(string(got), "bob@example.com") {
+			t.Errorf("Content = %q, %v; want the masked copy", got, err)
+		}
+	})
+}
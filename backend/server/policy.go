@@ -0,0 +1,385 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrPolicyNotFound = errors.New("policy not found")
+
+type PolicyStore interface {
+	ListPolicies(ctx context.Context) ([]*UploadPolicy, error)
+	PutPolicy(ctx context.Context, p *UploadPolicy) error
+	DeletePolicy(ctx context.Context, id string) error
+}
+
+// UploadPolicy is an operator rule every upload is checked against before
+// it is recorded. When and Require are conditions in the query endpoint's
+// SQL dialect, evaluated over the upload's attributes (policyAttributes).
+// A policy applies to uploads matching When, or to every upload when When
+// is empty; an applicable upload is rejected unless it satisfies Require,
+// and always when Require is empty. For example:
+//
+//	{"id": "trial-size", "when": "role = 'trialuser' AND size > MB(50)",
+//	 "message": "Trial accounts may upload files up to 50MB"}
+//	{"id": "finance-project", "when": "bucket = 'finance'",
+//	 "require": "HAS_TAG(tags, 'project')",
+//	 "message": "Uploads to finance need a project tag"}
+//
+// Attributes that are not set are NULL, so a comparison against them
+// neither applies a policy nor satisfies it.
+type UploadPolicy struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description,omitempty"`
+	When        string    `json:"when,omitempty"`
+	Require     string    `json:"require,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	Disabled    bool      `json:"disabled,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+
+	when, require sqlExpr
+}
+
+// policyAttributes are the columns a policy condition can refer to. tags
+// is the upload's tags joined with commas; use HAS_TAG to test for one.
+// tenant, role and apiKey come from the X-Tenant-ID, X-User-Role and
+// X-API-Key headers as sent; like size limit overrides, they should be set
+// by an authenticating proxy before they are trusted. A request made with
+// a declared API key takes its role from the key instead.
+var policyAttributes = []string{
+	"size", "rows", "columnCount", "filename", "extension", "contentType",
+	"key", "bucket", "folder", "tags", "source", "tenant", "role", "apiKey",
+}
+
+// policyFunctions extend the SQL functions for policy conditions.
+var policyFunctions = map[string]sqlFunction{
+	"KB": {1, 1, sizeUnit(1 << 10)},
+	"MB": {1, 1, sizeUnit(1 << 20)},
+	"GB": {1, 1, sizeUnit(1 << 30)},
+	// HAS_TAG(tags, name) is true when the upload has the tag name, or a
+	// tag of the form name:value or name=value.
+	"HAS_TAG": {2, 2, func(a []any) any {
+		name := sqlString(a[1])
+		if a[0] == nil || name == "" {
+			return false
+		}
+		for _, t := range strings.Split(sqlString(a[0]), ",") {
+			if t == name || strings.HasPrefix(t, name+":") || strings.HasPrefix(t, name+"=") {
+				return true
+			}
+		}
+		return false
+	}},
+}
+
+func sizeUnit(unit float64) func([]any) any {
+	return func(a []any) any {
+		f, ok := sqlNumber(a[0])
+		if !ok {
+			return nil
+		}
+		return f * unit
+	}
+}
+
+// compile parses the policy's conditions and resolves their columns.
+func (p *UploadPolicy) compile() error {
+	if !validID(p.ID) {
+		return errors.New("Policy ID must be 1-128 letters, digits, '-' or '_'")
+	}
+	var err error
+	if p.when, err = compilePolicyCondition(p.When); err != nil {
+		return fmt.Errorf("Invalid 'when': %w", err)
+	}
+	if p.require, err = compilePolicyCondition(p.Require); err != nil {
+		return fmt.Errorf("Invalid 'require': %w", err)
+	}
+	return nil
+}
+
+func compilePolicyCondition(src string) (sqlExpr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+	e, err := parseSQLCondition(src, policyFunctions)
+	if err != nil {
+		return nil, err
+	}
+	sqlWalk(e, func(x sqlExpr) bool {
+		c, ok := x.(*sqlColumn)
+		if !ok || err != nil {
+			return err == nil
+		}
+		c.Index = slices.IndexFunc(policyAttributes, func(n string) bool { return strings.EqualFold(n, c.Name) })
+		if c.Index < 0 {
+			err = sqlErrorf("unknown attribute %q (want one of %s)", c.Name, strings.Join(policyAttributes, ", "))
+		}
+		return true
+	})
+	return e, err
+}
+
+type uploaderKey struct{}
+
+// Uploader is who an upload is made by, for policies.
+type Uploader struct {
+	Tenant string
+	Role   string
+	APIKey string
+}
+
+// IdentifyUploader records the identity headers of API requests for the
+// upload policies. It runs after APIKeyAuth, whose key's role replaces the
+// X-User-Role header.
+func IdentifyUploader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := Uploader{Tenant: r.Header.Get("X-Tenant-ID"), Role: r.Header.Get("X-User-Role"), APIKey: r.Header.Get("X-API-Key")}
+		if k := authenticatedKey(r.Context()); k != nil {
+			u.Role = k.Role
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uploaderKey{}, u)))
+	})
+}
+
+// policyRow lays out rec's attributes in policyAttributes order.
+func policyRow(ctx context.Context, rec *FileRecord) []string {
+	u, _ := ctx.Value(uploaderKey{}).(Uploader)
+	bucket, _, _ := strings.Cut(rec.Key, "/")
+	return []string{
+		strconv.FormatInt(rec.Bytes, 10),
+		strconv.FormatInt(rec.RowCount, 10),
+		strconv.Itoa(len(rec.Columns)),
+		rec.Filename,
+		rec.Extension,
+		rec.ContentType,
+		rec.Key,
+		bucket,
+		rec.Folder,
+		strings.Join(rec.Tags, ","),
+		rec.Source,
+		u.Tenant,
+		u.Role,
+		u.APIKey,
+	}
+}
+
+var policyDenials = metrics.Counter("upload_policy_denials_total", "Uploads rejected by an upload policy.")
+
+// PolicyEngine holds the compiled upload policies. Changes made through the
+// admin API apply at once on this instance; Run picks up changes made
+// through other instances sharing the store.
+type PolicyEngine struct {
+	store PolicyStore
+	audit *AuditLog
+
+	// writeMu serializes PUTs, which read before they write.
+	writeMu sync.Mutex
+
+	// mu also serializes evaluation: LIKE caches its compiled pattern in
+	// the expression.
+	mu       sync.Mutex
+	policies []*UploadPolicy
+}
+
+func NewPolicyEngine(store PolicyStore, audit *AuditLog) *PolicyEngine {
+	return &PolicyEngine{store: store, audit: audit}
+}
+
+// Reload reads and compiles the stored policies. A stored policy that no
+// longer compiles is logged and skipped.
+func (e *PolicyEngine) Reload(ctx context.Context) error {
+	stored, err := e.store.ListPolicies(ctx)
+	if err != nil {
+		return err
+	}
+	policies := make([]*UploadPolicy, 0, len(stored))
+	for _, p := range stored {
+		if err := p.compile(); err != nil {
+			log.Printf("policy %s: %v", p.ID, err)
+			continue
+		}
+		policies = append(policies, p)
+	}
+	slices.SortFunc(policies, func(a, b *UploadPolicy) int { return strings.Compare(a.ID, b.ID) })
+	e.mu.Lock()
+	e.policies = policies
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *PolicyEngine) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := e.Reload(ctx); err != nil {
+				log.Printf("policy: reload: %v", err)
+			}
+		}
+	}
+}
+
+// Check rejects rec with a 403 when a policy applies to it and it does not
+// satisfy the policy. A nil engine allows everything.
+func (e *PolicyEngine) Check(ctx context.Context, rec *FileRecord) *UploadError {
+	if e == nil {
+		return nil
+	}
+	env := &sqlEnv{row: policyRow(ctx, rec)}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, p := range e.policies {
+		if p.Disabled {
+			continue
+		}
+		if p.when != nil {
+			if applies, ok := sqlBool(p.when.eval(env)); !ok || !applies {
+				continue
+			}
+		}
+		if p.require != nil {
+			if ok, _ := sqlBool(p.require.eval(env)); ok {
+				continue
+			}
+		}
+		policyDenials.Inc()
+		msg := "Upload rejected by policy '" + p.ID + "'"
+		if p.Message != "" {
+			msg += ": " + p.Message
+		}
+		return newUploadError(http.StatusForbidden, "forbidden", msg)
+	}
+	return nil
+}
+
+// ListHandler serves GET /v1/admin/policies.
+func (e *PolicyEngine) ListHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policies, err := e.store.ListPolicies(r.Context())
+		if err != nil {
+			writeInternalError(w, "Failed to list policies")
+			return
+		}
+		slices.SortFunc(policies, func(a, b *UploadPolicy) int { return strings.Compare(a.ID, b.ID) })
+		if policies == nil {
+			policies = []*UploadPolicy{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"policies": policies})
+	}
+}
+
+// PolicyHandler serves GET, PUT (create or replace) and DELETE on
+// /v1/admin/policies/{id}. A policy whose conditions do not compile is
+// refused with the parse error. Like the provisioning endpoints, a PUT
+// answers 201 when it creates the policy and leaves one it does not
+// change untouched.
+func (e *PolicyEngine) PolicyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		switch r.Method {
+		case http.MethodGet:
+			p, err := e.stored(r.Context(), id)
+			if err != nil {
+				writeInternalError(w, "Failed to read policy")
+				return
+			}
+			if p == nil {
+				writeNotFound(w, "Policy '"+id+"' not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, p)
+
+		case http.MethodPut:
+			var p UploadPolicy
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&p); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			if p.ID != "" && p.ID != id {
+				writeBadRequest(w, "Field 'id' does not match the URL")
+				return
+			}
+			p.ID = id
+			if err := p.compile(); err != nil {
+				writeBadRequest(w, err.Error())
+				return
+			}
+			e.writeMu.Lock()
+			defer e.writeMu.Unlock()
+			old, err := e.stored(r.Context(), id)
+			if err != nil {
+				writeInternalError(w, "Failed to read policy")
+				return
+			}
+			if old != nil && old.sameSpec(&p) {
+				writeJSON(w, http.StatusOK, old)
+				return
+			}
+			p.UpdatedAt = time.Now().UTC()
+			if err := e.store.PutPolicy(r.Context(), &p); err != nil {
+				writeInternalError(w, "Failed to save policy")
+				return
+			}
+			e.audit.Record(AuditEvent{Action: "policy_set", Actor: "admin", Detail: id})
+			e.reloadAfterChange(r.Context())
+			status := http.StatusCreated
+			if old != nil {
+				status = http.StatusOK
+			}
+			writeJSON(w, status, &p)
+
+		case http.MethodDelete:
+			err := e.store.DeletePolicy(r.Context(), id)
+			if errors.Is(err, ErrPolicyNotFound) {
+				writeNotFound(w, "Policy '"+id+"' not found")
+				return
+			}
+			if err != nil {
+				writeInternalError(w, "Failed to delete policy")
+				return
+			}
+			e.audit.Record(AuditEvent{Action: "policy_deleted", Actor: "admin", Detail: id})
+			e.reloadAfterChange(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeMethodNotAllowed(w, "Only GET, PUT and DELETE methods are allowed for policies")
+		}
+	}
+}
+
+// stored returns the stored policy id, or nil when there is none.
+func (e *PolicyEngine) stored(ctx context.Context, id string) (*UploadPolicy, error) {
+	policies, err := e.store.ListPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *UploadPolicy) sameSpec(o *UploadPolicy) bool {
+	return p.Description == o.Description && p.When == o.When && p.Require == o.Require && p.Message == o.Message && p.Disabled == o.Disabled
+}
+
+func (e *PolicyEngine) reloadAfterChange(ctx context.Context) {
+	if err := e.Reload(context.WithoutCancel(ctx)); err != nil {
+		log.Printf("policy: reload: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testPolicyEngine(t *testing.T, policies ...*UploadPolicy) *PolicyEngine {
+	t.Helper()
+	db := testIngest(t).Store.(*jsonStore)
+	for _, p := range policies {
+		if err := db.PutPolicy(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := NewPolicyEngine(db, &AuditLog{})
+	if err := e.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// An upload is rejected by the first policy that applies to it and that it
+// does not satisfy; unset attributes neither apply a policy nor satisfy it.
+func TestPolicyCheck(t *testing.T) {
+	e := testPolicyEngine(t,
+		&UploadPolicy{ID: "trial-size", When: "role = 'trialuser' AND size > MB(50)", Message: "Trial accounts may upload files up to 50MB"},
+		&UploadPolicy{ID: "finance-project", When: "bucket = 'finance'", Require: "HAS_TAG(tags, 'project')"},
+		&UploadPolicy{ID: "no-xlsx", When: "extension = '.xlsx'"},
+		&UploadPolicy{ID: "off", Disabled: true},
+		&UploadPolicy{ID: "broken", When: "nosuch = 1"},
+	)
+
+	tests := []struct {
+		name string
+		u    Uploader
+		rec  FileRecord
+		want string
+	}{
+		{"trial under the limit", Uploader{Role: "trialuser"}, FileRecord{Bytes: 50 << 20}, ""},
+		{"trial over the limit", Uploader{Role: "trialuser"}, FileRecord{Bytes: 50<<20 + 1}, "policy 'trial-size': Trial accounts may upload files up to 50MB"},
+		{"other role over the limit", Uploader{Role: "admin"}, FileRecord{Bytes: 1 << 30}, ""},
+		{"no role", Uploader{}, FileRecord{Bytes: 1 << 30}, ""},
+		{"finance with a project tag", Uploader{}, FileRecord{Key: "finance/q1.csv", Tags: []string{"team", "project:apollo"}}, ""},
+		{"finance with project=", Uploader{}, FileRecord{Key: "finance/q1.csv", Tags: []string{"project=apollo"}}, ""},
+		{"finance without a project tag", Uploader{}, FileRecord{Key: "finance/q1.csv", Tags: []string{"projects"}}, "Upload rejected by policy 'finance-project'"},
+		{"finance without tags", Uploader{}, FileRecord{Key: "finance/q1.csv"}, "policy 'finance-project'"},
+		{"other bucket", Uploader{}, FileRecord{Key: "sales/q1.csv"}, ""},
+		{"no require", Uploader{}, FileRecord{Extension: ".xlsx"}, "policy 'no-xlsx'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), uploaderKey{}, tt.u)
+			uerr := e.Check(ctx, &tt.rec)
+			if tt.want == "" {
+				if uerr != nil {
+					t.Fatalf("rejected: %s", uerr.Message)
+				}
+				return
+			}
+			if uerr == nil || uerr.Status != http.StatusForbidden || !strings.Contains(uerr.Message, tt.want) {
+				t.Fatalf("got %+v, want a 403 containing %q", uerr, tt.want)
+			}
+		})
+	}
+
+	var nilEngine *PolicyEngine
+	if uerr := nilEngine.Check(context.Background(), &FileRecord{}); uerr != nil {
+		t.Errorf("nil engine rejected: %+v", uerr)
+	}
+}
+
+func TestPolicyCompile(t *testing.T) {
+	tests := []struct {
+		name string
+		p    UploadPolicy
+		want string
+	}{
+		{"valid", UploadPolicy{ID: "p", When: "size > KB(1) AND filename LIKE '%.csv'", Require: "columnCount <= 20"}, ""},
+		{"empty conditions", UploadPolicy{ID: "p", When: "  "}, ""},
+		{"bad ID", UploadPolicy{ID: "a/b"}, "Policy ID"},
+		{"unknown attribute", UploadPolicy{ID: "p", When: "owner = 'bob'"}, "Invalid 'when': "},
+		{"bad require", UploadPolicy{ID: "p", Require: "size >"}, "Invalid 'require': "},
+		{"unknown function", UploadPolicy{ID: "p", When: "TB(size) > 1"}, "Invalid 'when': "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.p.compile()
+			if (err == nil) != (tt.want == "") || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+				t.Fatalf("compile = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Policies set or deleted through the admin API apply at once, and a PUT
+// that changes nothing leaves the stored policy untouched.
+func TestPolicyHandler(t *testing.T) {
+	e := testPolicyEngine(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/admin/policies", e.ListHandler())
+	mux.HandleFunc("/v1/admin/policies/{id}", e.PolicyHandler())
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	xlsx := &FileRecord{Extension: ".xlsx"}
+
+	const spec = `{"when": "extension = '.xlsx'", "message": "CSV only"}`
+	w := do(http.MethodPut, "/v1/admin/policies/no-xlsx", spec)
+	var created UploadPolicy
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &created) != nil || created.ID != "no-xlsx" {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	if uerr := e.Check(context.Background(), xlsx); uerr == nil {
+		t.Error("new policy not applied")
+	}
+	w = do(http.MethodPut, "/v1/admin/policies/no-xlsx", spec)
+	var same UploadPolicy
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &same) != nil || !same.UpdatedAt.Equal(created.UpdatedAt) {
+		t.Errorf("unchanged PUT: %d %s", w.Code, w.Body)
+	}
+
+	for _, tt := range []struct{ name, path, body, want string }{
+		{"id mismatch", "/v1/admin/policies/no-xlsx", `{"id": "other"}`, "does not match"},
+		{"bad condition", "/v1/admin/policies/no-xlsx", `{"when": "owner = 1"}`, "unknown attribute"},
+		{"bad JSON", "/v1/admin/policies/no-xlsx", `{`, "Invalid JSON"},
+		{"bad ID", "/v1/admin/policies/a.b", `{}`, "Policy ID"},
+	} {
+		if w := do(http.MethodPut, tt.path, tt.body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: %d %s", tt.name, w.Code, w.Body)
+		}
+	}
+
+	if w := do(http.MethodGet, "/v1/admin/policies", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"no-xlsx"`) {
+		t.Errorf("list: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodGet, "/v1/admin/policies/no-xlsx", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "CSV only") {
+		t.Errorf("get: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodDelete, "/v1/admin/policies/no-xlsx", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if uerr := e.Check(context.Background(), xlsx); uerr != nil {
+		t.Errorf("deleted policy still applied: %+v", uerr)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if w := do(method, "/v1/admin/policies/no-xlsx", ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s after delete: %d %s", method, w.Code, w.Body)
+		}
+	}
+}
+
+// The role policies see is the authenticated key's, not the header's.
+func TestIdentifyUploader(t *testing.T) {
+	for _, tt := range []struct{ key, header, want string }{
+		{"-", "admin", "admin"},
+		{"trialuser", "admin", "trialuser"},
+		{"", "admin", ""},
+	} {
+		var got Uploader
+		h := withKey(tt.key, IdentifyUploader(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = r.Context().Value(uploaderKey{}).(Uploader)
+		})))
+		req := httptest.NewRequest(http.MethodPost, "/v1/upload", nil)
+		req.Header.Set("X-User-Role", tt.header)
+		req.Header.Set("X-Tenant-ID", "acme")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got.Role != tt.want || got.Tenant != "acme" {
+			t.Errorf("key role %q, header %q: got %+v, want role %q", tt.key, tt.header, got, tt.want)
+		}
+	}
+}
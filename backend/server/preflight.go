@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// diskReserveBytes is kept free on the upload volume so metadata writes and
+// post-processing still succeed when an upload fills the disk.
+const diskReserveBytes = 64 << 20
+
+// preflight rejects a request from its headers alone, before any body bytes
+// are read. Content-Length bounds the whole body by bodyLimit;
+// X-Upload-Length, when sent, is the client's declared file size and is held
+// to fileLimit. The larger of the two is checked against free disk space
+// and sets the request's deadline; a body of unknown length is given the
+// time bodyLimit would take.
+func preflight(w http.ResponseWriter, r *http.Request, bodyLimit, fileLimit int64) bool {
+	if r.ContentLength > bodyLimit {
+		writeMessage(w, http.StatusRequestEntityTooLarge, "request_entity_too_large", newMessage("request_too_large",
+			"size", strconv.FormatInt(r.ContentLength, 10), "limit", strconv.FormatInt(bodyLimit, 10)))
+		return false
+	}
+	declared, ok := declaredLength(w, r, fileLimit)
+	if !ok {
+		return false
+	}
+	size := max(declared, r.ContentLength)
+	if !checkDiskSpace(w, size) {
+		return false
+	}
+	if size <= 0 && r.ContentLength < 0 {
+		size = bodyLimit
+	}
+	uploadDeadline.apply(w, size)
+	return true
+}
+
+// declaredLength parses X-Upload-Length, returning 0 when it is absent.
+func declaredLength(w http.ResponseWriter, r *http.Request, limit int64) (int64, bool) {
+	v := r.Header.Get("X-Upload-Length")
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		writeBadRequest(w, "Header 'X-Upload-Length' must be a non-negative integer")
+		return 0, false
+	}
+	if n > limit {
+		writeFileTooLarge(w, limit)
+		return 0, false
+	}
+	return n, true
+}
+
+// uploadLength returns the X-Upload-Length that preflight accepted, or 0.
+// Single-file handlers hold the received file to it.
+func uploadLength(r *http.Request) int64 {
+	n, _ := strconv.ParseInt(r.Header.Get("X-Upload-Length"), 10, 64)
+	return max(n, 0)
+}
+
+func checkDiskSpace(w http.ResponseWriter, need int64) bool {
+	if need <= 0 {
+		return true
+	}
+	free, err := diskFree(uploadDir)
+	if err != nil {
+		// Unknown free space is not a reason to refuse the upload.
+		return true
+	}
+	if free < uint64(need)+diskReserveBytes {
+		writeMessage(w, http.StatusInsufficientStorage, "insufficient_storage", newMessage("insufficient_storage", "size", strconv.FormatInt(need, 10)))
+		return false
+	}
+	return true
+}
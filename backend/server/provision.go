@@ -0,0 +1,440 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+type ProvisionStore interface {
+	ListBuckets(ctx context.Context) ([]*Bucket, error)
+	GetBucket(ctx context.Context, name string) (*Bucket, error)
+	PutBucket(ctx context.Context, b *Bucket) error
+	DeleteBucket(ctx context.Context, name string) error
+	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	PutAPIKey(ctx context.Context, k *APIKey) error
+	DeleteAPIKey(ctx context.Context, id string) error
+}
+
+// Bucket is a bucket declared through the admin API, the first segment of
+// the object keys it holds. MaxBytes, when set, is a size limit for
+// uploads to the bucket, applied like those of the limits file.
+type Bucket struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	MaxBytes    int64             `json:"maxBytes,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+func (b *Bucket) sameSpec(o *Bucket) bool {
+	return b.Description == o.Description && b.MaxBytes == o.MaxBytes && maps.Equal(b.Labels, o.Labels)
+}
+
+// APIKey is an API key declared through the admin API, accepted in
+// X-API-Key alongside UPLOAD_API_KEYS. Only the SHA-256 of the secret is
+// kept. Role is the role requests made with the key act in, such as one
+// of UPLOAD_PII_ROLES; keys from UPLOAD_API_KEYS have none.
+type APIKey struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description,omitempty"`
+	Role        string    `json:"role,omitempty"`
+	Disabled    bool      `json:"disabled,omitempty"`
+	Hash        string    `json:"hash"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// apiKeyResponse is the client view of a key. Secret is only ever sent in
+// the response that generated it.
+type apiKeyResponse struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description,omitempty"`
+	Role        string    `json:"role,omitempty"`
+	Disabled    bool      `json:"disabled,omitempty"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+func (k *APIKey) response(secret string) apiKeyResponse {
+	return apiKeyResponse{ID: k.ID, Description: k.Description, Role: k.Role, Disabled: k.Disabled, Secret: secret, CreatedAt: k.CreatedAt, UpdatedAt: k.UpdatedAt}
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Provisioning holds the buckets and API keys declared through the admin
+// API, for declarative tools such as a Terraform provider. Every PUT
+// names its resource and is idempotent: it creates the resource (201) or
+// brings it to the state in the body (200), and a PUT that changes
+// nothing leaves updatedAt alone, so re-applying a plan is a no-op. As
+// with upload policies, Run picks up changes made through other
+// instances.
+type Provisioning struct {
+	store ProvisionStore
+	audit *AuditLog
+
+	// writeMu serializes PUTs, which read before they write.
+	writeMu sync.Mutex
+
+	mu      sync.RWMutex
+	buckets map[string]*Bucket
+	keys    map[string]*APIKey // by hash
+}
+
+func NewProvisioning(store ProvisionStore, audit *AuditLog) *Provisioning {
+	return &Provisioning{store: store, audit: audit}
+}
+
+// Reload reads the stored buckets and keys.
+func (p *Provisioning) Reload(ctx context.Context) error {
+	buckets, err := p.store.ListBuckets(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := p.store.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	bm := make(map[string]*Bucket, len(buckets))
+	for _, b := range buckets {
+		bm[b.Name] = b
+	}
+	km := make(map[string]*APIKey, len(keys))
+	for _, k := range keys {
+		km[k.Hash] = k
+	}
+	p.mu.Lock()
+	p.buckets, p.keys = bm, km
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Provisioning) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := p.Reload(ctx); err != nil {
+				log.Printf("provisioning: reload: %v", err)
+			}
+		}
+	}
+}
+
+func (p *Provisioning) reloadAfterChange(ctx context.Context) {
+	if err := p.Reload(context.WithoutCancel(ctx)); err != nil {
+		log.Printf("provisioning: reload: %v", err)
+	}
+}
+
+// BucketLimit returns the size limit of a declared bucket.
+func (p *Provisioning) BucketLimit(bucket string) (int64, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	b, ok := p.buckets[bucket]
+	if !ok || b.MaxBytes <= 0 {
+		return 0, false
+	}
+	return b.MaxBytes, true
+}
+
+// HasKeys reports whether any API key has been declared, enabled or not.
+// Declaring one closes an API that UPLOAD_API_KEYS left open.
+func (p *Provisioning) HasKeys() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.keys) > 0
+}
+
+// Authenticate reports whether secret is an enabled declared key.
+func (p *Provisioning) Authenticate(secret string) bool {
+	return p.Key(secret) != nil
+}
+
+// KeyID returns the ID of the enabled declared key secret, or "".
+func (p *Provisioning) KeyID(secret string) string {
+	if k := p.Key(secret); k != nil {
+		return k.ID
+	}
+	return ""
+}
+
+// Key returns a copy of the enabled declared key secret, or nil.
+func (p *Provisioning) Key(secret string) *APIKey {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	k, ok := p.keys[hashAPIKey(secret)]
+	if !ok || k.Disabled {
+		return nil
+	}
+	cp := *k
+	return &cp
+}
+
+// BucketsHandler serves GET /v1/admin/buckets.
+func (p *Provisioning) BucketsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buckets, err := p.store.ListBuckets(r.Context())
+		if err != nil {
+			writeInternalError(w, "Failed to list buckets")
+			return
+		}
+		slices.SortFunc(buckets, func(a, b *Bucket) int { return strings.Compare(a.Name, b.Name) })
+		if buckets == nil {
+			buckets = []*Bucket{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"buckets": buckets})
+	}
+}
+
+// BucketHandler serves GET, PUT and DELETE on /v1/admin/buckets/{name}.
+func (p *Provisioning) BucketHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		switch r.Method {
+		case http.MethodGet:
+			b, err := p.store.GetBucket(r.Context(), name)
+			if errors.Is(err, ErrBucketNotFound) {
+				writeNotFound(w, "Bucket '"+name+"' not found")
+				return
+			}
+			if err != nil {
+				writeInternalError(w, "Failed to read bucket")
+				return
+			}
+			writeJSON(w, http.StatusOK, b)
+
+		case http.MethodPut:
+			var b Bucket
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&b); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			if b.Name != "" && b.Name != name {
+				writeBadRequest(w, "Field 'name' does not match the URL")
+				return
+			}
+			if !validID(name) {
+				writeBadRequest(w, "Bucket name must be 1-128 letters, digits, '-' or '_'")
+				return
+			}
+			if b.MaxBytes < 0 {
+				writeBadRequest(w, "Field 'maxBytes' must not be negative")
+				return
+			}
+			b.Name = name
+			if len(b.Labels) == 0 {
+				b.Labels = nil
+			}
+			p.writeMu.Lock()
+			defer p.writeMu.Unlock()
+			old, err := p.store.GetBucket(r.Context(), name)
+			if err != nil && !errors.Is(err, ErrBucketNotFound) {
+				writeInternalError(w, "Failed to read bucket")
+				return
+			}
+			if old != nil && old.sameSpec(&b) {
+				writeJSON(w, http.StatusOK, old)
+				return
+			}
+			now := time.Now().UTC()
+			b.CreatedAt, b.UpdatedAt = now, now
+			status := http.StatusCreated
+			if old != nil {
+				b.CreatedAt = old.CreatedAt
+				status = http.StatusOK
+			}
+			if err := p.store.PutBucket(r.Context(), &b); err != nil {
+				writeInternalError(w, "Failed to save bucket")
+				return
+			}
+			p.audit.Record(AuditEvent{Action: "bucket_set", Actor: "admin", Detail: name})
+			p.reloadAfterChange(r.Context())
+			writeJSON(w, status, &b)
+
+		case http.MethodDelete:
+			err := p.store.DeleteBucket(r.Context(), name)
+			if errors.Is(err, ErrBucketNotFound) {
+				writeNotFound(w, "Bucket '"+name+"' not found")
+				return
+			}
+			if err != nil {
+				writeInternalError(w, "Failed to delete bucket")
+				return
+			}
+			p.audit.Record(AuditEvent{Action: "bucket_deleted", Actor: "admin", Detail: name})
+			p.reloadAfterChange(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeMethodNotAllowed(w, "Only GET, PUT and DELETE methods are allowed for buckets")
+		}
+	}
+}
+
+// APIKeysHandler serves GET /v1/admin/api-keys.
+func (p *Provisioning) APIKeysHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := p.store.ListAPIKeys(r.Context())
+		if err != nil {
+			writeInternalError(w, "Failed to list API keys")
+			return
+		}
+		slices.SortFunc(keys, func(a, b *APIKey) int { return strings.Compare(a.ID, b.ID) })
+		out := make([]apiKeyResponse, len(keys))
+		for i, k := range keys {
+			out[i] = k.response("")
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"apiKeys": out})
+	}
+}
+
+type putAPIKeyRequest struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled"`
+	Secret      string `json:"secret"`
+}
+
+// APIKeyHandler serves GET, PUT and DELETE on /v1/admin/api-keys/{id}. A
+// PUT may carry the secret, such as one a provisioning tool generated and
+// keeps; the key then stays in step with it, and a different secret
+// rotates the key. Without one, a new key gets a generated secret,
+// returned in that response only, and an existing key keeps its own.
+func (p *Provisioning) APIKeyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		switch r.Method {
+		case http.MethodGet:
+			k, err := p.store.GetAPIKey(r.Context(), id)
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				writeNotFound(w, "API key '"+id+"' not found")
+				return
+			}
+			if err != nil {
+				writeInternalError(w, "Failed to read API key")
+				return
+			}
+			writeJSON(w, http.StatusOK, k.response(""))
+
+		case http.MethodPut:
+			var req putAPIKeyRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			if req.ID != "" && req.ID != id {
+				writeBadRequest(w, "Field 'id' does not match the URL")
+				return
+			}
+			if !validID(id) {
+				writeBadRequest(w, "API key ID must be 1-128 letters, digits, '-' or '_'")
+				return
+			}
+			if req.Secret != "" && len(req.Secret) < 16 {
+				writeBadRequest(w, "Field 'secret' must be at least 16 characters")
+				return
+			}
+			p.writeMu.Lock()
+			defer p.writeMu.Unlock()
+			old, err := p.store.GetAPIKey(r.Context(), id)
+			if err != nil && !errors.Is(err, ErrAPIKeyNotFound) {
+				writeInternalError(w, "Failed to read API key")
+				return
+			}
+			k := APIKey{ID: id, Description: req.Description, Role: req.Role, Disabled: req.Disabled}
+			var generated string
+			switch {
+			case req.Secret != "":
+				k.Hash = hashAPIKey(req.Secret)
+			case old != nil:
+				k.Hash = old.Hash
+			default:
+				generated = newAPIKeySecret()
+				k.Hash = hashAPIKey(generated)
+			}
+			if old != nil && old.Description == k.Description && old.Role == k.Role && old.Disabled == k.Disabled && old.Hash == k.Hash {
+				writeJSON(w, http.StatusOK, old.response(""))
+				return
+			}
+			if other := p.keyByHash(k.Hash); other != nil && other.ID != id {
+				writeConflict(w, "The secret is already used by API key '"+other.ID+"'")
+				return
+			}
+			now := time.Now().UTC()
+			k.CreatedAt, k.UpdatedAt = now, now
+			status := http.StatusCreated
+			if old != nil {
+				k.CreatedAt = old.CreatedAt
+				status = http.StatusOK
+			}
+			if err := p.store.PutAPIKey(r.Context(), &k); err != nil {
+				writeInternalError(w, "Failed to save API key")
+				return
+			}
+			p.audit.Record(AuditEvent{Action: "api_key_set", Actor: "admin", Detail: id})
+			p.reloadAfterChange(r.Context())
+			writeJSON(w, status, k.response(generated))
+
+		case http.MethodDelete:
+			err := p.store.DeleteAPIKey(r.Context(), id)
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				writeNotFound(w, "API key '"+id+"' not found")
+				return
+			}
+			if err != nil {
+				writeInternalError(w, "Failed to delete API key")
+				return
+			}
+			p.audit.Record(AuditEvent{Action: "api_key_deleted", Actor: "admin", Detail: id})
+			p.reloadAfterChange(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeMethodNotAllowed(w, "Only GET, PUT and DELETE methods are allowed for API keys")
+		}
+	}
+}
+
+func (p *Provisioning) keyByHash(h string) *APIKey {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.keys[h]
+}
+
+func newAPIKeySecret() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return "fup_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+// PurgeRequest names the file to purge. A file bound to a key with other
+// versions is only purged together with them, when AllVersions is set:
+// earlier versions are likely to hold the same data.
+type PurgeRequest struct {
+	ID          string `json:"id"`
+	Reason      string `json:"reason"`
+	AllVersions bool   `json:"allVersions,omitempty"`
+}
+
+// DeletionCertificate is returned by the purge endpoint as evidence that
+// every stored artifact of a file was removed. Signature covers the JSON
+// encoding of the certificate with Signature left empty.
+type DeletionCertificate struct {
+	FileID    string    `json:"fileId"`
+	SHA256    string    `json:"sha256"`
+	Artifacts []string  `json:"artifacts"`
+	Reason    string    `json:"reason,omitempty"`
+	PurgedAt  time.Time `json:"purgedAt"`
+	Verified  bool      `json:"verified"`
+	// Versions certifies the purge of the other versions of the file's
+	// key, purged with it. Verified covers them too.
+	Versions  []*DeletionCertificate `json:"versions,omitempty"`
+	Signature string                 `json:"signature"`
+}
+
+type artifact struct {
+	Kind string
+	Path string
+}
+
+// artifacts lists every on-disk file derived from the upload, blob first.
+func (r *FileRecord) artifacts() []artifact {
+	out := []artifact{{Kind: "blob", Path: r.Path}}
+	if r.ArchivePath != "" {
+		out = append(out, artifact{Kind: "archive", Path: r.ArchivePath})
+	}
+	if r.MaskedPath != "" {
+		out = append(out, artifact{Kind: "masked", Path: r.MaskedPath})
+	}
+	return out
+}
+
+// PurgeStore holds the documents that refer to files by ID, from which a
+// purge removes the purged file.
+type PurgeStore interface {
+	ShareStore
+	AccessStore
+	KeyStore
+	DeleteKey(ctx context.Context, key string) error
+	ListDatasets(ctx context.Context) ([]*Dataset, error)
+	PutDataset(ctx context.Context, ds *Dataset) error
+}
+
+// Purger erases a file together with everything kept about it elsewhere:
+// its shares, its access time, its versions of a key, its entries in
+// dataset versions, the lineage and duplicate references other files hold
+// to it, and the details earlier audit events give about it. A deleted
+// file leaves those behind; a purged one does not.
+type Purger struct {
+	store  MetadataStore
+	docs   PurgeStore
+	locker Locker
+	audit  *AuditLog
+}
+
+func NewPurger(store MetadataStore, docs PurgeStore, locker Locker, audit *AuditLog) *Purger {
+	return &Purger{store: store, docs: docs, locker: locker, audit: audit}
+}
+
+func PurgeHandler(p *Purger, signer *Signer, audit *AuditLog, events *EventRelay) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for purge")
+			return
+		}
+
+		var req PurgeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeBadRequest(w, "Invalid JSON body")
+			return
+		}
+		release, err := lockRecord(r.Context(), p.locker, req.ID)
+		if err != nil {
+			writeUpdateError(w, req.ID, err)
+			return
+		}
+		defer release()
+		rec, ok := loadRecord(w, r, p.store, req.ID)
+		if !ok {
+			return
+		}
+		others, err := p.otherVersions(r.Context(), rec)
+		if err != nil {
+			writeInternalError(w, "Failed to read key versions")
+			return
+		}
+		if len(others) > 0 && !req.AllVersions {
+			writeConflict(w, fmt.Sprintf("File '%s' is one of %d versions of key '%s'; set \"allVersions\" to purge them all", rec.ID, len(others)+1, rec.Key))
+			return
+		}
+		recs := []*FileRecord{rec}
+		for _, id := range others {
+			release, err := lockRecord(r.Context(), p.locker, id)
+			if err != nil {
+				writeUpdateError(w, id, err)
+				return
+			}
+			defer release()
+			v, ok := loadRecord(w, r, p.store, id)
+			if !ok {
+				return
+			}
+			recs = append(recs, v)
+		}
+		for _, v := range recs {
+			if v.Hold.Active(time.Now()) {
+				audit.Record(AuditEvent{Action: "purge_rejected", FileID: v.ID, Actor: "admin", Detail: "legal hold"})
+				writeConflict(w, "File '"+v.ID+"' is under legal hold")
+				return
+			}
+		}
+
+		var cert *DeletionCertificate
+		for _, v := range recs {
+			c, err := p.Purge(r.Context(), v)
+			if err != nil {
+				log.Printf("purge %s: %v", v.ID, err)
+				writeInternalError(w, "Failed to purge file '"+v.ID+"'")
+				return
+			}
+			c.Reason = req.Reason
+			audit.Record(AuditEvent{Action: "purge", FileID: v.ID, Actor: "admin", Detail: req.Reason})
+			events.EmitPurged(v.ID)
+			if cert == nil {
+				cert = c
+				continue
+			}
+			cert.Versions = append(cert.Versions, c)
+			cert.Verified = cert.Verified && c.Verified
+		}
+
+		payload, err := json.Marshal(cert)
+		if err != nil {
+			writeInternalError(w, "Failed to sign deletion certificate")
+			return
+		}
+		cert.Signature = signer.Sign(payload)
+		writeJSON(w, http.StatusOK, cert)
+	}
+}
+
+// otherVersions returns the files bound to rec's key besides rec.
+func (p *Purger) otherVersions(ctx context.Context, rec *FileRecord) ([]string, error) {
+	if rec.Key == "" {
+		return nil, nil
+	}
+	obj, err := p.docs.GetKey(ctx, rec.Key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, v := range obj.Versions {
+		if v.FileID != rec.ID && !slices.Contains(ids, v.FileID) {
+			ids = append(ids, v.FileID)
+		}
+	}
+	return ids, nil
+}
+
+// Purge removes rec's artifacts and record, then every reference to it,
+// and re-checks each before reporting the purge as verified. The caller
+// holds rec's lock.
+func (p *Purger) Purge(ctx context.Context, rec *FileRecord) (*DeletionCertificate, error) {
+	cert, err := purgeFile(ctx, p.store, rec)
+	if err != nil {
+		return nil, err
+	}
+	id := rec.ID
+	steps := []struct {
+		kind   string
+		remove func(context.Context, *FileRecord) error
+		left   func(context.Context, *FileRecord) (bool, error)
+	}{
+		{"shares", p.removeShares, p.sharesLeft},
+		{"access", p.removeAccess, p.accessLeft},
+		{"key versions", p.removeKeyVersions, p.keyVersionsLeft},
+		{"dataset entries", p.removeDatasetEntries, p.datasetEntriesLeft},
+		{"file references", p.removeFileReferences, p.fileReferencesLeft},
+		{"audit details", p.removeAuditDetails, p.auditDetailsLeft},
+	}
+	for _, s := range steps {
+		if err := s.remove(ctx, rec); err != nil {
+			return nil, fmt.Errorf("remove %s of %s: %w", s.kind, id, err)
+		}
+		cert.Artifacts = append(cert.Artifacts, s.kind)
+	}
+	for _, s := range steps {
+		left, err := s.left(ctx, rec)
+		if err != nil || left {
+			log.Printf("purge %s: %s left behind (%v)", id, s.kind, err)
+			cert.Verified = false
+		}
+	}
+	return cert, nil
+}
+
+func (p *Purger) fileShares(ctx context.Context, id string) ([]*Share, error) {
+	shares, err := p.docs.ListShares(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(shares, func(sh *Share) bool { return sh.FileID != id }), nil
+}
+
+func (p *Purger) removeShares(ctx context.Context, rec *FileRecord) error {
+	shares, err := p.fileShares(ctx, rec.ID)
+	if err != nil {
+		return err
+	}
+	for _, sh := range shares {
+		if err := p.docs.DeleteShare(ctx, sh.ID); err != nil && !errors.Is(err, ErrShareNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Purger) sharesLeft(ctx context.Context, rec *FileRecord) (bool, error) {
+	shares, err := p.fileShares(ctx, rec.ID)
+	return len(shares) > 0, err
+}
+
+func (p *Purger) removeAccess(ctx context.Context, rec *FileRecord) error {
+	return p.docs.DeleteAccess(ctx, rec.ID)
+}
+
+func (p *Purger) accessLeft(ctx context.Context, rec *FileRecord) (bool, error) {
+	at, err := p.docs.LastAccess(ctx, rec.ID)
+	return !at.IsZero(), err
+}
+
+// removeKeyVersions drops rec from the versions of its key, pointing the
+// key at its latest remaining version or deleting a key left with none.
+// PurgeHandler purges the remaining versions next.
+func (p *Purger) removeKeyVersions(ctx context.Context, rec *FileRecord) error {
+	if rec.Key == "" {
+		return nil
+	}
+	release, ok, err := p.locker.TryLock(ctx, "key:"+keyDocID(rec.Key), time.Minute)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("key '" + rec.Key + "' is locked by an upload")
+	}
+	defer release()
+	obj, err := p.docs.GetKey(ctx, rec.Key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n := len(obj.Versions)
+	obj.Versions = slices.DeleteFunc(obj.Versions, func(v KeyVersion) bool { return v.FileID == rec.ID })
+	switch {
+	case len(obj.Versions) == 0:
+		return p.docs.DeleteKey(ctx, rec.Key)
+	case len(obj.Versions) == n && obj.FileID != rec.ID:
+		return nil
+	}
+	obj.FileID = obj.Versions[len(obj.Versions)-1].FileID
+	obj.UpdatedAt = time.Now().UTC()
+	return p.docs.PutKey(ctx, obj)
+}
+
+func (p *Purger) keyVersionsLeft(ctx context.Context, rec *FileRecord) (bool, error) {
+	if rec.Key == "" {
+		return false, nil
+	}
+	obj, err := p.docs.GetKey(ctx, rec.Key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return obj.FileID == rec.ID || slices.ContainsFunc(obj.Versions, func(v KeyVersion) bool { return v.FileID == rec.ID }), nil
+}
+
+// removeDatasetEntries takes rec out of every version of every dataset
+// listing it; earlier versions keep their numbers but lose the entry.
+func (p *Purger) removeDatasetEntries(ctx context.Context, rec *FileRecord) error {
+	datasets, err := p.docs.ListDatasets(ctx)
+	if err != nil {
+		return err
+	}
+	listed := func(e DatasetEntry) bool { return e.FileID == rec.ID }
+	for _, ds := range datasets {
+		changed := false
+		for i, v := range ds.Versions {
+			if slices.ContainsFunc(v.Files, listed) {
+				ds.Versions[i].Files = slices.DeleteFunc(v.Files, listed)
+				changed = true
+			}
+		}
+		if changed {
+			if err := p.docs.PutDataset(ctx, ds); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Purger) datasetEntriesLeft(ctx context.Context, rec *FileRecord) (bool, error) {
+	datasets, err := p.docs.ListDatasets(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, ds := range datasets {
+		for _, v := range ds.Versions {
+			if slices.ContainsFunc(v.Files, func(e DatasetEntry) bool { return e.FileID == rec.ID }) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// refersTo reports whether other names the file id as a lineage source or
+// as what it duplicates.
+func refersTo(other *FileRecord, id string) bool {
+	return other.DuplicateOf == id || (other.Lineage != nil && slices.Contains(other.Lineage.Sources, id))
+}
+
+// removeFileReferences drops the lineage edges and duplicateOf references
+// other files hold to rec.
+func (p *Purger) removeFileReferences(ctx context.Context, rec *FileRecord) error {
+	recs, err := p.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range recs {
+		if !refersTo(other, rec.ID) {
+			continue
+		}
+		_, err := updateRecord(ctx, p.store, p.locker, other.ID, func(other *FileRecord) error {
+			if !refersTo(other, rec.ID) {
+				return errNoChange
+			}
+			if other.DuplicateOf == rec.ID {
+				other.DuplicateOf = ""
+			}
+			if other.Lineage != nil {
+				other.Lineage.Sources = slices.DeleteFunc(other.Lineage.Sources, func(s string) bool { return s == rec.ID })
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Purger) fileReferencesLeft(ctx context.Context, rec *FileRecord) (bool, error) {
+	recs, err := p.store.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(recs, func(other *FileRecord) bool { return refersTo(other, rec.ID) }), nil
+}
+
+func (p *Purger) removeAuditDetails(ctx context.Context, rec *FileRecord) error {
+	return p.audit.Redact(rec.ID)
+}
+
+func (p *Purger) auditDetailsLeft(ctx context.Context, rec *FileRecord) (bool, error) {
+	return p.audit.Mentions(rec.ID)
+}
+
+// purgeFile removes all artifacts and the metadata record, then re-checks
+// that nothing is left behind before reporting the purge as verified.
+func purgeFile(ctx context.Context, store MetadataStore, rec *FileRecord) (*DeletionCertificate, error) {
+	cert := &DeletionCertificate{FileID: rec.ID, SHA256: rec.ChecksumSHA}
+	arts := rec.artifacts()
+	for _, a := range arts {
+		if err := boundedWrite(ctx, "blob remove", func(commit func() error) error {
+			if err := commit(); err != nil {
+				return err
+			}
+			return os.Remove(a.Path)
+		}); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		cert.Artifacts = append(cert.Artifacts, a.Kind)
+	}
+	if err := store.Delete(ctx, rec.ID); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	cert.Artifacts = append(cert.Artifacts, "metadata")
+
+	cert.Verified = true
+	for _, a := range arts {
+		if _, err := bounded(ctx, "blob stat", func() (os.FileInfo, error) { return os.Stat(a.Path) }); !errors.Is(err, os.ErrNotExist) {
+			cert.Verified = false
+		}
+	}
+	if _, err := store.Get(ctx, rec.ID); !errors.Is(err, ErrNotFound) {
+		cert.Verified = false
+	}
+	cert.PurgedAt = time.Now().UTC()
+	rec.State = StateDeleted
+	return cert, nil
+}
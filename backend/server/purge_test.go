@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stuckShares is a PurgeStore whose share deletes silently do nothing.
+type stuckShares struct{ *jsonStore }
+
+func (stuckShares) DeleteShare(context.Context, string) error { return nil }
+
+func TestPurgeRemovesReferences(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string // file IDs bound to the key, "purged" for the purged file
+		stuck    bool     // whether share deletes fail silently
+		key      string   // the key's file afterwards, "" for deleted
+	}{
+		{"only version", []string{"purged"}, false, ""},
+		{"current version", []string{"older", "purged"}, false, "older"},
+		{"earlier version", []string{"purged", "newer"}, false, "newer"},
+		{"share left behind", []string{"purged"}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			in := testIngest(t)
+			db := in.Store.(*jsonStore)
+			audit, err := OpenAuditLog(auditLogPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := testRecord(t, in)
+			other, err := updateRecord(ctx, db, newLocalLocker(), testRecord(t, in).ID, func(o *FileRecord) error {
+				o.Lineage = &Lineage{Operation: LineageQuery, Sources: []string{rec.ID}}
+				o.DuplicateOf = rec.ID
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			obj := &ObjectKey{Key: "exports/daily.csv"}
+			for i, id := range tt.versions {
+				if id == "purged" {
+					id = rec.ID
+				}
+				obj.Versions = append(obj.Versions, KeyVersion{Version: i + 1, FileID: id})
+				obj.FileID = id
+			}
+			rec.Key = obj.Key
+			if err := db.Put(ctx, rec); err != nil {
+				t.Fatal(err)
+			}
+			for _, err := range []error{
+				db.PutKey(ctx, obj),
+				db.PutShare(ctx, &Share{ID: "s1", FileID: rec.ID}),
+				db.PutShare(ctx, &Share{ID: "s2", FileID: other.ID}),
+				db.TouchAccess(ctx, rec.ID, time.Now()),
+				db.PutDataset(ctx, &Dataset{ID: "d1", Versions: []DatasetVersion{
+					{Version: 1, Files: []DatasetEntry{{FileID: rec.ID}, {FileID: other.ID}}},
+					{Version: 2, Files: []DatasetEntry{{FileID: other.ID}}},
+				}}),
+			} {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			audit.Record(AuditEvent{Action: "hold_set", FileID: rec.ID, Detail: "case 42"})
+			audit.Record(AuditEvent{Action: "orphan_removed", Detail: "data/uploads/" + rec.ID + ".csv"})
+			audit.Record(AuditEvent{Action: "hold_set", FileID: other.ID, Detail: "case 43"})
+
+			var docs PurgeStore = db
+			if tt.stuck {
+				docs = stuckShares{db}
+			}
+			cert, err := NewPurger(db, docs, newLocalLocker(), audit).Purge(ctx, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Verified == tt.stuck {
+				t.Errorf("verified = %v with shares stuck = %v", cert.Verified, tt.stuck)
+			}
+			if tt.stuck {
+				return
+			}
+
+			if _, err := os.Stat(rec.Path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("blob left: %v", err)
+			}
+			if sh, _ := db.GetShare(ctx, "s2"); sh == nil {
+				t.Error("another file's share was removed")
+			}
+			got, err := db.GetKey(ctx, obj.Key)
+			switch {
+			case tt.key == "" && !errors.Is(err, ErrKeyNotFound):
+				t.Errorf("key left: %+v, %v", got, err)
+			case tt.key != "" && (err != nil || got.FileID != tt.key || len(got.Versions) != len(tt.versions)-1):
+				t.Errorf("key %+v, %v; want it at %s", got, err, tt.key)
+			}
+			ds, err := db.GetDataset(ctx, "d1")
+			if err != nil || len(ds.Versions) != 2 || len(ds.Versions[0].Files) != 1 || len(ds.Versions[1].Files) != 1 {
+				t.Errorf("dataset %+v, %v", ds, err)
+			}
+			o, err := db.Get(ctx, other.ID)
+			if err != nil || o.DuplicateOf != "" || slices.Contains(o.Lineage.Sources, rec.ID) {
+				t.Errorf("other file still refers to the purged one: %+v, %v", o, err)
+			}
+			if mentioned, err := audit.Mentions(rec.ID); mentioned || err != nil {
+				t.Errorf("audit log still mentions the purged file: %v", err)
+			}
+			if mentioned, _ := audit.Mentions(other.ID); !mentioned {
+				t.Error("audit detail of another file was redacted")
+			}
+		})
+	}
+}
+
+// A file with other versions of its key is purged only together with them,
+// and none is purged while any of them is under legal hold. Purge events
+// carry nothing but the file's ID.
+func TestPurgeHandlerKeyVersions(t *testing.T) {
+	ctx := context.Background()
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	locker := newLocalLocker()
+	audit, err := OpenAuditLog(auditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := NewSigner(StaticSecret("purge-key"))
+	handler := PurgeHandler(NewPurger(db, db, locker, audit), signer, audit, NewEventRelay(db, nil, locker))
+
+	obj := &ObjectKey{Key: "exports/daily.csv"}
+	var ids []string
+	for i := range 2 {
+		rec := testRecord(t, in)
+		rec.Key = obj.Key
+		if err := db.Put(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		obj.Versions = append(obj.Versions, KeyVersion{Version: i + 1, FileID: rec.ID})
+		obj.FileID = rec.ID
+		ids = append(ids, rec.ID)
+	}
+	if err := db.PutKey(ctx, obj); err != nil {
+		t.Fatal(err)
+	}
+	purge := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/v1/admin/purge", strings.NewReader(body)))
+		return w
+	}
+	stored := func() int {
+		n := 0
+		for _, id := range ids {
+			if _, err := db.Get(ctx, id); err == nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	if w := purge(`{"id": "` + ids[1] + `"}`); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "one of 2 versions of key 'exports/daily.csv'") {
+		t.Fatalf("purge of one version: %d %s", w.Code, w.Body)
+	}
+	if _, err := updateRecord(ctx, db, locker, ids[0], func(rec *FileRecord) error {
+		rec.Hold = &LegalHold{Reason: "case 42", SetAt: time.Now()}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if w := purge(`{"id": "` + ids[1] + `", "allVersions": true}`); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "legal hold") {
+		t.Fatalf("purge with a held version: %d %s", w.Code, w.Body)
+	}
+	if n := stored(); n != 2 {
+		t.Fatalf("%d of 2 versions left after rejected purges", n)
+	}
+	if _, err := updateRecord(ctx, db, locker, ids[0], func(rec *FileRecord) error {
+		rec.Hold = nil
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := purge(`{"id": "` + ids[1] + `", "reason": "erasure request", "allVersions": true}`)
+	var cert DeletionCertificate
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &cert) != nil {
+		t.Fatalf("purge of all versions: %d %s", w.Code, w.Body)
+	}
+	if cert.FileID != ids[1] || len(cert.Versions) != 1 || cert.Versions[0].FileID != ids[0] || !cert.Verified {
+		t.Errorf("certificate %+v", cert)
+	}
+	sig := cert.Signature
+	cert.Signature = ""
+	if payload, _ := json.Marshal(cert); !signer.Verify(payload, sig) {
+		t.Error("certificate signature does not verify")
+	}
+	if n := stored(); n != 0 {
+		t.Errorf("%d versions left", n)
+	}
+	if _, err := db.GetKey(ctx, obj.Key); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("key left: %v", err)
+	}
+
+	evs, err := db.Pending(ctx, 10)
+	if err != nil || len(evs) != 2 {
+		t.Fatalf("events %+v, %v", evs, err)
+	}
+	for i, ev := range evs {
+		if ev.Type != EventFileDeleted || !ev.Purged || ev.File != nil || ev.FileID != ids[1-i] {
+			t.Errorf("event %+v", ev)
+		}
+	}
+}
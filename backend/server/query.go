@@ -0,0 +1,586 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// queryMaxBuffered caps the rows or groups a query may hold in memory for
+// ORDER BY, GROUP BY and DISTINCT.
+const queryMaxBuffered = 1_000_000
+
+type queryRequest struct {
+	SQL    string           `json:"sql"`
+	Format string           `json:"format,omitempty"`
+	Save   *querySaveTarget `json:"save,omitempty"`
+}
+
+// querySaveTarget names the file a query result is saved as.
+type querySaveTarget struct {
+	Filename string   `json:"filename"`
+	Folder   string   `json:"folder,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+type QueryResponse struct {
+	Columns   []string `json:"columns"`
+	Rows      [][]any  `json:"rows"`
+	RowCount  int      `json:"rowCount"`
+	Truncated bool     `json:"truncated"`
+}
+
+// QueryHandler runs a restricted SQL SELECT against a stored CSV:
+// POST /v1/files/{id}/query with {"sql": "SELECT ... FROM file ..."}. The
+// first row names the columns. Results are capped at maxRows, with
+// "truncated" set when more matched, and the query is abandoned after
+// timeout. Results are JSON unless "format" is "csv" or the client only
+// accepts text/csv.
+//
+// With "save" the whole result is instead stored as a new CSV file, held
+// to the usual size limit rather than maxRows, whose lineage points back
+// at the source file and query.
+func QueryHandler(in *Ingest, maxRows int, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req queryRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeBadRequest(w, "Invalid JSON body")
+			return
+		}
+		if strings.TrimSpace(req.SQL) == "" {
+			writeBadRequest(w, "Field 'sql' is required")
+			return
+		}
+		format := req.Format
+		if format == "" {
+			format = "json"
+			if accept := r.Header.Get("Accept"); strings.Contains(accept, "text/csv") && !strings.Contains(accept, "json") {
+				format = "csv"
+			}
+		}
+		if format != "json" && format != "csv" {
+			writeBadRequest(w, "Field 'format' must be \"json\" or \"csv\"")
+			return
+		}
+		stmt, err := parseSQL(req.SQL)
+		if err != nil {
+			writeBadRequest(w, "Invalid query: "+err.Error())
+			return
+		}
+
+		rec, ok := loadRecord(w, r, in.Store, r.PathValue("id"))
+		if !ok {
+			return
+		}
+		if unavailable(w, rec) {
+			return
+		}
+		body, err := openContent(r.Context(), rec)
+		if err != nil {
+			writeBlobError(w, err)
+			return
+		}
+		defer body.Close()
+
+		cr := newLenientCSVReader(body)
+		if err := stmt.start(cr); err != nil {
+			writeQueryError(w, r, rec, err, timeout)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		start := time.Now()
+		defer func() {
+			metrics.Counter("query_seconds_sum", "Total time spent running file queries.").Add(time.Since(start).Seconds())
+			metrics.Counter("query_seconds_count", "Queries timed in query_seconds_sum.").Inc()
+		}()
+
+		if req.Save != nil {
+			saveQuery(ctx, w, r, in, stmt, cr, rec, req, timeout)
+			return
+		}
+
+		res := &QueryResponse{Columns: stmt.columns(), Rows: [][]any{}}
+		res.Truncated, err = stmt.run(ctx, cr, maxRows, func(row []any) error {
+			res.Rows = append(res.Rows, row)
+			return nil
+		})
+		if err != nil {
+			writeQueryError(w, r, rec, err, timeout)
+			return
+		}
+		res.RowCount = len(res.Rows)
+
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			if res.Truncated {
+				w.Header().Set("X-Query-Truncated", "true")
+			}
+			cw := csv.NewWriter(w)
+			cw.Write(res.Columns)
+			line := make([]string, len(res.Columns))
+			for _, row := range res.Rows {
+				for i, v := range row {
+					line[i] = sqlString(v)
+				}
+				cw.Write(line)
+			}
+			cw.Flush()
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+var errQueryDiscarded = errors.New("query result discarded")
+
+// saveQuery streams the query result into a new file through the regular
+// ingest pipeline.
+func saveQuery(ctx context.Context, w http.ResponseWriter, r *http.Request, in *Ingest, stmt *sqlSelect, cr *csv.Reader, src *FileRecord, req queryRequest, timeout time.Duration) {
+	folder, ok := cleanFolder(req.Save.Folder)
+	if !ok {
+		writeBadRequest(w, "Invalid folder '"+req.Save.Folder+"'")
+		return
+	}
+	filename := req.Save.Filename
+	if filename == "" {
+		filename = strings.TrimSuffix(src.Filename, filepath.Ext(src.Filename)) + "-query.csv"
+	}
+
+	pr, pw := io.Pipe()
+	runErr := make(chan error, 1)
+	go func() {
+		cw := csv.NewWriter(pw)
+		cw.Write(stmt.columns())
+		var line []string
+		_, err := stmt.run(ctx, cr, math.MaxInt, func(row []any) error {
+			line = line[:0]
+			for _, v := range row {
+				line = append(line, sqlString(v))
+			}
+			cw.Write(line)
+			return cw.Error()
+		})
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+		pw.CloseWithError(err)
+		runErr <- err
+	}()
+
+	limit := in.Limits.Default
+	meta := UploadMeta{
+		Folder:      folder,
+		Tags:        req.Save.Tags,
+		MaxBytes:    limit,
+		NotifyEmail: notifyAddress(r),
+		Lineage:     &Lineage{Operation: LineageQuery, Sources: []string{src.ID}, Query: req.SQL},
+	}
+	rec, uerr := in.Receive(r.Context(), &limitFile{r: pr, n: limit}, filename, meta)
+	// Unblock the query if ingest gave up before reading everything.
+	pr.CloseWithError(errQueryDiscarded)
+	if err := <-runErr; err != nil && !errors.Is(err, errQueryDiscarded) {
+		writeQueryError(w, r, src, err, timeout)
+		return
+	}
+	if uerr != nil {
+		writeUploadError(w, uerr)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUploadResponse(rec))
+}
+
+func writeQueryError(w http.ResponseWriter, r *http.Request, rec *FileRecord, err error, timeout time.Duration) {
+	var serr *sqlError
+	switch {
+	case errors.As(err, &serr):
+		writeBadRequest(w, "Invalid query: "+err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusServiceUnavailable, "service_unavailable", fmt.Sprintf("Query exceeded the %s time limit", timeout))
+	case r.Context().Err() == nil:
+		log.Printf("query %s: %v", rec.ID, err)
+		writeInternalError(w, "Failed to read stored file")
+	}
+}
+
+// queryRow is one output row plus the ORDER BY keys that are not output
+// columns.
+type queryRow struct {
+	vals []any
+	keys []any
+}
+
+// start reads the header from cr and binds the statement to it.
+func (q *sqlSelect) start(cr *csv.Reader) error {
+	header, err := cr.Read()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return q.bind(slices.Clone(header))
+}
+
+func (q *sqlSelect) columns() []string {
+	cols := make([]string, len(q.Items))
+	for i, it := range q.Items {
+		cols[i] = it.Name
+	}
+	return cols
+}
+
+// run executes the statement over the rest of cr, passing each result row
+// to emit, and reports whether rows past maxRows were dropped. It streams
+// when it can, stopping as soon as enough rows have been produced;
+// sorting, grouping and DISTINCT need every matching row first.
+func (q *sqlSelect) run(ctx context.Context, cr *csv.Reader, maxRows int, emit func([]any) error) (bool, error) {
+	limit, userLimited := maxRows, false
+	if q.Limit >= 0 && q.Limit <= maxRows {
+		limit, userLimited = q.Limit, true
+	}
+	grouped := len(q.GroupBy) > 0 || len(q.aggs) > 0
+	streaming := !grouped && !q.Distinct && len(q.OrderBy) == 0
+
+	var rows []queryRow
+	emitted, skipped := 0, 0
+	type group struct {
+		row    []string
+		states []*sqlAggState
+	}
+	groups := map[string]*group{}
+	var order []*group
+	env := &sqlEnv{}
+	for n := 0; ; n++ {
+		if n%1024 == 0 && ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		env.row = row
+		if q.Where != nil {
+			if ok, _ := sqlBool(q.Where.eval(env)); !ok {
+				continue
+			}
+		}
+		if grouped {
+			var key strings.Builder
+			for _, e := range q.GroupBy {
+				key.WriteString(sqlKey(e.eval(env)))
+				key.WriteByte(0)
+			}
+			g, ok := groups[key.String()]
+			if !ok {
+				if len(order) >= queryMaxBuffered {
+					return false, sqlErrorf("query produces more than %d groups", queryMaxBuffered)
+				}
+				g = &group{row: slices.Clone(row), states: q.newAggStates()}
+				groups[key.String()] = g
+				order = append(order, g)
+			}
+			for _, s := range g.states {
+				s.add(env)
+			}
+			continue
+		}
+		if !streaming {
+			if len(rows) >= queryMaxBuffered {
+				return false, sqlErrorf("query needs more than %d rows in memory; narrow it with WHERE", queryMaxBuffered)
+			}
+			rows = append(rows, q.project(env))
+			continue
+		}
+		if skipped < q.Offset {
+			skipped++
+			continue
+		}
+		if emitted == limit {
+			return !userLimited, nil
+		}
+		if err := emit(q.project(env).vals); err != nil {
+			return false, err
+		}
+		emitted++
+	}
+	if streaming {
+		return false, nil
+	}
+
+	if grouped {
+		// An aggregate without GROUP BY always yields one row.
+		if len(q.GroupBy) == 0 && len(order) == 0 {
+			order = append(order, &group{states: q.newAggStates()})
+		}
+		for _, g := range order {
+			env := &sqlEnv{row: g.row, aggs: make([]any, len(g.states))}
+			for i, s := range g.states {
+				env.aggs[i] = s.result()
+			}
+			if q.Having != nil {
+				if ok, _ := sqlBool(q.Having.eval(env)); !ok {
+					continue
+				}
+			}
+			rows = append(rows, q.project(env))
+		}
+	}
+	if q.Distinct {
+		seen := map[string]bool{}
+		rows = slices.DeleteFunc(rows, func(r queryRow) bool {
+			var key strings.Builder
+			for _, v := range r.vals {
+				key.WriteString(sqlKey(v))
+				key.WriteByte(0)
+			}
+			if seen[key.String()] {
+				return true
+			}
+			seen[key.String()] = true
+			return false
+		})
+	}
+	if len(q.OrderBy) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool { return q.less(rows[i], rows[j]) })
+	}
+	rows = rows[min(q.Offset, len(rows)):]
+	truncated := false
+	if len(rows) > limit {
+		rows, truncated = rows[:limit], !userLimited
+	}
+	for _, r := range rows {
+		if err := emit(r.vals); err != nil {
+			return false, err
+		}
+	}
+	return truncated, nil
+}
+
+func (q *sqlSelect) newAggStates() []*sqlAggState {
+	states := make([]*sqlAggState, len(q.aggs))
+	for i, a := range q.aggs {
+		states[i] = &sqlAggState{agg: a}
+	}
+	return states
+}
+
+func (q *sqlSelect) project(env *sqlEnv) queryRow {
+	r := queryRow{vals: make([]any, len(q.Items))}
+	for i, it := range q.Items {
+		r.vals[i] = it.Expr.eval(env)
+	}
+	for _, o := range q.OrderBy {
+		if o.Pos < 0 {
+			r.keys = append(r.keys, o.Expr.eval(env))
+		}
+	}
+	return r
+}
+
+// less orders rows by the ORDER BY terms. NULLs sort last ascending and
+// first descending.
+func (q *sqlSelect) less(a, b queryRow) bool {
+	k := 0
+	for _, o := range q.OrderBy {
+		var x, y any
+		if o.Pos >= 0 {
+			x, y = a.vals[o.Pos], b.vals[o.Pos]
+		} else {
+			x, y = a.keys[k], b.keys[k]
+			k++
+		}
+		var c int
+		switch {
+		case x == nil && y == nil:
+			continue
+		case x == nil:
+			c = 1
+		case y == nil:
+			c = -1
+		default:
+			c = sqlCompare(x, y)
+		}
+		if c != 0 {
+			return (c < 0) != o.Desc
+		}
+	}
+	return false
+}
+
+// bind expands * and resolves column names against the header, then
+// checks the statement makes sense for it.
+func (q *sqlSelect) bind(header []string) error {
+	names := make([]string, len(header))
+	for i := range header {
+		names[i] = columnName(header, i)
+	}
+	var items []sqlItem
+	for _, it := range q.Items {
+		if !it.Star {
+			items = append(items, it)
+			continue
+		}
+		for i, name := range names {
+			items = append(items, sqlItem{Expr: &sqlColumn{Name: name, Index: i}, Name: name})
+		}
+	}
+	q.Items = items
+
+	var err error
+	resolve := func(e sqlExpr) bool {
+		c, ok := e.(*sqlColumn)
+		if !ok || err != nil {
+			return err == nil
+		}
+		c.Index = slices.Index(names, c.Name)
+		if c.Index < 0 && !c.Quoted {
+			c.Index = slices.IndexFunc(names, func(n string) bool { return strings.EqualFold(n, c.Name) })
+		}
+		if c.Index < 0 {
+			err = sqlErrorf("unknown column %q", c.Name)
+		}
+		return true
+	}
+	for i, o := range q.OrderBy {
+		if l, ok := o.Expr.(*sqlLiteral); ok {
+			if f, ok := l.V.(float64); ok {
+				if f != float64(int(f)) || f < 1 || int(f) > len(q.Items) {
+					return sqlErrorf("ORDER BY position %v is not in the select list", f)
+				}
+				q.OrderBy[i].Pos = int(f) - 1
+				continue
+			}
+		}
+		if c, ok := o.Expr.(*sqlColumn); ok {
+			if pos := slices.IndexFunc(q.Items, func(it sqlItem) bool {
+				return it.Alias && (it.Name == c.Name || !c.Quoted && strings.EqualFold(it.Name, c.Name))
+			}); pos >= 0 {
+				q.OrderBy[i].Pos = pos
+				continue
+			}
+		}
+		sqlWalk(o.Expr, resolve)
+	}
+	sqlWalk(q.Where, resolve)
+	for _, e := range q.exprs() {
+		sqlWalk(e, resolve)
+	}
+	if err != nil {
+		return err
+	}
+
+	hasAgg := func(e sqlExpr) bool {
+		found := false
+		sqlWalk(e, func(e sqlExpr) bool {
+			_, isAgg := e.(*sqlAgg)
+			found = found || isAgg
+			return !found
+		})
+		return found
+	}
+	if q.Where != nil && hasAgg(q.Where) {
+		return sqlErrorf("aggregate functions are not allowed in WHERE")
+	}
+	for _, e := range q.GroupBy {
+		if hasAgg(e) {
+			return sqlErrorf("aggregate functions are not allowed in GROUP BY")
+		}
+	}
+	if len(q.GroupBy) == 0 && len(q.aggs) == 0 {
+		if q.Having != nil {
+			return sqlErrorf("HAVING needs GROUP BY or an aggregate")
+		}
+		return nil
+	}
+
+	// Outside aggregates a grouped query may only use grouped columns.
+	grouped := map[int]bool{}
+	for _, e := range q.GroupBy {
+		sqlWalk(e, func(e sqlExpr) bool {
+			if c, ok := e.(*sqlColumn); ok {
+				grouped[c.Index] = true
+			}
+			return true
+		})
+	}
+	for _, e := range q.exprs()[len(q.GroupBy):] {
+		sqlWalk(e, func(e sqlExpr) bool {
+			switch e := e.(type) {
+			case *sqlAgg:
+				return false
+			case *sqlColumn:
+				if !grouped[e.Index] && err == nil {
+					err = sqlErrorf("column %q must appear in GROUP BY or be used in an aggregate function", e.Name)
+				}
+			}
+			return true
+		})
+	}
+	return err
+}
+
+// exprs lists the expressions evaluated per output row, GROUP BY first:
+// GROUP BY, the select list, HAVING and ORDER BY terms not bound to
+// output columns. WHERE is left out.
+func (q *sqlSelect) exprs() []sqlExpr {
+	out := slices.Clone(q.GroupBy)
+	for _, it := range q.Items {
+		out = append(out, it.Expr)
+	}
+	if q.Having != nil {
+		out = append(out, q.Having)
+	}
+	for _, o := range q.OrderBy {
+		if o.Pos < 0 {
+			out = append(out, o.Expr)
+		}
+	}
+	return out
+}
+
+// sqlWalk calls fn for e and, while fn returns true, its children.
+func sqlWalk(e sqlExpr, fn func(sqlExpr) bool) {
+	if e == nil || !fn(e) {
+		return
+	}
+	switch e := e.(type) {
+	case *sqlUnary:
+		sqlWalk(e.X, fn)
+	case *sqlBinary:
+		sqlWalk(e.L, fn)
+		sqlWalk(e.R, fn)
+	case *sqlIsNull:
+		sqlWalk(e.X, fn)
+	case *sqlIn:
+		sqlWalk(e.X, fn)
+		for _, x := range e.List {
+			sqlWalk(x, fn)
+		}
+	case *sqlBetween:
+		sqlWalk(e.X, fn)
+		sqlWalk(e.Lo, fn)
+		sqlWalk(e.Hi, fn)
+	case *sqlLike:
+		sqlWalk(e.X, fn)
+		sqlWalk(e.Pattern, fn)
+	case *sqlCall:
+		for _, x := range e.Args {
+			sqlWalk(x, fn)
+		}
+	case *sqlAgg:
+		sqlWalk(e.Arg, fn)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+func TestQueryHandler(t *testing.T) {
+	in := testIngest(t)
+	meta := UploadMeta{MaxBytes: config.DefaultMaxUploadBytes}
+	small, uerr := in.Receive(context.Background(), strings.NewReader(sqlPeople), "people.csv", meta)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	large, uerr := in.Receive(context.Background(), strings.NewReader("n\n"+strings.Repeat("1\n", 5000)), "ones.csv", meta)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+
+	tests := []struct {
+		name, id, body, accept string
+		timeout                time.Duration
+		status                 int
+		want                   string // a substring of the response body
+		truncated              string // the X-Query-Truncated header
+	}{
+		{"json", small.ID, `{"sql": "SELECT name FROM people WHERE city = 'Oslo'"}`, "", time.Minute, http.StatusOK, `"rows":[["ann"],["cid"]],"rowCount":2,"truncated":false`, ""},
+		{"row cap", small.ID, `{"sql": "SELECT name FROM people"}`, "", time.Minute, http.StatusOK, `"rowCount":3,"truncated":true`, ""},
+		{"csv", small.ID, `{"sql": "SELECT name FROM people"}`, "text/csv", time.Minute, http.StatusOK, "name\nann\nbob\ncid\n", "true"},
+		{"csv format", small.ID, `{"sql": "SELECT name FROM people LIMIT 1", "format": "csv"}`, "", time.Minute, http.StatusOK, "name\nann\n", ""},
+		{"parse error", small.ID, `{"sql": "SELECT name"}`, "", time.Minute, http.StatusBadRequest, "expected FROM", ""},
+		{"unknown column", small.ID, `{"sql": "SELECT nope FROM people"}`, "", time.Minute, http.StatusBadRequest, "nope", ""},
+		{"no sql", small.ID, `{}`, "", time.Minute, http.StatusBadRequest, "'sql' is required", ""},
+		{"bad format", small.ID, `{"sql": "SELECT name FROM people", "format": "xml"}`, "", time.Minute, http.StatusBadRequest, "'format'", ""},
+		{"missing file", "nope", `{"sql": "SELECT name FROM people"}`, "", time.Minute, http.StatusNotFound, "", ""},
+		{"timeout", large.ID, `{"sql": "SELECT n FROM ones ORDER BY n"}`, "", time.Nanosecond, http.StatusServiceUnavailable, "time limit", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/files/"+tt.id+"/query", strings.NewReader(tt.body))
+			req.SetPathValue("id", tt.id)
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			QueryHandler(in, 3, tt.timeout)(w, req)
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("%d %s, want %d with %q", w.Code, w.Body, tt.status, tt.want)
+			}
+			if got := w.Header().Get("X-Query-Truncated"); got != tt.truncated {
+				t.Errorf("X-Query-Truncated = %q, want %q", got, tt.truncated)
+			}
+		})
+	}
+}
+
+// A saved result is stored whole, past the row cap, as a new file whose
+// lineage names the source and query.
+func TestQuerySave(t *testing.T) {
+	in := testIngest(t)
+	src := testRecord(t, in)
+	const sql = "SELECT UPPER(name) AS name FROM people"
+	body := `{"sql": "` + sql + `", "save": {"filename": "names.csv", "folder": "reports", "tags": ["q"]}}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/files/"+src.ID+"/query", strings.NewReader(body))
+	req.SetPathValue("id", src.ID)
+	w := httptest.NewRecorder()
+	QueryHandler(in, 0, time.Minute)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body)
+	}
+	var resp UploadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := in.Store.Get(context.Background(), resp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Filename != "names.csv" || rec.Folder != "reports" || rec.Lineage == nil ||
+		rec.Lineage.Operation != LineageQuery || rec.Lineage.Query != sql || len(rec.Lineage.Sources) != 1 || rec.Lineage.Sources[0] != src.ID {
+		t.Errorf("saved record %+v, lineage %+v", rec, rec.Lineage)
+	}
+	content, err := openBlob(rec, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if got, _ := io.ReadAll(content); string(got) != "name\nBOB\n" {
+		t.Errorf("saved content %q", got)
+	}
+}
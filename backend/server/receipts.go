@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Receipts signs upload receipts: compact JWS documents (RFC 7515) over the
+// file ID, checksum, size, block hash root and time of acceptance. They use Ed25519 (EdDSA,
+// RFC 8037) so anyone holding the public key from GET /v1/receipts/keys can
+// check them offline.
+type Receipts struct {
+	key ed25519.PrivateKey
+	kid string
+}
+
+// ReceiptClaims is the signed payload of a receipt.
+type ReceiptClaims struct {
+	ID        string `json:"id"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	ChunkRoot string `json:"chunkRoot,omitempty"` // Merkle root of the block hashes
+	IssuedAt  int64  `json:"iat"`
+}
+
+type receiptHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+const receiptType = "upload-receipt+jws"
+
+// NewReceipts loads the PKCS #8 PEM Ed25519 key at path, creating it when
+// the file does not exist yet. With no path it falls back to an ephemeral
+// key, which means receipts cannot be checked against the published key
+// after a restart.
+func NewReceipts(path string) (*Receipts, error) {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("UPLOAD_RECEIPT_KEY_FILE not set; using an ephemeral receipt key")
+		return newReceipts(key), nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, gerr := ed25519.GenerateKey(rand.Reader)
+		if gerr != nil {
+			return nil, gerr
+		}
+		der, merr := x509.MarshalPKCS8PrivateKey(key)
+		if merr != nil {
+			return nil, merr
+		}
+		out := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, out, 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("generated receipt key %s", path)
+		return newReceipts(key), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return newReceipts(key), nil
+}
+
+func newReceipts(key ed25519.PrivateKey) *Receipts {
+	return &Receipts{key: key, kid: receiptKeyID(key.Public().(ed25519.PublicKey))}
+}
+
+// receiptKeyID names a public key by the start of its SHA-256.
+func receiptKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Issue returns a receipt for rec. A nil *Receipts issues none.
+func (r *Receipts) Issue(rec *FileRecord) (string, error) {
+	if r == nil {
+		return "", nil
+	}
+	header, err := json.Marshal(receiptHeader{Alg: "EdDSA", Typ: receiptType, Kid: r.kid})
+	if err != nil {
+		return "", err
+	}
+	c := ReceiptClaims{ID: rec.ID, SHA256: rec.ChecksumSHA, Size: rec.Bytes, IssuedAt: rec.UploadedAt.Unix()}
+	if rec.Chunks != nil {
+		c.ChunkRoot = rec.Chunks.Root
+	}
+	claims, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64url(header) + "." + b64url(claims)
+	return signingInput + "." + b64url(ed25519.Sign(r.key, []byte(signingInput))), nil
+}
+
+// JWK is the public half of a receipt key in JSON Web Key form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (r *Receipts) jwks() JWKSet {
+	pub := r.key.Public().(ed25519.PublicKey)
+	return JWKSet{Keys: []JWK{{Kty: "OKP", Crv: "Ed25519", X: b64url(pub), Kid: r.kid, Alg: "EdDSA", Use: "sig"}}}
+}
+
+// KeysHandler serves the public receipt keys: GET /v1/receipts/keys.
+func (r *Receipts) KeysHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		writeJSON(w, http.StatusOK, r.jwks())
+	}
+}
+
+// VerifyReceipt checks receipt against the keys in set and returns its
+// claims. It needs nothing from the server beyond the key set.
+func VerifyReceipt(receipt string, set JWKSet) (*ReceiptClaims, error) {
+	parts := strings.Split(receipt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("receipt is not a compact JWS")
+	}
+	var header receiptHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("receipt header: %w", err)
+	}
+	if header.Alg != "EdDSA" || header.Typ != receiptType {
+		return nil, fmt.Errorf("unexpected receipt alg %q typ %q", header.Alg, header.Typ)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("receipt signature: %w", err)
+	}
+	for _, k := range set.Keys {
+		if k.Kid != header.Kid || k.Kty != "OKP" || k.Crv != "Ed25519" {
+			continue
+		}
+		pub, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s is malformed", k.Kid)
+		}
+		if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+			return nil, errors.New("receipt signature does not verify")
+		}
+		var claims ReceiptClaims
+		if err := decodeSegment(parts[1], &claims); err != nil {
+			return nil, fmt.Errorf("receipt claims: %w", err)
+		}
+		return &claims, nil
+	}
+	return nil, fmt.Errorf("no key %q in key set", header.Kid)
+}
+
+// Time returns when the receipt was issued.
+func (c *ReceiptClaims) Time() time.Time {
+	return time.Unix(c.IssuedAt, 0).UTC()
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hashFile returns the hex SHA-256 and size of the file at path.
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reconcileGrace is how old an unreferenced blob must be before it counts as
+// an orphan. Ingest publishes a blob before creating its record, so a young
+// blob may simply belong to an upload still committing.
+const reconcileGrace = time.Hour
+
+// ReconcileReport is the outcome of comparing storage with metadata.
+type ReconcileReport struct {
+	StartedAt       time.Time        `json:"startedAt"`
+	FinishedAt      time.Time        `json:"finishedAt"`
+	Records         int              `json:"records"`
+	Blobs           int              `json:"blobs"`
+	Repair          bool             `json:"repair"`
+	OrphanBlobs     []OrphanBlob     `json:"orphanBlobs"`
+	DanglingRecords []DanglingRecord `json:"danglingRecords"`
+}
+
+// OrphanBlob is a stored file no record refers to.
+type OrphanBlob struct {
+	Path       string    `json:"path"`
+	Bytes      int64     `json:"bytes"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	Removed    bool      `json:"removed,omitempty"`
+}
+
+// DanglingRecord is a record whose blob is gone.
+type DanglingRecord struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Marked bool   `json:"marked,omitempty"`
+}
+
+var (
+	reconcileOrphans  = metrics.Counter("upload_reconcile_orphan_blobs_total", "Unreferenced blobs found by reconciliation.")
+	reconcileDangling = metrics.Counter("upload_reconcile_dangling_records_total", "Records without a blob found by reconciliation.")
+)
+
+// Reconciler walks blob storage and the metadata store looking for blobs no
+// record refers to and records whose blob is missing. With repair it deletes
+// the orphans and marks the dangling records missing, quarantining them so
+// they are no longer offered for download.
+type Reconciler struct {
+	store      MetadataStore
+	locker     Locker
+	audit      *AuditLog
+	events     *EventRelay
+	archiveDir string
+}
+
+func NewReconciler(store MetadataStore, locker Locker, audit *AuditLog, events *EventRelay, archiveDir string) *Reconciler {
+	return &Reconciler{store: store, locker: locker, audit: audit, events: events, archiveDir: archiveDir}
+}
+
+// servingPath is the file that holds rec's content in its storage class.
+func servingPath(rec *FileRecord) string {
+	if rec.storageClass() == StorageCold {
+		return rec.ArchivePath
+	}
+	return rec.Path
+}
+
+func (c *Reconciler) Reconcile(ctx context.Context, repair bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{StartedAt: time.Now().UTC(), Repair: repair, OrphanBlobs: []OrphanBlob{}, DanglingRecords: []DanglingRecord{}}
+	recs, err := c.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Records = len(recs)
+
+	referenced := make(map[string]bool)
+	for _, rec := range recs {
+		for _, a := range rec.artifacts() {
+			referenced[filepath.Clean(a.Path)] = true
+		}
+		if rec.RestoreStatus == RestoreInProgress {
+			continue
+		}
+		path := servingPath(rec)
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		reconcileDangling.Inc()
+		d := DanglingRecord{ID: rec.ID, Path: path}
+		if repair {
+			d.Marked = c.markMissing(ctx, rec.ID)
+		}
+		report.DanglingRecords = append(report.DanglingRecords, d)
+	}
+
+	cutoff := time.Now().Add(-reconcileGrace)
+	for _, root := range []string{uploadDir, c.archiveDir} {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			report.Blobs++
+			// Temp files of in-flight writes are left to their writers.
+			if referenced[filepath.Clean(path)] || strings.HasSuffix(path, ".part") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				return nil
+			}
+			reconcileOrphans.Inc()
+			o := OrphanBlob{Path: path, Bytes: info.Size(), ModifiedAt: info.ModTime().UTC()}
+			if repair {
+				if err := os.Remove(path); err != nil {
+					log.Printf("reconcile: remove %s: %v", path, err)
+				} else {
+					o.Removed = true
+					c.audit.Record(AuditEvent{Action: "orphan_removed", Actor: "reconciler", Detail: path})
+				}
+			}
+			report.OrphanBlobs = append(report.OrphanBlobs, o)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.FinishedAt = time.Now().UTC()
+	return report, nil
+}
+
+// markMissing records that id's blob is gone, reloading the record so a
+// concurrent edit or restore is seen.
+func (c *Reconciler) markMissing(ctx context.Context, id string) bool {
+	missing, changed := false, false
+	rec, err := updateRecord(ctx, c.store, c.locker, id, func(rec *FileRecord) error {
+		if _, err := os.Stat(servingPath(rec)); !errors.Is(err, os.ErrNotExist) {
+			return errNoChange
+		}
+		missing = true
+		if rec.Integrity != nil && rec.Integrity.Status == IntegrityMissing && rec.state() == StateQuarantined {
+			return errNoChange
+		}
+		changed = true
+		rec.Integrity = &IntegrityCheck{Status: IntegrityMissing, CheckedAt: time.Now().UTC()}
+		if rec.state() != StateQuarantined {
+			if err := rec.quarantine("integrity", "blob missing"); err != nil {
+				log.Printf("reconcile: quarantine %s: %v", rec.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("reconcile: update %s: %v", id, err)
+		}
+		return false
+	}
+	if !changed {
+		return missing
+	}
+	c.audit.Record(AuditEvent{Action: "integrity_missing", FileID: rec.ID, Actor: "reconciler"})
+	c.events.Emit(EventFileUpdated, rec)
+	return true
+}
+
+// ReconcileHandler serves POST /v1/admin/reconcile, which runs a
+// reconciliation and returns its report. Nothing is changed unless
+// ?repair=true.
+func ReconcileHandler(c *Reconciler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repair := r.URL.Query().Get("repair") == "true"
+		if repair && maintenance.ReadOnly() {
+			writeReadOnly(w)
+			return
+		}
+		release, ok, err := c.locker.TryLock(r.Context(), "reconcile", 10*time.Minute)
+		if err != nil {
+			writeInternalError(w, "Failed to lock reconciliation")
+			return
+		}
+		if !ok {
+			writeConflict(w, "A reconciliation is already running")
+			return
+		}
+		defer release()
+
+		report, err := c.Reconcile(r.Context(), repair)
+		if err != nil {
+			log.Printf("reconcile: %v", err)
+			writeInternalError(w, "Reconciliation failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
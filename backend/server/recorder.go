@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RecordedRequest is what the request recorder keeps of one request: its
+// metadata with credentials redacted as in the access log, the response
+// status, and for error responses the error message sent. Client is a
+// fingerprint of the API key, so one client's requests can be picked out
+// without the key itself being stored.
+type RecordedRequest struct {
+	Time        time.Time         `json:"time"`
+	RequestID   string            `json:"requestId,omitempty"`
+	RemoteAddr  string            `json:"remoteAddr"`
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	Query       string            `json:"query,omitempty"`
+	Client      string            `json:"client,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	BytesIn     int64             `json:"bytesIn"`
+	Status      int               `json:"status"`
+	BytesOut    int64             `json:"bytesOut"`
+	Duration    time.Duration     `json:"durationNs"`
+	Error       string            `json:"error,omitempty"`
+	RespHeaders map[string]string `json:"responseHeaders,omitempty"`
+}
+
+// recordedResponseHeaders are the response headers worth seeing when a
+// client misbehaves.
+var recordedResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Range", "Location", "Retry-After", "ETag", "Cache-Control", "Upload-Offset"}
+
+// RequestRecorder keeps the last requests in a ring buffer for the admin
+// API, to debug a client integration without a packet capture. It is off
+// unless UPLOAD_REQUEST_RECORDING is set or an admin switches it on, and
+// each instance records only the requests it served. Admin API requests are
+// not recorded.
+type RequestRecorder struct {
+	on     atomic.Bool
+	redact map[string]bool
+
+	mu   sync.Mutex
+	ring []RecordedRequest
+	next int
+	full bool
+}
+
+func NewRequestRecorder(enabled bool, size int, extraRedact []string) *RequestRecorder {
+	rr := &RequestRecorder{redact: redactedHeaders(extraRedact), ring: make([]RecordedRequest, max(size, 1))}
+	rr.on.Store(enabled)
+	return rr
+}
+
+func (rr *RequestRecorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rr.on.Load() || strings.HasPrefix(r.URL.Path, "/v1/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rw := &recordingWriter{accessLogWriter: accessLogWriter{ResponseWriter: w}}
+		next.ServeHTTP(rw, r)
+
+		e := RecordedRequest{
+			Time:       start,
+			RequestID:  requestID(r),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      redactQuery(r.URL),
+			Client:     clientFingerprint(r.Header.Get("X-API-Key")),
+			Headers:    redactHeaders(r.Header, rr.redact),
+			BytesIn:    r.ContentLength,
+			Status:     rw.status,
+			BytesOut:   rw.bytes,
+			Duration:   time.Since(start),
+		}
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if e.Status >= 400 {
+			e.Error = errorMessage(rw.body)
+		}
+		for _, h := range recordedResponseHeaders {
+			if v := w.Header().Get(h); v != "" {
+				if e.RespHeaders == nil {
+					e.RespHeaders = map[string]string{}
+				}
+				e.RespHeaders[h] = v
+			}
+		}
+		rr.add(e)
+	})
+}
+
+func clientFingerprint(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:6])
+}
+
+// errorMessage extracts the message of an ErrorResponse body, or returns
+// the start of any other body.
+func errorMessage(body []byte) string {
+	var resp ErrorResponse
+	if json.Unmarshal(body, &resp) == nil && resp.Message != "" {
+		return resp.Message
+	}
+	return strings.ToValidUTF8(string(body), "")
+}
+
+func (rr *RequestRecorder) add(e RecordedRequest) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.ring[rr.next] = e
+	rr.next = (rr.next + 1) % len(rr.ring)
+	if rr.next == 0 {
+		rr.full = true
+	}
+}
+
+// recent returns the recorded requests, newest first.
+func (rr *RequestRecorder) recent() []RecordedRequest {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	n := rr.next
+	if rr.full {
+		n = len(rr.ring)
+	}
+	out := make([]RecordedRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, rr.ring[(rr.next-i+len(rr.ring))%len(rr.ring)])
+	}
+	return out
+}
+
+// Handler serves /v1/admin/requests. GET lists the recorded requests,
+// newest first, optionally filtered by ?status= (a code such as 413 or a
+// class such as 4xx), ?path= (a prefix), ?client=, ?requestId= and capped
+// by ?limit=. PUT {"enabled": bool} switches recording on or off, and
+// DELETE empties the buffer.
+func (rr *RequestRecorder) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			limit := len(rr.ring)
+			if v := q.Get("limit"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n <= 0 {
+					writeBadRequest(w, "Query parameter 'limit' must be a positive integer")
+					return
+				}
+				limit = n
+			}
+			status := q.Get("status")
+			if status != "" && !validStatusFilter(status) {
+				writeBadRequest(w, "Query parameter 'status' must be a status code or class such as 4xx")
+				return
+			}
+			out := []RecordedRequest{}
+			for _, e := range rr.recent() {
+				if len(out) == limit {
+					break
+				}
+				if status != "" && !statusMatches(status, e.Status) ||
+					!strings.HasPrefix(e.Path, q.Get("path")) ||
+					q.Get("client") != "" && e.Client != q.Get("client") ||
+					q.Get("requestId") != "" && e.RequestID != q.Get("requestId") {
+					continue
+				}
+				out = append(out, e)
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"enabled": rr.on.Load(), "capacity": len(rr.ring), "requests": out})
+
+		case http.MethodPut:
+			var body struct {
+				Enabled *bool `json:"enabled"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&body); err != nil || body.Enabled == nil {
+				writeBadRequest(w, "Body must be {\"enabled\": true|false}")
+				return
+			}
+			rr.on.Store(*body.Enabled)
+			writeJSON(w, http.StatusOK, map[string]any{"enabled": *body.Enabled, "capacity": len(rr.ring)})
+
+		case http.MethodDelete:
+			rr.mu.Lock()
+			clear(rr.ring)
+			rr.next, rr.full = 0, false
+			rr.mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeMethodNotAllowed(w, "Only GET, PUT and DELETE methods are allowed for recorded requests")
+		}
+	}
+}
+
+func validStatusFilter(f string) bool {
+	if len(f) != 3 {
+		return false
+	}
+	if strings.HasSuffix(f, "xx") {
+		return f[0] >= '1' && f[0] <= '5'
+	}
+	_, err := strconv.Atoi(f)
+	return err == nil
+}
+
+func statusMatches(f string, status int) bool {
+	if strings.HasSuffix(f, "xx") {
+		return status/100 == int(f[0]-'0')
+	}
+	return strconv.Itoa(status) == f
+}
+
+// recordingWriter also keeps the start of error response bodies.
+type recordingWriter struct {
+	accessLogWriter
+	body []byte
+}
+
+const recordedErrorBytes = 1 << 10
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	n, err := rw.accessLogWriter.Write(p)
+	if rw.status >= 400 && len(rw.body) < recordedErrorBytes {
+		rw.body = append(rw.body, p[:min(n, recordedErrorBytes-len(rw.body))]...)
+	}
+	return n, err
+}
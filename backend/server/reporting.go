@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// ErrorReport describes a panic or a 5xx response together with the request
+// that produced it.
+type ErrorReport struct {
+	Time        time.Time `json:"time"`
+	Level       string    `json:"level"`
+	Message     string    `json:"message"`
+	Stack       string    `json:"stack,omitempty"`
+	Method      string    `json:"method"`
+	Route       string    `json:"route"`
+	RequestID   string    `json:"requestId"`
+	Status      int       `json:"status"`
+	UploadBytes int64     `json:"uploadBytes"`
+}
+
+// ErrorReporter forwards reports to an external service. Report must not
+// block the request; implementations deliver in the background.
+type ErrorReporter interface {
+	Report(rep ErrorReport)
+}
+
+// NewErrorReporter returns a reporter for whichever of Sentry and a generic
+// webhook are configured, or nil when neither is.
+func NewErrorReporter(sentryDSN string, webhookURL *Secret) (ErrorReporter, error) {
+	var rs multiReporter
+	if sentryDSN != "" {
+		s, err := newSentryReporter(sentryDSN)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, s)
+	}
+	if webhookURL.Value() != "" {
+		rs = append(rs, &webhookReporter{url: webhookURL})
+	}
+	if len(rs) == 0 {
+		return nil, nil
+	}
+	return rs, nil
+}
+
+type multiReporter []ErrorReporter
+
+func (m multiReporter) Report(rep ErrorReport) {
+	for _, r := range m {
+		r.Report(rep)
+	}
+}
+
+var reportClient = &http.Client{Timeout: 5 * time.Second}
+
+func postReport(url string, header http.Header, body any) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := reportClient.Do(req)
+		if err != nil {
+			log.Printf("error report to %s failed: %v", req.URL.Host, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("error report to %s failed: %s", req.URL.Host, resp.Status)
+		}
+	}()
+}
+
+// webhookReporter POSTs each ErrorReport as JSON.
+type webhookReporter struct {
+	url *Secret
+}
+
+func (w *webhookReporter) Report(rep ErrorReport) {
+	postReport(w.url.Value(), nil, rep)
+}
+
+// sentryReporter sends events to Sentry's store endpoint using the key and
+// project parsed from a DSN (https://<key>@<host>/<project>).
+type sentryReporter struct {
+	storeURL string
+	auth     string
+}
+
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, errors.New("invalid Sentry DSN")
+	}
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	prefix, project := "", path
+	if i >= 0 {
+		prefix, project = "/"+path[:i], path[i+1:]
+	}
+	if project == "" {
+		return nil, errors.New("invalid Sentry DSN: missing project ID")
+	}
+	return &sentryReporter{
+		storeURL: fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		auth:     "Sentry sentry_version=7, sentry_client=file-upload/1.0, sentry_key=" + u.User.Username(),
+	}, nil
+}
+
+func (s *sentryReporter) Report(rep ErrorReport) {
+	eventID, err := randomHex(16)
+	if err != nil {
+		return
+	}
+	level := "error"
+	if rep.Level == "panic" {
+		level = "fatal"
+	}
+	event := map[string]any{
+		"event_id":  eventID,
+		"timestamp": rep.Time.UTC().Format(time.RFC3339),
+		"level":     level,
+		"platform":  "go",
+		"logger":    "file-upload",
+		"message":   rep.Message,
+		"tags": map[string]string{
+			"route":      rep.Route,
+			"method":     rep.Method,
+			"request_id": rep.RequestID,
+			"status":     fmt.Sprint(rep.Status),
+		},
+		"extra": map[string]any{
+			"upload_bytes": rep.UploadBytes,
+			"stack":        rep.Stack,
+		},
+	}
+	postReport(s.storeURL, http.Header{"X-Sentry-Auth": {s.auth}}, event)
+}
+
+// Recover turns panics into a JSON 500 instead of a dropped connection and
+// reports panics and 5xx responses to reporter, which may be nil. Reports
+// carry the ID assigned by the RequestID middleware.
+func Recover(reporter ErrorReporter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID := requestID(r)
+		rw := &recoverWriter{ResponseWriter: w}
+
+		report := func(level, msg, stack string, status int) {
+			if reporter == nil {
+				return
+			}
+			reporter.Report(ErrorReport{
+				Time:        time.Now(),
+				Level:       level,
+				Message:     msg,
+				Stack:       stack,
+				Method:      r.Method,
+				Route:       r.URL.Path,
+				RequestID:   reqID,
+				Status:      status,
+				UploadBytes: r.ContentLength,
+			})
+		}
+
+		defer func() {
+			p := recover()
+			if p == nil {
+				if rw.status >= 500 {
+					report("error", rw.errorMessage(), "", rw.status)
+				}
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			stack := string(debug.Stack())
+			log.Printf("panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, reqID, p, stack)
+			report("panic", fmt.Sprint(p), stack, http.StatusInternalServerError)
+			if !rw.wroteHeader {
+				writeInternalError(rw, "Internal server error (request "+reqID+")")
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// recoverWriter tracks whether a response has started and keeps the start
+// of 5xx bodies so the report can carry the error message.
+type recoverWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        []byte
+}
+
+func (rw *recoverWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status, rw.wroteHeader = status, true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recoverWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.status, rw.wroteHeader = http.StatusOK, true
+	}
+	if rw.status >= 500 && len(rw.body) < 4096 {
+		rw.body = append(rw.body, p[:min(len(p), 4096-len(rw.body))]...)
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *recoverWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *recoverWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *recoverWriter) errorMessage() string {
+	var er ErrorResponse
+	if json.Unmarshal(rw.body, &er) == nil && er.Message != "" {
+		return er.Message
+	}
+	return http.StatusText(rw.status)
+}
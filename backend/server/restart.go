@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// inheritedFDsEnv tells a process started by restart which listener
+// descriptors it was handed, as a comma-separated count per endpoint. They
+// start at fd 3 and are followed by the write end of a pipe used to report
+// readiness back to the old process.
+const inheritedFDsEnv = "UPLOAD_INHERITED_FDS"
+
+var (
+	// inherited holds the listener groups passed by restart that Listen
+	// has not claimed yet, in endpoint order.
+	inherited     [][]net.Listener
+	inheritedOnce sync.Once
+	inheritedErr  error
+
+	// readyPipe is set in a process started by restart until notifyParent
+	// has reported that it is serving.
+	readyPipe *os.File
+)
+
+// restarted reports whether this process is taking over from an older one
+// that may still be draining requests.
+func restarted() bool {
+	return os.Getenv(inheritedFDsEnv) != "" || readyPipe != nil
+}
+
+// inheritedListeners returns the next endpoint's listeners passed by
+// restart, or nil when the process was started normally.
+func inheritedListeners() ([]net.Listener, error) {
+	inheritedOnce.Do(func() {
+		inherited, inheritedErr = loadInherited()
+	})
+	if inheritedErr != nil || len(inherited) == 0 {
+		return nil, inheritedErr
+	}
+	ls := inherited[0]
+	inherited = inherited[1:]
+	return ls, nil
+}
+
+func loadInherited() ([][]net.Listener, error) {
+	v := os.Getenv(inheritedFDsEnv)
+	if v == "" {
+		return nil, nil
+	}
+	os.Unsetenv(inheritedFDsEnv)
+	fd := listenFDsStart
+	var groups [][]net.Listener
+	for _, c := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(c)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", inheritedFDsEnv, v)
+		}
+		group := make([]net.Listener, 0, n)
+		for i := 0; i < n; i++ {
+			f := os.NewFile(uintptr(fd), "inherited-"+strconv.Itoa(fd))
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("inherited listener fd %d: %w", fd, err)
+			}
+			group = append(group, l)
+			fd++
+		}
+		groups = append(groups, group)
+	}
+	readyPipe = os.NewFile(uintptr(fd), "ready")
+	return groups, nil
+}
+
+// notifyParent tells the process that started this one that it can stop
+// accepting connections.
+func notifyParent() {
+	if readyPipe == nil {
+		return
+	}
+	_, _ = readyPipe.Write([]byte{1})
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// restart starts a new copy of the running binary on the same listeners and
+// waits until it is serving. The listening sockets are shared, so no
+// connection is refused while the two processes overlap.
+func restart(endpoints []*Endpoint, timeout time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	counts := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		for _, l := range e.Listeners {
+			fl, ok := l.(interface{ File() (*os.File, error) })
+			if !ok {
+				readyW.Close()
+				return fmt.Errorf("listener %s cannot be passed to a new process", l.Addr())
+			}
+			f, err := fl.File()
+			if err != nil {
+				readyW.Close()
+				return err
+			}
+			files = append(files, f)
+		}
+		counts = append(counts, strconv.Itoa(len(e.Listeners)))
+	}
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), inheritedFDsEnv+"="+strings.Join(counts, ","))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Drop our copy of the write end so a child that dies before reporting
+	// readiness shows up as EOF.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := ready.Read(b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			_ = cmd.Wait()
+			return fmt.Errorf("new process exited before it was ready: %w", err)
+		}
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return errors.New("new process did not become ready in time")
+	}
+	go func() { _ = cmd.Process.Release() }()
+	return nil
+}
+
+// Endpoint is one HTTP server and the listeners it accepts on. The public
+// API and the admin API run as separate endpoints so each can be bound,
+// secured and firewalled on its own.
+type Endpoint struct {
+	Name      string
+	Server    *http.Server
+	Listeners []net.Listener
+	TLSCert   string
+	TLSKey    string
+}
+
+func (e *Endpoint) serve(l net.Listener) error {
+	if e.TLSCert != "" {
+		return e.Server.ServeTLS(l, e.TLSCert, e.TLSKey)
+	}
+	return e.Server.Serve(l)
+}
+
+// runServers serves every endpoint until the process is told to stop.
+// SIGTERM and interrupt drain in-flight requests for up to drain and return.
+// The restart signal (SIGUSR2 where supported) first hands the listeners to a
+// new copy of the binary, so a deploy does not interrupt large transfers.
+func runServers(endpoints []*Endpoint, drain time.Duration) error {
+	errc := make(chan error, 1)
+	for _, e := range endpoints {
+		for _, l := range e.Listeners {
+			log.Printf("%s listening on %s %s", e.Name, l.Addr().Network(), l.Addr())
+			go func(e *Endpoint, l net.Listener) {
+				if err := e.serve(l); !errors.Is(err, http.ErrServerClosed) {
+					select {
+					case errc <- fmt.Errorf("%s: %w", e.Name, err):
+					default:
+					}
+				}
+			}(e, l)
+		}
+	}
+	notifyParent()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append(restartSignals, os.Interrupt, syscall.SIGTERM)...)
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case sig := <-sigs:
+			if isRestartSignal(sig) {
+				if err := restart(endpoints, 30*time.Second); err != nil {
+					log.Printf("restart failed, still serving: %v", err)
+					continue
+				}
+				// The successor owns the socket files now.
+				for _, e := range endpoints {
+					for _, l := range e.Listeners {
+						if ul, ok := l.(*net.UnixListener); ok {
+							ul.SetUnlinkOnClose(false)
+						}
+					}
+				}
+				log.Printf("restart: new process is serving; draining in-flight requests")
+			} else {
+				log.Printf("received %v; draining in-flight requests", sig)
+			}
+			return shutdown(endpoints, drain)
+		}
+	}
+}
+
+// shutdown drains all endpoints concurrently, closing any that are still
+// busy once drain has passed.
+func shutdown(endpoints []*Endpoint, drain time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.Server.Shutdown(ctx); err != nil {
+				log.Printf("%s: drain incomplete after %s: %v", e.Name, drain, err)
+				errs[i] = e.Server.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func isRestartSignal(sig os.Signal) bool {
+	for _, s := range restartSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
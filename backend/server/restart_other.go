@@ -0,0 +1,9 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// restartSignals is empty where listener descriptors cannot be inherited;
+// the process only supports a plain drain-and-exit.
+var restartSignals []os.Signal
@@ -0,0 +1,529 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Bucket is the bucket direct uploads are staged in, under Prefix.
+// Requests are signed with the credentials awsCall uses; with
+// AWS_ENDPOINT_URL_S3 set the bucket is addressed path-style on that
+// endpoint, as S3-compatible services expect.
+type S3Bucket struct {
+	Name   string
+	Prefix string
+}
+
+// s3Client has no overall timeout: finalizing streams whole objects.
+var s3Client = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: 30 * time.Second,
+}}
+
+// baseURL is the URL of the bucket itself, which presigned POSTs go to.
+func (b *S3Bucket) baseURL(region string) (*url.URL, error) {
+	if ep := awsEndpoint("s3"); ep != "" {
+		u, err := url.Parse(strings.TrimSuffix(ep, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("AWS_ENDPOINT_URL_S3: %w", err)
+		}
+		u.Path += "/" + b.Name + "/"
+		return u, nil
+	}
+	return &url.URL{Scheme: "https", Host: b.Name + ".s3." + region + ".amazonaws.com", Path: "/"}, nil
+}
+
+func (b *S3Bucket) objectURL(region, key string) (*url.URL, error) {
+	u, err := b.baseURL(region)
+	if err != nil {
+		return nil, err
+	}
+	u.Path += key
+	return u, nil
+}
+
+// PresignPut returns a URL a client can PUT exactly size bytes to as key
+// until ttl passes, without credentials of its own.
+func (b *S3Bucket) PresignPut(key string, size int64, ttl time.Duration, now time.Time) (string, error) {
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return "", err
+	}
+	u, err := b.objectURL(creds.Region, key)
+	if err != nil {
+		return "", err
+	}
+	return presignSigV4(http.MethodPut, u, map[string]string{"content-length": strconv.FormatInt(size, 10)}, "s3", creds, ttl, now), nil
+}
+
+// PresignPost returns the URL and form fields of a browser POST upload of
+// exactly size bytes to key, valid until ttl passes. The file goes in a
+// "file" field after these.
+func (b *S3Bucket) PresignPost(key string, size int64, ttl time.Duration, now time.Time) (string, map[string]string, error) {
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return "", nil, err
+	}
+	u, err := b.baseURL(creds.Region)
+	if err != nil {
+		return "", nil, err
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + creds.Region + "/s3/aws4_request"
+	fields := map[string]string{
+		"key":              key,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": creds.KeyID + "/" + scope,
+		"x-amz-date":       amzDate,
+	}
+	if creds.Token != "" {
+		fields["x-amz-security-token"] = creds.Token
+	}
+	conditions := []any{
+		map[string]string{"bucket": b.Name},
+		[]any{"content-length-range", size, size},
+	}
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		conditions = append(conditions, map[string]string{k: fields[k]})
+	}
+	policy, err := json.Marshal(map[string]any{
+		"expiration": now.Add(ttl).UTC().Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(sigV4Key(creds.Secret, amzDate[:8], creds.Region, "s3"), fields["policy"]))
+	return u.String(), fields, nil
+}
+
+// do sends a request for key signed the same way as PresignPut, so the
+// server needs no other signing path.
+func (b *S3Bucket) do(ctx context.Context, method, key string) (*http.Response, error) {
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	u, err := b.objectURL(creds.Region, key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, presignSigV4(method, u, nil, "s3", creds, 5*time.Minute, time.Now()), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s3Client.Do(req)
+}
+
+var errObjectNotFound = errors.New("object not found")
+
+// Stat returns the size of the object at key.
+func (b *S3Bucket) Stat(ctx context.Context, key string) (int64, error) {
+	resp, err := b.do(ctx, http.MethodHead, key)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, errObjectNotFound
+	default:
+		return 0, fmt.Errorf("HEAD %s: %s", key, resp.Status)
+	}
+}
+
+// Open streams the object at key.
+func (b *S3Bucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, http.MethodGet, key)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errObjectNotFound
+		}
+		return nil, fmt.Errorf("GET %s: %s: %s", key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object at key; a missing object is not an error.
+func (b *S3Bucket) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("DELETE %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// presignSigV4 returns u with SigV4 query-string authentication for method
+// valid for ttl from now. The host and headers are signed, so the request
+// must send those headers with exactly these values; the payload is not.
+func presignSigV4(method string, u *url.URL, headers map[string]string, service string, creds awsCredentials, ttl time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + creds.Region + "/" + service + "/aws4_request"
+	signed := map[string]string{"host": u.Host}
+	for k, v := range headers {
+		signed[strings.ToLower(k)] = v
+	}
+	names := slices.Sorted(maps.Keys(signed))
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(signed[k]) + "\n")
+	}
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", creds.KeyID+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	q.Set("X-Amz-SignedHeaders", strings.Join(names, ";"))
+	if creds.Token != "" {
+		q.Set("X-Amz-Security-Token", creds.Token)
+	}
+	path := awsURIEncode(u.Path, false)
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{method, path, awsCanonicalQuery(q), canonHeaders.String(), strings.Join(names, ";"), "UNSIGNED-PAYLOAD"}, "\n")
+	crHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+	q.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(sigV4Key(creds.Secret, amzDate[:8], creds.Region, service), toSign)))
+	return u.Scheme + "://" + u.Host + path + "?" + awsCanonicalQuery(q)
+}
+
+// awsCanonicalQuery sorts and encodes q as SigV4 requires.
+func awsCanonicalQuery(q url.Values) string {
+	var parts []string
+	for _, k := range slices.Sorted(maps.Keys(q)) {
+		for _, v := range q[k] {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, and
+// '/' too when encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+var ErrDirectUploadNotFound = errors.New("direct upload not found")
+
+// directFinalizeGrace is how long after its URLs expire an upload can
+// still be finalized before the reaper discards it.
+const directFinalizeGrace = time.Hour
+
+// DirectUpload is a file a client is sending straight to the S3 bucket. It
+// becomes a stored file when the client finalizes it. ExpiresAt is when its
+// presigned URLs stop working.
+type DirectUpload struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	ObjectKey string    `json:"objectKey"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum,omitempty"`
+	MaxBytes  int64     `json:"maxBytes"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type DirectUploadStore interface {
+	GetDirectUpload(ctx context.Context, id string) (*DirectUpload, error)
+	PutDirectUpload(ctx context.Context, du *DirectUpload) error
+	DeleteDirectUpload(ctx context.Context, id string) error
+	ListDirectUploads(ctx context.Context) ([]*DirectUpload, error)
+}
+
+// DirectUploads brokers uploads that go from the client to the S3 bucket
+// without passing through this server: POST /v1/uploads/direct hands out a
+// presigned PUT and POST for the file, and POST
+// /v1/uploads/direct/{id}/complete finalizes it. Finalizing checks the
+// object's size, then reads it once from the bucket through the same
+// validation, checks and metadata as any upload; the staged object is
+// deleted afterwards.
+//
+// The client's upload skips this server, but finalizing does not: stored
+// files live on this server's storage, which has no S3 backend to record a
+// file as kept in the bucket, and validation reads every row. Verifying
+// the object in place, from its HEAD size and the checksum S3 reports, is
+// out of scope until blobs can be stored in a bucket.
+type DirectUploads struct {
+	ingest *Ingest
+	store  DirectUploadStore
+	locker Locker
+	bucket *S3Bucket
+	ttl    time.Duration
+}
+
+func NewDirectUploads(ingest *Ingest, store DirectUploadStore, locker Locker, bucket *S3Bucket, ttl time.Duration) *DirectUploads {
+	return &DirectUploads{ingest: ingest, store: store, locker: locker, bucket: bucket, ttl: ttl}
+}
+
+type createDirectUploadRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// DirectUploadResponse tells the client where to send the file: PUT the
+// bytes to Put.URL with Put.Headers, or POST Post.Fields followed by the
+// file as a "file" field to Post.URL, then finalize at Complete.
+type DirectUploadResponse struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Put       struct {
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+	} `json:"put"`
+	Post struct {
+		URL    string            `json:"url"`
+		Fields map[string]string `json:"fields"`
+	} `json:"post"`
+	Complete string `json:"complete"`
+}
+
+// CreateHandler serves POST /v1/uploads/direct with a JSON body naming the
+// file and its size in bytes, and optionally its hex SHA-256, which the
+// file is held to when finalized.
+func (d *DirectUploads) CreateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := d.ingest.Limits.For(r)
+		var req createDirectUploadRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeBadRequest(w, "Invalid JSON body")
+			return
+		}
+		if req.Filename == "" {
+			writeBadRequest(w, "Field 'filename' is required")
+			return
+		}
+		filename, msg := sanitizeFilename(req.Filename)
+		if msg.Text != "" {
+			writeMessage(w, http.StatusBadRequest, "bad_request", msg)
+			return
+		}
+		ext := strings.ToLower(filepath.Ext(filename))
+		if !allowedExtension(ext) {
+			writeMessage(w, http.StatusUnsupportedMediaType, "unsupported_media_type", newMessage("unsupported_file_type", "ext", ext))
+			return
+		}
+		if req.Size <= 0 {
+			writeBadRequest(w, "Field 'size' must be a positive number of bytes")
+			return
+		}
+		if req.Size > limit {
+			writeFileTooLarge(w, limit)
+			return
+		}
+		if req.Checksum != "" {
+			sum, ok := parseChecksum(req.Checksum)
+			if !ok {
+				writeBadRequest(w, "Field 'checksum' must be a hex SHA-256 digest")
+				return
+			}
+			req.Checksum = sum
+		}
+		// The file is copied to this server's storage when finalized.
+		if !checkDiskSpace(w, req.Size) {
+			return
+		}
+
+		id, err := d.ingest.IDs.NewID()
+		if err != nil {
+			writeInternalError(w, "Failed to generate upload ID")
+			return
+		}
+		now := time.Now().UTC()
+		du := &DirectUpload{
+			ID:        id,
+			Filename:  filename,
+			ObjectKey: d.bucket.Prefix + id + ext,
+			Size:      req.Size,
+			Checksum:  req.Checksum,
+			MaxBytes:  limit,
+			CreatedAt: now,
+			ExpiresAt: now.Add(d.ttl),
+		}
+		var resp DirectUploadResponse
+		resp.ID, resp.Filename, resp.Size, resp.ExpiresAt = du.ID, du.Filename, du.Size, du.ExpiresAt
+		resp.Put.Method = http.MethodPut
+		resp.Put.Headers = map[string]string{"Content-Length": strconv.FormatInt(du.Size, 10)}
+		if resp.Put.URL, err = d.bucket.PresignPut(du.ObjectKey, du.Size, d.ttl, now); err == nil {
+			resp.Post.URL, resp.Post.Fields, err = d.bucket.PresignPost(du.ObjectKey, du.Size, d.ttl, now)
+		}
+		if err != nil {
+			log.Printf("direct uploads: presign %s: %v", du.ObjectKey, err)
+			writeInternalError(w, "Failed to sign upload URLs")
+			return
+		}
+		resp.Complete = "/v1/uploads/direct/" + id + "/complete"
+		if err := d.store.PutDirectUpload(r.Context(), du); err != nil {
+			writeInternalError(w, "Failed to save upload")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
+
+// CompleteHandler serves POST /v1/uploads/direct/{id}/complete, storing
+// the uploaded object as a file. A file that fails validation is rejected
+// for good and its object deleted; when the object is missing or the
+// failure is on the server's side the upload can be finalized again.
+func (d *DirectUploads) CompleteHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		release, ok, err := d.locker.TryLock(r.Context(), "direct:"+id, time.Minute)
+		if err != nil {
+			writeInternalError(w, "Failed to lock upload")
+			return
+		}
+		if !ok {
+			writeConflict(w, "Upload '"+id+"' is already being finalized")
+			return
+		}
+		defer release()
+
+		du, err := d.store.GetDirectUpload(r.Context(), id)
+		if errors.Is(err, ErrDirectUploadNotFound) {
+			writeNotFound(w, "Upload '"+id+"' not found")
+			return
+		}
+		if err != nil {
+			writeInternalError(w, "Failed to load upload")
+			return
+		}
+		if time.Now().After(du.ExpiresAt.Add(directFinalizeGrace)) {
+			writeNotFound(w, "Upload '"+id+"' has expired")
+			return
+		}
+		size, err := d.bucket.Stat(r.Context(), du.ObjectKey)
+		if errors.Is(err, errObjectNotFound) {
+			writeConflict(w, "Upload '"+id+"' has not been sent to the bucket yet")
+			return
+		}
+		if err != nil {
+			log.Printf("direct uploads: stat %s: %v", du.ObjectKey, err)
+			writeError(w, http.StatusBadGateway, "bad_gateway", "Failed to reach the upload bucket")
+			return
+		}
+		if size != du.Size {
+			d.discard(r.Context(), du)
+			writeUploadError(w, newUploadErrorMessage(http.StatusBadRequest, "size_mismatch", newMessage("size_mismatch",
+				"declared", strconv.FormatInt(du.Size, 10), "received", strconv.FormatInt(size, 10))))
+			return
+		}
+		uploadDeadline.apply(w, size)
+		body, err := d.bucket.Open(r.Context(), du.ObjectKey)
+		if err != nil {
+			log.Printf("direct uploads: open %s: %v", du.ObjectKey, err)
+			writeError(w, http.StatusBadGateway, "bad_gateway", "Failed to read the uploaded file from the bucket")
+			return
+		}
+		defer body.Close()
+		meta := UploadMeta{
+			MaxBytes:     du.MaxBytes,
+			Checksum:     du.Checksum,
+			DeclaredSize: du.Size,
+			NotifyEmail:  notifyAddress(r),
+			Source:       "s3://" + d.bucket.Name + "/" + du.ObjectKey,
+		}
+		rec, uerr := d.ingest.Receive(r.Context(), &limitFile{r: body, n: du.MaxBytes}, du.Filename, meta)
+		if uerr != nil {
+			if uerr.Status < 500 {
+				d.discard(r.Context(), du)
+			}
+			writeUploadError(w, uerr)
+			return
+		}
+		d.discard(context.WithoutCancel(r.Context()), du)
+		writeJSON(w, http.StatusOK, newUploadResponse(rec))
+	}
+}
+
+// discard deletes du's object and record, logging rather than failing: an
+// object left behind is also removed by the reaper or a bucket lifecycle
+// rule on the prefix.
+func (d *DirectUploads) discard(ctx context.Context, du *DirectUpload) {
+	if err := d.bucket.Delete(ctx, du.ObjectKey); err != nil {
+		log.Printf("direct uploads: delete %s: %v", du.ObjectKey, err)
+		return
+	}
+	if err := d.store.DeleteDirectUpload(ctx, du.ID); err != nil && !errors.Is(err, ErrDirectUploadNotFound) {
+		log.Printf("direct uploads: delete %s: %v", du.ID, err)
+	}
+}
+
+// Reap discards uploads that were never finalized every interval, once
+// they can no longer be.
+func (d *DirectUploads) Reap(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			runExclusive(ctx, d.locker, "direct-upload-reaper", d.reapExpired)
+		}
+	}
+}
+
+func (d *DirectUploads) reapExpired(ctx context.Context) {
+	if maintenance.ReadOnly() {
+		return
+	}
+	uploads, err := d.store.ListDirectUploads(ctx)
+	if err != nil {
+		log.Printf("direct uploads: list: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, du := range uploads {
+		if now.Before(du.ExpiresAt.Add(directFinalizeGrace)) {
+			continue
+		}
+		d.discard(ctx, du)
+	}
+}
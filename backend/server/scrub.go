@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	IntegrityOK        = "ok"
+	IntegrityCorrupted = "corrupted"
+	IntegrityMissing   = "missing"
+)
+
+// IntegrityCheck is the outcome of the last scrub. For files with block
+// hashes, BadBlocks lists the chunkHashBlock-sized blocks that no longer
+// match, so a corrupted blob can be repaired region by region.
+type IntegrityCheck struct {
+	Status    string    `json:"status"`
+	CheckedAt time.Time `json:"checkedAt"`
+	BadBlocks []int     `json:"badBlocks,omitempty"`
+}
+
+type ScrubStatus struct {
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Total      int        `json:"total"`
+	Checked    int        `json:"checked"`
+	Corrupted  int        `json:"corrupted"`
+	Missing    int        `json:"missing"`
+}
+
+var (
+	scrubChecked   = metrics.Counter("upload_scrub_checked_total", "Blobs re-hashed by the integrity scrubber.")
+	scrubCorrupted = metrics.Counter("upload_scrub_corrupted_total", "Blobs whose checksum did not match metadata.")
+	scrubMissing   = metrics.Counter("upload_scrub_missing_total", "Records whose blob could not be found.")
+	scrubProgress  = metrics.Gauge("upload_scrub_progress_ratio", "Fraction of records checked in the current scrub run.")
+)
+
+// Scrubber periodically re-reads every stored blob and compares its SHA-256
+// with the value recorded at upload time.
+type Scrubber struct {
+	store      MetadataStore
+	locker     Locker
+	audit      *AuditLog
+	quarantine bool
+
+	mu     sync.Mutex
+	status ScrubStatus
+}
+
+func NewScrubber(store MetadataStore, locker Locker, audit *AuditLog, quarantine bool) *Scrubber {
+	return &Scrubber{store: store, locker: locker, audit: audit, quarantine: quarantine}
+}
+
+func (s *Scrubber) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			runExclusive(ctx, s.locker, "scrub", s.scrub)
+		}
+	}
+}
+
+func (s *Scrubber) Status() ScrubStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *Scrubber) scrub(ctx context.Context) {
+	if maintenance.ReadOnly() {
+		return
+	}
+	recs, err := s.store.List(ctx)
+	if err != nil {
+		log.Printf("scrub: list records: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	if s.status.Running {
+		s.mu.Unlock()
+		return
+	}
+	started := time.Now().UTC()
+	s.status = ScrubStatus{Running: true, StartedAt: &started, Total: len(recs)}
+	s.mu.Unlock()
+	scrubProgress.Set(0)
+
+	for _, rec := range recs {
+		if rec.RestoreStatus == RestoreInProgress || rec.Encryption.customer() {
+			continue
+		}
+		status := s.check(ctx, rec)
+
+		s.mu.Lock()
+		s.status.Checked++
+		switch status {
+		case IntegrityCorrupted:
+			s.status.Corrupted++
+		case IntegrityMissing:
+			s.status.Missing++
+		}
+		scrubProgress.Set(float64(s.status.Checked) / float64(s.status.Total))
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	s.status.Running = false
+	finished := time.Now().UTC()
+	s.status.FinishedAt = &finished
+	s.mu.Unlock()
+}
+
+func (s *Scrubber) check(ctx context.Context, rec *FileRecord) string {
+	scrubChecked.Inc()
+	status := IntegrityOK
+	sum, chunks, err := hashBlob(rec)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		status = IntegrityMissing
+		scrubMissing.Inc()
+	case err != nil:
+		log.Printf("scrub: read %s: %v", rec.ID, err)
+		return ""
+	case sum != rec.ChecksumSHA:
+		status = IntegrityCorrupted
+		scrubCorrupted.Inc()
+	}
+
+	// Hashing can take a while; the update applies to the record as it is
+	// now, so edits made meanwhile are kept.
+	var prev *IntegrityCheck
+	var detail string
+	_, err = updateRecord(ctx, s.store, s.locker, rec.ID, func(rec *FileRecord) error {
+		prev = rec.Integrity
+		rec.Integrity = &IntegrityCheck{Status: status, CheckedAt: time.Now().UTC()}
+		if status == IntegrityCorrupted && rec.Chunks != nil {
+			rec.Integrity.BadBlocks = badBlocks(rec.Chunks, chunks)
+			detail = fmt.Sprintf("blocks %v of %d bytes differ", rec.Integrity.BadBlocks, rec.Chunks.BlockSize)
+		}
+		if status != IntegrityOK && (prev == nil || prev.Status != status) && s.quarantine && rec.state() != StateQuarantined {
+			if err := rec.quarantine("integrity", "blob "+status); err != nil {
+				log.Printf("scrub: quarantine %s: %v", rec.ID, err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return ""
+	}
+	if err != nil {
+		log.Printf("scrub: update %s: %v", rec.ID, err)
+		return status
+	}
+	if status != IntegrityOK && (prev == nil || prev.Status != status) {
+		s.audit.Record(AuditEvent{Action: "integrity_" + status, FileID: rec.ID, Actor: "scrubber", Detail: detail})
+	}
+	return status
+}
+
+// hashBlob re-reads rec's blob and returns its SHA-256 and block hashes.
+func hashBlob(rec *FileRecord) (string, *ChunkHashes, error) {
+	body, err := openBlob(rec, false)
+	if err != nil {
+		return "", nil, err
+	}
+	defer body.Close()
+	h := sha256.New()
+	var chunks chunkHasher
+	if _, err := io.Copy(io.MultiWriter(h, &chunks), body); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), chunks.Sum(), nil
+}
+
+// ScrubHandler reports scrub progress (GET) or starts a run now (POST).
+func ScrubHandler(s *Scrubber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.Status())
+		case http.MethodPost:
+			if s.Status().Running {
+				writeConflict(w, "A scrub is already running")
+				return
+			}
+			go runExclusive(context.Background(), s.locker, "scrub", s.scrub)
+			writeJSON(w, http.StatusAccepted, s.Status())
+		default:
+			writeMethodNotAllowed(w, "Only GET and POST methods are allowed for scrub")
+		}
+	}
+}
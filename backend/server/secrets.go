@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"example.com/file-upload-go/config"
+)
+
+// Secret-bearing settings (signing keys, the admin and debug tokens, the
+// SMTP password, error-reporting endpoints) may be given as a reference to
+// a secrets provider instead of the value itself:
+//
+//	env:NAME                    the environment variable NAME
+//	file:/run/secrets/key       a file's contents, trailing newline trimmed
+//	vault:secret/data/app#key   a field of a HashiCorp Vault KV secret
+//	awssm:prod/upload[#key]     an AWS Secrets Manager secret, or a field of
+//	                            its JSON value
+//
+// Anything else is taken literally. Referenced secrets are fetched again
+// every refresh interval, so rotating a key in the provider reaches the
+// running server without a restart; consumers read the current value on
+// each use, and verifiers also accept the previous one so signatures issued
+// just before a rotation keep working until they expire.
+type SecretProvider interface {
+	Fetch(ctx context.Context, ref string) (string, error)
+}
+
+// Secret is a live handle on one secret setting. A nil *Secret is valid and
+// holds the empty string.
+type Secret struct {
+	name     string
+	ref      string // "scheme:rest" for referenced secrets, "" for literals
+	provider SecretProvider
+	cur      atomic.Pointer[string]
+	prev     atomic.Pointer[string]
+}
+
+// StaticSecret wraps a literal value.
+func StaticSecret(value string) *Secret {
+	s := &Secret{}
+	s.cur.Store(&value)
+	return s
+}
+
+// Value returns the current value.
+func (s *Secret) Value() string {
+	if s == nil {
+		return ""
+	}
+	if v := s.cur.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// Previous returns the value before the last rotation, or "" if there has
+// not been one.
+func (s *Secret) Previous() string {
+	if s == nil {
+		return ""
+	}
+	if v := s.prev.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+func (s *Secret) set(v string) (rotated bool) {
+	old := s.cur.Swap(&v)
+	if old == nil || *old == v {
+		return false
+	}
+	s.prev.Store(old)
+	return true
+}
+
+// Secrets resolves secret settings and keeps the referenced ones current.
+type Secrets struct {
+	providers map[string]SecretProvider
+
+	mu      sync.Mutex
+	watched []*Secret
+}
+
+// NewSecrets sets up the env, file and AWS Secrets Manager providers. The
+// latter reads its region and credentials from the standard AWS_*
+// environment variables when used.
+func NewSecrets() *Secrets {
+	return &Secrets{providers: map[string]SecretProvider{
+		"env":   envProvider{},
+		"file":  fileProvider{},
+		"awssm": &awsSecretsProvider{},
+	}}
+}
+
+// UseVault adds the Vault provider, authenticating with token.
+func (s *Secrets) UseVault(addr string, token *Secret) {
+	s.providers["vault"] = &vaultProvider{addr: strings.TrimSuffix(addr, "/"), token: token}
+}
+
+// Load resolves the setting called name. Referenced secrets must resolve at
+// startup; an unreachable provider is a configuration error, not something
+// to discover on the first signed URL.
+func (s *Secrets) Load(ctx context.Context, name, value string) (*Secret, error) {
+	scheme, _, ok := strings.Cut(value, ":")
+	if !ok || !isSecretScheme(scheme) {
+		return StaticSecret(value), nil
+	}
+	p := s.providers[scheme]
+	if p == nil {
+		return nil, fmt.Errorf("%s: no %s secrets provider configured", name, scheme)
+	}
+	sec := &Secret{name: name, ref: value, provider: p}
+	v, err := p.Fetch(ctx, strings.TrimPrefix(value, scheme+":"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	sec.set(v)
+	s.mu.Lock()
+	s.watched = append(s.watched, sec)
+	s.mu.Unlock()
+	return sec, nil
+}
+
+func refreshFailed(name string) {
+	metrics.Counter("secret_refresh_errors_total", "Secret refreshes that failed and kept the last good value.", "secret", name).Inc()
+}
+
+func isSecretScheme(scheme string) bool {
+	switch scheme {
+	case "env", "file", "vault", "awssm":
+		return true
+	}
+	return false
+}
+
+// Run refreshes referenced secrets every interval until ctx is done. A
+// failed refresh keeps the last good value.
+func (s *Secrets) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.Refresh(ctx)
+		}
+	}
+}
+
+// Refresh fetches every referenced secret once.
+func (s *Secrets) Refresh(ctx context.Context) {
+	s.mu.Lock()
+	watched := append([]*Secret(nil), s.watched...)
+	s.mu.Unlock()
+	for _, sec := range watched {
+		scheme, rest, _ := strings.Cut(sec.ref, ":")
+		fctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		v, err := sec.provider.Fetch(fctx, rest)
+		cancel()
+		if err != nil {
+			refreshFailed(sec.name)
+			log.Printf("secrets: refresh %s from %s: %v", sec.name, scheme, err)
+			continue
+		}
+		if v == "" {
+			refreshFailed(sec.name)
+			log.Printf("secrets: refresh %s from %s: empty value; keeping the current one", sec.name, scheme)
+			continue
+		}
+		if sec.set(v) {
+			metrics.Counter("secret_rotations_total", "Secrets whose value changed on refresh.", "secret", sec.name).Inc()
+			log.Printf("secrets: %s rotated", sec.name)
+		}
+	}
+}
+
+// ServerSecrets are the secret settings of the server.
+type ServerSecrets struct {
+	*Secrets
+	SigningKey    *Secret
+	CDNSigningKey *Secret
+	AdminToken    *Secret
+	DebugToken    *Secret
+	SMTPPassword  *Secret
+	SentryDSN     *Secret
+	ErrorWebhook  *Secret
+	GCPToken      *Secret
+}
+
+// loadSecrets resolves every secret setting in cfg. The Vault token may
+// itself be an env: or file: reference, e.g. to a file kept fresh by a
+// Vault agent, and is refreshed like the rest.
+func loadSecrets(cfg config.Config) (*ServerSecrets, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	s := &ServerSecrets{Secrets: NewSecrets()}
+	vaultToken, err := s.Load(ctx, "UPLOAD_VAULT_TOKEN", cfg.VaultToken)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.VaultAddr != "" {
+		s.UseVault(cfg.VaultAddr, vaultToken)
+	}
+	for _, v := range []struct {
+		dst         **Secret
+		name, value string
+	}{
+		{&s.SigningKey, "UPLOAD_SIGNING_KEY", cfg.SigningKey},
+		{&s.CDNSigningKey, "UPLOAD_CDN_SIGNING_KEY", cfg.CDNSigningKey},
+		{&s.AdminToken, "UPLOAD_ADMIN_TOKEN", cfg.AdminToken},
+		{&s.DebugToken, "UPLOAD_DEBUG_TOKEN", cfg.DebugToken},
+		{&s.SMTPPassword, "UPLOAD_SMTP_PASSWORD", cfg.SMTPPassword},
+		{&s.SentryDSN, "UPLOAD_SENTRY_DSN", cfg.SentryDSN},
+		{&s.ErrorWebhook, "UPLOAD_ERROR_WEBHOOK", cfg.ErrorWebhook},
+		{&s.GCPToken, "UPLOAD_GCP_ACCESS_TOKEN", cfg.GCPAccessToken},
+	} {
+		if *v.dst, err = s.Load(ctx, v.name, v.value); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+type envProvider struct{}
+
+func (envProvider) Fetch(_ context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+type fileProvider struct{}
+
+func (fileProvider) Fetch(_ context.Context, path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+var cloudClient = &http.Client{Timeout: 15 * time.Second}
+
+// splitField splits "path#field".
+func splitField(ref string) (path, field string) {
+	path, field, _ = strings.Cut(ref, "#")
+	return path, field
+}
+
+// vaultProvider reads from Vault's HTTP API. Refs are "<path>#<field>" with
+// the full API path, e.g. "secret/data/upload#signing_key" for KV v2 or
+// "secret/upload#signing_key" for KV v1.
+type vaultProvider struct {
+	addr  string
+	token *Secret
+}
+
+func (v *vaultProvider) Fetch(ctx context.Context, ref string) (string, error) {
+	path, field := splitField(ref)
+	if field == "" {
+		return "", errors.New("vault reference needs a #field")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token.Value())
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: %s", resp.Status)
+	}
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	data := body.Data
+	if inner, ok := data["data"]; ok && data["metadata"] != nil {
+		// KV v2 nests the secret under data.data.
+		data = nil
+		if err := json.Unmarshal(inner, &data); err != nil {
+			return "", fmt.Errorf("vault: %w", err)
+		}
+	}
+	return secretField(data, field)
+}
+
+func secretField(data map[string]json.RawMessage, field string) (string, error) {
+	raw, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("secret field %q is not a string", field)
+	}
+	return s, nil
+}
+
+// awsSecretsProvider calls Secrets Manager's GetSecretValue; see awsCall
+// for credentials. AWS_ENDPOINT_URL_SECRETS_MANAGER overrides the endpoint.
+type awsSecretsProvider struct{}
+
+func (*awsSecretsProvider) Fetch(ctx context.Context, ref string) (string, error) {
+	id, field := splitField(ref)
+	var out struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := awsCall(ctx, "secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": id}, &out); err != nil {
+		return "", fmt.Errorf("awssm: %w", err)
+	}
+	if out.SecretString == nil {
+		return "", errors.New("awssm: secret has no string value")
+	}
+	if field == "" {
+		return *out.SecretString, nil
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*out.SecretString), &data); err != nil {
+		return "", errors.New("awssm: secret value is not a JSON object")
+	}
+	return secretField(data, field)
+}
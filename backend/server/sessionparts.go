@@ -0,0 +1,178 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ByteRange is the half-open range [Start, End) of a file.
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// addRange merges [start, end) into the sorted, disjoint ranges rs.
+func addRange(rs []ByteRange, start, end int64) []ByteRange {
+	rs = append(rs, ByteRange{start, end})
+	slices.SortFunc(rs, func(a, b ByteRange) int { return cmp.Compare(a.Start, b.Start) })
+	out := rs[:1]
+	for _, r := range rs[1:] {
+		last := &out[len(out)-1]
+		if r.Start <= last.End {
+			last.End = max(last.End, r.End)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func rangesLen(rs []ByteRange) int64 {
+	var n int64
+	for _, r := range rs {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// appendPart writes a chunk of a parallel session at its Upload-Offset,
+// which may be anywhere in the file. Chunks are written straight into the
+// part file without holding the session lock, so several can stream at
+// once; the lock is only taken to record the range received. Offset is
+// then the number of bytes received, and Parts says which. The checksum
+// and CSV checks run over the whole file on completion.
+func (s *Sessions) appendPart(w http.ResponseWriter, r *http.Request, sess *UploadSession) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeBadRequest(w, "Header 'Upload-Offset' is required")
+		return
+	}
+	if offset < 0 || offset >= sess.Size {
+		writeBadRequest(w, "Upload-Offset "+strconv.FormatInt(offset, 10)+" is outside the upload of "+strconv.FormatInt(sess.Size, 10)+" bytes")
+		return
+	}
+	limit := min(s.maxChunk, sess.Size-offset)
+	if !preflight(w, r, limit, sess.Size) {
+		return
+	}
+	f, err := os.OpenFile(sess.TempPath, os.O_WRONLY, 0o644)
+	if err != nil {
+		writeInternalError(w, "Failed to open temporary file")
+		return
+	}
+	n, err := io.Copy(io.NewOffsetWriter(f, offset), http.MaxBytesReader(w, r.Body, limit))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		// Nothing is recorded, so whatever reached the file is rewritten
+		// when the client retries the chunk.
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeRequestEntityTooLarge(w, "Chunk exceeds the maximum chunk size or total upload size")
+		} else {
+			writeInternalError(w, "Failed to write chunk")
+		}
+		return
+	}
+	if n == 0 {
+		writeBadRequest(w, "Chunk is empty")
+		return
+	}
+
+	release, ok := s.waitLock(w, r.Context(), sess.ID)
+	if !ok {
+		return
+	}
+	defer release()
+	sess, ok = s.load(w, r, sess.ID)
+	if !ok {
+		return
+	}
+	sess.Parts = addRange(sess.Parts, offset, offset+n)
+	sess.Offset = rangesLen(sess.Parts)
+	sess.UpdatedAt = time.Now().UTC()
+	sess.ExpiresAt = sess.UpdatedAt.Add(s.ttl)
+	if err := s.store.PutSession(r.Context(), sess); err != nil {
+		writeInternalError(w, "Failed to save upload session")
+		return
+	}
+	s.write(w, http.StatusOK, sess)
+}
+
+// waitLock takes the session lock for the brief update of a parallel
+// part, waiting for other parts to finish theirs rather than failing.
+func (s *Sessions) waitLock(w http.ResponseWriter, ctx context.Context, id string) (func(), bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		release, ok, err := s.locker.TryLock(ctx, "session:"+id, 2*time.Minute)
+		if err != nil {
+			writeInternalError(w, "Failed to lock upload session")
+			return nil, false
+		}
+		if ok {
+			return release, true
+		}
+		if time.Now().After(deadline) {
+			writeConflict(w, "Another request is writing to upload session '"+id+"'")
+			return nil, false
+		}
+		select {
+		case <-ctx.Done():
+			writeConflict(w, "Another request is writing to upload session '"+id+"'")
+			return nil, false
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// scanParts hashes and counts a completed parallel upload in one pass,
+// leaving the states completion reads, with the CSV shape limits applied.
+func (s *Sessions) scanParts(sess *UploadSession) error {
+	f, err := os.Open(sess.TempPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	stats := s.ingest.newCSVStats()
+	chunks := &chunkHasher{}
+	if _, err := io.CopyN(io.MultiWriter(h, chunks, stats), f, sess.Size); err != nil {
+		return err
+	}
+	if sess.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return err
+	}
+	sess.CSVStats = stats
+	sess.Chunks = chunks
+	return nil
+}
+
+// recoverParts checks a parallel session after a restart. A chunk that was
+// being written was never recorded, so its bytes are simply rewritten on
+// retry; only a lost part file forgets the parts received.
+func (s *Sessions) recoverParts(ctx context.Context, sess *UploadSession) error {
+	_, err := os.Stat(sess.TempPath)
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(sess.TempPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	sess.Parts = nil
+	sess.Offset = 0
+	sess.UpdatedAt = time.Now().UTC()
+	return s.store.PutSession(ctx, sess)
+}
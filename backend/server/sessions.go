@@ -0,0 +1,735 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("upload session not found")
+
+// UploadSession tracks a chunked upload. All state lives in the shared
+// SessionStore and the part file under the shared session directory, so any
+// instance can accept the next chunk. HashState is the marshaled SHA-256
+// state covering the first Offset bytes, so completing an upload only hashes
+// what has not been seen yet.
+type UploadSession struct {
+	ID        string       `json:"id"`
+	Filename  string       `json:"filename"`
+	TempPath  string       `json:"tempPath"`
+	Offset    int64        `json:"offset"`
+	Size      int64        `json:"size,omitempty"`
+	MaxBytes  int64        `json:"maxBytes,omitempty"`
+	HashState []byte       `json:"hashState,omitempty"`
+	Chunks    *chunkHasher `json:"chunks,omitempty"`
+	CSVStats  *csvStats    `json:"csvStats,omitempty"`
+	Parallel  bool         `json:"parallel,omitempty"`
+	Parts     []ByteRange  `json:"parts,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+}
+
+// SessionResponse is the client view of a session; server paths stay
+// internal.
+type SessionResponse struct {
+	ID        string      `json:"id"`
+	Filename  string      `json:"filename"`
+	Offset    int64       `json:"offset"`
+	Size      int64       `json:"size,omitempty"`
+	State     string      `json:"state"`
+	MaxChunk  int64       `json:"maxChunkBytes"`
+	Parallel  bool        `json:"parallel,omitempty"`
+	Parts     []ByteRange `json:"parts,omitempty"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+}
+
+type SessionStore interface {
+	GetSession(ctx context.Context, id string) (*UploadSession, error)
+	PutSession(ctx context.Context, sess *UploadSession) error
+	DeleteSession(ctx context.Context, id string) error
+	ListSessions(ctx context.Context) ([]*UploadSession, error)
+}
+
+type Sessions struct {
+	store    SessionStore
+	locker   Locker
+	ingest   *Ingest
+	dir      string
+	ttl      time.Duration
+	maxChunk int64
+}
+
+func NewSessions(store SessionStore, locker Locker, in *Ingest, dir string, ttl time.Duration, maxChunk int64) *Sessions {
+	return &Sessions{store: store, locker: locker, ingest: in, dir: dir, ttl: ttl, maxChunk: maxChunk}
+}
+
+type createSessionRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Parallel bool   `json:"parallel"`
+}
+
+// CreateHandler opens a new session: POST /v1/uploads {"filename": "...",
+// "size": N}. Size is optional and may instead be sent as X-Upload-Length;
+// when given, chunks may not go past it and the upload only completes once
+// exactly that many bytes have arrived. With "parallel": true, which needs
+// the size, chunks may arrive in any order and at once; see appendPart.
+func (s *Sessions) CreateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := s.ingest.Limits.For(r)
+		if r.Method == http.MethodOptions {
+			writeUploadOptions(w, "POST, OPTIONS", limit)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for creating upload sessions")
+			return
+		}
+		var req createSessionRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeBadRequest(w, "Invalid JSON body")
+			return
+		}
+		if req.Filename == "" {
+			writeBadRequest(w, "Field 'filename' is required")
+			return
+		}
+		filename, msg := sanitizeFilename(req.Filename)
+		if msg.Text != "" {
+			writeMessage(w, http.StatusBadRequest, "bad_request", msg)
+			return
+		}
+		if ext := strings.ToLower(filepath.Ext(filename)); !allowedExtension(ext) {
+			writeMessage(w, http.StatusUnsupportedMediaType, "unsupported_media_type", newMessage("unsupported_file_type", "ext", ext))
+			return
+		}
+		if req.Size < 0 {
+			writeBadRequest(w, "Field 'size' must not be negative")
+			return
+		}
+		if req.Size > limit {
+			writeFileTooLarge(w, limit)
+			return
+		}
+		declared, ok := declaredLength(w, r, limit)
+		if !ok {
+			return
+		}
+		if req.Size == 0 {
+			req.Size = declared
+		}
+		if req.Parallel && req.Size == 0 {
+			writeBadRequest(w, "Parallel uploads need the file size in 'size' or X-Upload-Length")
+			return
+		}
+		if !checkDiskSpace(w, req.Size) {
+			return
+		}
+
+		id, err := s.ingest.IDs.NewID()
+		if err != nil {
+			writeInternalError(w, "Failed to generate session ID")
+			return
+		}
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			writeInternalError(w, "Failed to create session directory")
+			return
+		}
+		now := time.Now().UTC()
+		sess := &UploadSession{
+			ID:        id,
+			Filename:  filename,
+			Size:      req.Size,
+			MaxBytes:  limit,
+			Parallel:  req.Parallel,
+			TempPath:  filepath.Join(s.dir, id+".part"),
+			CreatedAt: now,
+			UpdatedAt: now,
+			ExpiresAt: now.Add(s.ttl),
+		}
+		f, err := os.OpenFile(sess.TempPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err != nil {
+			writeInternalError(w, "Failed to create temporary file")
+			return
+		}
+		f.Close()
+		if err := s.store.PutSession(r.Context(), sess); err != nil {
+			_ = os.Remove(sess.TempPath)
+			writeInternalError(w, "Failed to save upload session")
+			return
+		}
+		w.Header().Set("Location", "/v1/uploads/"+id)
+		s.write(w, http.StatusCreated, sess)
+	}
+}
+
+// SessionHandler serves GET/HEAD (current offset), PATCH (append a chunk at
+// Upload-Offset) and DELETE (abort) on /v1/uploads/{id}.
+func (s *Sessions) SessionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			sess, ok := s.load(w, r, r.PathValue("id"))
+			if !ok {
+				return
+			}
+			s.write(w, http.StatusOK, sess)
+		case http.MethodPatch:
+			s.appendChunk(w, r)
+		case http.MethodDelete:
+			s.abort(w, r)
+		default:
+			writeMethodNotAllowed(w, "Only GET, HEAD, PATCH and DELETE methods are allowed for upload sessions")
+		}
+	}
+}
+
+func (s *Sessions) appendChunk(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if sess, err := s.store.GetSession(r.Context(), id); err == nil && sess.Parallel {
+		s.appendPart(w, r, sess)
+		return
+	}
+	release, ok := s.lock(w, r.Context(), id, lockTTL(s.maxChunk))
+	if !ok {
+		return
+	}
+	defer release()
+
+	sess, ok := s.load(w, r, id)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeBadRequest(w, "Header 'Upload-Offset' is required")
+		return
+	}
+	if offset != sess.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(sess.Offset, 10))
+		writeConflict(w, "Upload-Offset "+strconv.FormatInt(offset, 10)+" does not match committed offset "+strconv.FormatInt(sess.Offset, 10))
+		return
+	}
+
+	remaining := sess.MaxBytes
+	if remaining == 0 {
+		remaining = s.ingest.Limits.Default
+	}
+	if sess.Size > 0 {
+		remaining = sess.Size
+	}
+	limit := min(s.maxChunk, remaining-sess.Offset)
+	if !preflight(w, r, limit, remaining) {
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, limit)
+
+	h, err := resumeHash(sess)
+	if err != nil {
+		writeInternalError(w, "Failed to restore upload checksum state")
+		return
+	}
+	stats, err := s.resumeCSVStats(sess)
+	if err != nil {
+		writeInternalError(w, "Failed to restore upload row count")
+		return
+	}
+	chunks, err := resumeChunks(sess)
+	if err != nil {
+		writeInternalError(w, "Failed to restore upload block hashes")
+		return
+	}
+	f, err := os.OpenFile(sess.TempPath, os.O_WRONLY, 0o644)
+	if err != nil {
+		writeInternalError(w, "Failed to open temporary file")
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(sess.Offset, io.SeekStart); err != nil {
+		writeInternalError(w, "Failed to seek temporary file")
+		return
+	}
+
+	n, err := io.Copy(io.MultiWriter(f, h, chunks, stats), body)
+	if err == nil {
+		sess.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary()
+	}
+	if err == nil {
+		err = chunks.save()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the chunk made it to disk; the client
+		// retries from the committed offset.
+		_ = f.Truncate(sess.Offset)
+		var maxErr *http.MaxBytesError
+		var limitErr *csvLimitError
+		if errors.As(err, &maxErr) {
+			writeRequestEntityTooLarge(w, "Chunk exceeds the maximum chunk size or total upload size")
+		} else if errors.As(err, &limitErr) {
+			writeBadRequest(w, limitErr.Error())
+		} else {
+			writeInternalError(w, "Failed to write chunk")
+		}
+		return
+	}
+
+	sess.Offset += n
+	sess.UpdatedAt = time.Now().UTC()
+	sess.ExpiresAt = sess.UpdatedAt.Add(s.ttl)
+	if err := s.store.PutSession(r.Context(), sess); err != nil {
+		_ = f.Truncate(sess.Offset - n)
+		writeInternalError(w, "Failed to save upload session")
+		return
+	}
+	s.write(w, http.StatusOK, sess)
+}
+
+// abort cancels a session on the client's behalf, releasing its part file
+// and session record straight away instead of leaving them for the reaper.
+func (s *Sessions) abort(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	release, ok := s.lock(w, r.Context(), id, lockTTL(0))
+	if !ok {
+		return
+	}
+	defer release()
+
+	sess, ok := s.load(w, r, id)
+	if !ok {
+		return
+	}
+	if err := s.discard(r.Context(), sess); err != nil {
+		log.Printf("sessions: abort %s: %v", sess.ID, err)
+		writeInternalError(w, "Failed to abort upload session")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CompleteHandler validates the assembled file and turns it into a stored
+// file: POST /v1/uploads/{id}/complete[?ifNotExists=true].
+func (s *Sessions) CompleteHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for completing uploads")
+			return
+		}
+		customer, uerr := customerKey(r)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		id := r.PathValue("id")
+		release, ok := s.lock(w, r.Context(), id, lockTTL(s.ingest.Limits.For(r)))
+		if !ok {
+			return
+		}
+		defer release()
+
+		sess, ok := s.load(w, r, id)
+		if !ok {
+			return
+		}
+		if sess.Offset == 0 {
+			writeMessage(w, http.StatusBadRequest, "bad_request", newMessage("empty_file"))
+			return
+		}
+		if sess.Size > 0 && sess.Offset != sess.Size {
+			s.write(w, http.StatusConflict, sess)
+			return
+		}
+		if sess.Parallel {
+			if err := s.scanParts(sess); err != nil {
+				var limitErr *csvLimitError
+				if errors.As(err, &limitErr) {
+					writeBadRequest(w, limitErr.Error())
+					return
+				}
+				writeInternalError(w, "Failed to read uploaded data")
+				return
+			}
+		}
+
+		f, err := os.Open(sess.TempPath)
+		if err != nil {
+			writeInternalError(w, "Failed to open temporary file")
+			return
+		}
+		head := make([]byte, 512)
+		nHead, _ := io.ReadFull(f, head)
+		f.Close()
+		contentType, ext, msg := checkCSV(head[:nHead], sess.Filename)
+		if msg.Text != "" {
+			uerr := newUploadErrorMessage(http.StatusUnsupportedMediaType, "unsupported_media_type", msg)
+			s.ingest.notifyUpload(sess.Filename, "", notifyAddress(r), nil, uerr)
+			writeUploadError(w, uerr)
+			return
+		}
+		h, err := resumeHash(sess)
+		if err != nil {
+			writeInternalError(w, "Failed to read uploaded data")
+			return
+		}
+		checksum := hex.EncodeToString(h.Sum(nil))
+		stats, err := s.resumeCSVStats(sess)
+		if err != nil {
+			writeInternalError(w, "Failed to read uploaded data")
+			return
+		}
+		chunks, err := resumeChunks(sess)
+		if err != nil {
+			writeInternalError(w, "Failed to read uploaded data")
+			return
+		}
+		duplicateOf, uerr := s.ingest.checkDuplicate(r.Context(), checksum, r.URL.Query().Get("ifNotExists") == "true")
+		if uerr != nil {
+			s.ingest.notifyUpload(sess.Filename, "", notifyAddress(r), nil, uerr)
+			writeUploadError(w, uerr)
+			return
+		}
+
+		now := time.Now()
+		finalPath, err := blobPath(sess.ID, ext, now)
+		if err != nil {
+			writeInternalError(w, "Failed to create upload directory")
+			return
+		}
+		// The part file is set aside, not moved, until the record is
+		// committed: a late chunk can no longer open it, and a completion
+		// that fails puts it back so the client can retry.
+		held := sess.heldPath()
+		if err := boundedWrite(r.Context(), "part hold", func(commit func() error) error {
+			if err := commit(); err != nil {
+				return err
+			}
+			return os.Rename(sess.TempPath, held)
+		}); err != nil {
+			writeInternalError(w, "Failed to finalize file")
+			return
+		}
+		if err := boundedWrite(r.Context(), "blob stage", func(commit func() error) error {
+			if err := commit(); err != nil {
+				return err
+			}
+			return stageFile(held, finalPath)
+		}); err != nil {
+			_ = os.Rename(held, sess.TempPath)
+			if errors.Is(err, errBlobExists) {
+				writeConflict(w, "Upload '"+sess.ID+"' collides with a stored file; start a new upload")
+				return
+			}
+			writeInternalError(w, "Failed to finalize file")
+			return
+		}
+		rec := &FileRecord{
+			ID:          sess.ID,
+			Filename:    sess.Filename,
+			Path:        finalPath,
+			Bytes:       sess.Offset,
+			ChecksumSHA: checksum,
+			ContentType: contentType,
+			Extension:   ext,
+			UploadedAt:  now,
+			DuplicateOf: duplicateOf,
+			Chunks:      chunks.Sum(),
+			RowCount:    stats.rowCount(),
+			Columns:     stats.columns(),
+			customerKey: customer,
+		}
+		if err := s.ingest.Commit(r.Context(), rec); err != nil {
+			_ = os.Remove(finalPath)
+			if err := os.Rename(held, sess.TempPath); err != nil {
+				log.Printf("sessions: restore %s: %v", sess.ID, err)
+			}
+			var uerr *UploadError
+			if errors.As(err, &uerr) {
+				writeUploadError(w, uerr)
+				return
+			}
+			writeInternalError(w, "Failed to record file metadata")
+			return
+		}
+		if err := s.discard(context.WithoutCancel(r.Context()), sess); err != nil {
+			log.Printf("sessions: discard %s: %v", sess.ID, err)
+		}
+		s.ingest.notifyUpload(sess.Filename, "", notifyAddress(r), rec, nil)
+		writeJSON(w, http.StatusOK, newUploadResponse(rec))
+	}
+}
+
+// Reap removes expired sessions and their part files every interval.
+func (s *Sessions) Reap(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			runExclusive(ctx, s.locker, "session-reaper", s.reapExpired)
+		}
+	}
+}
+
+func (s *Sessions) reapExpired(ctx context.Context) {
+	if maintenance.ReadOnly() {
+		return
+	}
+	sessions, err := s.store.ListSessions(ctx)
+	if err != nil {
+		log.Printf("sessions: list: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, sess := range sessions {
+		if now.Before(sess.ExpiresAt) {
+			continue
+		}
+		if err := s.discard(ctx, sess); err != nil {
+			log.Printf("sessions: reap %s: %v", sess.ID, err)
+		}
+	}
+}
+
+// Recover reconciles persisted sessions with their part files after a
+// restart. A chunk that was being written when the process died may have
+// left bytes past the committed offset; those are truncated so the client
+// can resume from the offset it was last told. Sessions whose part file is
+// gone or shorter than recorded are rewound to what is actually on disk.
+func (s *Sessions) Recover(ctx context.Context) {
+	sessions, err := s.store.ListSessions(ctx)
+	if err != nil {
+		log.Printf("sessions: recover: list: %v", err)
+		return
+	}
+	for _, sess := range sessions {
+		release, ok, err := s.locker.TryLock(ctx, "session:"+sess.ID, 2*time.Minute)
+		if err != nil || !ok {
+			continue
+		}
+		if err := s.recoverOne(ctx, sess); err != nil {
+			log.Printf("sessions: recover %s: %v", sess.ID, err)
+		}
+		release()
+	}
+}
+
+func (s *Sessions) recoverOne(ctx context.Context, sess *UploadSession) error {
+	// A completion interrupted before committing leaves the part file
+	// set aside.
+	if _, err := os.Stat(sess.heldPath()); err == nil {
+		if err := os.Rename(sess.heldPath(), sess.TempPath); err != nil {
+			return err
+		}
+	}
+	if sess.Parallel {
+		return s.recoverParts(ctx, sess)
+	}
+	fi, err := os.Stat(sess.TempPath)
+	if errors.Is(err, os.ErrNotExist) {
+		f, err := os.OpenFile(sess.TempPath, os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		fi, err = os.Stat(sess.TempPath)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Size() > sess.Offset:
+		return os.Truncate(sess.TempPath, sess.Offset)
+	case fi.Size() < sess.Offset:
+		log.Printf("sessions: %s part file holds %d of %d committed bytes; rewinding", sess.ID, fi.Size(), sess.Offset)
+		sess.Offset = fi.Size()
+		sess.HashState = nil
+		sess.Chunks = nil
+		sess.UpdatedAt = time.Now().UTC()
+		return s.store.PutSession(ctx, sess)
+	}
+	return nil
+}
+
+// resumeHash returns a SHA-256 hash positioned at sess.Offset. The saved
+// state is used when present; sessions without one (created before it was
+// tracked, or rewound by Recover) re-read the committed bytes instead.
+func resumeHash(sess *UploadSession) (hash.Hash, error) {
+	h := sha256.New()
+	if len(sess.HashState) > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(sess.HashState); err == nil {
+			return h, nil
+		}
+		h.Reset()
+	}
+	if sess.Offset == 0 {
+		return h, nil
+	}
+	f, err := os.Open(sess.TempPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(h, f, sess.Offset); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// resumeCSVStats returns the session's row counting state, rebuilding it
+// from the part file for sessions that predate it, with the configured
+// shape limits applied to the bytes still to come.
+func (s *Sessions) resumeCSVStats(sess *UploadSession) (*csvStats, error) {
+	if sess.CSVStats == nil {
+		stats := &csvStats{}
+		if sess.Offset > 0 {
+			f, err := os.Open(sess.TempPath)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			if _, err := io.CopyN(stats, f, sess.Offset); err != nil {
+				return nil, err
+			}
+		}
+		sess.CSVStats = stats
+	}
+	sess.CSVStats.limits = s.ingest.newCSVStats().limits
+	return sess.CSVStats, nil
+}
+
+// resumeChunks returns the session's block hashing state, rebuilding it
+// from the part file for sessions that predate it.
+func resumeChunks(sess *UploadSession) (*chunkHasher, error) {
+	if sess.Chunks == nil {
+		chunks := &chunkHasher{}
+		if sess.Offset > 0 {
+			f, err := os.Open(sess.TempPath)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			if _, err := io.CopyN(chunks, f, sess.Offset); err != nil {
+				return nil, err
+			}
+		}
+		sess.Chunks = chunks
+	}
+	return sess.Chunks, nil
+}
+
+// heldPath is where CompleteHandler keeps the part file while it commits.
+func (sess *UploadSession) heldPath() string {
+	return sess.TempPath + ".completing"
+}
+
+func (s *Sessions) discard(ctx context.Context, sess *UploadSession) error {
+	if err := boundedWrite(ctx, "part remove", func(commit func() error) error {
+		if err := commit(); err != nil {
+			return err
+		}
+		err := os.Remove(sess.heldPath())
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			err = os.Remove(sess.TempPath)
+		}
+		return err
+	}); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := s.store.DeleteSession(ctx, sess.ID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+	return nil
+}
+
+// lockTTL is how long a session lock lives without renewal: as long as a
+// request moving size bytes may run, so a missed renewal cannot hand the
+// session to another request while this one is still writing.
+func lockTTL(size int64) time.Duration {
+	if uploadDeadline.MinBytesPerSecond <= 0 {
+		return requestTimeout
+	}
+	return max(uploadDeadline.For(size), requestTimeout)
+}
+
+func (s *Sessions) lock(w http.ResponseWriter, ctx context.Context, id string, ttl time.Duration) (func(), bool) {
+	release, ok, err := s.locker.TryLock(ctx, "session:"+id, ttl)
+	if err != nil {
+		writeInternalError(w, "Failed to lock upload session")
+		return nil, false
+	}
+	if !ok {
+		writeConflict(w, "Another request is writing to upload session '"+id+"'")
+		return nil, false
+	}
+	return release, true
+}
+
+func (s *Sessions) load(w http.ResponseWriter, r *http.Request, id string) (*UploadSession, bool) {
+	sess, err := s.store.GetSession(r.Context(), id)
+	if errors.Is(err, ErrSessionNotFound) {
+		writeNotFound(w, "Upload session '"+id+"' not found")
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, "Failed to load upload session")
+		return nil, false
+	}
+	return sess, true
+}
+
+func (s *Sessions) write(w http.ResponseWriter, status int, sess *UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(sess.Offset, 10))
+	if sess.Size > 0 {
+		w.Header().Set("Upload-Length", strconv.FormatInt(sess.Size, 10))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, SessionResponse{
+		ID:        sess.ID,
+		Filename:  sess.Filename,
+		Offset:    sess.Offset,
+		Size:      sess.Size,
+		State:     StateUploading,
+		MaxChunk:  s.maxChunk,
+		Parallel:  sess.Parallel,
+		Parts:     sess.Parts,
+		ExpiresAt: sess.ExpiresAt,
+	})
+}
+
+// stageFile links src at dst without replacing an existing dst and leaves
+// src in place, falling back to a copy when they live on different
+// filesystems or links are unsupported.
+func stageFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if errors.Is(err, os.ErrExist) {
+		return errBlobExists
+	}
+	if err == nil {
+		return nil
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return errBlobExists
+	}
+	return copyFile(dst, src, nil, nil)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSession opens a session through the handlers and uploads body to it
+// in one chunk.
+func testSession(t *testing.T, s *Sessions, body string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.CreateHandler()(w, httptest.NewRequest(http.MethodPost, "/v1/uploads", strings.NewReader(`{"filename":"people.csv"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var resp SessionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPatch, "/v1/uploads/"+resp.ID, strings.NewReader(body))
+	req.SetPathValue("id", resp.ID)
+	req.Header.Set("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+	s.SessionHandler()(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("append: %d %s", w.Code, w.Body)
+	}
+	return resp.ID
+}
+
+// A completion that fails to commit leaves the session and its part file
+// as they were, so retrying it succeeds.
+func TestCompleteRetry(t *testing.T) {
+	in := testIngest(t)
+	s := NewSessions(in.Store.(*jsonStore), newLocalLocker(), in, t.TempDir(), time.Hour, 1<<20)
+	id := testSession(t, s, "name,email\nbob,bob@example.com\n")
+	part := filepath.Join(s.dir, id+".part")
+
+	tests := []struct {
+		name     string
+		readOnly bool
+		status   int
+		partLeft bool
+	}{
+		{"commit fails", true, http.StatusInternalServerError, true},
+		{"retry", false, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.readOnly {
+				readOnly(t)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/v1/uploads/"+id+"/complete", nil)
+			req.SetPathValue("id", id)
+			w := httptest.NewRecorder()
+			s.CompleteHandler()(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if _, err := os.Stat(part); (err == nil) != tt.partLeft {
+				t.Errorf("part file present = %v, want %v", err == nil, tt.partLeft)
+			}
+			if _, err := s.store.GetSession(req.Context(), id); (err == nil) != tt.partLeft {
+				t.Errorf("session present = %v, want %v", err == nil, tt.partLeft)
+			}
+		})
+	}
+	rec, err := in.Store.Get(context.Background(), id)
+	if err != nil || rec.Bytes == 0 {
+		t.Fatalf("stored record: %+v, %v", rec, err)
+	}
+}
+
+func TestLockTTL(t *testing.T) {
+	saved := uploadDeadline
+	t.Cleanup(func() { uploadDeadline = saved })
+
+	tests := []struct {
+		deadline UploadDeadline
+		size     int64
+		want     time.Duration
+	}{
+		{UploadDeadline{}, 100 << 20, requestTimeout},
+		{UploadDeadline{MinBytesPerSecond: 1 << 20, Slack: 30 * time.Second}, 0, requestTimeout},
+		{UploadDeadline{MinBytesPerSecond: 1 << 20, Slack: 30 * time.Second}, 200 << 20, 230 * time.Second},
+	}
+	for _, tt := range tests {
+		uploadDeadline = tt.deadline
+		if got := lockTTL(tt.size); got != tt.want {
+			t.Errorf("lockTTL(%d) with %+v = %v, want %v", tt.size, tt.deadline, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP version 3 packet types and status codes
+// (draft-ietf-secsh-filexfer-02), the version every server speaks.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpMkdir    = 14
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpFxOK     = 0
+	sftpFxEOF    = 1
+	sftpFxNoFile = 2
+
+	sftpOpenRead = 0x1
+
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrACModTime   = 0x8
+	sftpAttrExtended    = 0x80000000
+
+	sftpReadChunk = 32 << 10
+)
+
+// sftpStatusError is a non-OK SSH_FXP_STATUS reply.
+type sftpStatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.Message, e.Code)
+}
+
+func (e *sftpStatusError) Is(target error) bool {
+	return e.Code == sftpFxNoFile && target == os.ErrNotExist
+}
+
+// sftpEntry is one directory listing entry.
+type sftpEntry struct {
+	Name    string
+	Size    int64
+	Mode    uint32 // POSIX st_mode; 0 when the server did not send it
+	ModTime time.Time
+}
+
+func (e sftpEntry) IsRegular() bool { return e.Mode == 0 || e.Mode&0o170000 == 0o100000 }
+
+// sftpClient is a minimal SFTP v3 client covering what ingestion needs:
+// listing a directory, reading files, creating directories and renaming.
+// Requests are sent one at a time.
+type sftpClient struct {
+	mu     sync.Mutex
+	conn   *ssh.Client
+	w      io.WriteCloser
+	r      io.Reader
+	nextID uint32
+}
+
+// dialSFTP connects to addr and starts the sftp subsystem.
+func dialSFTP(addr string, cfg *ssh.ClientConfig) (*sftpClient, error) {
+	conn, err := ssh.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	w, err := sess.StdinPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := sess.RequestSubsystem("sftp"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &sftpClient{conn: conn, w: w, r: r}
+	if err := c.init(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sftpClient) Close() error {
+	c.w.Close()
+	return c.conn.Close()
+}
+
+func (c *sftpClient) init() error {
+	if err := c.writePacket(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return err
+	}
+	typ, _, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if typ != sftpVersion {
+		return fmt.Errorf("sftp: unexpected packet %d during handshake", typ)
+	}
+	return nil
+}
+
+func (c *sftpClient) writePacket(typ byte, payload []byte) error {
+	b := make([]byte, 0, 5+len(payload))
+	b = binary.BigEndian.AppendUint32(b, uint32(1+len(payload)))
+	b = append(b, typ)
+	b = append(b, payload...)
+	_, err := c.w.Write(b)
+	return err
+}
+
+func (c *sftpClient) readPacket() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > 1<<24 {
+		return 0, nil, fmt.Errorf("sftp: bad packet length %d", n)
+	}
+	body := make([]byte, n-1)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], body, nil
+}
+
+// call sends a request and returns the reply type and the payload after the
+// request ID. STATUS replies other than OK come back as errors.
+func (c *sftpClient) call(typ byte, args ...any) (byte, *sftpBuf, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	id := c.nextID
+	b := binary.BigEndian.AppendUint32(nil, id)
+	for _, a := range args {
+		switch v := a.(type) {
+		case string:
+			b = appendSFTPString(b, v)
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		}
+	}
+	if err := c.writePacket(typ, b); err != nil {
+		return 0, nil, err
+	}
+	rtyp, body, err := c.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	buf := &sftpBuf{b: body}
+	if got := buf.uint32(); got != id {
+		return 0, nil, fmt.Errorf("sftp: reply for request %d, want %d", got, id)
+	}
+	if rtyp == sftpStatus {
+		code, msg := buf.uint32(), buf.string()
+		if code != sftpFxOK {
+			return 0, nil, &sftpStatusError{Code: code, Message: msg}
+		}
+	}
+	return rtyp, buf, buf.err
+}
+
+func (c *sftpClient) handle(typ byte, args ...any) (string, error) {
+	rtyp, buf, err := c.call(typ, args...)
+	if err != nil {
+		return "", err
+	}
+	if rtyp != sftpHandle {
+		return "", fmt.Errorf("sftp: unexpected reply %d, want handle", rtyp)
+	}
+	return buf.string(), buf.err
+}
+
+func (c *sftpClient) closeHandle(h string) error {
+	_, _, err := c.call(sftpClose, h)
+	return err
+}
+
+// ReadDir lists dir, leaving out "." and "..".
+func (c *sftpClient) ReadDir(dir string) ([]sftpEntry, error) {
+	h, err := c.handle(sftpOpendir, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(h)
+	var out []sftpEntry
+	for {
+		rtyp, buf, err := c.call(sftpReaddir, h)
+		var serr *sftpStatusError
+		if errors.As(err, &serr) && serr.Code == sftpFxEOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rtyp != sftpName {
+			return nil, fmt.Errorf("sftp: unexpected reply %d, want name", rtyp)
+		}
+		for n := buf.uint32(); n > 0 && buf.err == nil; n-- {
+			e := sftpEntry{Name: buf.string()}
+			buf.string() // longname
+			buf.attrs(&e)
+			if e.Name != "." && e.Name != ".." {
+				out = append(out, e)
+			}
+		}
+		if buf.err != nil {
+			return nil, buf.err
+		}
+	}
+}
+
+// Open opens path for reading.
+func (c *sftpClient) Open(path string) (io.ReadCloser, error) {
+	h, err := c.handle(sftpOpen, path, uint32(sftpOpenRead), uint32(0))
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{c: c, h: h}, nil
+}
+
+func (c *sftpClient) Mkdir(path string) error {
+	_, _, err := c.call(sftpMkdir, path, uint32(0))
+	return err
+}
+
+func (c *sftpClient) Rename(from, to string) error {
+	_, _, err := c.call(sftpRename, from, to)
+	return err
+}
+
+type sftpFile struct {
+	c   *sftpClient
+	h   string
+	off uint64
+	eof bool
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if f.eof {
+		return 0, io.EOF
+	}
+	rtyp, buf, err := f.c.call(sftpRead, f.h, f.off, uint32(min(len(p), sftpReadChunk)))
+	var serr *sftpStatusError
+	if errors.As(err, &serr) && serr.Code == sftpFxEOF {
+		f.eof = true
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if rtyp != sftpData {
+		return 0, fmt.Errorf("sftp: unexpected reply %d, want data", rtyp)
+	}
+	data := buf.bytes()
+	if buf.err != nil {
+		return 0, buf.err
+	}
+	n := copy(p, data)
+	f.off += uint64(n)
+	return n, nil
+}
+
+func (f *sftpFile) Close() error { return f.c.closeHandle(f.h) }
+
+func appendSFTPString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// sftpBuf decodes reply payloads; the first short read sets err and every
+// later read returns zero values.
+type sftpBuf struct {
+	b   []byte
+	err error
+}
+
+func (b *sftpBuf) take(n int) []byte {
+	if b.err != nil || len(b.b) < n {
+		b.err = errors.New("sftp: short packet")
+		return nil
+	}
+	v := b.b[:n]
+	b.b = b.b[n:]
+	return v
+}
+
+func (b *sftpBuf) uint32() uint32 {
+	if v := b.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (b *sftpBuf) uint64() uint64 {
+	if v := b.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (b *sftpBuf) bytes() []byte { return b.take(int(b.uint32())) }
+
+func (b *sftpBuf) string() string { return string(b.bytes()) }
+
+func (b *sftpBuf) attrs(e *sftpEntry) {
+	flags := b.uint32()
+	if flags&sftpAttrSize != 0 {
+		e.Size = int64(b.uint64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		b.uint32()
+		b.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		e.Mode = b.uint32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		b.uint32()
+		e.ModTime = time.Unix(int64(b.uint32()), 0)
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := b.uint32(); n > 0 && b.err == nil; n-- {
+			b.string()
+			b.string()
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPSource is a remote directory polled for CSVs on a cron schedule.
+// Files that are ingested move to ProcessedDir; files the pipeline rejects
+// move to RejectedDir, so neither is picked up again. Files changed within
+// the last SettleSeconds are left for the next poll in case the partner is
+// still writing them.
+type SFTPSource struct {
+	Name               string   `json:"name"`
+	Addr               string   `json:"addr"`
+	User               string   `json:"user"`
+	Password           string   `json:"password,omitempty"`
+	PrivateKeyFile     string   `json:"privateKeyFile,omitempty"`
+	HostKey            string   `json:"hostKey,omitempty"`
+	InsecureSkipVerify bool     `json:"insecureSkipHostKeyVerify,omitempty"`
+	Dir                string   `json:"dir"`
+	Pattern            string   `json:"pattern,omitempty"`
+	Schedule           string   `json:"schedule"`
+	ProcessedDir       string   `json:"processedDir,omitempty"`
+	RejectedDir        string   `json:"rejectedDir,omitempty"`
+	SettleSeconds      *int     `json:"settleSeconds,omitempty"`
+	Folder             string   `json:"folder,omitempty"`
+	Tags               []string `json:"tags,omitempty"`
+
+	sched  *cronSchedule
+	client *ssh.ClientConfig
+	settle time.Duration
+}
+
+// LoadSFTPSources reads path, a JSON array of SFTPSource, and checks each
+// entry. An empty path yields no sources.
+func LoadSFTPSources(path string) ([]*SFTPSource, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var srcs []*SFTPSource
+	if err := json.Unmarshal(b, &srcs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for i, src := range srcs {
+		if src.Name == "" || seen[src.Name] {
+			return nil, fmt.Errorf("sftp source %d: name is required and must be unique", i)
+		}
+		seen[src.Name] = true
+		if err := src.prepare(); err != nil {
+			return nil, fmt.Errorf("sftp source %q: %w", src.Name, err)
+		}
+	}
+	return srcs, nil
+}
+
+func (s *SFTPSource) prepare() error {
+	if s.Addr == "" || s.User == "" || s.Dir == "" {
+		return errors.New("addr, user and dir are required")
+	}
+	sched, err := parseCron(s.Schedule)
+	if err != nil {
+		return err
+	}
+	s.sched = sched
+	if s.Pattern == "" {
+		s.Pattern = "*.csv"
+	}
+	if _, err := path.Match(s.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q", s.Pattern)
+	}
+	if s.ProcessedDir == "" {
+		s.ProcessedDir = path.Join(s.Dir, "processed")
+	}
+	if s.RejectedDir == "" {
+		s.RejectedDir = path.Join(s.Dir, "rejected")
+	}
+	s.settle = time.Minute
+	if s.SettleSeconds != nil {
+		s.settle = time.Duration(*s.SettleSeconds) * time.Second
+	}
+	folder, ok := cleanFolder(s.Folder)
+	if !ok {
+		return fmt.Errorf("invalid folder %q", s.Folder)
+	}
+	s.Folder = folder
+
+	var auth []ssh.AuthMethod
+	if s.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(s.PrivateKeyFile)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return fmt.Errorf("parse private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.Password != "" {
+		auth = append(auth, ssh.Password(s.Password))
+	}
+	if len(auth) == 0 {
+		return errors.New("password or privateKeyFile is required")
+	}
+	var hostKey ssh.HostKeyCallback
+	switch {
+	case s.HostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.HostKey))
+		if err != nil {
+			return fmt.Errorf("parse hostKey: %w", err)
+		}
+		hostKey = ssh.FixedHostKey(key)
+	case s.InsecureSkipVerify:
+		hostKey = ssh.InsecureIgnoreHostKey()
+	default:
+		return errors.New("hostKey is required unless insecureSkipHostKeyVerify is set")
+	}
+	s.client = &ssh.ClientConfig{User: s.User, Auth: auth, HostKeyCallback: hostKey, Timeout: 30 * time.Second}
+	return nil
+}
+
+// SFTPIngest runs the pollers for every configured source.
+type SFTPIngest struct {
+	in      *Ingest
+	locker  Locker
+	sources []*SFTPSource
+}
+
+func NewSFTPIngest(in *Ingest, locker Locker, sources []*SFTPSource) *SFTPIngest {
+	return &SFTPIngest{in: in, locker: locker, sources: sources}
+}
+
+// Run polls each source on its schedule until ctx is cancelled. The lock
+// keeps instances sharing the source from pulling the same files.
+func (s *SFTPIngest) Run(ctx context.Context) {
+	for _, src := range s.sources {
+		go func(src *SFTPSource) {
+			for {
+				next := src.sched.Next(time.Now())
+				if next.IsZero() {
+					log.Printf("sftp %s: schedule %q never fires", src.Name, src.Schedule)
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(next)):
+				}
+				runExclusive(ctx, s.locker, "sftp-ingest:"+src.Name, func(ctx context.Context) {
+					if err := s.poll(ctx, src); err != nil {
+						log.Printf("sftp %s: %v", src.Name, err)
+					}
+				})
+			}
+		}(src)
+	}
+}
+
+func (s *SFTPIngest) poll(ctx context.Context, src *SFTPSource) error {
+	c, err := dialSFTP(src.Addr, src.client)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	entries, err := c.ReadDir(src.Dir)
+	if err != nil {
+		return fmt.Errorf("list %s: %w", src.Dir, err)
+	}
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if ok, _ := path.Match(src.Pattern, e.Name); !ok || !e.IsRegular() {
+			continue
+		}
+		if !e.ModTime.IsZero() && time.Since(e.ModTime) < src.settle {
+			continue
+		}
+		s.pull(ctx, c, src, e.Name)
+	}
+	return nil
+}
+
+// pull ingests one remote file and moves it out of the way. Server-side
+// failures leave it in place to be retried on the next poll.
+func (s *SFTPIngest) pull(ctx context.Context, c *sftpClient, src *SFTPSource, name string) {
+	remote := path.Join(src.Dir, name)
+	f, err := c.Open(remote)
+	if err != nil {
+		log.Printf("sftp %s: open %s: %v", src.Name, remote, err)
+		return
+	}
+	limit := s.in.Limits.Default
+	meta := UploadMeta{
+		Folder:   src.Folder,
+		Tags:     src.Tags,
+		MaxBytes: limit,
+		Source:   "sftp://" + src.User + "@" + src.Addr + remote,
+	}
+	rec, uerr := s.in.Receive(ctx, &limitFile{r: f, n: limit}, name, meta)
+	f.Close()
+
+	dest, outcome := src.ProcessedDir, "ingested"
+	switch {
+	case uerr != nil && uerr.Status >= http.StatusInternalServerError:
+		log.Printf("sftp %s: ingest %s: %s; will retry", src.Name, remote, uerr.Message)
+		metrics.Counter("sftp_files_total", "Files pulled from SFTP sources, by source and outcome.", "source", src.Name, "outcome", "failed").Inc()
+		return
+	case uerr != nil:
+		dest, outcome = src.RejectedDir, "rejected"
+		log.Printf("sftp %s: rejected %s: %s", src.Name, remote, uerr.Message)
+	default:
+		log.Printf("sftp %s: ingested %s as %s", src.Name, remote, rec.ID)
+	}
+	metrics.Counter("sftp_files_total", "Files pulled from SFTP sources, by source and outcome.", "source", src.Name, "outcome", outcome).Inc()
+	if err := moveRemote(c, remote, dest, name); err != nil {
+		log.Printf("sftp %s: move %s to %s: %v", src.Name, remote, dest, err)
+	}
+}
+
+// moveRemote renames remote into dir, creating dir if needed. A name
+// already taken there gets a timestamp suffix rather than failing, since
+// a file left in place would be pulled again.
+func moveRemote(c *sftpClient, remote, dir, name string) error {
+	_ = c.Mkdir(dir)
+	err := c.Rename(remote, path.Join(dir, name))
+	if err == nil {
+		return nil
+	}
+	return c.Rename(remote, path.Join(dir, name+"."+strconv.FormatInt(time.Now().Unix(), 10)))
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrShareNotFound = errors.New("share link not found")
+
+const (
+	// maxShareAccessLog bounds the per-link access log; older entries
+	// roll off.
+	maxShareAccessLog = 200
+	maxSharePassword  = 1024
+)
+
+// Outcomes recorded in a share's access log.
+const (
+	ShareDownloaded   = "downloaded"
+	ShareBadPassword  = "bad_password"
+	ShareLimitReached = "limit_reached"
+	ShareExpired      = "expired"
+	ShareNotAvailable = "not_available"
+)
+
+// Share is a public link to one file. Anyone holding the link can download
+// the file unless it has a password, has expired or has used up its
+// download allowance.
+type Share struct {
+	ID           string        `json:"id"`
+	FileID       string        `json:"fileId"`
+	PasswordHash string        `json:"passwordHash,omitempty"`
+	MaxDownloads int           `json:"maxDownloads,omitempty"`
+	Downloads    int           `json:"downloads"`
+	ExpiresAt    *time.Time    `json:"expiresAt,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	Access       []ShareAccess `json:"access,omitempty"`
+}
+
+type ShareAccess struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Outcome    string    `json:"outcome"`
+}
+
+// ShareResponse is the owner's view of a share; the password hash stays
+// internal.
+type ShareResponse struct {
+	ID           string        `json:"id"`
+	FileID       string        `json:"fileId"`
+	URL          string        `json:"url"`
+	HasPassword  bool          `json:"hasPassword"`
+	MaxDownloads int           `json:"maxDownloads,omitempty"`
+	Downloads    int           `json:"downloads"`
+	ExpiresAt    *time.Time    `json:"expiresAt,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	Access       []ShareAccess `json:"access,omitempty"`
+}
+
+func (s *Share) response(withAccess bool) ShareResponse {
+	resp := ShareResponse{
+		ID:           s.ID,
+		FileID:       s.FileID,
+		URL:          "/v1/shares/" + s.ID,
+		HasPassword:  s.PasswordHash != "",
+		MaxDownloads: s.MaxDownloads,
+		Downloads:    s.Downloads,
+		ExpiresAt:    s.ExpiresAt,
+		CreatedAt:    s.CreatedAt,
+	}
+	if withAccess {
+		resp.Access = s.Access
+		if resp.Access == nil {
+			resp.Access = []ShareAccess{}
+		}
+	}
+	return resp
+}
+
+func (s *Share) record(r *http.Request, outcome string) {
+	s.Access = append(s.Access, ShareAccess{
+		Time:       time.Now().UTC(),
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		Outcome:    outcome,
+	})
+	if n := len(s.Access) - maxShareAccessLog; n > 0 {
+		s.Access = slices.Delete(s.Access, 0, n)
+	}
+}
+
+type ShareStore interface {
+	GetShare(ctx context.Context, id string) (*Share, error)
+	PutShare(ctx context.Context, sh *Share) error
+	DeleteShare(ctx context.Context, id string) error
+	ListShares(ctx context.Context) ([]*Share, error)
+}
+
+// Argon2id parameters for share passwords (the OWASP baseline), stored in
+// the hash string so they can be raised later without breaking old links.
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeyLen  = 32
+)
+
+func hashSharePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkSharePassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	got := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+type Shares struct {
+	store    ShareStore
+	files    MetadataStore
+	locker   Locker
+	notifier *Notifier
+}
+
+func NewShares(store ShareStore, files MetadataStore, locker Locker, notifier *Notifier) *Shares {
+	return &Shares{store: store, files: files, locker: locker, notifier: notifier}
+}
+
+type shareRequest struct {
+	Password         *string `json:"password"`
+	MaxDownloads     *int    `json:"maxDownloads"`
+	ExpiresInSeconds *int    `json:"expiresInSeconds"`
+}
+
+// apply validates req and copies the fields it sets onto sh. An empty
+// password removes protection; zero clears the download limit or expiry.
+func (req *shareRequest) apply(sh *Share) string {
+	if req.Password != nil {
+		if len(*req.Password) > maxSharePassword {
+			return "Field 'password' is too long"
+		}
+		sh.PasswordHash = ""
+		if *req.Password != "" {
+			hash, err := hashSharePassword(*req.Password)
+			if err != nil {
+				return "Failed to hash password"
+			}
+			sh.PasswordHash = hash
+		}
+	}
+	if req.MaxDownloads != nil {
+		if *req.MaxDownloads < 0 {
+			return "Field 'maxDownloads' must not be negative"
+		}
+		sh.MaxDownloads = *req.MaxDownloads
+	}
+	if req.ExpiresInSeconds != nil {
+		if *req.ExpiresInSeconds < 0 {
+			return "Field 'expiresInSeconds' must not be negative"
+		}
+		sh.ExpiresAt = nil
+		if *req.ExpiresInSeconds > 0 {
+			exp := time.Now().UTC().Add(time.Duration(*req.ExpiresInSeconds) * time.Second).Truncate(time.Second)
+			sh.ExpiresAt = &exp
+		}
+	}
+	return ""
+}
+
+// CollectionHandler serves POST (create) and GET (list) on
+// /v1/files/{id}/shares.
+func (s *Shares) CollectionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec, ok := loadRecord(w, r, s.files, r.PathValue("id"))
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			var req shareRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<14)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			id, err := randomHex(16)
+			if err != nil {
+				writeInternalError(w, "Failed to generate share ID")
+				return
+			}
+			sh := &Share{ID: id, FileID: rec.ID, CreatedAt: time.Now().UTC()}
+			if msg := req.apply(sh); msg != "" {
+				writeBadRequest(w, msg)
+				return
+			}
+			if err := s.store.PutShare(r.Context(), sh); err != nil {
+				writeInternalError(w, "Failed to save share link")
+				return
+			}
+			w.Header().Set("Location", "/v1/files/"+rec.ID+"/shares/"+id)
+			writeJSON(w, http.StatusCreated, sh.response(false))
+
+		case http.MethodGet:
+			all, err := s.store.ListShares(r.Context())
+			if err != nil {
+				writeInternalError(w, "Failed to list share links")
+				return
+			}
+			out := []ShareResponse{}
+			for _, sh := range all {
+				if sh.FileID == rec.ID {
+					out = append(out, sh.response(false))
+				}
+			}
+			slices.SortFunc(out, func(a, b ShareResponse) int { return a.CreatedAt.Compare(b.CreatedAt) })
+			writeJSON(w, http.StatusOK, out)
+
+		default:
+			writeMethodNotAllowed(w, "Only GET and POST methods are allowed for share links")
+		}
+	}
+}
+
+// ShareHandler serves GET (details and access log), PATCH (change password,
+// limit or expiry) and DELETE (revoke) on /v1/files/{id}/shares/{share}.
+func (s *Shares) ShareHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok := s.lock(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		sh, ok := s.load(w, r)
+		if !ok {
+			return
+		}
+		if sh.FileID != r.PathValue("id") {
+			writeNotFound(w, "Share link '"+sh.ID+"' not found")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, sh.response(true))
+
+		case http.MethodPatch:
+			var req shareRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<14)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+			if msg := req.apply(sh); msg != "" {
+				writeBadRequest(w, msg)
+				return
+			}
+			if err := s.store.PutShare(r.Context(), sh); err != nil {
+				writeInternalError(w, "Failed to save share link")
+				return
+			}
+			writeJSON(w, http.StatusOK, sh.response(true))
+
+		case http.MethodDelete:
+			if err := s.store.DeleteShare(r.Context(), sh.ID); err != nil && !errors.Is(err, ErrShareNotFound) {
+				writeInternalError(w, "Failed to delete share link")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeMethodNotAllowed(w, "Only GET, PATCH and DELETE methods are allowed for share links")
+		}
+	}
+}
+
+// DownloadHandler serves the file behind a share link: GET /v1/shares/{share}.
+// Passwords arrive as the password of HTTP Basic auth, so a plain link
+// makes browsers prompt for it, or in X-Share-Password for scripted
+// clients. Every attempt is written to the link's access log.
+func (s *Shares) DownloadHandler(download http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w, "Only GET and HEAD methods are allowed for share links")
+			return
+		}
+		release, ok := s.lock(w, r)
+		if !ok {
+			return
+		}
+		sh, ok := s.load(w, r)
+		if !ok {
+			release()
+			return
+		}
+
+		outcome := s.admit(w, r, sh)
+		if outcome == ShareDownloaded && r.Method == http.MethodGet {
+			sh.Downloads++
+		}
+		sh.record(r, outcome)
+		err := s.store.PutShare(r.Context(), sh)
+		release()
+		access := sh.Access[len(sh.Access)-1]
+		s.notifier.Notify(NotifyData{Event: NotifyShareAccessed, Share: sh, Access: &access})
+		if err != nil {
+			log.Printf("shares: update %s: %v", sh.ID, err)
+			if outcome == ShareDownloaded {
+				writeInternalError(w, "Failed to update share link")
+				return
+			}
+		}
+		if outcome == ShareDownloaded {
+			download(w, withCacheClass(withFileID(r, sh.FileID), CacheNone))
+		}
+	}
+}
+
+// admit decides whether r may download through sh, writing the refusal
+// itself when it may not.
+func (s *Shares) admit(w http.ResponseWriter, r *http.Request, sh *Share) string {
+	if sh.ExpiresAt != nil && !time.Now().Before(*sh.ExpiresAt) {
+		writeMessage(w, http.StatusGone, "gone", newMessage("share_expired"))
+		return ShareExpired
+	}
+	if sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads {
+		writeMessage(w, http.StatusGone, "gone", newMessage("share_limit_reached"))
+		return ShareLimitReached
+	}
+	if sh.PasswordHash != "" {
+		password := r.Header.Get("X-Share-Password")
+		if _, p, ok := r.BasicAuth(); ok && password == "" {
+			password = p
+		}
+		if password == "" || !checkSharePassword(sh.PasswordHash, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="share", charset="UTF-8"`)
+			writeMessage(w, http.StatusUnauthorized, "unauthorized", newMessage("share_password_required"))
+			return ShareBadPassword
+		}
+	}
+	if _, err := s.files.Get(r.Context(), sh.FileID); errors.Is(err, ErrNotFound) {
+		writeMessage(w, http.StatusNotFound, "not_found", newMessage("share_unavailable"))
+		return ShareNotAvailable
+	}
+	return ShareDownloaded
+}
+
+// lock serialises updates to one share so concurrent downloads cannot go
+// past its limit.
+func (s *Shares) lock(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	id := r.PathValue("share")
+	release, ok, err := s.locker.TryLock(r.Context(), "share:"+id, time.Minute)
+	if err != nil {
+		writeInternalError(w, "Failed to lock share link")
+		return nil, false
+	}
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		writeConflict(w, "Share link '"+id+"' is busy; retry shortly")
+		return nil, false
+	}
+	return release, true
+}
+
+func (s *Shares) load(w http.ResponseWriter, r *http.Request) (*Share, bool) {
+	id := r.PathValue("share")
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		writeNotFound(w, "Share link '"+id+"' not found")
+		return nil, false
+	}
+	sh, err := s.store.GetShare(r.Context(), id)
+	if errors.Is(err, ErrShareNotFound) {
+		writeNotFound(w, "Share link '"+id+"' not found")
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, "Failed to load share link")
+		return nil, false
+	}
+	return sh, true
+}
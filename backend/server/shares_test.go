@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharePassword(t *testing.T) {
+	hash, err := hashSharePassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+	tests := []struct {
+		name, encoded, password string
+		ok                      bool
+	}{
+		{"right password", hash, "s3cret", true},
+		{"wrong password", hash, "S3cret", false},
+		{"empty password", hash, "", false},
+		{"other algorithm", strings.Replace(hash, "argon2id", "argon2i", 1), "s3cret", false},
+		{"other version", strings.Replace(hash, "v=19", "v=16", 1), "s3cret", false},
+		{"other salt", strings.Join(append(parts[:4:4], "AAAAAAAAAAAAAAAAAAAAAA", parts[5]), "$"), "s3cret", false},
+		{"malformed", "$argon2id$v=19$m=19456$x", "s3cret", false},
+		{"empty hash", "", "", false},
+	}
+	for _, tt := range tests {
+		if got := checkSharePassword(tt.encoded, tt.password); got != tt.ok {
+			t.Errorf("%s: checkSharePassword = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+	if again, _ := hashSharePassword("s3cret"); again == hash {
+		t.Error("two hashes of one password share a salt")
+	}
+}
+
+// A share link admits downloads only with its password, before it expires
+// and up to its limit, and logs every attempt.
+func TestShareDownload(t *testing.T) {
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	rec := testRecord(t, in)
+	shares := NewShares(db, db, newLocalLocker(), nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/files/{id}/shares", shares.CollectionHandler())
+	mux.HandleFunc("/v1/files/{id}/shares/{share}", shares.ShareHandler())
+	mux.HandleFunc("/v1/shares/{share}", shares.DownloadHandler(DownloadHandler(db, db, nil)))
+
+	do := func(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	create := func(t *testing.T, body string) ShareResponse {
+		t.Helper()
+		w := do(http.MethodPost, "/v1/files/"+rec.ID+"/shares", body, nil)
+		var sh ShareResponse
+		if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &sh) != nil {
+			t.Fatalf("create: %d %s", w.Code, w.Body)
+		}
+		if strings.Contains(w.Body.String(), "argon2") {
+			t.Errorf("share response leaks the password hash: %s", w.Body)
+		}
+		return sh
+	}
+	password := func(p string) http.Header { return http.Header{"X-Share-Password": {p}} }
+	basic := func(p string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth("", p)
+		return req.Header
+	}
+
+	t.Run("password and limit", func(t *testing.T) {
+		sh := create(t, `{"password": "s3cret", "maxDownloads": 2}`)
+		steps := []struct {
+			method string
+			header http.Header
+			status int
+		}{
+			{http.MethodGet, nil, http.StatusUnauthorized},
+			{http.MethodGet, password("wrong"), http.StatusUnauthorized},
+			{http.MethodGet, basic("wrong"), http.StatusUnauthorized},
+			{http.MethodHead, password("s3cret"), http.StatusOK},
+			{http.MethodGet, password("s3cret"), http.StatusOK},
+			{http.MethodGet, basic("s3cret"), http.StatusOK},
+			{http.MethodGet, password("s3cret"), http.StatusGone},
+		}
+		for i, st := range steps {
+			w := do(st.method, sh.URL, "", st.header)
+			if w.Code != st.status {
+				t.Fatalf("step %d: %s: %d %s, want %d", i, st.method, w.Code, w.Body, st.status)
+			}
+			if st.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("step %d: no WWW-Authenticate challenge", i)
+			}
+		}
+
+		w := do(http.MethodGet, "/v1/files/"+rec.ID+"/shares/"+sh.ID, "", nil)
+		var got ShareResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		var outcomes []string
+		for _, a := range got.Access {
+			outcomes = append(outcomes, a.Outcome)
+		}
+		want := "bad_password,bad_password,bad_password,downloaded,downloaded,downloaded,limit_reached"
+		if got.Downloads != 2 || strings.Join(outcomes, ",") != want {
+			t.Errorf("downloads %d, access log %v; want 2 and %s", got.Downloads, outcomes, want)
+		}
+	})
+
+	t.Run("password removed", func(t *testing.T) {
+		sh := create(t, `{"password": "s3cret"}`)
+		path := "/v1/files/" + rec.ID + "/shares/" + sh.ID
+		if w := do(http.MethodPatch, path, `{"password": ""}`, nil); w.Code != http.StatusOK {
+			t.Fatalf("patch: %d %s", w.Code, w.Body)
+		}
+		if w := do(http.MethodGet, sh.URL, "", nil); w.Code != http.StatusOK {
+			t.Errorf("download: %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		sh := create(t, `{"expiresInSeconds": 60}`)
+		stored, err := db.GetShare(context.Background(), sh.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		past := time.Now().Add(-time.Second)
+		stored.ExpiresAt = &past
+		if err := db.PutShare(context.Background(), stored); err != nil {
+			t.Fatal(err)
+		}
+		if w := do(http.MethodGet, sh.URL, "", nil); w.Code != http.StatusGone {
+			t.Errorf("download: %d %s, want 410", w.Code, w.Body)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		sh := create(t, `{}`)
+		if w := do(http.MethodDelete, "/v1/files/"+rec.ID+"/shares/"+sh.ID, "", nil); w.Code != http.StatusNoContent {
+			t.Fatalf("delete: %d %s", w.Code, w.Body)
+		}
+		if w := do(http.MethodGet, sh.URL, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("download: %d %s, want 404", w.Code, w.Body)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, body := range []string{`{"maxDownloads": -1}`, `{"expiresInSeconds": -5}`, `{"password": "` + strings.Repeat("x", maxSharePassword+1) + `"}`} {
+			if w := do(http.MethodPost, "/v1/files/"+rec.ID+"/shares", body, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("create %s: %d, want 400", body[:min(len(body), 40)], w.Code)
+			}
+		}
+		if w := do(http.MethodGet, "/v1/shares/not-hex", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("malformed ID: %d, want 404", w.Code)
+		}
+	})
+}
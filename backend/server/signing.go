@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+)
+
+// Signer produces HMAC-SHA256 signatures for documents the server hands out
+// and later needs to vouch for. It signs with the key's current value and
+// verifies against the current and previous values, so a key rotated in the
+// secrets provider does not invalidate what was signed just before.
+type Signer struct {
+	key *Secret
+}
+
+// NewSigner uses key when set; otherwise it falls back to an ephemeral random
+// key, which means signatures will not verify across restarts.
+func NewSigner(key *Secret) *Signer {
+	if key.Value() != "" {
+		return &Signer{key: key}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("generate signing key: %v", err)
+	}
+	log.Println("UPLOAD_SIGNING_KEY not set; using an ephemeral signing key")
+	return &Signer{key: StaticSecret(string(b))}
+}
+
+func hmacSum(key string, payload []byte) []byte {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+func (s *Signer) Sign(payload []byte) string {
+	return hex.EncodeToString(hmacSum(s.key.Value(), payload))
+}
+
+func (s *Signer) Verify(payload []byte, signature string) bool {
+	want, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	if hmac.Equal(hmacSum(s.key.Value(), payload), want) {
+		return true
+	}
+	prev := s.key.Previous()
+	return prev != "" && hmac.Equal(hmacSum(prev, payload), want)
+}
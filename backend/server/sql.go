@@ -0,0 +1,1085 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file implements the small SQL dialect accepted by the query
+// endpoint: a single SELECT over one CSV, with WHERE, GROUP BY, HAVING,
+// ORDER BY, LIMIT and OFFSET, the usual operators, a handful of scalar
+// functions and COUNT/SUM/AVG/MIN/MAX. Every cell is text; operators treat
+// values that parse as numbers numerically and empty cells as NULL.
+
+// sqlMaxDepth bounds expression nesting so hostile input cannot exhaust
+// the stack.
+const sqlMaxDepth = 64
+
+type sqlError struct{ msg string }
+
+func (e *sqlError) Error() string { return e.msg }
+
+func sqlErrorf(format string, args ...any) error {
+	return &sqlError{fmt.Sprintf(format, args...)}
+}
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokQuoted // "double quoted" identifier
+	tokString
+	tokNumber
+	tokOp
+)
+
+type sqlToken struct {
+	kind     int
+	text     string
+	pos, end int
+}
+
+func lexSQL(src string) ([]sqlToken, error) {
+	var toks []sqlToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '-' && strings.HasPrefix(src[i:], "--"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '_' || c < 0x80 && unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] < 0x80 && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])))) {
+				j++
+			}
+			toks = append(toks, sqlToken{tokIdent, src[i:j], i, j})
+			i = j
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+				j++
+				if j < len(src) && (src[j] == '+' || src[j] == '-') {
+					j++
+				}
+				for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+					j++
+				}
+			}
+			toks = append(toks, sqlToken{tokNumber, src[i:j], i, j})
+			i = j
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, sqlErrorf("unterminated %c at position %d", c, i)
+				}
+				if src[j] == c {
+					// A doubled quote stands for itself.
+					if j+1 < len(src) && src[j+1] == c {
+						b.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(src[j])
+				j++
+			}
+			kind := tokString
+			if c == '"' {
+				kind = tokQuoted
+			}
+			toks = append(toks, sqlToken{kind, b.String(), i, j + 1})
+			i = j + 1
+		default:
+			op := string(c)
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "<=", ">=", "<>", "!=", "||":
+					op = two
+				}
+			}
+			if !strings.Contains("=<>!|(),*+-/%;", op[:1]) || op == "!" || op == "|" {
+				return nil, sqlErrorf("unexpected character %q at position %d", c, i)
+			}
+			toks = append(toks, sqlToken{tokOp, op, i, i + len(op)})
+			i += len(op)
+		}
+	}
+	return append(toks, sqlToken{tokEOF, "", len(src), len(src)}), nil
+}
+
+// sqlReserved words cannot be used as bare column names or aliases; quote
+// them to refer to columns of that name.
+var sqlReserved = map[string]bool{
+	"SELECT": true, "DISTINCT": true, "FROM": true, "WHERE": true, "GROUP": true,
+	"BY": true, "HAVING": true, "ORDER": true, "ASC": true, "DESC": true,
+	"LIMIT": true, "OFFSET": true, "AS": true, "AND": true, "OR": true,
+	"NOT": true, "IN": true, "IS": true, "NULL": true, "LIKE": true,
+	"ILIKE": true, "BETWEEN": true, "TRUE": true, "FALSE": true,
+}
+
+// sqlSelect is a parsed query.
+type sqlSelect struct {
+	Distinct bool
+	Items    []sqlItem
+	Where    sqlExpr
+	GroupBy  []sqlExpr
+	Having   sqlExpr
+	OrderBy  []sqlOrder
+	Limit    int // -1 when absent
+	Offset   int
+
+	aggs []*sqlAgg
+}
+
+type sqlItem struct {
+	Expr  sqlExpr
+	Name  string
+	Star  bool
+	Alias bool
+}
+
+type sqlOrder struct {
+	Expr sqlExpr
+	Desc bool
+	Pos  int // output column when ordering by alias or ordinal, else -1
+}
+
+type sqlParser struct {
+	src   string
+	toks  []sqlToken
+	p     int
+	depth int
+	aggs  []*sqlAgg
+	inAgg bool
+	// funcs adds scalar functions to sqlFunctions, for dialects built on
+	// this one; nil for queries.
+	funcs map[string]sqlFunction
+}
+
+// parseSQL parses a single SELECT statement.
+func parseSQL(src string) (*sqlSelect, error) {
+	toks, err := lexSQL(src)
+	if err != nil {
+		return nil, err
+	}
+	ps := &sqlParser{src: src, toks: toks}
+	stmt, err := ps.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	stmt.aggs = ps.aggs
+	return stmt, nil
+}
+
+// parseSQLCondition parses a standalone boolean expression, as found in a
+// WHERE clause, with funcs available besides the standard functions.
+// Aggregates are not allowed.
+func parseSQLCondition(src string, funcs map[string]sqlFunction) (sqlExpr, error) {
+	toks, err := lexSQL(src)
+	if err != nil {
+		return nil, err
+	}
+	ps := &sqlParser{src: src, toks: toks, funcs: funcs}
+	e, err := ps.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if ps.peek().kind != tokEOF {
+		return nil, ps.errExpected("end of expression")
+	}
+	if len(ps.aggs) > 0 {
+		return nil, sqlErrorf("aggregate functions are not allowed here")
+	}
+	return e, nil
+}
+
+func (ps *sqlParser) peek() sqlToken { return ps.toks[ps.p] }
+
+func (ps *sqlParser) next() sqlToken {
+	t := ps.toks[ps.p]
+	if t.kind != tokEOF {
+		ps.p++
+	}
+	return t
+}
+
+func (ps *sqlParser) isKeyword(kw string) bool {
+	t := ps.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, kw)
+}
+
+func (ps *sqlParser) acceptKeyword(kws ...string) bool {
+	save := ps.p
+	for _, kw := range kws {
+		if !ps.isKeyword(kw) {
+			ps.p = save
+			return false
+		}
+		ps.p++
+	}
+	return true
+}
+
+func (ps *sqlParser) expectKeyword(kws ...string) error {
+	if !ps.acceptKeyword(kws...) {
+		return ps.errExpected(strings.Join(kws, " "))
+	}
+	return nil
+}
+
+func (ps *sqlParser) isOp(op string) bool {
+	t := ps.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (ps *sqlParser) acceptOp(op string) bool {
+	if ps.isOp(op) {
+		ps.p++
+		return true
+	}
+	return false
+}
+
+func (ps *sqlParser) expectOp(op string) error {
+	if !ps.acceptOp(op) {
+		return ps.errExpected("'" + op + "'")
+	}
+	return nil
+}
+
+func (ps *sqlParser) errExpected(what string) error {
+	t := ps.peek()
+	if t.kind == tokEOF {
+		return sqlErrorf("expected %s at end of query", what)
+	}
+	return sqlErrorf("expected %s at position %d, found %q", what, t.pos, ps.src[t.pos:t.end])
+}
+
+func (ps *sqlParser) parseSelect() (*sqlSelect, error) {
+	if err := ps.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	stmt := &sqlSelect{Limit: -1}
+	stmt.Distinct = ps.acceptKeyword("DISTINCT")
+	for {
+		item, err := ps.parseItem()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Items = append(stmt.Items, item)
+		if !ps.acceptOp(",") {
+			break
+		}
+	}
+	if err := ps.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if t := ps.next(); t.kind != tokIdent && t.kind != tokQuoted || t.kind == tokIdent && sqlReserved[strings.ToUpper(t.text)] {
+		ps.p--
+		return nil, ps.errExpected("a table name")
+	}
+
+	var err error
+	if ps.acceptKeyword("WHERE") {
+		if stmt.Where, err = ps.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if ps.acceptKeyword("GROUP", "BY") {
+		for {
+			e, err := ps.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, e)
+			if !ps.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if ps.acceptKeyword("HAVING") {
+		if stmt.Having, err = ps.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if ps.acceptKeyword("ORDER", "BY") {
+		for {
+			e, err := ps.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			o := sqlOrder{Expr: e, Pos: -1}
+			if ps.acceptKeyword("DESC") {
+				o.Desc = true
+			} else {
+				ps.acceptKeyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, o)
+			if !ps.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if ps.acceptKeyword("LIMIT") {
+		if stmt.Limit, err = ps.parseCount("LIMIT"); err != nil {
+			return nil, err
+		}
+	}
+	if ps.acceptKeyword("OFFSET") {
+		if stmt.Offset, err = ps.parseCount("OFFSET"); err != nil {
+			return nil, err
+		}
+	}
+	ps.acceptOp(";")
+	if ps.peek().kind != tokEOF {
+		return nil, ps.errExpected("end of query")
+	}
+	return stmt, nil
+}
+
+func (ps *sqlParser) parseCount(clause string) (int, error) {
+	t := ps.next()
+	n, err := strconv.Atoi(t.text)
+	if t.kind != tokNumber || err != nil || n < 0 {
+		return 0, sqlErrorf("%s needs a non-negative integer", clause)
+	}
+	return n, nil
+}
+
+func (ps *sqlParser) parseItem() (sqlItem, error) {
+	if ps.acceptOp("*") {
+		return sqlItem{Star: true}, nil
+	}
+	start := ps.p
+	e, err := ps.parseExpr()
+	if err != nil {
+		return sqlItem{}, err
+	}
+	item := sqlItem{Expr: e, Name: ps.text(start)}
+	if c, ok := e.(*sqlColumn); ok {
+		item.Name = c.Name
+	}
+	explicit := ps.acceptKeyword("AS")
+	if t := ps.peek(); t.kind == tokQuoted || t.kind == tokIdent && !sqlReserved[strings.ToUpper(t.text)] {
+		ps.p++
+		item.Name, item.Alias = t.text, true
+	} else if explicit {
+		return sqlItem{}, ps.errExpected("an alias")
+	}
+	return item, nil
+}
+
+// text returns the source of the tokens from start up to the current one.
+func (ps *sqlParser) text(start int) string {
+	return ps.src[ps.toks[start].pos:ps.toks[ps.p-1].end]
+}
+
+func (ps *sqlParser) parseExpr() (sqlExpr, error) {
+	ps.depth++
+	defer func() { ps.depth-- }()
+	if ps.depth > sqlMaxDepth {
+		return nil, sqlErrorf("expression nested too deeply")
+	}
+	return ps.parseOr()
+}
+
+func (ps *sqlParser) parseOr() (sqlExpr, error) {
+	l, err := ps.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for ps.acceptKeyword("OR") {
+		r, err := ps.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &sqlBinary{Op: "OR", L: l, R: r}
+	}
+	return l, nil
+}
+
+func (ps *sqlParser) parseAnd() (sqlExpr, error) {
+	l, err := ps.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for ps.acceptKeyword("AND") {
+		r, err := ps.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &sqlBinary{Op: "AND", L: l, R: r}
+	}
+	return l, nil
+}
+
+func (ps *sqlParser) parseNot() (sqlExpr, error) {
+	if ps.acceptKeyword("NOT") {
+		ps.depth++
+		defer func() { ps.depth-- }()
+		if ps.depth > sqlMaxDepth {
+			return nil, sqlErrorf("expression nested too deeply")
+		}
+		x, err := ps.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlUnary{Op: "NOT", X: x}, nil
+	}
+	return ps.parseComparison()
+}
+
+func (ps *sqlParser) parseComparison() (sqlExpr, error) {
+	l, err := ps.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "<>", "!=", "<", "<=", ">", ">="} {
+		if ps.acceptOp(op) {
+			r, err := ps.parseConcat()
+			if err != nil {
+				return nil, err
+			}
+			if op == "!=" {
+				op = "<>"
+			}
+			return &sqlBinary{Op: op, L: l, R: r}, nil
+		}
+	}
+	if ps.acceptKeyword("IS") {
+		not := ps.acceptKeyword("NOT")
+		if err := ps.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &sqlIsNull{X: l, Not: not}, nil
+	}
+	not := ps.acceptKeyword("NOT")
+	switch {
+	case ps.acceptKeyword("IN"):
+		if err := ps.expectOp("("); err != nil {
+			return nil, err
+		}
+		in := &sqlIn{X: l, Not: not}
+		for {
+			e, err := ps.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			in.List = append(in.List, e)
+			if !ps.acceptOp(",") {
+				break
+			}
+		}
+		return in, ps.expectOp(")")
+	case ps.isKeyword("LIKE") || ps.isKeyword("ILIKE"):
+		fold := ps.isKeyword("ILIKE")
+		ps.p++
+		pat, err := ps.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlLike{X: l, Pattern: pat, Not: not, Fold: fold}, nil
+	case ps.acceptKeyword("BETWEEN"):
+		lo, err := ps.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		if err := ps.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		hi, err := ps.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlBetween{X: l, Lo: lo, Hi: hi, Not: not}, nil
+	case not:
+		return nil, ps.errExpected("IN, LIKE or BETWEEN after NOT")
+	}
+	return l, nil
+}
+
+func (ps *sqlParser) parseConcat() (sqlExpr, error) {
+	l, err := ps.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for ps.acceptOp("||") {
+		r, err := ps.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		l = &sqlBinary{Op: "||", L: l, R: r}
+	}
+	return l, nil
+}
+
+func (ps *sqlParser) parseAdditive() (sqlExpr, error) {
+	l, err := ps.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for ps.isOp("+") || ps.isOp("-") {
+		op := ps.next().text
+		r, err := ps.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		l = &sqlBinary{Op: op, L: l, R: r}
+	}
+	return l, nil
+}
+
+func (ps *sqlParser) parseMultiplicative() (sqlExpr, error) {
+	l, err := ps.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for ps.isOp("*") || ps.isOp("/") || ps.isOp("%") {
+		op := ps.next().text
+		r, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = &sqlBinary{Op: op, L: l, R: r}
+	}
+	return l, nil
+}
+
+func (ps *sqlParser) parseUnary() (sqlExpr, error) {
+	if ps.acceptOp("-") {
+		ps.depth++
+		defer func() { ps.depth-- }()
+		if ps.depth > sqlMaxDepth {
+			return nil, sqlErrorf("expression nested too deeply")
+		}
+		x, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlUnary{Op: "-", X: x}, nil
+	}
+	ps.acceptOp("+")
+	return ps.parsePrimary()
+}
+
+func (ps *sqlParser) parsePrimary() (sqlExpr, error) {
+	t := ps.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, sqlErrorf("invalid number %q", t.text)
+		}
+		return &sqlLiteral{V: f}, nil
+	case tokString:
+		return &sqlLiteral{V: t.text}, nil
+	case tokQuoted:
+		return &sqlColumn{Name: t.text, Quoted: true}, nil
+	case tokOp:
+		if t.text == "(" {
+			e, err := ps.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return e, ps.expectOp(")")
+		}
+	case tokIdent:
+		upper := strings.ToUpper(t.text)
+		switch upper {
+		case "NULL":
+			return &sqlLiteral{}, nil
+		case "TRUE", "FALSE":
+			return &sqlLiteral{V: upper == "TRUE"}, nil
+		}
+		if ps.isOp("(") {
+			return ps.parseCall(upper)
+		}
+		if !sqlReserved[upper] {
+			return &sqlColumn{Name: t.text}, nil
+		}
+	}
+	ps.p--
+	return nil, ps.errExpected("an expression")
+}
+
+func (ps *sqlParser) parseCall(name string) (sqlExpr, error) {
+	ps.next() // (
+	if _, ok := sqlAggregates[name]; ok {
+		if ps.inAgg {
+			return nil, sqlErrorf("aggregate functions cannot be nested")
+		}
+		agg := &sqlAgg{Name: name, Index: len(ps.aggs)}
+		if name == "COUNT" && ps.acceptOp("*") {
+			ps.aggs = append(ps.aggs, agg)
+			return agg, ps.expectOp(")")
+		}
+		agg.Distinct = ps.acceptKeyword("DISTINCT")
+		ps.inAgg = true
+		arg, err := ps.parseExpr()
+		ps.inAgg = false
+		if err != nil {
+			return nil, err
+		}
+		agg.Arg = arg
+		ps.aggs = append(ps.aggs, agg)
+		return agg, ps.expectOp(")")
+	}
+	fn, ok := ps.funcs[name]
+	if !ok {
+		fn, ok = sqlFunctions[name]
+	}
+	if !ok {
+		return nil, sqlErrorf("unknown function %s", name)
+	}
+	call := &sqlCall{Name: name, fn: fn.fn}
+	if !ps.isOp(")") {
+		for {
+			e, err := ps.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, e)
+			if !ps.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if len(call.Args) < fn.min || len(call.Args) > fn.max {
+		return nil, sqlErrorf("wrong number of arguments to %s", name)
+	}
+	return call, ps.expectOp(")")
+}
+
+// sqlEnv is what an expression is evaluated against: the current row, or
+// for grouped queries a representative row of the group plus its
+// aggregate results.
+type sqlEnv struct {
+	row  []string
+	aggs []any
+}
+
+type sqlExpr interface {
+	eval(env *sqlEnv) any
+}
+
+type sqlColumn struct {
+	Name   string
+	Quoted bool
+	Index  int
+}
+
+func (c *sqlColumn) eval(env *sqlEnv) any {
+	if c.Index >= len(env.row) || env.row[c.Index] == "" {
+		return nil
+	}
+	return env.row[c.Index]
+}
+
+type sqlLiteral struct{ V any }
+
+func (l *sqlLiteral) eval(*sqlEnv) any { return l.V }
+
+type sqlUnary struct {
+	Op string
+	X  sqlExpr
+}
+
+func (u *sqlUnary) eval(env *sqlEnv) any {
+	v := u.X.eval(env)
+	if u.Op == "NOT" {
+		b, ok := sqlBool(v)
+		if !ok {
+			return nil
+		}
+		return !b
+	}
+	f, ok := sqlNumber(v)
+	if !ok {
+		return nil
+	}
+	return -f
+}
+
+type sqlBinary struct {
+	Op   string
+	L, R sqlExpr
+}
+
+func (b *sqlBinary) eval(env *sqlEnv) any {
+	switch b.Op {
+	case "AND", "OR":
+		// Three-valued logic: NULL AND false is false, NULL OR true is true.
+		l, lok := sqlBool(b.L.eval(env))
+		if lok && l == (b.Op == "OR") {
+			return l
+		}
+		r, rok := sqlBool(b.R.eval(env))
+		if rok && r == (b.Op == "OR") {
+			return r
+		}
+		if !lok || !rok {
+			return nil
+		}
+		return l
+	}
+	l, r := b.L.eval(env), b.R.eval(env)
+	if l == nil || r == nil {
+		return nil
+	}
+	switch b.Op {
+	case "||":
+		return sqlString(l) + sqlString(r)
+	case "=", "<>", "<", "<=", ">", ">=":
+		c := sqlCompare(l, r)
+		switch b.Op {
+		case "=":
+			return c == 0
+		case "<>":
+			return c != 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}
+	x, xok := sqlNumber(l)
+	y, yok := sqlNumber(r)
+	if !xok || !yok {
+		return nil
+	}
+	switch b.Op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		if y == 0 {
+			return nil
+		}
+		return x / y
+	}
+	if y == 0 {
+		return nil
+	}
+	return math.Mod(x, y)
+}
+
+type sqlIsNull struct {
+	X   sqlExpr
+	Not bool
+}
+
+func (n *sqlIsNull) eval(env *sqlEnv) any { return (n.X.eval(env) == nil) != n.Not }
+
+type sqlIn struct {
+	X    sqlExpr
+	List []sqlExpr
+	Not  bool
+}
+
+func (in *sqlIn) eval(env *sqlEnv) any {
+	v := in.X.eval(env)
+	if v == nil {
+		return nil
+	}
+	sawNull := false
+	for _, e := range in.List {
+		w := e.eval(env)
+		if w == nil {
+			sawNull = true
+			continue
+		}
+		if sqlCompare(v, w) == 0 {
+			return !in.Not
+		}
+	}
+	if sawNull {
+		return nil
+	}
+	return in.Not
+}
+
+type sqlBetween struct {
+	X, Lo, Hi sqlExpr
+	Not       bool
+}
+
+func (b *sqlBetween) eval(env *sqlEnv) any {
+	v, lo, hi := b.X.eval(env), b.Lo.eval(env), b.Hi.eval(env)
+	if v == nil || lo == nil || hi == nil {
+		return nil
+	}
+	return (sqlCompare(v, lo) >= 0 && sqlCompare(v, hi) <= 0) != b.Not
+}
+
+type sqlLike struct {
+	X, Pattern sqlExpr
+	Not, Fold  bool
+
+	lastPattern string
+	re          *regexp.Regexp
+}
+
+func (l *sqlLike) eval(env *sqlEnv) any {
+	v, p := l.X.eval(env), l.Pattern.eval(env)
+	if v == nil || p == nil {
+		return nil
+	}
+	pat := sqlString(p)
+	if l.re == nil || pat != l.lastPattern {
+		var b strings.Builder
+		b.WriteString("(?s)^")
+		if l.Fold {
+			b.WriteString("(?i)")
+		}
+		for _, r := range pat {
+			switch r {
+			case '%':
+				b.WriteString(".*")
+			case '_':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		l.re, l.lastPattern = regexp.MustCompile(b.String()), pat
+	}
+	return l.re.MatchString(sqlString(v)) != l.Not
+}
+
+type sqlCall struct {
+	Name string
+	Args []sqlExpr
+	fn   func(args []any) any
+}
+
+func (c *sqlCall) eval(env *sqlEnv) any {
+	args := make([]any, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = a.eval(env)
+	}
+	return c.fn(args)
+}
+
+type sqlFunction struct {
+	min, max int
+	fn       func(args []any) any
+}
+
+var sqlFunctions = map[string]sqlFunction{
+	"LOWER":  {1, 1, sqlStringFunc(strings.ToLower)},
+	"UPPER":  {1, 1, sqlStringFunc(strings.ToUpper)},
+	"TRIM":   {1, 1, sqlStringFunc(strings.TrimSpace)},
+	"LENGTH": {1, 1, func(a []any) any { return nullOr(a[0], func() any { return float64(len([]rune(sqlString(a[0])))) }) }},
+	"ABS": {1, 1, func(a []any) any {
+		f, ok := sqlNumber(a[0])
+		if !ok {
+			return nil
+		}
+		return math.Abs(f)
+	}},
+	"ROUND": {1, 2, func(a []any) any {
+		f, ok := sqlNumber(a[0])
+		if !ok {
+			return nil
+		}
+		digits := 0.0
+		if len(a) == 2 {
+			if digits, ok = sqlNumber(a[1]); !ok {
+				return nil
+			}
+		}
+		scale := math.Pow(10, math.Trunc(digits))
+		return math.Round(f*scale) / scale
+	}},
+	"COALESCE": {1, 64, func(a []any) any {
+		for _, v := range a {
+			if v != nil {
+				return v
+			}
+		}
+		return nil
+	}},
+}
+
+func sqlStringFunc(f func(string) string) func([]any) any {
+	return func(a []any) any { return nullOr(a[0], func() any { return f(sqlString(a[0])) }) }
+}
+
+func nullOr(v any, f func() any) any {
+	if v == nil {
+		return nil
+	}
+	return f()
+}
+
+// sqlAgg is an aggregate call. Index is its slot in sqlEnv.aggs.
+type sqlAgg struct {
+	Name     string
+	Arg      sqlExpr // nil for COUNT(*)
+	Distinct bool
+	Index    int
+}
+
+func (a *sqlAgg) eval(env *sqlEnv) any {
+	if env.aggs == nil {
+		return nil
+	}
+	return env.aggs[a.Index]
+}
+
+var sqlAggregates = map[string]bool{"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true}
+
+// sqlAggState accumulates one aggregate over a group.
+type sqlAggState struct {
+	agg   *sqlAgg
+	n     int
+	sum   float64
+	best  any
+	seen  map[string]bool
+	valid bool
+}
+
+func (s *sqlAggState) add(env *sqlEnv) {
+	if s.agg.Arg == nil {
+		s.n++
+		return
+	}
+	v := s.agg.Arg.eval(env)
+	if v == nil {
+		return
+	}
+	if s.agg.Distinct {
+		key := sqlKey(v)
+		if s.seen[key] {
+			return
+		}
+		if s.seen == nil {
+			s.seen = map[string]bool{}
+		}
+		s.seen[key] = true
+	}
+	switch s.agg.Name {
+	case "COUNT":
+		s.n++
+	case "SUM", "AVG":
+		if f, ok := sqlNumber(v); ok {
+			s.sum += f
+			s.n++
+			s.valid = true
+		}
+	case "MIN", "MAX":
+		if !s.valid {
+			s.best, s.valid = v, true
+			return
+		}
+		c := sqlCompare(v, s.best)
+		if s.agg.Name == "MIN" && c < 0 || s.agg.Name == "MAX" && c > 0 {
+			s.best = v
+		}
+	}
+}
+
+func (s *sqlAggState) result() any {
+	switch s.agg.Name {
+	case "COUNT":
+		return float64(s.n)
+	case "SUM":
+		if s.valid {
+			return s.sum
+		}
+	case "AVG":
+		if s.valid {
+			return s.sum / float64(s.n)
+		}
+	default:
+		return s.best
+	}
+	return nil
+}
+
+// sqlNumber reads v as a number: numbers as they are, and text that
+// parses as one.
+func sqlNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func sqlBool(v any) (bool, bool) {
+	switch v := v.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		return b, err == nil
+	case float64:
+		return v != 0, true
+	}
+	return false, false
+}
+
+func sqlString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// sqlCompare orders two non-NULL values: numerically when both read as
+// numbers, as text otherwise.
+func sqlCompare(a, b any) int {
+	if x, ok := sqlNumber(a); ok {
+		if y, ok := sqlNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(sqlString(a), sqlString(b))
+}
+
+// sqlKey identifies a value for DISTINCT and GROUP BY; numbers that
+// compare equal share a key whether they came from text or not.
+func sqlKey(v any) string {
+	if v == nil {
+		return "\x00"
+	}
+	if f, ok := sqlNumber(v); ok {
+		return "n" + strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return "s" + sqlString(v)
+}
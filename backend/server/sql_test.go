@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const sqlPeople = "name,city,age\nann,Oslo,31\nbob,Rome,25\ncid,Oslo,40\ndee,Paris,25\neve,Rome,\n"
+
+// runSQL runs src over the CSV data and returns the result rows as text.
+func runSQL(src, data string, maxRows int) ([]string, bool, error) {
+	stmt, err := parseSQL(src)
+	if err != nil {
+		return nil, false, err
+	}
+	cr := newLenientCSVReader(strings.NewReader(data))
+	if err := stmt.start(cr); err != nil {
+		return nil, false, err
+	}
+	var rows []string
+	truncated, err := stmt.run(context.Background(), cr, maxRows, func(row []any) error {
+		line := make([]string, len(row))
+		for i, v := range row {
+			line[i] = sqlString(v)
+		}
+		rows = append(rows, strings.Join(line, ","))
+		return nil
+	})
+	return rows, truncated, err
+}
+
+func TestSQLQueries(t *testing.T) {
+	tests := []struct {
+		name, sql string
+		want      string // rows joined by ";"
+	}{
+		{"select all", `SELECT * FROM people LIMIT 1`, "ann,Oslo,31"},
+		{"where number", `SELECT name FROM people WHERE age > 30`, "ann;cid"},
+		{"where and or", `SELECT name FROM people WHERE city = 'Oslo' AND age < 35 OR city = 'Paris'`, "ann;dee"},
+		{"where null", `SELECT name FROM people WHERE age IS NULL`, "eve"},
+		{"where in", `SELECT name FROM people WHERE city IN ('Rome', 'Paris')`, "bob;dee;eve"},
+		{"where between", `SELECT name FROM people WHERE age BETWEEN 25 AND 31`, "ann;bob;dee"},
+		{"where like", `SELECT name FROM people WHERE city LIKE 'R%'`, "bob;eve"},
+		{"quoted column", `SELECT "name" FROM people WHERE "city" = 'Paris'`, "dee"},
+		{"expression and function", `SELECT UPPER(name) AS n, age + 1 FROM people WHERE name = 'bob'`, "BOB,26"},
+		{"group by", `SELECT city, COUNT(*) FROM people GROUP BY city ORDER BY city`, "Oslo,2;Paris,1;Rome,2"},
+		{"having", `SELECT city, COUNT(*) AS n FROM people GROUP BY city HAVING COUNT(*) > 1 ORDER BY n DESC, city`, "Oslo,2;Rome,2"},
+		{"aggregates", `SELECT MIN(age), MAX(age), SUM(age), COUNT(age) FROM people`, "25,40,121,4"},
+		{"order by", `SELECT name FROM people ORDER BY age, name`, "bob;dee;ann;cid;eve"},
+		{"order by desc, nulls highest", `SELECT name FROM people ORDER BY age DESC, name`, "eve;cid;ann;bob;dee"},
+		{"order by ordinal", `SELECT name, age FROM people WHERE age IS NOT NULL ORDER BY 2, 1 DESC`, "dee,25;bob,25;ann,31;cid,40"},
+		{"distinct", `SELECT DISTINCT city FROM people ORDER BY city`, "Oslo;Paris;Rome"},
+		{"limit offset", `SELECT name FROM people LIMIT 2 OFFSET 1`, "bob;cid"},
+		{"limit zero", `SELECT name FROM people LIMIT 0`, ""},
+		{"trailing semicolon", `select name from people where name = 'ann';`, "ann"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, truncated, err := runSQL(tt.sql, sqlPeople, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(rows, ";"); got != tt.want || truncated {
+				t.Errorf("got %q (truncated %v), want %q", got, truncated, tt.want)
+			}
+		})
+	}
+}
+
+func TestSQLErrors(t *testing.T) {
+	tests := []struct {
+		name, sql, want string
+	}{
+		{"empty", ``, "expected SELECT"},
+		{"not a select", `DELETE FROM people`, "expected SELECT"},
+		{"no from", `SELECT name`, "expected FROM"},
+		{"no table", `SELECT name FROM`, "expected a table name"},
+		{"empty where", `SELECT name FROM people WHERE`, "expected"},
+		{"trailing input", `SELECT name FROM people; DROP TABLE people`, "expected end of query"},
+		{"unterminated string", `SELECT name FROM people WHERE city = 'Oslo`, "unterminated"},
+		{"negative limit", `SELECT name FROM people LIMIT -1`, "LIMIT"},
+		{"unknown function", `SELECT SLEEP(1) FROM people`, "SLEEP"},
+		{"unknown column", `SELECT nope FROM people`, "nope"},
+		{"aggregate in where", `SELECT name FROM people WHERE COUNT(*) > 1`, "WHERE"},
+		{"too deep", `SELECT name FROM people WHERE ` + strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100), "deep"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := runSQL(tt.sql, sqlPeople, 100)
+			var serr *sqlError
+			if !errors.As(err, &serr) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want a query error mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Rows past maxRows are dropped and reported as truncated; a LIMIT within
+// the cap is not truncation.
+func TestSQLRowCap(t *testing.T) {
+	tests := []struct {
+		sql       string
+		maxRows   int
+		rows      int
+		truncated bool
+	}{
+		{`SELECT name FROM people`, 2, 2, true},
+		{`SELECT name FROM people ORDER BY name`, 2, 2, true},
+		{`SELECT DISTINCT city FROM people`, 2, 2, true},
+		{`SELECT name FROM people`, 5, 5, false},
+		{`SELECT name FROM people LIMIT 2`, 2, 2, false},
+		{`SELECT name FROM people LIMIT 3`, 2, 2, true},
+	}
+	for _, tt := range tests {
+		rows, truncated, err := runSQL(tt.sql, sqlPeople, tt.maxRows)
+		if err != nil || len(rows) != tt.rows || truncated != tt.truncated {
+			t.Errorf("%s with cap %d: %d rows, truncated %v, %v; want %d rows, truncated %v", tt.sql, tt.maxRows, len(rows), truncated, err, tt.rows, tt.truncated)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+type StatsStore interface {
+	ListUploadStats(ctx context.Context, from, to time.Time) ([]*UploadStats, error)
+	PutUploadStats(ctx context.Context, s *UploadStats) error
+	DeleteUploadStatsBefore(ctx context.Context, t time.Time) error
+}
+
+// latencyBoundsMs are the upper bounds of the latency histogram buckets;
+// a last bucket holds everything slower.
+var latencyBoundsMs = []float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 300000}
+
+// UploadStats is one instance's tally of upload requests during an hour.
+// Latency counts requests per latencyBoundsMs bucket, so hours and
+// instances add up and percentiles can be read off any window.
+type UploadStats struct {
+	Hour         time.Time `json:"hour"`
+	Instance     string    `json:"instance"`
+	Requests     int64     `json:"requests"`
+	Failures     int64     `json:"failures"`
+	ServerErrors int64     `json:"serverErrors"`
+	Latency      []int64   `json:"latency"`
+	MaxLatencyMs float64   `json:"maxLatencyMs"`
+}
+
+func (s *UploadStats) add(o *UploadStats) {
+	s.Requests += o.Requests
+	s.Failures += o.Failures
+	s.ServerErrors += o.ServerErrors
+	if len(s.Latency) < len(o.Latency) {
+		s.Latency = append(s.Latency, make([]int64, len(o.Latency)-len(s.Latency))...)
+	}
+	for i, n := range o.Latency {
+		s.Latency[i] += n
+	}
+	s.MaxLatencyMs = max(s.MaxLatencyMs, o.MaxLatencyMs)
+}
+
+// p95 is the upper bound of the bucket holding the 95th percentile
+// latency, capped at the slowest request seen; nil without requests.
+func (s *UploadStats) p95() *float64 {
+	var n int64
+	for _, c := range s.Latency {
+		n += c
+	}
+	if n == 0 {
+		return nil
+	}
+	rank := (n*95 + 99) / 100
+	var seen int64
+	for i, c := range s.Latency {
+		seen += c
+		if seen < rank {
+			continue
+		}
+		v := s.MaxLatencyMs
+		if i < len(latencyBoundsMs) {
+			v = min(latencyBoundsMs[i], v)
+		}
+		return &v
+	}
+	return nil
+}
+
+// uploadRoutes are the routes whose requests ingest a file.
+var uploadRoutes = map[string]bool{
+	"POST /v1/files/{$}":                    true,
+	"POST /v1/files/batch":                  true,
+	"POST /v1/files/intent":                 true,
+	"POST /v1/files/import":                 true,
+	"POST /v1/files/{id}/delta":             true,
+	"POST /v1/uploads/{id}/complete":        true,
+	"POST /v1/uploads/direct/{id}/complete": true,
+}
+
+// UploadHistory keeps hourly UploadStats of this instance, writing them to
+// the store as it goes and dropping those older than the retention.
+type UploadHistory struct {
+	store     StatsStore
+	instance  string
+	retention time.Duration
+
+	mu      sync.Mutex
+	hours   map[time.Time]*UploadStats // not yet written since last change
+	minutes [60]minuteTally            // the last hour, for Recent
+}
+
+// minuteTally counts the upload requests of one minute.
+type minuteTally struct {
+	minute             time.Time
+	requests, failures int64
+}
+
+func NewUploadHistory(store StatsStore, retention time.Duration) *UploadHistory {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return &UploadHistory{store: store, instance: hex.EncodeToString(b), retention: retention, hours: map[time.Time]*UploadStats{}}
+}
+
+// Middleware tallies the status and latency of requests to uploadRoutes.
+func (h *UploadHistory) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !uploadRoutes[r.Pattern] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			h.record(start, status, time.Since(start))
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+func (h *UploadHistory) record(at time.Time, status int, d time.Duration) {
+	hour := at.UTC().Truncate(time.Hour)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.hours[hour]
+	if !ok {
+		s = &UploadStats{Hour: hour, Instance: h.instance, Latency: make([]int64, len(latencyBoundsMs)+1)}
+		h.hours[hour] = s
+	}
+	s.Requests++
+	minute := at.UTC().Truncate(time.Minute)
+	m := &h.minutes[minute.Unix()/60%int64(len(h.minutes))]
+	if !m.minute.Equal(minute) {
+		*m = minuteTally{minute: minute}
+	}
+	m.requests++
+	if status >= 400 {
+		s.Failures++
+		m.failures++
+	}
+	if status >= 500 {
+		s.ServerErrors++
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	i, _ := slices.BinarySearch(latencyBoundsMs, ms)
+	s.Latency[i]++
+	s.MaxLatencyMs = max(s.MaxLatencyMs, ms)
+}
+
+// Recent counts this instance's upload requests, and those that failed,
+// over the window before now, to the minute and at most an hour.
+func (h *UploadHistory) Recent(now time.Time, window time.Duration) (requests, failures int64) {
+	since := now.UTC().Add(-window)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range h.minutes {
+		if m.minute.After(since) && !m.minute.After(now) {
+			requests += m.requests
+			failures += m.failures
+		}
+	}
+	return requests, failures
+}
+
+// Run writes the tallies every interval and prunes old ones hourly.
+func (h *UploadHistory) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var pruned time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.Flush(ctx)
+			if time.Since(pruned) >= time.Hour && h.retention > 0 {
+				pruned = time.Now()
+				if err := h.store.DeleteUploadStatsBefore(ctx, pruned.Add(-h.retention)); err != nil {
+					log.Printf("stats: prune: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// Flush writes the tallies. Each hour is written whole, so a rewrite
+// replaces the last; hours before the current one are then forgotten.
+func (h *UploadHistory) Flush(ctx context.Context) {
+	current := time.Now().UTC().Truncate(time.Hour)
+	h.mu.Lock()
+	pending := make([]UploadStats, 0, len(h.hours))
+	for hour, s := range h.hours {
+		pending = append(pending, *s)
+		pending[len(pending)-1].Latency = slices.Clone(s.Latency)
+		if hour.Before(current) {
+			delete(h.hours, hour)
+		}
+	}
+	h.mu.Unlock()
+	for i := range pending {
+		if err := h.store.PutUploadStats(ctx, &pending[i]); err != nil {
+			log.Printf("stats: write %s: %v", pending[i].Hour.Format(time.RFC3339), err)
+			h.mu.Lock()
+			if _, ok := h.hours[pending[i].Hour]; !ok {
+				h.hours[pending[i].Hour] = &pending[i]
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// stats returns the stored tallies of [from, to) with this instance's
+// unwritten ones in place of their stored copies.
+func (h *UploadHistory) stats(ctx context.Context, from, to time.Time) ([]*UploadStats, error) {
+	stored, err := h.store.ListUploadStats(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := slices.DeleteFunc(stored, func(s *UploadStats) bool {
+		_, ok := h.hours[s.Hour]
+		return ok && s.Instance == h.instance
+	})
+	for hour, s := range h.hours {
+		if !hour.Before(from) && hour.Before(to) {
+			c := *s
+			c.Latency = slices.Clone(s.Latency)
+			out = append(out, &c)
+		}
+	}
+	return out, nil
+}
+
+// TimePoint is one window of GET /v1/admin/stats/timeseries. Uploads and
+// Bytes count the files stored in the window that are still on record;
+// the rest describe upload requests, failures being those answered 4xx or
+// 5xx and ServerErrors the 5xx alone. P95LatencyMs is null for a window
+// without requests.
+type TimePoint struct {
+	Start        time.Time `json:"start"`
+	Uploads      int64     `json:"uploads"`
+	Bytes        int64     `json:"bytes"`
+	Requests     int64     `json:"requests"`
+	Failures     int64     `json:"failures"`
+	ServerErrors int64     `json:"serverErrors"`
+	P95LatencyMs *float64  `json:"p95LatencyMs"`
+
+	latency UploadStats
+}
+
+type timeseriesResponse struct {
+	Interval string      `json:"interval"`
+	From     time.Time   `json:"from"`
+	To       time.Time   `json:"to"`
+	Points   []TimePoint `json:"points"`
+	Total    TimePoint   `json:"total"`
+}
+
+// maxTimePoints bounds the windows one request may ask for.
+const maxTimePoints = 2000
+
+// TimeseriesHandler serves GET /v1/admin/stats/timeseries?interval=hour|day
+// &from=&to=, upload statistics per UTC hour or day over [from, to), both
+// RFC 3339 and rounded down to the interval. The default is the last 24
+// hours by hour or the last 30 days by day.
+func (h *UploadHistory) TimeseriesHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		interval := q.Get("interval")
+		var step time.Duration
+		switch interval {
+		case "", "day":
+			interval, step = "day", 24*time.Hour
+		case "hour":
+			step = time.Hour
+		default:
+			writeBadRequest(w, "Parameter 'interval' must be hour or day")
+			return
+		}
+		now := time.Now().UTC()
+		to := now.Truncate(step).Add(step)
+		from := to.Add(-30 * step)
+		if step == time.Hour {
+			from = to.Add(-24 * step)
+		}
+		for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+			if v := q.Get(name); v != "" {
+				parsed, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					writeBadRequest(w, "Parameter '"+name+"' must be an RFC 3339 time")
+					return
+				}
+				*t = parsed.UTC().Truncate(step)
+			}
+		}
+		if !from.Before(to) {
+			writeBadRequest(w, "Parameter 'from' must be before 'to'")
+			return
+		}
+		n := int(to.Sub(from) / step)
+		if n > maxTimePoints {
+			writeBadRequest(w, "The range spans more than 2000 windows; narrow it or use a longer interval")
+			return
+		}
+
+		points := make([]TimePoint, n)
+		for i := range points {
+			points[i].Start = from.Add(time.Duration(i) * step)
+		}
+		at := func(t time.Time) *TimePoint {
+			if t.Before(from) || !t.Before(to) {
+				return nil
+			}
+			return &points[int(t.Sub(from)/step)]
+		}
+		err := walkRecords(r.Context(), store, func(rec *FileRecord) error {
+			if p := at(rec.UploadedAt.UTC()); p != nil {
+				p.Uploads++
+				p.Bytes += rec.Bytes
+			}
+			return nil
+		})
+		if err != nil {
+			writeInternalError(w, "Failed to read file metadata")
+			return
+		}
+		stats, err := h.stats(r.Context(), from, to)
+		if err != nil {
+			writeInternalError(w, "Failed to read upload statistics")
+			return
+		}
+		for _, s := range stats {
+			if p := at(s.Hour); p != nil {
+				p.latency.add(s)
+			}
+		}
+
+		total := TimePoint{Start: from}
+		for i := range points {
+			p := &points[i]
+			p.Requests, p.Failures, p.ServerErrors = p.latency.Requests, p.latency.Failures, p.latency.ServerErrors
+			p.P95LatencyMs = p.latency.p95()
+			total.Uploads += p.Uploads
+			total.Bytes += p.Bytes
+			total.latency.add(&p.latency)
+		}
+		total.Requests, total.Failures, total.ServerErrors = total.latency.Requests, total.latency.Failures, total.latency.ServerErrors
+		total.P95LatencyMs = total.latency.p95()
+		writeJSON(w, http.StatusOK, timeseriesResponse{Interval: interval, From: from, To: to, Points: points, Total: total})
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// statusMaxWait caps how long a status request may block, leaving room
+// under requestTimeout.
+const statusMaxWait = 50 * time.Second
+
+// statusPollInterval is how often a waiting request re-reads the record, to
+// pick up changes made outside this process's checker.
+const statusPollInterval = time.Second
+
+type FileStatus struct {
+	ID         string         `json:"id"`
+	State      string         `json:"state"`
+	Filename   string         `json:"filename,omitempty"`
+	Checks     *CheckProgress `json:"checks,omitempty"`
+	Quarantine *Quarantine    `json:"quarantine,omitempty"`
+	Offset     int64          `json:"offset,omitempty"` // bytes received while uploading
+	Size       int64          `json:"size,omitempty"`
+}
+
+// settled reports whether a state can no longer change on its own.
+func settled(state string) bool {
+	return state != StateUploading && state != StateScanning
+}
+
+// StatusHandler reports where a file is in its lifecycle:
+// GET /v1/files/{id}/status. A resumable upload that has not been completed
+// reports "uploading" under its session ID, which becomes the file ID.
+// With ?wait= (such as 30s, at most 50s) the response is held until the file
+// is available or quarantined, or the wait runs out, so clients need not
+// poll.
+func StatusHandler(store MetadataStore, sessions SessionStore, checker *Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var wait time.Duration
+		if v := r.URL.Query().Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				n, nerr := strconv.Atoi(v)
+				d, err = time.Duration(n)*time.Second, nerr
+			}
+			if err != nil || d < 0 || d > statusMaxWait {
+				writeBadRequest(w, "Parameter 'wait' must be a duration of at most "+statusMaxWait.String())
+				return
+			}
+			wait = d
+		}
+		id := r.PathValue("id")
+
+		st, err := fileStatus(r.Context(), store, sessions, checker, id)
+		if err == nil && wait > 0 && !settled(st.State) {
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			defer cancel()
+			tick := time.NewTicker(statusPollInterval)
+			defer tick.Stop()
+			for err == nil && !settled(st.State) {
+				select {
+				case <-ctx.Done():
+				case <-checker.Changed():
+				case <-tick.C:
+				}
+				if ctx.Err() != nil {
+					break
+				}
+				st, err = fileStatus(r.Context(), store, sessions, checker, id)
+			}
+		}
+		if errors.Is(err, ErrNotFound) {
+			writeMessage(w, http.StatusNotFound, "not_found", newMessage("file_not_found", "id", id))
+			return
+		}
+		if err != nil {
+			if r.Context().Err() == nil {
+				writeInternalError(w, "Failed to load file metadata")
+			}
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+func fileStatus(ctx context.Context, store MetadataStore, sessions SessionStore, checker *Checker, id string) (*FileStatus, error) {
+	rec, err := store.Get(ctx, id)
+	if err == nil {
+		st := &FileStatus{ID: rec.ID, State: rec.state(), Filename: rec.Filename, Quarantine: rec.Quarantine}
+		if st.State == StateScanning {
+			st.Checks = checker.Progress(id)
+		}
+		return st, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	sess, serr := sessions.GetSession(ctx, id)
+	if errors.Is(serr, ErrSessionNotFound) {
+		return nil, ErrNotFound
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return &FileStatus{ID: sess.ID, State: StateUploading, Filename: sess.Filename, Offset: sess.Offset, Size: sess.Size}, nil
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileType is an accepted upload format: the extension blobs of that type
+// are stored under and the sniffed media types that may carry it.
+type fileType struct {
+	Ext        string   `json:"extension"`
+	MediaTypes []string `json:"mediaTypes"`
+}
+
+// uploadTypes lists every accepted format. Sniffing cannot tell CSV apart
+// from other plain text, so the client's extension selects the entry and the
+// sniffed type must be one the entry allows.
+var uploadTypes = []fileType{
+	{Ext: ".csv", MediaTypes: []string{"text/csv", "application/vnd.ms-excel", "text/plain", "application/octet-stream"}},
+}
+
+// detectFileType returns the stored extension for an upload named filename
+// whose content sniffed as contentType, or "" when the pair is not accepted.
+func detectFileType(contentType, filename string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, t := range uploadTypes {
+		if t.Ext != ext {
+			continue
+		}
+		for _, mt := range t.MediaTypes {
+			if mt == mediaType {
+				return t.Ext
+			}
+		}
+	}
+	return ""
+}
+
+func allowedExtension(ext string) bool {
+	ext = strings.ToLower(ext)
+	for _, t := range uploadTypes {
+		if t.Ext == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// blobPath returns the final location for a new blob, creating its
+// year/month directory. Every stored blob is named by this function.
+func blobPath(id, ext string, now time.Time) (string, error) {
+	dir := filepath.Join(uploadDir, now.Format("2006"), now.Format("01"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+ext), nil
+}
+
+// createTemp opens a new, uniquely named temporary file next to path for
+// content that will end up there. Concurrent writers for the same path never
+// share a temp file; the caller removes it unless it was published.
+func createTemp(path string) (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+var errBlobExists = errors.New("blob already exists")
+
+// verifyWrites is set from UPLOAD_VERIFY_WRITES at startup. When on, every
+// new blob is read back once it is stored as it will be kept, compressed
+// and encrypted, and its decoded content checked against the hash taken
+// while it streamed in, to catch storage that acknowledges writes it does
+// not keep, as some NFS and FUSE mounts do.
+var verifyWrites bool
+
+var writeVerifyFailures = metrics.Counter("upload_write_verify_failures_total", "New blobs whose read-back hash differed from the uploaded bytes.")
+
+// verifyBlob reads rec's blob back from storage, decoding its compression
+// and encryption, and checks the content's SHA-256 against rec's checksum.
+func verifyBlob(rec *FileRecord) error {
+	f, err := os.Open(rec.Path)
+	if err != nil {
+		return err
+	}
+	err = dropPageCache(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	body, err := openBlob(rec, false)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		writeVerifyFailures.Inc()
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != rec.ChecksumSHA {
+		writeVerifyFailures.Inc()
+		return fmt.Errorf("read back with sha256 %s, expected %s", got, rec.ChecksumSHA)
+	}
+	return nil
+}
+
+// publishBlob moves a finished temp file to path without replacing a file
+// already there, so an ID collision fails with errBlobExists instead of
+// clobbering another upload's blob.
+func publishBlob(tmp, path string) error {
+	err := os.Link(tmp, path)
+	if errors.Is(err, os.ErrExist) {
+		return errBlobExists
+	}
+	if err != nil {
+		// Filesystems without hard links fall back to a checked rename.
+		if _, serr := os.Lstat(path); serr == nil {
+			return errBlobExists
+		}
+		return os.Rename(tmp, path)
+	}
+	return os.Remove(tmp)
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientTraffic tallies each client's upload requests, failures and bytes
+// by the minute over the last hour, for the top-talkers endpoint and the
+// per-client quota. A client is its declared key's ID, a fingerprint of a
+// static UPLOAD_API_KEYS key, or its address when it sent no known key;
+// secrets themselves are never kept or shown. The tallies are this
+// instance's own.
+//
+// The Prometheus counters are labelled by client only for known keys, so
+// arbitrary addresses or headers cannot grow their cardinality; the rest
+// count as "anonymous".
+type ClientTraffic struct {
+	static   map[string]string // secret -> client
+	declared *Provisioning
+
+	// quotaBytes, when positive, caps the upload bytes a client may send
+	// over quotaWindow; further uploads get 429 until enough ages out.
+	quotaBytes  int64
+	quotaWindow time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*clientTally
+	lastSweep time.Time
+}
+
+type clientTally struct {
+	minutes [60]clientMinute
+	last    time.Time
+}
+
+type clientMinute struct {
+	minute                    time.Time
+	requests, failures, bytes int64
+}
+
+// NewClientTraffic tracks clients of the given static and declared keys.
+// A quota of 0 turns throttling off; window is at most an hour.
+func NewClientTraffic(staticKeys []string, declared *Provisioning, quotaBytes int64, window time.Duration) *ClientTraffic {
+	t := &ClientTraffic{
+		static:      map[string]string{},
+		declared:    declared,
+		quotaBytes:  quotaBytes,
+		quotaWindow: min(window, time.Hour),
+		clients:     map[string]*clientTally{},
+	}
+	for _, k := range staticKeys {
+		sum := sha256.Sum256([]byte(k))
+		t.static[k] = "key:" + hex.EncodeToString(sum[:6])
+	}
+	return t
+}
+
+// client names the client of r, and whether it used a known key.
+func (t *ClientTraffic) client(r *http.Request) (string, bool) {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		if id := t.declared.KeyID(k); id != "" {
+			return "key:" + id, true
+		}
+		if c, ok := t.static[k]; ok {
+			return c, true
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host, false
+}
+
+// Middleware counts requests to uploadRoutes and the body bytes they
+// send, and turns a client over its quota away with 429.
+func (t *ClientTraffic) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !uploadRoutes[r.Pattern] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, known := t.client(r)
+		label := "anonymous"
+		if known {
+			label = client
+		}
+		now := time.Now()
+		if wait := t.overQuota(client, now); wait > 0 {
+			t.record(client, now, http.StatusTooManyRequests, 0)
+			metrics.Counter("upload_client_requests_total", "Upload requests, by client.", "client", label).Inc()
+			metrics.Counter("upload_client_throttled_total", "Uploads refused for exceeding the per-client quota, by client.", "client", label).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "too_many_requests", "Upload quota exceeded; retry later")
+			return
+		}
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			t.record(client, now, status, body.n)
+			metrics.Counter("upload_client_requests_total", "Upload requests, by client.", "client", label).Inc()
+			metrics.Counter("upload_client_bytes_total", "Upload request body bytes received, by client.", "client", label).Add(float64(body.n))
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (t *ClientTraffic) record(client string, at time.Time, status int, bytes int64) {
+	minute := at.UTC().Truncate(time.Minute)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.Sub(t.lastSweep) > time.Minute {
+		t.sweep(at)
+	}
+	c, ok := t.clients[client]
+	if !ok {
+		c = &clientTally{}
+		t.clients[client] = c
+	}
+	c.last = at
+	m := &c.minutes[minute.Unix()/60%int64(len(c.minutes))]
+	if !m.minute.Equal(minute) {
+		*m = clientMinute{minute: minute}
+	}
+	m.requests++
+	m.bytes += bytes
+	if status >= 400 {
+		m.failures++
+	}
+}
+
+// sweep forgets clients idle for longer than the tallies reach back.
+func (t *ClientTraffic) sweep(now time.Time) {
+	for k, c := range t.clients {
+		if now.Sub(c.last) > time.Hour {
+			delete(t.clients, k)
+		}
+	}
+	t.lastSweep = now
+}
+
+// Recent sums client's tallies over the window before now, to the minute
+// and at most an hour.
+func (t *ClientTraffic) Recent(client string, now time.Time, window time.Duration) (requests, failures, bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.clients[client]
+	if c == nil {
+		return 0, 0, 0
+	}
+	return c.sum(now, window)
+}
+
+func (c *clientTally) sum(now time.Time, window time.Duration) (requests, failures, bytes int64) {
+	since := now.UTC().Add(-window)
+	for _, m := range c.minutes {
+		if m.minute.After(since) && !m.minute.After(now) {
+			requests += m.requests
+			failures += m.failures
+			bytes += m.bytes
+		}
+	}
+	return requests, failures, bytes
+}
+
+// overQuota returns how long client must wait for enough of its recent
+// bytes to age out of the quota window, or 0 when it is under quota.
+func (t *ClientTraffic) overQuota(client string, now time.Time) time.Duration {
+	if t.quotaBytes <= 0 {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.clients[client]
+	if c == nil {
+		return 0
+	}
+	_, _, bytes := c.sum(now, t.quotaWindow)
+	if bytes < t.quotaBytes {
+		return 0
+	}
+	// Walk the minutes oldest first until dropping them gets under quota.
+	minutes := slices.Clone(c.minutes[:])
+	slices.SortFunc(minutes, func(a, b clientMinute) int { return a.minute.Compare(b.minute) })
+	since := now.UTC().Add(-t.quotaWindow)
+	for _, m := range minutes {
+		if !m.minute.After(since) || m.minute.After(now) {
+			continue
+		}
+		bytes -= m.bytes
+		if bytes < t.quotaBytes {
+			return max(m.minute.Add(t.quotaWindow).Sub(now), time.Second)
+		}
+	}
+	return t.quotaWindow
+}
+
+// Talker is one client's traffic over the window of a top-talkers report.
+type Talker struct {
+	Client            string  `json:"client"`
+	Requests          int64   `json:"requests"`
+	Failures          int64   `json:"failures"`
+	Bytes             int64   `json:"bytes"`
+	RequestsPerMinute float64 `json:"requestsPerMinute"`
+	BytesPerSecond    float64 `json:"bytesPerSecond"`
+}
+
+// Top returns the clients with the most traffic over the window before
+// now, by "bytes" or "requests", busiest first.
+func (t *ClientTraffic) Top(now time.Time, window time.Duration, by string, limit int) []Talker {
+	t.mu.Lock()
+	talkers := make([]Talker, 0, len(t.clients))
+	for client, c := range t.clients {
+		requests, failures, bytes := c.sum(now, window)
+		if requests == 0 {
+			continue
+		}
+		talkers = append(talkers, Talker{
+			Client:            client,
+			Requests:          requests,
+			Failures:          failures,
+			Bytes:             bytes,
+			RequestsPerMinute: float64(requests) / window.Minutes(),
+			BytesPerSecond:    float64(bytes) / window.Seconds(),
+		})
+	}
+	t.mu.Unlock()
+	slices.SortFunc(talkers, func(a, b Talker) int {
+		if by == "requests" {
+			return cmp.Or(cmp.Compare(b.Requests, a.Requests), cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Client, b.Client))
+		}
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(b.Requests, a.Requests), cmp.Compare(a.Client, b.Client))
+	})
+	return talkers[:min(limit, len(talkers))]
+}
+
+// TopTalkersHandler serves GET /v1/admin/stats/top-talkers?minutes=&by=
+// &limit=, the clients sending the most upload traffic over the last
+// minutes (1 to 60, default 15), by bytes or requests.
+func (t *ClientTraffic) TopTalkersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		minutes := 15
+		if v := q.Get("minutes"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 60 {
+				writeBadRequest(w, "Parameter 'minutes' must be between 1 and 60")
+				return
+			}
+			minutes = n
+		}
+		by := q.Get("by")
+		switch by {
+		case "":
+			by = "bytes"
+		case "bytes", "requests":
+		default:
+			writeBadRequest(w, "Parameter 'by' must be bytes or requests")
+			return
+		}
+		limit := 10
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				writeBadRequest(w, "Parameter 'limit' must be between 1 and 1000")
+				return
+			}
+			limit = n
+		}
+		talkers := t.Top(time.Now(), time.Duration(minutes)*time.Minute, by, limit)
+		writeJSON(w, http.StatusOK, map[string]any{"minutes": minutes, "by": by, "clients": talkers})
+	}
+}
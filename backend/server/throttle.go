@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits throughput to rate bytes per second with bursts of up
+// to burst bytes. Callers reserve tokens up front and sleep off any deficit,
+// so concurrent users share the rate fairly in arrival order.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil for a non-positive rate, which every method
+// treats as unlimited.
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := max(float64(bytesPerSec)/4, 32<<10)
+	return &tokenBucket{rate: float64(bytesPerSec), burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) chunk() int {
+	if b == nil {
+		return 1 << 30
+	}
+	return int(b.burst)
+}
+
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Bandwidth holds the global buckets and the per-connection rate for
+// request bodies (in) and responses (out).
+type Bandwidth struct {
+	globalIn  *tokenBucket
+	globalOut *tokenBucket
+	connRate  int64
+}
+
+func NewBandwidth(globalBytesPerSec, connBytesPerSec int64) *Bandwidth {
+	return &Bandwidth{
+		globalIn:  newTokenBucket(globalBytesPerSec),
+		globalOut: newTokenBucket(globalBytesPerSec),
+		connRate:  connBytesPerSec,
+	}
+}
+
+type connBucketsKey struct{}
+
+type connBuckets struct {
+	in, out *tokenBucket
+}
+
+// ConnContext gives each connection its own buckets so keep-alive requests
+// on one connection share its limit. Install it as http.Server.ConnContext.
+func (bw *Bandwidth) ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connBucketsKey{}, &connBuckets{
+		in:  newTokenBucket(bw.connRate),
+		out: newTokenBucket(bw.connRate),
+	})
+}
+
+// Middleware throttles request bodies and responses against the global and
+// per-connection buckets.
+func (bw *Bandwidth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cb, _ := r.Context().Value(connBucketsKey{}).(*connBuckets)
+		if cb == nil {
+			cb = &connBuckets{}
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), buckets: []*tokenBucket{bw.globalIn, cb.in}}
+		}
+		w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), buckets: []*tokenBucket{bw.globalOut, cb.out}}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	for _, b := range tr.buckets {
+		if c := b.chunk(); len(p) > c {
+			p = p[:c]
+		}
+	}
+	n, err := tr.ReadCloser.Read(p)
+	for _, b := range tr.buckets {
+		if werr := b.wait(tr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		for _, b := range tw.buckets {
+			n = min(n, b.chunk())
+		}
+		for _, b := range tw.buckets {
+			if err := b.wait(tw.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
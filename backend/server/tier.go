@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	StorageHot  = "hot"
+	StorageCold = "cold"
+
+	RestoreInProgress = "in_progress"
+	RestoreCompleted  = "completed"
+	RestoreFailed     = "failed"
+)
+
+// AccessStore keeps when each file was last downloaded. Access times are
+// kept apart from the records: a download is not an edit, so it neither
+// bumps the revision nor contends with edits for the record's lock.
+type AccessStore interface {
+	TouchAccess(ctx context.Context, id string, at time.Time) error
+	// LastAccess returns the zero time for a file never downloaded.
+	LastAccess(ctx context.Context, id string) (time.Time, error)
+	DeleteAccess(ctx context.Context, id string) error
+}
+
+// Tierer moves blobs that have not been accessed for a while into a
+// gzip-compressed archive directory and brings them back on request.
+type Tierer struct {
+	store      MetadataStore
+	access     AccessStore
+	events     *EventRelay
+	locker     Locker
+	archiveDir string
+	after      time.Duration
+}
+
+func NewTierer(store MetadataStore, access AccessStore, events *EventRelay, locker Locker, archiveDir string, after time.Duration) *Tierer {
+	return &Tierer{store: store, access: access, events: events, locker: locker, archiveDir: archiveDir, after: after}
+}
+
+// errTierMoved stops moving a blob between tiers whose record changed
+// storage while it was copied.
+var errTierMoved = errors.New("file changed tier while its blob was copied")
+
+// Run sweeps for cold candidates every interval until ctx is cancelled.
+func (t *Tierer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		runExclusive(ctx, t.locker, "tier-sweep", t.sweep)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *Tierer) sweep(ctx context.Context) {
+	if maintenance.ReadOnly() {
+		return
+	}
+	recs, err := t.store.List(ctx)
+	if err != nil {
+		log.Printf("tier: list records: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-t.after)
+	for _, rec := range recs {
+		if rec.RestoreStatus == RestoreInProgress {
+			// Picks up restores whose worker died with its process.
+			t.runRestore(ctx, *rec)
+			continue
+		}
+		if rec.storageClass() != StorageHot || rec.lastAccess().After(cutoff) {
+			continue
+		}
+		if at, err := t.access.LastAccess(ctx, rec.ID); err != nil || at.After(cutoff) {
+			continue
+		}
+		if err := t.archive(ctx, rec); err != nil {
+			log.Printf("tier: archive %s: %v", rec.ID, err)
+		}
+	}
+}
+
+func (t *Tierer) archive(ctx context.Context, rec *FileRecord) error {
+	if err := os.MkdirAll(t.archiveDir, 0o755); err != nil {
+		return err
+	}
+	// Blobs already compressed or encrypted at rest are archived verbatim.
+	archivePath := filepath.Join(t.archiveDir, filepath.Base(rec.Path))
+	wrap := compressWriter(EncodingGzip)
+	if rec.Encoding != "" || rec.Encryption != nil {
+		wrap = nil
+	} else {
+		archivePath += encodingSuffix(EncodingGzip)
+	}
+	if err := copyFile(archivePath, rec.Path, wrap, nil); err != nil {
+		return err
+	}
+
+	// The copy was made from the listed record; it only replaces the blob
+	// if the record still points at that blob, hot.
+	updated, err := updateRecord(ctx, t.store, t.locker, rec.ID, func(cur *FileRecord) error {
+		if cur.Path != rec.Path || cur.storageClass() != StorageHot || cur.RestoreStatus == RestoreInProgress {
+			return errTierMoved
+		}
+		cur.StorageClass = StorageCold
+		cur.ArchivePath = archivePath
+		cur.RestoreStatus = ""
+		return nil
+	})
+	if err != nil {
+		_ = os.Remove(archivePath)
+		if errors.Is(err, errTierMoved) || errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	t.events.Emit(EventFileUpdated, updated)
+	return os.Remove(rec.Path)
+}
+
+func (t *Tierer) restore(ctx context.Context, rec *FileRecord) error {
+	unwrap := decompressReader(EncodingGzip)
+	if rec.Encoding != "" || rec.Encryption != nil {
+		unwrap = nil
+	}
+	if err := copyFile(rec.Path, rec.ArchivePath, nil, unwrap); err != nil {
+		return err
+	}
+	archivePath := rec.ArchivePath
+	updated, err := updateRecord(ctx, t.store, t.locker, rec.ID, func(cur *FileRecord) error {
+		if cur.ArchivePath != archivePath {
+			return errTierMoved
+		}
+		cur.StorageClass = StorageHot
+		cur.ArchivePath = ""
+		cur.RestoreStatus = RestoreCompleted
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// A restored file counts as accessed, or the next sweep would archive
+	// it again straight away.
+	if err := t.access.TouchAccess(ctx, rec.ID, time.Now().UTC()); err != nil {
+		log.Printf("tier: touch %s: %v", rec.ID, err)
+	}
+	t.events.Emit(EventFileUpdated, updated)
+	return os.Remove(archivePath)
+}
+
+// restoreRetryAfter is what clients waiting on a restore are told to wait
+// before checking again.
+const restoreRetryAfter = 5 * time.Second
+
+// StartRestore begins bringing the cold file id back to the hot tier and
+// returns its record. The restore runs in the background under a lock, so
+// a sweep can resume one whose process died; started is false when the
+// file is already hot or on its way back.
+func (t *Tierer) StartRestore(ctx context.Context, id string) (rec *FileRecord, started bool, err error) {
+	rec, err = updateRecord(ctx, t.store, t.locker, id, func(rec *FileRecord) error {
+		if rec.storageClass() == StorageHot || rec.RestoreStatus == RestoreInProgress {
+			return errNoChange
+		}
+		started = true
+		rec.RestoreStatus = RestoreInProgress
+		return nil
+	})
+	if err != nil || !started {
+		return rec, false, err
+	}
+	// The restore outlives the request that started it.
+	go t.runRestore(context.WithoutCancel(ctx), *rec)
+	return rec, true, nil
+}
+
+// runRestore restores rec unless another worker already is, and marks the
+// restore failed if it does not finish.
+func (t *Tierer) runRestore(ctx context.Context, rec FileRecord) {
+	release, ok, err := t.locker.TryLock(ctx, "restore:"+rec.ID, time.Minute)
+	if err != nil || !ok {
+		return
+	}
+	defer release()
+	err = t.restore(ctx, &rec)
+	if err == nil || errors.Is(err, errTierMoved) {
+		return
+	}
+	log.Printf("tier: restore %s: %v", rec.ID, err)
+	_, err = updateRecord(ctx, t.store, t.locker, rec.ID, func(cur *FileRecord) error {
+		if cur.RestoreStatus != RestoreInProgress {
+			return errNoChange
+		}
+		cur.RestoreStatus = RestoreFailed
+		return nil
+	})
+	if err != nil {
+		log.Printf("tier: update %s: %v", rec.ID, err)
+	}
+}
+
+// writeRestoring answers a request for a file being restored with 202 and
+// when to try again.
+func writeRestoring(w http.ResponseWriter, rec *FileRecord) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(restoreRetryAfter/time.Second)))
+	w.Header().Set("Location", "/v1/files/"+rec.ID+"/metadata")
+	writeJSON(w, http.StatusAccepted, FileMetadata{UploadResponse: newUploadResponse(rec), UploadedAt: rec.UploadedAt})
+}
+
+// RestoreHandler starts bringing a cold file back to the hot tier. The
+// restore runs in the background; clients poll the record's restoreStatus
+// as Retry-After suggests.
+func RestoreHandler(t *Tierer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for restore")
+			return
+		}
+		id := r.PathValue("id")
+		rec, _, err := t.StartRestore(r.Context(), id)
+		if err != nil {
+			writeUpdateError(w, id, err)
+			return
+		}
+		if rec.storageClass() == StorageHot {
+			writeJSON(w, http.StatusOK, FileMetadata{UploadResponse: newUploadResponse(rec), UploadedAt: rec.UploadedAt})
+			return
+		}
+		writeRestoring(w, rec)
+	}
+}
+
+// copyFile writes src to dst through optional compression wrappers, using a
+// temp file and rename so dst only appears once complete.
+func copyFile(dst, src string, wrapW func(io.Writer) (io.WriteCloser, error), wrapR func(io.Reader) (io.ReadCloser, error)) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if wrapR != nil {
+		rc, err := wrapR(in)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	}
+
+	out, err := createTemp(dst)
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	defer os.Remove(tmp)
+
+	var w io.Writer = out
+	var wc io.WriteCloser
+	if wrapW != nil {
+		if wc, err = wrapW(out); err != nil {
+			out.Close()
+			return err
+		}
+		w = wc
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		out.Close()
+		return err
+	}
+	if wc != nil {
+		if err := wc.Close(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
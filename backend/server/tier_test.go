@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testColdRecord uploads a file and archives it.
+func testColdRecord(t *testing.T, in *Ingest, tier *Tierer) *FileRecord {
+	t.Helper()
+	rec := testRecord(t, in)
+	if err := tier.archive(context.Background(), rec); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := in.Store.Get(context.Background(), rec.ID)
+	if err != nil || rec.storageClass() != StorageCold {
+		t.Fatalf("archive: %+v, %v", rec, err)
+	}
+	return rec
+}
+
+// A download of a cold file starts its restore and says when to come back;
+// the file is served once it is hot again.
+func TestDownloadCold(t *testing.T) {
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	tier := NewTierer(db, db, nil, newLocalLocker(), filepath.Join(t.TempDir(), "archive"), time.Hour)
+	rec := testColdRecord(t, in, tier)
+	download := DownloadHandler(db, db, tier)
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/files/"+rec.ID, nil)
+		req.SetPathValue("id", rec.ID)
+		w := httptest.NewRecorder()
+		download(w, req)
+		return w
+	}
+	w := get()
+	if w.Code != http.StatusAccepted || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("cold download: %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for w = get(); w.Code == http.StatusAccepted && time.Now().Before(deadline); w = get() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "name,email\nbob,bob@example.com\n" {
+		t.Fatalf("after restore: %d %s", w.Code, w.Body)
+	}
+}
+
+// A restore left in progress by a process that died is finished by the
+// next sweep.
+func TestSweepResumesRestore(t *testing.T) {
+	in := testIngest(t)
+	db := in.Store.(*jsonStore)
+	locker := newLocalLocker()
+	tier := NewTierer(db, db, nil, locker, filepath.Join(t.TempDir(), "archive"), time.Hour)
+	rec := testColdRecord(t, in, tier)
+	ctx := context.Background()
+	if _, err := updateRecord(ctx, db, locker, rec.ID, func(cur *FileRecord) error {
+		cur.RestoreStatus = RestoreInProgress
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tier.sweep(ctx)
+	got, err := db.Get(ctx, rec.ID)
+	if err != nil || got.storageClass() != StorageHot || got.RestoreStatus != RestoreCompleted {
+		t.Fatalf("after sweep: %+v, %v", got, err)
+	}
+}
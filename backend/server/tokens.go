@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadTokens mints and checks short-lived download links. A token is
+// "<expiry unix seconds>.<signature>", where the signature covers the scope,
+// the file ID and the expiry, so it opens exactly one file for reading and
+// can be verified without any server-side state.
+type DownloadTokens struct {
+	signer *Signer
+	maxTTL time.Duration
+}
+
+func NewDownloadTokens(signer *Signer, maxTTL time.Duration) *DownloadTokens {
+	return &DownloadTokens{signer: signer, maxTTL: maxTTL}
+}
+
+func downloadTokenPayload(fileID string, exp int64) []byte {
+	return []byte("download\n" + fileID + "\n" + strconv.FormatInt(exp, 10))
+}
+
+// Mint returns a token for fileID valid for ttl, capped at the configured
+// maximum.
+func (t *DownloadTokens) Mint(fileID string, ttl time.Duration) (string, time.Time) {
+	if ttl <= 0 || ttl > t.maxTTL {
+		ttl = t.maxTTL
+	}
+	exp := time.Now().Add(ttl).Truncate(time.Second)
+	return strconv.FormatInt(exp.Unix(), 10) + "." + t.signer.Sign(downloadTokenPayload(fileID, exp.Unix())), exp
+}
+
+// Valid reports whether token grants download access to fileID right now.
+func (t *DownloadTokens) Valid(token, fileID string) bool {
+	if t == nil || token == "" || fileID == "" {
+		return false
+	}
+	rawExp, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	exp, err := strconv.ParseInt(rawExp, 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return false
+	}
+	return t.signer.Verify(downloadTokenPayload(fileID, exp), sig)
+}
+
+type mintTokenRequest struct {
+	TTLSeconds int `json:"ttlSeconds"`
+}
+
+type DownloadTokenResponse struct {
+	FileID    string    `json:"fileId"`
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// MintHandler issues a download link for an existing file:
+// POST /v1/files/{id}/download-token {"ttlSeconds": N}. The body is optional.
+func (t *DownloadTokens) MintHandler(store MetadataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, "Only POST method is allowed for download tokens")
+			return
+		}
+		var req mintTokenRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+				writeBadRequest(w, "Invalid JSON body")
+				return
+			}
+		}
+		if req.TTLSeconds < 0 {
+			writeBadRequest(w, "Field 'ttlSeconds' must not be negative")
+			return
+		}
+		rec, ok := loadRecord(w, r, store, r.PathValue("id"))
+		if !ok {
+			return
+		}
+		token, exp := t.Mint(rec.ID, time.Duration(req.TTLSeconds)*time.Second)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, DownloadTokenResponse{
+			FileID:    rec.ID,
+			Token:     token,
+			URL:       "/v1/files/" + rec.ID + "?token=" + url.QueryEscape(token),
+			ExpiresAt: exp.UTC(),
+		})
+	}
+}
+
+// downloadPattern is the only route a download token opens; HEAD requests
+// match it too.
+const downloadPattern = "GET /v1/files/{id}"
+
+type apiKeyKey struct{}
+
+// authenticatedKey returns the declared API key the request was
+// authenticated with, or nil: for keys from UPLOAD_API_KEYS, download
+// tokens, CDN signatures, and while the API is open.
+func authenticatedKey(ctx context.Context) *APIKey {
+	k, _ := ctx.Value(apiKeyKey{}).(*APIKey)
+	return k
+}
+
+// APIKeyAuth requires one of keys, or an enabled key declared through the
+// admin API, in X-API-Key. Requests for downloadPattern may instead carry a
+// download token for that file in the token query parameter, which is what
+// browser links use, or a CDN signature. The API is left open while no
+// keys are configured or declared.
+func APIKeyAuth(keys []string, declared *Provisioning, tokens *DownloadTokens, cdn *CDNSigner) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(keys) == 0 && !declared.HasKeys() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if got := r.Header.Get("X-API-Key"); got != "" {
+				for _, k := range keys {
+					if subtle.ConstantTimeCompare([]byte(got), []byte(k)) == 1 {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+				if k := declared.Key(got); k != nil {
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, k)))
+					return
+				}
+				writeMessage(w, http.StatusUnauthorized, "unauthorized", newMessage("invalid_api_key"))
+				return
+			}
+			if r.Pattern == downloadPattern && (tokens.Valid(r.URL.Query().Get("token"), r.PathValue("id")) || cdn.Valid(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeMessage(w, http.StatusUnauthorized, "unauthorized", newMessage("missing_credentials"))
+		})
+	}
+}
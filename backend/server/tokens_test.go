@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadTokens(t *testing.T) {
+	key := StaticSecret("token-key")
+	tokens := NewDownloadTokens(NewSigner(key), time.Hour)
+	token, exp := tokens.Mint("abc", 10*time.Minute)
+	if d := time.Until(exp); d <= 9*time.Minute || d > 10*time.Minute {
+		t.Errorf("token expires in %s, want 10m", d)
+	}
+	if _, exp := tokens.Mint("abc", 48*time.Hour); time.Until(exp) > time.Hour {
+		t.Errorf("TTL past the maximum was not capped: expires %s", exp)
+	}
+
+	signed := func(id string, exp time.Time) string {
+		return strconv.FormatInt(exp.Unix(), 10) + "." + NewSigner(key).Sign(downloadTokenPayload(id, exp.Unix()))
+	}
+	rawExp, sig, _ := strings.Cut(token, ".")
+	later, _ := strconv.ParseInt(rawExp, 10, 64)
+	tests := []struct {
+		name, token, id string
+		ok              bool
+	}{
+		{"minted", token, "abc", true},
+		{"other file", token, "abd", false},
+		{"expired", signed("abc", time.Now().Add(-time.Second)), "abc", false},
+		{"expiry moved", strconv.FormatInt(later+3600, 10) + "." + sig, "abc", false},
+		{"signature changed", rawExp + "." + strings.Repeat("0", len(sig)), "abc", false},
+		{"signature not hex", rawExp + ".zz", "abc", false},
+		{"no signature", rawExp, "abc", false},
+		{"empty", "", "abc", false},
+		{"no file", token, "", false},
+		{"other key", strconv.FormatInt(later, 10) + "." + NewSigner(StaticSecret("other")).Sign(downloadTokenPayload("abc", later)), "abc", false},
+	}
+	for _, tt := range tests {
+		if got := tokens.Valid(tt.token, tt.id); got != tt.ok {
+			t.Errorf("%s: Valid = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+
+	// Tokens signed before a key rotation stay valid until they expire.
+	key.set("rotated-key")
+	if !tokens.Valid(token, "abc") {
+		t.Error("token signed with the previous key rejected")
+	}
+	if (*DownloadTokens)(nil).Valid(token, "abc") {
+		t.Error("nil DownloadTokens accepted a token")
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	db, err := NewJSONStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, k := range []*APIKey{
+		{ID: "analyst", Role: "analyst", Hash: hashAPIKey("declared-secret")},
+		{ID: "off", Disabled: true, Hash: hashAPIKey("disabled-secret")},
+	} {
+		if err := db.PutAPIKey(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	declared := NewProvisioning(db, &AuditLog{})
+	if err := declared.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tokens := NewDownloadTokens(NewSigner(StaticSecret("token-key")), time.Hour)
+	token, _ := tokens.Mint("abc", time.Minute)
+
+	var seen *APIKey
+	auth := APIKeyAuth([]string{"static-secret"}, declared, tokens, nil)
+	ok := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = authenticatedKey(r.Context()) }))
+	handler := http.NewServeMux()
+	handler.Handle(downloadPattern, ok)
+	handler.Handle("GET /v1/files/{id}/metadata", ok)
+
+	tests := []struct {
+		name, path, key string
+		status          int
+		keyID           string
+	}{
+		{"static key", "/v1/files/abc/metadata", "static-secret", http.StatusOK, ""},
+		{"declared key", "/v1/files/abc/metadata", "declared-secret", http.StatusOK, "analyst"},
+		{"disabled key", "/v1/files/abc/metadata", "disabled-secret", http.StatusUnauthorized, ""},
+		{"wrong key", "/v1/files/abc/metadata", "guess", http.StatusUnauthorized, ""},
+		{"no credentials", "/v1/files/abc/metadata", "", http.StatusUnauthorized, ""},
+		{"token", "/v1/files/abc?token=" + token, "", http.StatusOK, ""},
+		{"token for another file", "/v1/files/abd?token=" + token, "", http.StatusUnauthorized, ""},
+		{"token off the download route", "/v1/files/abc/metadata?token=" + token, "", http.StatusUnauthorized, ""},
+		{"wrong key with token", "/v1/files/abc?token=" + token, "guess", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = nil
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			got := ""
+			if seen != nil {
+				got = seen.ID
+			}
+			if got != tt.keyID {
+				t.Errorf("request authenticated as key %q, want %q", got, tt.keyID)
+			}
+		})
+	}
+
+	// With no keys configured or declared the API is open.
+	w := httptest.NewRecorder()
+	APIKeyAuth(nil, nil, nil, nil)(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/files", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("open API: status %d", w.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Router registers routes with method and wildcard patterns such as
+// "GET /v1/files/{id}" and answers requests that match no route with the
+// same JSON error body as every handler, rather than ServeMux's plain text.
+// Routes with an {id} wildcard only match valid IDs.
+type Router struct {
+	mux *http.ServeMux
+}
+
+func NewRouter() *Router {
+	return &Router{mux: http.NewServeMux()}
+}
+
+func (rt *Router) Handle(pattern string, h http.Handler) {
+	if strings.Contains(pattern, "{id}") {
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !validID(r.PathValue("id")) {
+				writeNotFound(w, "No route for "+r.URL.Path)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	rt.mux.Handle(pattern, h)
+}
+
+func (rt *Router) HandleFunc(pattern string, h http.HandlerFunc) {
+	rt.Handle(pattern, h)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, pattern := rt.mux.Handler(r)
+	if pattern != "" {
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+	// No route matched: let the mux decide between 404, 405 (which also
+	// sets Allow) and a redirect, then replace its plain-text body.
+	miss := &routeMissWriter{ResponseWriter: w}
+	h.ServeHTTP(miss, r)
+	switch miss.status {
+	case http.StatusMethodNotAllowed:
+		writeMethodNotAllowed(w, "Method "+r.Method+" is not allowed for "+r.URL.Path)
+	case http.StatusNotFound:
+		writeNotFound(w, "No route for "+r.URL.Path)
+	default:
+		if miss.status != 0 {
+			w.WriteHeader(miss.status)
+		}
+	}
+}
+
+// routeMissWriter records the status ServeMux chose for an unmatched request
+// and discards its body; headers such as Allow and Location pass through.
+type routeMissWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (m *routeMissWriter) WriteHeader(code int) { m.status = code }
+
+func (m *routeMissWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func withFileID(r *http.Request, id string) *http.Request {
+	r = r.Clone(r.Context())
+	r.SetPathValue("id", id)
+	return r
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("file record not found")
+	ErrExists   = errors.New("file record already exists")
+)
+
+type FileRecord struct {
+	ID          string         `json:"id"`
+	Revision    int64          `json:"revision"` // bumped by every metadata edit
+	Filename    string         `json:"filename"`
+	Path        string         `json:"path"`
+	Bytes       int64          `json:"bytesWritten"`
+	ChecksumSHA string         `json:"sha256"`
+	ContentType string         `json:"contentType"`
+	Extension   string         `json:"extension,omitempty"`
+	UploadedAt  time.Time      `json:"uploadedAt"`
+	DuplicateOf string         `json:"duplicateOf,omitempty"`
+	Folder      string         `json:"folder,omitempty"`
+	Tags        []string       `json:"tags,omitempty"`
+	Key         string         `json:"key,omitempty"`
+	Source      string         `json:"source,omitempty"`
+	Lineage     *Lineage       `json:"lineage,omitempty"`
+	Description string         `json:"description,omitempty"`
+	ExpiresAt   *time.Time     `json:"expiresAt,omitempty"`
+	SchemaID    string         `json:"schemaId,omitempty"`
+	RowCount    int64          `json:"rowCount"`
+	Columns     []string       `json:"columns,omitempty"`
+	PII         *PIIReport     `json:"pii,omitempty"`
+	Formulas    *FormulaReport `json:"formulas,omitempty"`
+	MaskedPath  string         `json:"maskedPath,omitempty"`
+	Hold        *LegalHold     `json:"legalHold,omitempty"`
+
+	// The masked copy is stored like the blob: with its encoding and,
+	// under encryption at rest, a data key of its own.
+	MaskedBytes      int64           `json:"maskedBytes,omitempty"`
+	MaskedEncoding   string          `json:"maskedEncoding,omitempty"`
+	MaskedEncryption *BlobEncryption `json:"maskedEncryption,omitempty"`
+
+	StorageClass  string `json:"storageClass"`
+	ArchivePath   string `json:"archivePath,omitempty"`
+	RestoreStatus string `json:"restoreStatus,omitempty"`
+	// LastAccessedAt is only read, from records written before access
+	// times moved to the AccessStore.
+	LastAccessedAt time.Time `json:"lastAccessedAt"`
+
+	Encoding    string            `json:"encoding,omitempty"`
+	Compression *CompressionStats `json:"compression,omitempty"`
+	Encryption  *BlobEncryption   `json:"encryption,omitempty"`
+
+	State      string          `json:"state,omitempty"`
+	Quarantine *Quarantine     `json:"quarantine,omitempty"`
+	Integrity  *IntegrityCheck `json:"integrity,omitempty"`
+	Chunks     *ChunkHashes    `json:"chunks,omitempty"`
+	Receipt    string          `json:"receipt,omitempty"`
+	// Quarantined is the flag used before State existed; it is only read.
+	Quarantined bool `json:"quarantined,omitempty"`
+
+	// customerKey is the client's key for a blob encrypted with one, set
+	// while a request that sent it is being served; it is never stored.
+	customerKey []byte
+}
+
+// storageClass treats records written before tiering existed as hot.
+func (r *FileRecord) storageClass() string {
+	if r.StorageClass == "" {
+		return StorageHot
+	}
+	return r.StorageClass
+}
+
+// masked returns a record for rec's masked copy, which openBlob and the
+// download code read like any blob. It is always hot and has no masked copy
+// of its own.
+func (r *FileRecord) masked() *FileRecord {
+	m := *r
+	m.Path, m.Bytes = r.MaskedPath, r.MaskedBytes
+	m.Encoding, m.Compression, m.Encryption = r.MaskedEncoding, nil, r.MaskedEncryption
+	m.StorageClass, m.ArchivePath = StorageHot, ""
+	m.ChecksumSHA, m.Chunks = "", nil
+	m.MaskedPath, m.MaskedBytes, m.MaskedEncoding, m.MaskedEncryption = "", 0, "", nil
+	if m.Bytes == 0 {
+		// Written before its size was kept, so plain.
+		if fi, err := os.Stat(m.Path); err == nil {
+			m.Bytes = fi.Size()
+		}
+	}
+	return &m
+}
+
+// extension is the suffix the blob is stored under. Records written before
+// it was tracked were always CSV.
+func (r *FileRecord) extension() string {
+	if r.Extension == "" {
+		return ".csv"
+	}
+	return r.Extension
+}
+
+func (r *FileRecord) lastAccess() time.Time {
+	if r.LastAccessedAt.IsZero() {
+		return r.UploadedAt
+	}
+	return r.LastAccessedAt
+}
+
+// MetadataStore persists one FileRecord per stored upload.
+type MetadataStore interface {
+	Get(ctx context.Context, id string) (*FileRecord, error)
+	Put(ctx context.Context, rec *FileRecord) error
+	// Create stores a new record, failing with ErrExists when the ID is
+	// already taken.
+	Create(ctx context.Context, rec *FileRecord) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]*FileRecord, error)
+	// FindByChecksum returns the files with the given SHA-256, oldest
+	// first, without reading every record.
+	FindByChecksum(ctx context.Context, checksum string) ([]*FileRecord, error)
+}
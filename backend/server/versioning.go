@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIVersion is one served version of the API. Handler receives requests
+// with their full path, /vN prefix included, so existing route patterns keep
+// working as versions are added alongside.
+type APIVersion struct {
+	Name    string
+	Handler http.Handler
+
+	// Deprecated versions answer with Deprecation, and when set, Sunset and
+	// a successor-version Link.
+	Deprecated   bool
+	DeprecatedAt time.Time
+	Sunset       time.Time
+	Successor    string
+}
+
+// VersionRouter selects an API version by path prefix (/v1/..., /v2/...).
+// Unprefixed paths may name one with the API-Version header instead; they
+// are rewritten to the prefixed path. Anything else goes to fallback, which
+// serves version-independent routes such as /metrics.
+type VersionRouter struct {
+	versions map[string]*APIVersion
+	fallback http.Handler
+}
+
+func NewVersionRouter(fallback http.Handler) *VersionRouter {
+	return &VersionRouter{versions: map[string]*APIVersion{}, fallback: fallback}
+}
+
+func (vr *VersionRouter) Register(v APIVersion) {
+	vr.versions[v.Name] = &v
+}
+
+func (vr *VersionRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := normalizeAPIVersion(r.Header.Get("API-Version"))
+	seg, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	if isVersionSegment(seg) {
+		v, ok := vr.versions[seg]
+		if !ok {
+			writeNotFound(w, "Unsupported API version '"+seg+"'")
+			return
+		}
+		if header != "" && header != seg {
+			writeBadRequest(w, "API-Version header '"+header+"' does not match path version '"+seg+"'")
+			return
+		}
+		vr.serve(w, r, v)
+		return
+	}
+
+	if header == "" {
+		vr.fallback.ServeHTTP(w, r)
+		return
+	}
+	v, ok := vr.versions[header]
+	if !ok {
+		writeBadRequest(w, "Unsupported API version '"+header+"'")
+		return
+	}
+	r = r.Clone(r.Context())
+	r.URL.Path = "/" + v.Name + r.URL.Path
+	r.URL.RawPath = ""
+	vr.serve(w, r, v)
+}
+
+func (vr *VersionRouter) serve(w http.ResponseWriter, r *http.Request, v *APIVersion) {
+	h := w.Header()
+	h.Set("API-Version", v.Name)
+	if v.Deprecated {
+		if v.DeprecatedAt.IsZero() {
+			h.Set("Deprecation", "true")
+		} else {
+			h.Set("Deprecation", "@"+strconv.FormatInt(v.DeprecatedAt.Unix(), 10))
+		}
+		if !v.Sunset.IsZero() {
+			h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+		}
+		if v.Successor != "" {
+			h.Add("Link", "</"+v.Successor+"/>; rel=\"successor-version\"")
+		}
+	}
+	v.Handler.ServeHTTP(w, r)
+}
+
+// normalizeAPIVersion accepts "2" as well as "v2".
+func normalizeAPIVersion(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || strings.HasPrefix(s, "v") {
+		return s
+	}
+	return "v" + s
+}
+
+func isVersionSegment(seg string) bool {
+	if len(seg) < 2 || seg[0] != 'v' {
+		return false
+	}
+	for _, c := range seg[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
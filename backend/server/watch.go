@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchRescanInterval is how often the drop folder is listed in full, which
+// catches files whose events were missed and retries server-side failures.
+const watchRescanInterval = time.Minute
+
+// Watcher ingests files other processes drop into a local directory. A file
+// is picked up once it has gone quiet for the settle period, ingested
+// through the same pipeline as HTTP uploads, and removed. Files the
+// pipeline rejects move to the quarantine directory next to a
+// <name>.error.json describing why. Dotfiles are ignored, so writers can
+// stage into ".name" and rename when done.
+type Watcher struct {
+	in         *Ingest
+	dir        string
+	quarantine string
+	settle     time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+	active  map[string]bool
+}
+
+func NewWatcher(in *Ingest, dir, quarantine string, settle time.Duration) (*Watcher, error) {
+	if quarantine == "" {
+		quarantine = filepath.Join(dir, "quarantine")
+	}
+	for _, d := range []string{dir, quarantine} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Watcher{
+		in:         in,
+		dir:        dir,
+		quarantine: quarantine,
+		settle:     settle,
+		pending:    map[string]*time.Timer{},
+		active:     map[string]bool{},
+	}, nil
+}
+
+// Run watches the directory until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+	if err := fw.Add(w.dir); err != nil {
+		return err
+	}
+	w.scan(ctx)
+	ticker := time.NewTicker(watchRescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write) {
+				w.schedule(ctx, ev.Name)
+			}
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return nil
+			}
+			// Overflows drop events; the next rescan picks the files up.
+			log.Printf("watch %s: %v", w.dir, err)
+		case <-ticker.C:
+			w.scan(ctx)
+		}
+	}
+}
+
+func (w *Watcher) scan(ctx context.Context) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		log.Printf("watch %s: %v", w.dir, err)
+		return
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			w.schedule(ctx, filepath.Join(w.dir, e.Name()))
+		}
+	}
+}
+
+// schedule (re)starts the settle timer for path, so a file still being
+// written is only ingested once writes stop.
+func (w *Watcher) schedule(ctx context.Context, path string) {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t, ok := w.pending[path]; ok {
+		t.Reset(w.settle)
+		return
+	}
+	w.pending[path] = time.AfterFunc(w.settle, func() {
+		w.mu.Lock()
+		delete(w.pending, path)
+		if w.active[path] {
+			w.mu.Unlock()
+			return
+		}
+		w.active[path] = true
+		w.mu.Unlock()
+
+		w.ingest(ctx, path)
+
+		w.mu.Lock()
+		delete(w.active, path)
+		w.mu.Unlock()
+	})
+}
+
+func (w *Watcher) ingest(ctx context.Context, path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	if time.Since(fi.ModTime()) < w.settle {
+		w.schedule(ctx, path)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("watch %s: %v", w.dir, err)
+		return
+	}
+	name := filepath.Base(path)
+	limit := w.in.Limits.Default
+	abs, _ := filepath.Abs(path)
+	meta := UploadMeta{MaxBytes: limit, Source: "file://" + filepath.ToSlash(abs)}
+	rec, uerr := w.in.Receive(ctx, &limitFile{r: f, n: limit}, name, meta)
+	f.Close()
+
+	switch {
+	case uerr != nil && uerr.Status >= http.StatusInternalServerError:
+		log.Printf("watch %s: ingest %s: %s; will retry", w.dir, name, uerr.Message)
+		watchFiles("failed").Inc()
+	case uerr != nil:
+		log.Printf("watch %s: quarantined %s: %s", w.dir, name, uerr.Message)
+		watchFiles("quarantined").Inc()
+		if err := w.quarantineFile(path, name, uerr); err != nil {
+			log.Printf("watch %s: quarantine %s: %v", w.dir, name, err)
+		}
+	default:
+		log.Printf("watch %s: ingested %s as %s", w.dir, name, rec.ID)
+		watchFiles("ingested").Inc()
+		if err := os.Remove(path); err != nil {
+			log.Printf("watch %s: remove %s: %v", w.dir, name, err)
+		}
+	}
+}
+
+func watchFiles(outcome string) *Metric {
+	return metrics.Counter("watch_files_total", "Files picked up from the drop folder, by outcome.", "outcome", outcome)
+}
+
+// quarantineFile moves path aside with a record of why it was rejected.
+// An existing quarantined file of the same name is kept by suffixing the
+// new one with a timestamp.
+func (w *Watcher) quarantineFile(path, name string, uerr *UploadError) error {
+	dest := filepath.Join(w.quarantine, name)
+	if _, err := os.Lstat(dest); err == nil {
+		dest += "." + strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return err
+	}
+	report, err := json.MarshalIndent(map[string]any{
+		"filename":      name,
+		"status":        uerr.Status,
+		"code":          uerr.Code,
+		"message":       uerr.Message,
+		"quarantinedAt": time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest+".error.json", append(report, '\n'), 0o644)
+}
@@ -9,6 +9,8 @@ type UploadResponse = {
     sha256: string;
     contentType: string;
     filename: string;
+    rowCount: number;
+    columns: string[];
 }
 
 const PREVIEW_ROWS = 200;